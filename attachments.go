@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// ATTACHMENTS_DIR_ENV_VAR is where source wrote the files attached to
+// the credentials it loaded, so that clear can remove them
+const ATTACHMENTS_DIR_ENV_VAR string = "CREDULOUS_FILES"
+
+// ATTACHMENTS_DIR_PREFIX starts the name of every directory source
+// writes attachments to; clear removes nothing else
+const ATTACHMENTS_DIR_PREFIX string = "credulous-files-"
+
+// SHM_DIR is a tmpfs on Linux, so attachments written there never
+// reach a disk
+const SHM_DIR string = "/dev/shm"
+
+// Attachment is a file saved with a set of credentials, and encrypted
+// with them, such as a kubeconfig or a client certificate. Source writes
+// it out and points EnvVar at it.
+type Attachment struct {
+	EnvVar string
+	Name   string
+	Data   []byte
+}
+
+// parseAttachArgs reads the files given with --attach as NAME=path,
+// NAME being the variable to point at the file when it's sourced
+func parseAttachArgs(c *cli.Context) ([]Attachment, error) {
+	attachments := []Attachment{}
+	names := make(map[string]bool)
+	for _, arg := range c.StringSlice("attach") {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || !envVarName.MatchString(parts[0]) || parts[1] == "" {
+			return nil, errors.New("Invalid attachment '" + arg + "'; please give it as NAME=path")
+		}
+		data, err := ioutil.ReadFile(expandHome(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(parts[1])
+		if names[name] {
+			return nil, errors.New("More than one attachment is named " + name)
+		}
+		names[name] = true
+		attachments = append(attachments, Attachment{EnvVar: parts[0], Name: name, Data: data})
+	}
+	return attachments, nil
+}
+
+// attachmentsRoot is where to make a directory for attachments: the
+// tmpfs if there is one, or else the usual temporary directory
+func attachmentsRoot() string {
+	if info, err := os.Stat(SHM_DIR); err == nil && info.IsDir() {
+		return SHM_DIR
+	}
+	return os.TempDir()
+}
+
+// writeAttachments writes attachments to a new directory only we can
+// read, returning it and the variables that point at them. The names
+// come from the decrypted credentials, which anyone who can push can
+// encrypt for us, so only plain file names are written.
+func writeAttachments(root string, attachments []Attachment) (dir string, vars []envVar, err error) {
+	if len(attachments) == 0 {
+		return "", nil, nil
+	}
+	for _, attachment := range attachments {
+		name := attachment.Name
+		if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+			return "", nil, errors.New("Refusing to write the attachment '" + name + "', which is not a file name")
+		}
+	}
+	dir, err = ioutil.TempDir(root, ATTACHMENTS_DIR_PREFIX)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, attachment := range attachments {
+		path := filepath.Join(dir, attachment.Name)
+		if err := ioutil.WriteFile(path, attachment.Data, 0600); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+		vars = append(vars, envVar{attachment.EnvVar, path})
+	}
+	return dir, vars, nil
+}
+
+// removeAttachments removes a directory source wrote attachments to,
+// refusing anything that doesn't look like one, since the directory
+// comes from the environment
+func removeAttachments(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if !filepath.IsAbs(dir) || !strings.HasPrefix(filepath.Base(dir), ATTACHMENTS_DIR_PREFIX) {
+		return errors.New("Not removing " + dir + ", which is not a directory of attachments")
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAttachments(t *testing.T) {
+	Convey("Test files attached to credentials", t, func() {
+		root, err := ioutil.TempDir("", "credulous-test")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(root)
+		attachments := []Attachment{
+			{EnvVar: "KUBECONFIG", Name: "config", Data: []byte("apiVersion: v1\n")},
+			{EnvVar: "GOOGLE_APPLICATION_CREDENTIALS", Name: "gcp.json", Data: []byte("{}")},
+		}
+
+		Convey("They are written where only we can read them", func() {
+			dir, vars, err := writeAttachments(root, attachments)
+			So(err, ShouldEqual, nil)
+			So(filepath.Dir(dir), ShouldEqual, root)
+			So(filepath.Base(dir), ShouldStartWith, ATTACHMENTS_DIR_PREFIX)
+			info, err := os.Stat(dir)
+			So(err, ShouldEqual, nil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0700))
+
+			So(vars, ShouldResemble, []envVar{
+				{"KUBECONFIG", filepath.Join(dir, "config")},
+				{"GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(dir, "gcp.json")},
+			})
+			info, err = os.Stat(vars[0].Value)
+			So(err, ShouldEqual, nil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+			b, err := ioutil.ReadFile(vars[0].Value)
+			So(err, ShouldEqual, nil)
+			So(string(b), ShouldEqual, "apiVersion: v1\n")
+
+			So(removeAttachments(dir), ShouldEqual, nil)
+			_, err = os.Stat(dir)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Names that would leave the directory are refused, and nothing is written", func() {
+			for _, name := range []string{"../../.bashrc", "/etc/passwd", "a/b", "..", ".", ""} {
+				dir, _, err := writeAttachments(root, []Attachment{attachments[0], {EnvVar: "X", Name: name, Data: []byte("evil")}})
+				So(err.Error(), ShouldEqual, "Refusing to write the attachment '"+name+"', which is not a file name")
+				So(dir, ShouldEqual, "")
+			}
+			entries, err := ioutil.ReadDir(root)
+			So(err, ShouldEqual, nil)
+			So(len(entries), ShouldEqual, 0)
+		})
+
+		Convey("Without any, nothing is written", func() {
+			dir, vars, err := writeAttachments(root, nil)
+			So(err, ShouldEqual, nil)
+			So(dir, ShouldEqual, "")
+			So(len(vars), ShouldEqual, 0)
+		})
+
+		Convey("Clear removes nothing but attachments", func() {
+			So(removeAttachments(""), ShouldEqual, nil)
+			So(removeAttachments(root).Error(), ShouldEqual, "Not removing "+root+", which is not a directory of attachments")
+			So(removeAttachments(ATTACHMENTS_DIR_PREFIX+"x").Error(), ShouldContainSubstring, "not a directory of attachments")
+		})
+
+		Convey("Sourcing points variables at them, and says where they are", func() {
+			creds := Credentials{
+				IamUsername:      "bob",
+				AccountAliasOrId: "acct",
+				Encryptions: []Encryption{{decoded: Credential{
+					KeyId:     "AKIAEXAMPLE",
+					SecretKey: "secret",
+					Files:     attachments[:1],
+				}}},
+			}
+			var out bytes.Buffer
+			So(creds.SourceAs(&out, "bash"), ShouldEqual, nil)
+			dir := ""
+			for _, line := range strings.Split(out.String(), "\n") {
+				if strings.HasPrefix(line, "export CREDULOUS_FILES=") {
+					dir = strings.Trim(strings.TrimPrefix(line, "export CREDULOUS_FILES="), `"`)
+				}
+			}
+			defer removeAttachments(dir)
+			So(out.String(), ShouldContainSubstring, `export KUBECONFIG="`+filepath.Join(dir, "config")+`"`)
+			So(out.String(), ShouldContainSubstring, `export CREDULOUS_LOADED_VARS="KUBECONFIG"`)
+			So(loadedEnvNames("KUBECONFIG"), ShouldContain, "KUBECONFIG")
+		})
+
+		Convey("Formats that can't be cleared get nothing written", func() {
+			creds := Credentials{
+				IamUsername:      "bob",
+				AccountAliasOrId: "acct",
+				Encryptions:      []Encryption{{decoded: Credential{KeyId: "AKIAEXAMPLE", SecretKey: "secret", Files: attachments}}},
+			}
+			for _, format := range []string{"dotenv", "json"} {
+				var out bytes.Buffer
+				err := creds.SourceAs(&out, format)
+				So(err.Error(), ShouldEqual, "bob@acct has attached files, which "+format+" can't load; please use a shell, or 'credulous exec'")
+				So(out.Len(), ShouldEqual, 0)
+			}
+		})
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The same variables the AWS CLI and SDKs read
+const AWS_SHARED_CREDENTIALS_ENV string = "AWS_SHARED_CREDENTIALS_FILE"
+const AWS_CONFIG_FILE_ENV string = "AWS_CONFIG_FILE"
+
+// awsCredentialsFile is the shared credentials file the AWS tools read,
+// ~/.aws/credentials unless the environment says otherwise
+func awsCredentialsFile() string {
+	if filename := os.Getenv(AWS_SHARED_CREDENTIALS_ENV); filename != "" {
+		return filename
+	}
+	return filepath.Join(os.Getenv("HOME"), ".aws", "credentials")
+}
+
+// awsConfigFile is the AWS tools' config file, ~/.aws/config unless the
+// environment says otherwise
+func awsConfigFile() string {
+	if filename := os.Getenv(AWS_CONFIG_FILE_ENV); filename != "" {
+		return filename
+	}
+	return filepath.Join(os.Getenv("HOME"), ".aws", "config")
+}
+
+// awsConfigSection names a profile's section in the config file, which
+// unlike the credentials file puts "profile" in front of all but the
+// default
+func awsConfigSection(profile string) string {
+	if profile == "default" {
+		return profile
+	}
+	return "profile " + profile
+}
+
+// iniFile is an INI file such as ~/.aws/credentials, kept line by line
+// so that it can be changed without losing the comments and layout of
+// the parts left alone
+type iniFile struct {
+	// preamble is whatever comes before the first section
+	preamble []string
+	sections []*iniSection
+}
+
+// iniSection is a [name] header and the lines up to the next one
+type iniSection struct {
+	name  string
+	lines []string
+}
+
+func parseINI(data []byte) *iniFile {
+	f := &iniFile{}
+	text := strings.TrimSuffix(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	if text == "" {
+		return f
+	}
+	var current *iniSection
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			current = &iniSection{name: strings.TrimSpace(trimmed[1 : len(trimmed)-1])}
+			f.sections = append(f.sections, current)
+		}
+		if current == nil {
+			f.preamble = append(f.preamble, line)
+		} else {
+			current.lines = append(current.lines, line)
+		}
+	}
+	return f
+}
+
+// readINIFile reads an INI file, which is empty if it doesn't exist yet
+func readINIFile(filename string) (*iniFile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &iniFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseINI(data), nil
+}
+
+func (f *iniFile) Bytes() []byte {
+	lines := append([]string{}, f.preamble...)
+	for _, section := range f.sections {
+		lines = append(lines, section.lines...)
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+func (f *iniFile) sectionNames() []string {
+	names := []string{}
+	for _, section := range f.sections {
+		names = append(names, section.name)
+	}
+	return names
+}
+
+// section returns the named section, or nil
+func (f *iniFile) section(name string) *iniSection {
+	for _, section := range f.sections {
+		if section.name == name {
+			return section
+		}
+	}
+	return nil
+}
+
+// addSection adds an empty section at the end, set off from whatever
+// comes before it by a blank line
+func (f *iniFile) addSection(name string) *iniSection {
+	last := &f.preamble
+	if len(f.sections) > 0 {
+		last = &f.sections[len(f.sections)-1].lines
+	}
+	if len(*last) > 0 && strings.TrimSpace((*last)[len(*last)-1]) != "" {
+		*last = append(*last, "")
+	}
+	section := &iniSection{name: name, lines: []string{"[" + name + "]"}}
+	f.sections = append(f.sections, section)
+	return section
+}
+
+func (f *iniFile) removeSection(name string) {
+	kept := []*iniSection{}
+	for _, section := range f.sections {
+		if section.name != name {
+			kept = append(kept, section)
+		}
+	}
+	f.sections = kept
+}
+
+// iniSetting splits a "key = value" line; comments and continuation lines
+// aren't settings
+func iniSetting(line string) (key, value string, ok bool) {
+	if line == "" || line[0] == ' ' || line[0] == '\t' {
+		return "", "", false
+	}
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";") || strings.HasPrefix(trimmed, "[") {
+		return "", "", false
+	}
+	parts := strings.SplitN(trimmed, "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1]), true
+}
+
+func (s *iniSection) get(key string) string {
+	for _, line := range s.lines {
+		if k, v, ok := iniSetting(line); ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// set changes a setting in place, or adds it after the section's last
+// line that isn't blank
+func (s *iniSection) set(key, value string) {
+	line := key + " = " + value
+	for i, existing := range s.lines {
+		if k, _, ok := iniSetting(existing); ok && k == key {
+			s.lines[i] = line
+			return
+		}
+	}
+	at := len(s.lines)
+	for at > 1 && strings.TrimSpace(s.lines[at-1]) == "" {
+		at--
+	}
+	s.lines = append(s.lines[:at], append([]string{line}, s.lines[at:]...)...)
+}
+
+// unset removes a setting, and tells whether the section has any left
+func (s *iniSection) unset(key string) (remaining bool) {
+	kept := []string{}
+	for _, line := range s.lines {
+		k, _, ok := iniSetting(line)
+		if ok && k == key {
+			continue
+		}
+		remaining = remaining || ok
+		kept = append(kept, line)
+	}
+	s.lines = kept
+	return remaining
+}
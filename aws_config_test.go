@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const TEST_AWS_CREDENTIALS string = `# managed by hand
+[default]
+aws_access_key_id = AKIADEFAULT
+aws_secret_access_key=secret/with=equals
+
+; a comment
+[work]
+region = ap-southeast-2
+s3 =
+  max_concurrent_requests = 20
+`
+
+func TestINIFile(t *testing.T) {
+	Convey("Test reading and changing INI files", t, func() {
+		ini := parseINI([]byte(TEST_AWS_CREDENTIALS))
+
+		Convey("Unchanged files are written back as they were", func() {
+			So(string(ini.Bytes()), ShouldEqual, TEST_AWS_CREDENTIALS)
+			So(string(parseINI(nil).Bytes()), ShouldEqual, "")
+		})
+
+		Convey("Settings are read from their sections", func() {
+			So(ini.sectionNames(), ShouldResemble, []string{"default", "work"})
+			So(ini.section("default").get("aws_access_key_id"), ShouldEqual, "AKIADEFAULT")
+			So(ini.section("default").get("aws_secret_access_key"), ShouldEqual, "secret/with=equals")
+			So(ini.section("work").get("region"), ShouldEqual, "ap-southeast-2")
+			So(ini.section("work").get("max_concurrent_requests"), ShouldEqual, "")
+			So(ini.section("nosuch"), ShouldBeNil)
+		})
+
+		Convey("Settings are changed in place, or added", func() {
+			ini.section("default").set("aws_access_key_id", "AKIACHANGED")
+			ini.section("work").set("output", "json")
+			ini.addSection("new").set("region", "us-east-1")
+			So(string(ini.Bytes()), ShouldEqual, `# managed by hand
+[default]
+aws_access_key_id = AKIACHANGED
+aws_secret_access_key=secret/with=equals
+
+; a comment
+[work]
+region = ap-southeast-2
+s3 =
+  max_concurrent_requests = 20
+output = json
+
+[new]
+region = us-east-1
+`)
+			So(parseINI(nil).addSection("default").lines, ShouldResemble, []string{"[default]"})
+		})
+
+		Convey("Settings and sections can be removed", func() {
+			So(ini.section("work").unset("region"), ShouldBeTrue)
+			So(ini.section("default").unset("aws_access_key_id"), ShouldBeTrue)
+			So(ini.section("default").unset("aws_secret_access_key"), ShouldBeFalse)
+			ini.removeSection("default")
+			So(string(ini.Bytes()), ShouldEqual, "# managed by hand\n[work]\ns3 =\n  max_concurrent_requests = 20\n")
+		})
+	})
+}
@@ -15,13 +15,19 @@ type Instancer interface {
 	ListAccountAliases() (*iam.AccountAliasesResp, error)
 }
 
+// newIAM builds the IAM client used for every AWS call credulous makes.
+// It is a variable so that tests can point it at a local fake server.
+var newIAM = func(auth aws.Auth) *iam.IAM {
+	// Note: the region is irrelevant for IAM, but not the partition
+	return iam.New(auth, iamRegion())
+}
+
 func getAWSUsernameAndAlias(cred Credential) (username, alias string, err error) {
 	auth := aws.Auth{
 		AccessKey: cred.KeyId,
 		SecretKey: cred.SecretKey,
 	}
-	// Note: the region is irrelevant for IAM
-	instance := iam.New(auth, aws.APSoutheast2)
+	instance := newIAMClient(auth)
 	username, err = getAWSUsername(instance)
 	if err != nil {
 		return "", "", err
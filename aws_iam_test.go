@@ -240,3 +240,30 @@ func TestVerifyUser(t *testing.T) {
 
 	})
 }
+
+func TestGetAWSUsernameAndAlias(t *testing.T) {
+	Convey("Test getAWSUsernameAndAlias against the fake IAM server", t, func() {
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		keyId, secret := fake.AddUser("bob")
+
+		Convey("with valid credentials", func() {
+			username, alias, err := getAWSUsernameAndAlias(Credential{KeyId: keyId, SecretKey: secret})
+			So(err, ShouldEqual, nil)
+			So(username, ShouldEqual, "bob")
+			So(alias, ShouldEqual, "test-alias")
+		})
+		Convey("with an inactive key", func() {
+			fake.SetKeyStatus(keyId, "Inactive")
+			_, _, err := getAWSUsernameAndAlias(Credential{KeyId: keyId, SecretKey: secret})
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("with an unknown key", func() {
+			_, _, err := getAWSUsernameAndAlias(Credential{KeyId: "AKIANOSUCHKEY0000000", SecretKey: "nope"})
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/realestate-com-au/goamz/aws"
+	"github.com/realestate-com-au/goamz/iam"
+)
+
+type AWSErrorKind int
+
+const (
+	AWSUnknownError AWSErrorKind = iota
+	AWSThrottlingError
+	AWSInvalidCredentialsError
+	AWSAccessDeniedError
+	AWSNetworkError
+	AWSServerError
+)
+
+func (kind AWSErrorKind) String() string {
+	switch kind {
+	case AWSThrottlingError:
+		return "throttled"
+	case AWSInvalidCredentialsError:
+		return "invalid credentials"
+	case AWSAccessDeniedError:
+		return "access denied"
+	case AWSNetworkError:
+		return "network error"
+	case AWSServerError:
+		return "server error"
+	}
+	return "unknown error"
+}
+
+// AWSError is returned by every IAM call credulous makes, so that
+// callers can tell a bad key from a flaky network
+type AWSError struct {
+	Kind AWSErrorKind
+	Op   string
+	Err  error
+}
+
+func (e *AWSError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func classifyAWSError(err error) AWSErrorKind {
+	switch e := err.(type) {
+	case *AWSError:
+		return e.Kind
+	case *iam.Error:
+		switch e.Code {
+		case "Throttling", "ThrottlingException", "RequestLimitExceeded",
+			"TooManyRequestsException":
+			return AWSThrottlingError
+		case "InvalidClientTokenId", "InvalidAccessKeyId", "SignatureDoesNotMatch",
+			"IncompleteSignature", "AuthFailure", "ExpiredToken":
+			return AWSInvalidCredentialsError
+		case "AccessDenied", "AccessDeniedException", "UnauthorizedOperation":
+			return AWSAccessDeniedError
+		}
+		if e.StatusCode >= 500 {
+			return AWSServerError
+		}
+	case net.Error:
+		return AWSNetworkError
+	}
+	return AWSUnknownError
+}
+
+type RetryPolicy struct {
+	// Attempts caps the number of calls made; zero means no cap
+	Attempts int
+	// Timeout caps the total time spent retrying; zero means no cap
+	Timeout   time.Duration
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	RetryOn   []AWSErrorKind
+}
+
+// Throttling and server errors are always safe to retry; network errors
+// are too, except where the call isn't idempotent (see CreateAccessKey)
+var defaultRetryPolicy = RetryPolicy{
+	Attempts:  5,
+	BaseDelay: 200 * time.Millisecond,
+	MaxDelay:  5 * time.Second,
+	RetryOn:   []AWSErrorKind{AWSThrottlingError, AWSNetworkError, AWSServerError},
+}
+
+// Newly-created keys are rejected as invalid until they have propagated
+// through IAM, so keep trying for up to ROTATE_TIMEOUT seconds
+var propagationRetryPolicy = RetryPolicy{
+	Timeout:   time.Duration(ROTATE_TIMEOUT) * time.Second,
+	BaseDelay: 500 * time.Millisecond,
+	MaxDelay:  5 * time.Second,
+	RetryOn: []AWSErrorKind{AWSThrottlingError, AWSNetworkError, AWSServerError,
+		AWSInvalidCredentialsError},
+}
+
+// overridden in tests so that they don't have to wait for the backoff
+var retrySleep = time.Sleep
+
+func (policy RetryPolicy) retries(kind AWSErrorKind) bool {
+	for _, k := range policy.RetryOn {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns an exponentially-increasing delay for the given
+// attempt, with half of it randomised so that concurrent clients don't
+// retry in lockstep
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	delay := policy.BaseDelay << uint(attempt)
+	if delay > policy.MaxDelay || delay <= 0 {
+		delay = policy.MaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// do calls fn until it succeeds, fails with an error the policy won't
+// retry, or the policy's attempts or timeout run out. Any error returned
+// is an *AWSError.
+func (policy RetryPolicy) do(op string, fn func() error) error {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		kind := classifyAWSError(err)
+		delay := policy.backoff(attempt)
+		if !policy.retries(kind) ||
+			(policy.Attempts > 0 && attempt+1 >= policy.Attempts) ||
+			(policy.Timeout > 0 && time.Since(start)+delay > policy.Timeout) {
+			if awsErr, ok := err.(*AWSError); ok {
+				return awsErr
+			}
+			return &AWSError{Kind: kind, Op: op, Err: err}
+		}
+		retrySleep(delay)
+	}
+}
+
+// IAMClient wraps the goamz IAM client, retrying each call according to
+// its policy
+type IAMClient struct {
+	Auth   aws.Auth
+	iam    *iam.IAM
+	policy RetryPolicy
+}
+
+func newIAMClient(auth aws.Auth) *IAMClient {
+	return &IAMClient{
+		Auth:   auth,
+		iam:    newIAM(auth),
+		policy: defaultRetryPolicy,
+	}
+}
+
+func (c *IAMClient) GetUser(username string) (resp *iam.GetUserResp, err error) {
+	err = c.policy.do("GetUser", func() (err error) {
+		resp, err = c.iam.GetUser(username)
+		return err
+	})
+	return resp, err
+}
+
+func (c *IAMClient) AccessKeys(username string) (resp *iam.AccessKeysResp, err error) {
+	err = c.policy.do("ListAccessKeys", func() (err error) {
+		resp, err = c.iam.AccessKeys(username)
+		return err
+	})
+	return resp, err
+}
+
+func (c *IAMClient) ListAccountAliases() (resp *iam.AccountAliasesResp, err error) {
+	err = c.policy.do("ListAccountAliases", func() (err error) {
+		resp, err = c.iam.ListAccountAliases()
+		return err
+	})
+	return resp, err
+}
+
+func (c *IAMClient) CreateAccessKey(username string) (resp *iam.CreateAccessKeyResp, err error) {
+	// a network error may hide a key that was actually created, and
+	// retrying could then hit the two-key limit, so only retry when
+	// AWS has told us it rejected the request
+	policy := c.policy
+	policy.RetryOn = []AWSErrorKind{AWSThrottlingError}
+	err = policy.do("CreateAccessKey", func() (err error) {
+		resp, err = c.iam.CreateAccessKey(username)
+		return err
+	})
+	return resp, err
+}
+
+func (c *IAMClient) DeleteAccessKey(id, username string) (resp *iam.SimpleResp, err error) {
+	err = c.policy.do("DeleteAccessKey", func() (err error) {
+		resp, err = c.iam.DeleteAccessKey(id, username)
+		return err
+	})
+	return resp, err
+}
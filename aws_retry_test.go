@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/realestate-com-au/goamz/aws"
+	"github.com/realestate-com-au/goamz/iam"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClassifyAWSError(t *testing.T) {
+	Convey("Test classifying AWS errors", t, func() {
+		Convey("Throttling", func() {
+			err := &iam.Error{StatusCode: 400, Code: "Throttling"}
+			So(classifyAWSError(err), ShouldEqual, AWSThrottlingError)
+		})
+		Convey("Invalid credentials", func() {
+			err := &iam.Error{StatusCode: 403, Code: "InvalidClientTokenId"}
+			So(classifyAWSError(err), ShouldEqual, AWSInvalidCredentialsError)
+		})
+		Convey("Access denied", func() {
+			err := &iam.Error{StatusCode: 403, Code: "AccessDenied"}
+			So(classifyAWSError(err), ShouldEqual, AWSAccessDeniedError)
+		})
+		Convey("Server errors", func() {
+			err := &iam.Error{StatusCode: 503, Code: "ServiceUnavailable"}
+			So(classifyAWSError(err), ShouldEqual, AWSServerError)
+		})
+		Convey("Network errors", func() {
+			err := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+			So(classifyAWSError(err), ShouldEqual, AWSNetworkError)
+		})
+		Convey("Anything else", func() {
+			So(classifyAWSError(errors.New("boom")), ShouldEqual, AWSUnknownError)
+		})
+		Convey("Already-wrapped errors keep their kind", func() {
+			err := &AWSError{Kind: AWSAccessDeniedError, Op: "GetUser", Err: errors.New("no")}
+			So(classifyAWSError(err), ShouldEqual, AWSAccessDeniedError)
+		})
+	})
+}
+
+func TestRetryPolicy(t *testing.T) {
+	Convey("Test retrying with backoff", t, func() {
+		var slept []time.Duration
+		origSleep := retrySleep
+		retrySleep = func(d time.Duration) { slept = append(slept, d) }
+		defer func() { retrySleep = origSleep }()
+
+		policy := RetryPolicy{
+			Attempts:  4,
+			BaseDelay: 100 * time.Millisecond,
+			MaxDelay:  250 * time.Millisecond,
+			RetryOn:   []AWSErrorKind{AWSThrottlingError},
+		}
+		throttled := &iam.Error{StatusCode: 400, Code: "Throttling"}
+
+		Convey("Success needs no retries", func() {
+			err := policy.do("op", func() error { return nil })
+			So(err, ShouldEqual, nil)
+			So(len(slept), ShouldEqual, 0)
+		})
+		Convey("Retryable errors are retried until success", func() {
+			calls := 0
+			err := policy.do("op", func() error {
+				calls += 1
+				if calls < 3 {
+					return throttled
+				}
+				return nil
+			})
+			So(err, ShouldEqual, nil)
+			So(calls, ShouldEqual, 3)
+			So(len(slept), ShouldEqual, 2)
+		})
+		Convey("Retries stop after the allowed attempts", func() {
+			calls := 0
+			err := policy.do("op", func() error {
+				calls += 1
+				return throttled
+			})
+			So(calls, ShouldEqual, 4)
+			So(classifyAWSError(err), ShouldEqual, AWSThrottlingError)
+			So(err.Error(), ShouldEqual, "op: "+throttled.Error())
+		})
+		Convey("Delays grow but never exceed the maximum", func() {
+			policy.do("op", func() error { return throttled })
+			for _, d := range slept {
+				So(d, ShouldBeLessThanOrEqualTo, policy.MaxDelay)
+				So(d, ShouldBeGreaterThanOrEqualTo, policy.BaseDelay/2)
+			}
+		})
+		Convey("Errors the policy doesn't cover are returned at once", func() {
+			calls := 0
+			err := policy.do("op", func() error {
+				calls += 1
+				return &iam.Error{StatusCode: 403, Code: "AccessDenied"}
+			})
+			So(calls, ShouldEqual, 1)
+			So(classifyAWSError(err), ShouldEqual, AWSAccessDeniedError)
+		})
+	})
+}
+
+func TestIAMClientRetries(t *testing.T) {
+	Convey("Test the retrying IAM client against the fake IAM server", t, func() {
+		origSleep := retrySleep
+		retrySleep = func(time.Duration) {}
+		defer func() { retrySleep = origSleep }()
+
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		keyId, secret := fake.AddUser("bob")
+		client := newIAMClient(aws.Auth{AccessKey: keyId, SecretKey: secret})
+
+		Convey("Throttled calls succeed once the throttling stops", func() {
+			fake.ThrottleNext(2)
+			username, err := getAWSUsername(client)
+			So(err, ShouldEqual, nil)
+			So(username, ShouldEqual, "bob")
+			So(fake.Calls("GetUser"), ShouldEqual, 3)
+		})
+		Convey("Persistent throttling gives a throttling error", func() {
+			fake.ThrottleNext(100)
+			_, err := getAWSUsername(client)
+			So(classifyAWSError(err), ShouldEqual, AWSThrottlingError)
+			So(exitCode(err), ShouldEqual, EXIT_THROTTLED)
+		})
+		Convey("Invalid credentials are not retried", func() {
+			bad := newIAMClient(aws.Auth{AccessKey: "AKIANOSUCHKEY0000000", SecretKey: "nope"})
+			_, err := getAWSUsername(bad)
+			So(classifyAWSError(err), ShouldEqual, AWSInvalidCredentialsError)
+			So(exitCode(err), ShouldEqual, EXIT_INVALID_CREDENTIALS)
+			So(fake.Calls("GetUser"), ShouldEqual, 1)
+		})
+		Convey("Rotation waits for the new key to propagate", func() {
+			fake.DelayActivation(3)
+			cred := Credential{KeyId: keyId, SecretKey: secret}
+			err := (&cred).rotateCredentials("bob")
+			So(err, ShouldEqual, nil)
+			So(cred.KeyId, ShouldNotEqual, keyId)
+		})
+	})
+}
@@ -2,27 +2,13 @@
 #
 # credulous.sh
 #
-# Wrapper that sources output of 'credulous source' command into
-# current environment
+# Sets up the current shell for credulous: a wrapper that sources the
+# output of 'credulous source' into the current environment, and of
+# 'credulous clear' to remove it again, and completion. It all comes from
+# 'credulous shell-init', so it always matches the installed credulous.
 #
 # Source this from your ~/.bash_profile
 
-credulous () {
-    BINARY=$( type -P credulous )
-    RES=$( $BINARY $@ )
-    RET=$?
-    if [ $RET -eq 0 -a "x$1" = "xsource" ]; then
-        echo -n "Loading AWS creds into current environment..."
-        eval "$RES"
-        if [ $? -eq 0 ]; then
-          echo "OK"
-        else
-          echo "FAIL"
-        fi
-    elif [ $RET -eq 0 ]; then
-        echo "$RES"
-    else
-        echo "Failed to source credentials"
-        return 1
-    fi
-}
+if [ -n "$BASH_VERSION" ] && type -P credulous >/dev/null; then
+    eval "$(credulous shell-init bash)"
+fi
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/realestate-com-au/goamz/aws"
+)
+
+// CONFIG_FILE_ENV names a config file to use instead of ~/.credulous/config
+const CONFIG_FILE_ENV string = "CREDULOUS_CONFIG"
+
+// CONFIG_ENV_PREFIX starts the environment variables that override
+// settings in the config file, such as CREDULOUS_KEY for key
+const CONFIG_ENV_PREFIX string = "CREDULOUS_"
+
+const (
+	CONFIG_STRING = iota
+	CONFIG_PATH
+	CONFIG_INT
+	CONFIG_LIST
+)
+
+// configSetting is a setting the config file can have. Those that are
+// perAccount can also be given in an [account.<account>] section, which
+// wins for that account.
+type configSetting struct {
+	name       string
+	kind       int
+	perAccount bool
+	usage      string
+}
+
+var CONFIG_SETTINGS = []configSetting{
+	{"key", CONFIG_PATH, true, "SSH private key to decrypt with"},
+	{"recipients", CONFIG_LIST, true, "SSH public keys, or @groups of them, to encrypt for"},
+	{"repo", CONFIG_STRING, true, "Default repository, to save to and to search after repo_order"},
+	{"repo_order", CONFIG_LIST, false, "Repositories to search for credentials, in order"},
+	{"lifetime", CONFIG_INT, true, "Credential lifetime in seconds"},
+	{"format", CONFIG_STRING, false, "Output format for source, pick and clear"},
+	{"region", CONFIG_STRING, false, "AWS region"},
+	{"partition", CONFIG_STRING, false, "AWS partition: aws, aws-cn or aws-us-gov"},
+	{"agent_socket", CONFIG_PATH, false, "ssh-agent socket for reaching git remotes"},
+}
+
+// PARTITION_IAM_ENDPOINTS are where IAM is for each AWS partition
+var PARTITION_IAM_ENDPOINTS = map[string]string{
+	"aws":        "https://iam.amazonaws.com",
+	"aws-cn":     "https://iam.cn-north-1.amazonaws.com.cn",
+	"aws-us-gov": "https://iam.us-gov.amazonaws.com",
+}
+
+// Config is ~/.credulous/config: TOML, though only as much of it as
+// credulous needs, which is strings, integers and arrays of strings at
+// the top level and in sections. It's kept line by line, like the AWS
+// files, so that setting things doesn't lose comments.
+type Config struct {
+	file *iniFile
+}
+
+func configFile() string {
+	if filename := os.Getenv(CONFIG_FILE_ENV); filename != "" {
+		return filename
+	}
+	return filepath.Join(getRootPath(), "config")
+}
+
+// loadConfig reads the config file, checking every setting in it
+func loadConfig() (Config, error) {
+	file, err := readINIFile(configFile())
+	if err != nil {
+		return Config{}, err
+	}
+	cfg := Config{file: file}
+	for _, name := range cfg.names() {
+		setting, err := findConfigSetting(name)
+		if err == nil {
+			_, err = cfg.get(name)
+		}
+		if err == nil {
+			err = setting.check(cfg.rawValues(name))
+		}
+		if err != nil {
+			return Config{}, errors.New(configFile() + ": " + err.Error())
+		}
+	}
+	return cfg, nil
+}
+
+func (cfg Config) save() error {
+	return writeFileAtomic(configFile(), cfg.file.Bytes(), 0600)
+}
+
+// splitSettingName splits account.prod.lifetime into the section the
+// setting is in and its key
+func splitSettingName(name string) (section, key string) {
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 {
+		return "", name
+	}
+	return name[:dot], name[dot+1:]
+}
+
+// unquoteSection strips any quotes TOML put around a section's parts
+func unquoteSection(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+// topLevel is the part of the file before any section, as a section
+func (cfg Config) topLevel() *iniSection {
+	return &iniSection{lines: cfg.file.preamble}
+}
+
+func (cfg Config) section(name string) *iniSection {
+	if name == "" {
+		return cfg.topLevel()
+	}
+	for _, section := range cfg.file.sections {
+		if unquoteSection(section.name) == name {
+			return section
+		}
+	}
+	return nil
+}
+
+// names lists every setting in the file, as section.key
+func (cfg Config) names() []string {
+	names := []string{}
+	sections := append([]*iniSection{cfg.topLevel()}, cfg.file.sections...)
+	for _, section := range sections {
+		prefix := ""
+		if section.name != "" {
+			prefix = unquoteSection(section.name) + "."
+		}
+		for _, line := range section.lines {
+			if key, _, ok := iniSetting(line); ok {
+				names = append(names, prefix+key)
+			}
+		}
+	}
+	return names
+}
+
+// rawValues is a setting's value, or nil if it isn't set or can't be
+// read
+func (cfg Config) rawValues(name string) []string {
+	values, _ := cfg.get(name)
+	return values
+}
+
+// get reads a setting from the file: its value, as a list even if it's
+// just one string or number, or nil if it isn't set
+func (cfg Config) get(name string) ([]string, error) {
+	sectionName, key := splitSettingName(name)
+	section := cfg.section(sectionName)
+	if section == nil {
+		return nil, nil
+	}
+	for _, line := range section.lines {
+		if k, v, ok := iniSetting(line); ok && k == key {
+			values, err := parseConfigValue(v)
+			if err != nil {
+				return nil, errors.New("Invalid value for " + name + ": " + err.Error())
+			}
+			return values, nil
+		}
+	}
+	return nil, nil
+}
+
+// set changes a setting in the file, adding its section if need be
+func (cfg Config) set(name string, values []string) error {
+	setting, err := findConfigSetting(name)
+	if err != nil {
+		return err
+	}
+	if err = setting.check(values); err != nil {
+		return err
+	}
+	sectionName, key := splitSettingName(name)
+	section := cfg.section(sectionName)
+	if section == nil {
+		section = cfg.file.addSection(sectionName)
+	}
+	section.set(key, formatConfigValue(setting.kind, values))
+	if sectionName == "" {
+		cfg.file.preamble = section.lines
+	}
+	return nil
+}
+
+// unset removes a setting from the file, and its section if that leaves
+// it empty
+func (cfg Config) unset(name string) error {
+	if _, err := findConfigSetting(name); err != nil {
+		return err
+	}
+	sectionName, key := splitSettingName(name)
+	section := cfg.section(sectionName)
+	if section == nil {
+		return nil
+	}
+	remaining := section.unset(key)
+	if sectionName == "" {
+		cfg.file.preamble = section.lines
+	} else if !remaining {
+		cfg.file.removeSection(section.name)
+	}
+	return nil
+}
+
+// findConfigSetting checks a setting's name: one of CONFIG_SETTINGS,
+// groups.<group>, or account.<account>.<setting> for those that can be
+// given per account
+func findConfigSetting(name string) (configSetting, error) {
+	sectionName, key := splitSettingName(name)
+	switch {
+	case sectionName == "groups" && key != "":
+		return configSetting{name: name, kind: CONFIG_LIST}, nil
+	case strings.HasPrefix(sectionName, "account.") && sectionName != "account.":
+		for _, setting := range CONFIG_SETTINGS {
+			if setting.perAccount && setting.name == key {
+				return setting, nil
+			}
+		}
+	case sectionName == "":
+		for _, setting := range CONFIG_SETTINGS {
+			if setting.name == key {
+				return setting, nil
+			}
+		}
+	}
+	return configSetting{}, errors.New("Unknown setting '" + name + "'; see 'credulous config list --all'")
+}
+
+// check makes sure a value makes sense for a setting
+func (setting configSetting) check(values []string) error {
+	if setting.kind != CONFIG_LIST && len(values) != 1 {
+		return errors.New(setting.name + " takes a single value")
+	}
+	switch setting.name {
+	case "lifetime":
+		if n, err := strconv.Atoi(values[0]); err != nil || n < 0 {
+			return errors.New("lifetime must be a number of seconds")
+		}
+	case "format":
+		if _, err := resolveEnvFormat(values[0]); err != nil {
+			return err
+		}
+	case "region":
+		if _, ok := aws.Regions[values[0]]; !ok {
+			return errors.New("Unknown AWS region '" + values[0] + "'")
+		}
+	case "partition":
+		if _, ok := PARTITION_IAM_ENDPOINTS[values[0]]; !ok {
+			return errors.New("Unknown AWS partition '" + values[0] + "'; expected aws, aws-cn or aws-us-gov")
+		}
+	}
+	return nil
+}
+
+// parseConfigValue reads a TOML value that fits on one line: a string,
+// an integer or boolean, or an array of them
+func parseConfigValue(text string) ([]string, error) {
+	values := []string{}
+	rest := strings.TrimSpace(text)
+	array := strings.HasPrefix(rest, "[")
+	if array {
+		rest = strings.TrimSpace(rest[1:])
+	}
+	for !array || !strings.HasPrefix(rest, "]") {
+		value, remaining, err := parseConfigScalar(rest)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		rest = strings.TrimSpace(remaining)
+		if !array {
+			break
+		}
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return nil, errors.New("expected , or ] in " + text)
+		}
+	}
+	if array {
+		rest = strings.TrimSpace(rest[1:])
+	}
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil, errors.New("unexpected " + rest)
+	}
+	return values, nil
+}
+
+func parseConfigScalar(text string) (value, rest string, err error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		for i := 1; i < len(text); i++ {
+			if text[i] == '\\' {
+				i++
+			} else if text[i] == '"' {
+				value, err = strconv.Unquote(text[:i+1])
+				return value, text[i+1:], err
+			}
+		}
+	case strings.HasPrefix(text, "'"):
+		if end := strings.Index(text[1:], "'"); end >= 0 {
+			return text[1 : end+1], text[end+2:], nil
+		}
+	default:
+		end := strings.IndexAny(text, " \t,]#")
+		if end < 0 {
+			end = len(text)
+		}
+		value = text[:end]
+		if _, err := strconv.ParseInt(value, 10, 64); err == nil || value == "true" || value == "false" {
+			return value, text[end:], nil
+		}
+		return "", "", errors.New("expected a quoted string, a number or true or false, not '" + value + "'")
+	}
+	return "", "", errors.New("unterminated string " + text)
+}
+
+func formatConfigValue(kind int, values []string) string {
+	quoted := []string{}
+	for _, value := range values {
+		if kind == CONFIG_INT {
+			quoted = append(quoted, value)
+		} else {
+			quoted = append(quoted, strconv.Quote(value))
+		}
+	}
+	if kind == CONFIG_LIST {
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+	return quoted[0]
+}
+
+// configEnvName is the environment variable that overrides a top-level
+// setting
+func configEnvName(name string) string {
+	return CONFIG_ENV_PREFIX + strings.ToUpper(name)
+}
+
+// configValues looks up a setting for an account, or for no account in
+// particular if it's "": from the environment first, then the account's
+// section of the config file, then the top level. Lists in the
+// environment are separated by commas. A config file that can't be read
+// is warned about and left out.
+func configValues(name, account string) []string {
+	setting, err := findConfigSetting(name)
+	if err != nil {
+		panic(err)
+	}
+	if value := os.Getenv(configEnvName(name)); value != "" {
+		if setting.kind == CONFIG_LIST {
+			return strings.Split(value, ",")
+		}
+		return []string{value}
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Print("WARNING: ignoring config: " + err.Error())
+		return nil
+	}
+	if account != "" && setting.perAccount {
+		if values := cfg.rawValues("account." + account + "." + name); values != nil {
+			return values
+		}
+	}
+	return cfg.rawValues(name)
+}
+
+// configString is a single-valued setting, "" if it isn't set; paths
+// have ~ expanded
+func configString(name, account string) string {
+	values := configValues(name, account)
+	if len(values) == 0 {
+		return ""
+	}
+	for _, setting := range CONFIG_SETTINGS {
+		if setting.name == name && setting.kind == CONFIG_PATH {
+			return expandHome(values[0])
+		}
+	}
+	return values[0]
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[1:])
+	}
+	return path
+}
+
+// expandRecipients turns @group into the public keys the config file
+// lists for the group, and expands ~ in the rest
+func expandRecipients(recipients []string) ([]string, error) {
+	files := []string{}
+	for _, recipient := range recipients {
+		if !strings.HasPrefix(recipient, "@") {
+			files = append(files, expandHome(recipient))
+			continue
+		}
+		group := recipient[1:]
+		cfg, err := loadConfig()
+		if err != nil {
+			return nil, err
+		}
+		members := cfg.rawValues("groups." + group)
+		if members == nil {
+			return nil, errors.New("No recipient group '" + group + "' in " + configFile())
+		}
+		for _, member := range members {
+			if strings.HasPrefix(member, "@") {
+				return nil, errors.New("Recipient group '" + group + "' can't include another group")
+			}
+			files = append(files, expandHome(member))
+		}
+	}
+	return files, nil
+}
+
+// configuredRegion is the region AWS calls go to unless told otherwise
+func configuredRegion() aws.Region {
+	if region, ok := aws.Regions[configString("region", "")]; ok {
+		return region
+	}
+	return aws.APSoutheast2
+}
+
+// iamRegion is the configured region, with IAM where the configured
+// partition has it
+func iamRegion() aws.Region {
+	region := configuredRegion()
+	if endpoint, ok := PARTITION_IAM_ENDPOINTS[configString("partition", "")]; ok {
+		region.IAMEndpoint = endpoint
+	}
+	return region
+}
+
+// useConfiguredAgent points ssh, and go-git's ssh-agent auth, at the
+// configured agent socket, if there is one
+func useConfiguredAgent() {
+	if socket := configString("agent_socket", ""); socket != "" {
+		os.Setenv("SSH_AUTH_SOCK", socket)
+	}
+}
+
+// listConfig writes every setting that's in effect, in the config
+// file's own syntax and order, noting those that come from the
+// environment
+func listConfig(output io.Writer, cfg Config) {
+	for _, setting := range CONFIG_SETTINGS {
+		if value := os.Getenv(configEnvName(setting.name)); value != "" {
+			values := []string{value}
+			if setting.kind == CONFIG_LIST {
+				values = strings.Split(value, ",")
+			}
+			fmt.Fprintf(output, "%s = %s  # from %s\n", setting.name,
+				formatConfigValue(setting.kind, values), configEnvName(setting.name))
+		}
+	}
+	for _, name := range cfg.names() {
+		sectionName, key := splitSettingName(name)
+		if sectionName == "" && os.Getenv(configEnvName(key)) != "" {
+			continue
+		}
+		setting, _ := findConfigSetting(name)
+		fmt.Fprintf(output, "%s = %s\n", name, formatConfigValue(setting.kind, cfg.rawValues(name)))
+	}
+}
+
+// describeConfigSettings writes what can be set, for config list --all
+func describeConfigSettings(output io.Writer) {
+	for _, setting := range CONFIG_SETTINGS {
+		scope := ""
+		if setting.perAccount {
+			scope = " (also per account)"
+		}
+		fmt.Fprintf(output, "%-14s %s%s; %s overrides it\n", setting.name, setting.usage, scope, configEnvName(setting.name))
+	}
+	fmt.Fprintf(output, "%-14s %s\n", "groups.<name>", "SSH public keys to encrypt for, as @<name>")
+}
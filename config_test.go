@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const TEST_CONFIG string = `# defaults for work
+key = "~/.ssh/work_rsa"
+lifetime = 86400  # a day
+recipients = ["~/.ssh/work_rsa.pub", "@ops"]
+
+[groups]
+ops = ['/keys/alice.pub', "/keys/bob.pub"]
+
+[account."prod"]
+lifetime = 3600
+repo = "prod"
+`
+
+func TestConfig(t *testing.T) {
+	Convey("Test the config file", t, func() {
+		home, cleanup := withTempHome()
+		defer cleanup()
+		So(ioutil.WriteFile(configFile(), []byte(TEST_CONFIG), 0600), ShouldEqual, nil)
+		origKey := os.Getenv("CREDULOUS_KEY")
+		defer os.Setenv("CREDULOUS_KEY", origKey)
+		os.Setenv("CREDULOUS_KEY", "")
+
+		Convey("Values are TOML strings, numbers and arrays", func() {
+			values, err := parseConfigValue(`["a\"b", 'c\d' , 3] # done`)
+			So(err, ShouldEqual, nil)
+			So(values, ShouldResemble, []string{`a"b`, `c\d`, "3"})
+
+			_, err = parseConfigValue("bare")
+			So(err.Error(), ShouldEqual, "expected a quoted string, a number or true or false, not 'bare'")
+			_, err = parseConfigValue(`["a" "b"]`)
+			So(err.Error(), ShouldEqual, `expected , or ] in ["a" "b"]`)
+		})
+
+		Convey("Settings are looked up for an account, then at the top level", func() {
+			So(configString("key", ""), ShouldEqual, filepath.Join(home, ".ssh/work_rsa"))
+			So(configString("lifetime", ""), ShouldEqual, "86400")
+			So(configString("lifetime", "prod"), ShouldEqual, "3600")
+			So(configString("lifetime", "dev"), ShouldEqual, "86400")
+			So(configString("repo", ""), ShouldEqual, "")
+			So(configString("repo", "prod"), ShouldEqual, "prod")
+		})
+
+		Convey("The environment overrides the file", func() {
+			os.Setenv("CREDULOUS_KEY", "/other/key")
+			So(configString("key", "prod"), ShouldEqual, "/other/key")
+
+			cfg, err := loadConfig()
+			So(err, ShouldEqual, nil)
+			var out bytes.Buffer
+			listConfig(&out, cfg)
+			So(out.String(), ShouldStartWith, "key = \"/other/key\"  # from CREDULOUS_KEY\nlifetime = 86400\n")
+			So(out.String(), ShouldEndWith, "account.prod.lifetime = 3600\naccount.prod.repo = \"prod\"\n")
+		})
+
+		Convey("Groups stand for their keys", func() {
+			files, err := expandRecipients(configValues("recipients", ""))
+			So(err, ShouldEqual, nil)
+			So(files, ShouldResemble, []string{filepath.Join(home, ".ssh/work_rsa.pub"), "/keys/alice.pub", "/keys/bob.pub"})
+
+			_, err = expandRecipients([]string{"@nosuch"})
+			So(err.Error(), ShouldEqual, "No recipient group 'nosuch' in "+configFile())
+		})
+
+		Convey("Setting things keeps the rest of the file", func() {
+			cfg, err := loadConfig()
+			So(err, ShouldEqual, nil)
+			So(cfg.set("lifetime", []string{"7200"}), ShouldEqual, nil)
+			So(cfg.set("format", []string{"fish"}), ShouldEqual, nil)
+			So(cfg.set("account.dev.recipients", []string{"@ops"}), ShouldEqual, nil)
+			So(cfg.unset("account.prod.lifetime"), ShouldEqual, nil)
+			So(cfg.unset("account.prod.repo"), ShouldEqual, nil)
+			So(cfg.save(), ShouldEqual, nil)
+
+			b, err := ioutil.ReadFile(configFile())
+			So(err, ShouldEqual, nil)
+			So(string(b), ShouldEqual, `# defaults for work
+key = "~/.ssh/work_rsa"
+lifetime = 7200
+recipients = ["~/.ssh/work_rsa.pub", "@ops"]
+format = "fish"
+
+[groups]
+ops = ['/keys/alice.pub', "/keys/bob.pub"]
+
+[account.dev]
+recipients = ["@ops"]
+`)
+			format, err := resolveEnvFormat("")
+			So(err, ShouldEqual, nil)
+			So(format, ShouldEqual, "fish")
+		})
+
+		Convey("Nonsense isn't let in", func() {
+			cfg, err := loadConfig()
+			So(err, ShouldEqual, nil)
+			So(cfg.set("colour", []string{"red"}).Error(), ShouldEqual, "Unknown setting 'colour'; see 'credulous config list --all'")
+			So(cfg.set("account.prod.region", []string{"us-east-1"}).Error(), ShouldEqual, "Unknown setting 'account.prod.region'; see 'credulous config list --all'")
+			So(cfg.set("lifetime", []string{"soon"}).Error(), ShouldEqual, "lifetime must be a number of seconds")
+			So(cfg.set("partition", []string{"aws-mars"}).Error(), ShouldEqual, "Unknown AWS partition 'aws-mars'; expected aws, aws-cn or aws-us-gov")
+			So(cfg.set("key", []string{"a", "b"}).Error(), ShouldEqual, "key takes a single value")
+
+			So(ioutil.WriteFile(configFile(), []byte("lifetime = forever\n"), 0600), ShouldEqual, nil)
+			_, err = loadConfig()
+			So(err.Error(), ShouldEqual, configFile()+": Invalid value for lifetime: expected a quoted string, a number or true or false, not 'forever'")
+		})
+
+		Convey("The configured repos come first", func() {
+			for _, dir := range []string{"local", "team", "ops"} {
+				So(os.MkdirAll(filepath.Join(getRootPath(), dir), 0700), ShouldEqual, nil)
+			}
+			cfg, err := loadConfig()
+			So(err, ShouldEqual, nil)
+			So(cfg.set("repo_order", []string{"ops"}), ShouldEqual, nil)
+			So(cfg.set("repo", []string{"team"}), ShouldEqual, nil)
+			So(cfg.save(), ShouldEqual, nil)
+			order, err := repoSearchOrder()
+			So(err, ShouldEqual, nil)
+			So(order, ShouldResemble, []string{"ops", "team", "local"})
+		})
+
+		Convey("The partition decides where IAM is", func() {
+			origPartition := os.Getenv("CREDULOUS_PARTITION")
+			defer os.Setenv("CREDULOUS_PARTITION", origPartition)
+			os.Setenv("CREDULOUS_PARTITION", "aws-us-gov")
+			So(iamRegion().IAMEndpoint, ShouldEqual, "https://iam.us-gov.amazonaws.com")
+		})
+	})
+}
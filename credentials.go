@@ -5,18 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/realestate-com-au/goamz/aws"
-	"github.com/realestate-com-au/goamz/iam"
 
-	"code.google.com/p/go.crypto/ssh"
+	"golang.org/x/crypto/ssh"
 )
 
 const FORMAT_VERSION string = "2014-06-12"
@@ -32,6 +30,12 @@ type Credentials struct {
 	CreateTime       string
 	LifeTime         int
 	Encryptions      []Encryption
+	// Tags are kept in plaintext, so that credentials can be picked
+	// out by them without decrypting anything
+	Tags map[string]string `json:",omitempty"`
+	// Kind is what sort of secret this is; AWS credentials, which were
+	// all there was until there were kinds, leave it out
+	Kind string `json:",omitempty"`
 }
 
 type Encryption struct {
@@ -47,6 +51,10 @@ type Credential struct {
 	KeyId     string
 	SecretKey string
 	EnvVars   map[string]string
+	// Data is the contents of a file secret
+	Data []byte `json:",omitempty"`
+	// Files are attached to AWS credentials, for source to write out
+	Files []Attachment `json:",omitempty"`
 }
 
 type OldCredential struct {
@@ -69,6 +77,7 @@ type SaveData struct {
 	force    bool
 	repo     string
 	isRepo   bool
+	tags     map[string]string
 }
 
 func decodeOldCredential(data []byte, keyfile string) (*OldCredential, error) {
@@ -181,12 +190,7 @@ func parseCredential(data []byte, keyfile string) (*Credentials, error) {
 	return &creds, nil
 }
 
-func readCredentialFile(fileName string, keyfile string) (*Credentials, error) {
-	b, err := ioutil.ReadFile(fileName)
-	if err != nil {
-		return nil, err
-	}
-
+func decodeCredentialData(b []byte, keyfile string) (*Credentials, error) {
 	if !strings.Contains(string(b), "Version") {
 		log.Print("INFO: These credentials are in the old format; re-run 'credulous save' now to remove this warning")
 		creds, err := parseOldCredential(b, keyfile)
@@ -204,42 +208,70 @@ func readCredentialFile(fileName string, keyfile string) (*Credentials, error) {
 	return creds, nil
 }
 
+// WriteToDisk saves the credentials to a repo's store, which these days
+// need not be on disk at all
 func (cred Credentials) WriteToDisk(repo, filename string) (err error) {
 	b, err := json.Marshal(cred)
 	if err != nil {
 		return err
 	}
-	path := filepath.Join(repo, cred.AccountAliasOrId, cred.IamUsername)
-	os.MkdirAll(path, 0700)
-	err = ioutil.WriteFile(filepath.Join(path, filename), b, 0600)
+	store, err := openStore(repo)
 	if err != nil {
 		return err
 	}
-	isrepo, err := isGitRepo(repo)
-	if err != nil {
-		return err
-	}
-	if !isrepo {
-		return nil
-	}
-	relpath := filepath.Join(cred.AccountAliasOrId, cred.IamUsername, filename)
-	_, err = gitAddCommitFile(repo, relpath, "Added by Credulous")
-	if err != nil {
-		return err
-	}
-	return nil
+	return store.Put(cred.AccountAliasOrId, cred.IamUsername, filename, b)
 }
 
 func (cred OldCredential) Display(output io.Writer) {
-	fmt.Fprintf(output, "export AWS_ACCESS_KEY_ID=\"%v\"\nexport AWS_SECRET_ACCESS_KEY=\"%v\"\n", cred.KeyId, cred.SecretKey)
+	cred.DisplayAs(output, "bash")
+}
+
+// DisplayAs writes the credentials in one of the envFormats
+func (cred OldCredential) DisplayAs(output io.Writer, format string) error {
+	return writeEnv(output, format, credentialEnvironment(Credential{KeyId: cred.KeyId, SecretKey: cred.SecretKey}))
 }
 
 func (cred Credentials) Display(output io.Writer) {
-	fmt.Fprintf(output, "export AWS_ACCESS_KEY_ID=\"%v\"\nexport AWS_SECRET_ACCESS_KEY=\"%v\"\n",
-		cred.Encryptions[0].decoded.KeyId, cred.Encryptions[0].decoded.SecretKey)
-	for key, val := range cred.Encryptions[0].decoded.EnvVars {
-		fmt.Fprintf(output, "export %s=\"%s\"\n", key, val)
+	cred.DisplayAs(output, "bash")
+}
+
+// DisplayAs writes the credentials, and the environment saved with
+// them, in one of the envFormats
+func (cred Credentials) DisplayAs(output io.Writer, format string) error {
+	return writeEnv(output, format, credentialEnvironment(cred.Encryptions[0].decoded))
+}
+
+// expiryTime is when a set of credentials should be rotated by, going
+// by the lifetime they were saved with, or 0 if they don't expire
+func (cred Credentials) expiryTime() int64 {
+	created, err := strconv.ParseInt(cred.CreateTime, 10, 64)
+	if err != nil || cred.LifeTime <= 0 {
+		return 0
+	}
+	return created + int64(cred.LifeTime)
+}
+
+// SourceAs is DisplayAs for loading into a shell, along with the
+// loadedMarkers, writing out any attached files first
+func (cred Credentials) SourceAs(output io.Writer, format string) error {
+	decoded := cred.Encryptions[0].decoded
+	if len(decoded.Files) > 0 && envFormats[format].unset == nil {
+		// nothing could ever clear them out of the tmpfs again
+		return errors.New(cred.IamUsername + "@" + cred.AccountAliasOrId + " has attached files, which " + format +
+			" can't load; please use a shell, or 'credulous exec'")
 	}
+	dir, fileVars, err := writeAttachments(attachmentsRoot(), decoded.Files)
+	if err != nil {
+		return err
+	}
+	vars := append(credentialEnvironment(decoded), fileVars...)
+	if envFormats[format].unset != nil {
+		vars = append(vars, loadedMarkers(cred, dir)...)
+	}
+	if err = writeEnv(output, format, vars); err != nil {
+		removeAttachments(dir)
+	}
+	return err
 }
 
 func (creds Credentials) verifyUserAndAccount() error {
@@ -249,8 +281,7 @@ func (creds Credentials) verifyUserAndAccount() error {
 		AccessKey: creds.Encryptions[0].decoded.KeyId,
 		SecretKey: creds.Encryptions[0].decoded.SecretKey,
 	}
-	// Note: the region is irrelevant for IAM
-	instance := iam.New(auth, aws.APSoutheast2)
+	instance := newIAMClient(auth)
 
 	// Make sure the account is who we expect
 	err := verify_account(creds.AccountAliasOrId, instance)
@@ -280,7 +311,7 @@ func (cred *Credential) deleteOneKey(username string) (err error) {
 		AccessKey: cred.KeyId,
 		SecretKey: cred.SecretKey,
 	}
-	instance := iam.New(auth, aws.APSoutheast2)
+	instance := newIAMClient(auth)
 
 	allKeys, err := instance.AccessKeys(username)
 	if err != nil {
@@ -337,7 +368,7 @@ func (cred *Credential) createNewAccessKey(username string) (err error) {
 		AccessKey: cred.KeyId,
 		SecretKey: cred.SecretKey,
 	}
-	instance := iam.New(auth, aws.APSoutheast2)
+	instance := newIAMClient(auth)
 
 	resp, err := instance.CreateAccessKey(username)
 	if err != nil {
@@ -366,17 +397,19 @@ func (cred *Credential) rotateCredentials(username string) (err error) {
 	if err != nil {
 		return err
 	}
-	// Loop until the credentials are active
-	count := 0
-	for _, _, err = getAWSUsernameAndAlias(*cred); err != nil && count < ROTATE_TIMEOUT; _, _, err = getAWSUsernameAndAlias(*cred) {
-		time.Sleep(1 * time.Second)
-		count += 1
-	}
-	if err != nil {
-		err = errors.New("Timed out waiting for new credentials to become active")
+	// Wait until the new credentials have propagated through IAM
+	err = propagationRetryPolicy.do("rotate", func() error {
+		_, _, err := getAWSUsernameAndAlias(*cred)
 		return err
+	})
+	if err != nil && classifyAWSError(err) == AWSInvalidCredentialsError {
+		err = &AWSError{
+			Kind: AWSInvalidCredentialsError,
+			Op:   "rotate",
+			Err:  errors.New("Timed out waiting for new credentials to become active"),
+		}
 	}
-	return nil
+	return err
 }
 
 func SaveCredentials(data SaveData) (err error) {
@@ -387,7 +420,7 @@ func SaveCredentials(data SaveData) (err error) {
 		key_create_date = time.Now().Unix()
 	} else {
 		auth := aws.Auth{AccessKey: data.cred.KeyId, SecretKey: data.cred.SecretKey}
-		instance := iam.New(auth, aws.APSoutheast2)
+		instance := newIAMClient(auth)
 		if data.username == "" {
 			data.username, err = getAWSUsername(instance)
 			if err != nil {
@@ -410,22 +443,12 @@ func SaveCredentials(data SaveData) (err error) {
 	}
 
 	fmt.Printf("saving credentials for %s@%s\n", data.username, data.alias)
-	plaintext, err := json.Marshal(data.cred)
-	if err != nil {
+	if err = checkKindUnchanged(data.repo, data.alias, data.username, SECRET_KIND_AWS); err != nil {
 		return err
 	}
-
-	enc_slice := []Encryption{}
-	for _, pubkey := range data.pubkeys {
-		encoded, err := CredulousEncode(string(plaintext), pubkey)
-		if err != nil {
-			return err
-		}
-
-		enc_slice = append(enc_slice, Encryption{
-			Ciphertext:  encoded,
-			Fingerprint: SSHFingerprint(pubkey),
-		})
+	enc_slice, err := encryptCredential(data.cred, data.pubkeys)
+	if err != nil {
+		return err
 	}
 	creds := Credentials{
 		Version:          FORMAT_VERSION,
@@ -434,6 +457,7 @@ func SaveCredentials(data SaveData) (err error) {
 		CreateTime:       fmt.Sprintf("%d", key_create_date),
 		Encryptions:      enc_slice,
 		LifeTime:         data.lifetime,
+		Tags:             mergeTags(data.repo, data.alias, data.username, data.tags),
 	}
 
 	filename := fmt.Sprintf("%v-%v.json", key_create_date, data.cred.KeyId[12:])
@@ -441,6 +465,28 @@ func SaveCredentials(data SaveData) (err error) {
 	return err
 }
 
+// encryptCredential encrypts a credential for each of the keys
+func encryptCredential(cred Credential, pubkeys []ssh.PublicKey) ([]Encryption, error) {
+	plaintext, err := json.Marshal(cred)
+	if err != nil {
+		return nil, err
+	}
+
+	enc_slice := []Encryption{}
+	for _, pubkey := range pubkeys {
+		encoded, err := CredulousEncode(string(plaintext), pubkey)
+		if err != nil {
+			return nil, err
+		}
+
+		enc_slice = append(enc_slice, Encryption{
+			Ciphertext:  encoded,
+			Fingerprint: SSHFingerprint(pubkey),
+		})
+	}
+	return enc_slice, nil
+}
+
 type FileLister interface {
 	Readdir(int) ([]os.FileInfo, error)
 	Name() string
@@ -462,20 +508,47 @@ func getDirs(fl FileLister) ([]os.FileInfo, error) {
 	return dirs, nil
 }
 
-func findDefaultDir(fl FileLister) (string, error) {
-	dirs, err := getDirs(fl)
-	if err != nil {
-		return "", err
-	}
-
+// pickDefault returns the only one of names, if there is only one
+func pickDefault(names []string) (string, error) {
 	switch {
-	case len(dirs) == 0:
+	case len(names) == 0:
 		return "", errors.New("No saved credentials found; please run 'credulous save' first")
-	case len(dirs) > 1:
+	case len(names) > 1:
 		return "", errors.New("More than one account found; please specify account and user")
 	}
 
-	return dirs[0].Name(), nil
+	return names[0], nil
+}
+
+// defaultIdentity fills in the account and user to use, when there is
+// only one choice of them in the store
+func defaultIdentity(store Store, alias, username string) (string, string, error) {
+	identities, err := store.Identities()
+	if err != nil {
+		return "", "", err
+	}
+	accounts := make(map[string]bool)
+	for _, identity := range identities {
+		account, _ := splitIdentity(identity)
+		accounts[account] = true
+	}
+	if alias == "" {
+		if alias, err = pickDefault(sortedKeys(accounts)); err != nil {
+			return "", "", err
+		}
+	}
+	if username == "" {
+		users := make(map[string]bool)
+		for _, identity := range identities {
+			if account, user := splitIdentity(identity); account == alias {
+				users[user] = true
+			}
+		}
+		if username, err = pickDefault(sortedKeys(users)); err != nil {
+			return "", "", err
+		}
+	}
+	return alias, username, nil
 }
 
 func (cred Credentials) ValidateCredentials(alias string, username string) error {
@@ -496,35 +569,30 @@ func (cred Credentials) ValidateCredentials(alias string, username string) error
 }
 
 func RetrieveCredentials(rootPath string, alias string, username string, keyfile string) (Credentials, error) {
-	rootDir, err := os.Open(rootPath)
+	store, err := openStore(rootPath)
 	if err != nil {
-		panic_the_err(err)
+		return Credentials{}, err
 	}
 
-	if alias == "" {
-		if alias, err = findDefaultDir(rootDir); err != nil {
-			panic_the_err(err)
+	if alias == "" || username == "" {
+		if alias, username, err = defaultIdentity(store, alias, username); err != nil {
+			return Credentials{}, err
 		}
 	}
 
-	if username == "" {
-		aliasDir, err := os.Open(filepath.Join(rootPath, alias))
-		if err != nil {
-			panic_the_err(err)
-		}
-		username, err = findDefaultDir(aliasDir)
-		if err != nil {
-			panic_the_err(err)
-		}
+	latest, err := store.Latest(alias, username)
+	if err != nil {
+		return Credentials{}, err
 	}
-
-	fullPath := filepath.Join(rootPath, alias, username)
-	latest, err := latestFileInDir(fullPath)
+	policy, err := signaturePolicy(rootPath)
 	if err != nil {
 		return Credentials{}, err
 	}
-	filePath := filepath.Join(fullPath, latest.Name())
-	cred, err := readCredentialFile(filePath, keyfile)
+	name := describeStoredFile(rootPath, alias, username, latest.Name)
+	if err = verifyCredentialData(name, latest.Data, latest.Sig, policy); err != nil {
+		return Credentials{}, err
+	}
+	cred, err := decodeCredentialData(latest.Data, keyfile)
 	if err != nil {
 		return Credentials{}, err
 	}
@@ -532,73 +600,58 @@ func RetrieveCredentials(rootPath string, alias string, username string, keyfile
 	return *cred, nil
 }
 
-func latestFileInDir(dir string) (os.FileInfo, error) {
-	entries, err := ioutil.ReadDir(dir)
-	panic_the_err(err)
-	if len(entries) == 0 {
-		return nil, errors.New("No credentials have been saved for that user and account; please run 'credulous save' first")
+// parseCredentialFilename splits the name of a saved credential file,
+// <create time>-<end of key ID>.json, into its parts
+func parseCredentialFilename(name string) (createTime int64, keySuffix string, err error) {
+	base := strings.TrimSuffix(filepath.Base(name), ".json")
+	parts := strings.SplitN(base, "-", 2)
+	if len(parts) != 2 || parts[1] == "" || base == filepath.Base(name) {
+		return 0, "", errors.New("Not a credential file: " + name)
+	}
+	createTime, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", errors.New("Not a credential file: " + name)
 	}
-	return entries[len(entries)-1], nil
+	return createTime, parts[1], nil
 }
 
-func listAvailableCredentials(rootDir FileLister) ([]string, error) {
-	creds := make(map[string]int)
+// listAvailableCredentials lists the identities with current credentials
+// in any of the repos under the root, or any of the stores in settings,
+// which 'credulous repo add' set up
+func listAvailableCredentials(rootDir FileLister, settings RepoSettings) ([]string, error) {
+	repos := []string{}
 
 	repo_dirs, err := getDirs(rootDir) // get just the directories
 	if err != nil {
 		return []string{}, err
 	}
+	for _, repo_dirent := range repo_dirs {
+		if !strings.HasPrefix(repo_dirent.Name(), ".") {
+			repos = append(repos, filepath.Join(rootDir.Name(), repo_dirent.Name()))
+		}
+	}
+
+	for _, name := range sortedStoreNames(settings) {
+		repos = append(repos, settings.Stores[name])
+	}
 
-	if len(repo_dirs) == 0 {
+	if len(repos) == 0 {
 		return []string{}, errors.New("No saved credentials found; please run 'credulous save' first")
 	}
 
-	for _, repo_dirent := range repo_dirs {
-		repo_path := filepath.Join(rootDir.Name(), repo_dirent.Name())
-		repo_dir, err := os.Open(repo_path)
+	creds := make(map[string]bool)
+	for _, repo := range repos {
+		store, err := openStore(repo)
 		if err != nil {
 			return []string{}, err
 		}
-
-		alias_dirs, err := getDirs(repo_dir)
+		found, err := storeCredentials(store)
 		if err != nil {
 			return []string{}, err
 		}
-
-		for _, alias_dirent := range alias_dirs {
-			if alias_dirent.Name() == ".git" {
-				continue
-			}
-			alias_path := filepath.Join(repo_path, alias_dirent.Name())
-			alias_dir, err := os.Open(alias_path)
-			if err != nil {
-				return []string{}, err
-			}
-
-			user_dirs, err := getDirs(alias_dir)
-			if err != nil {
-				return []string{}, err
-			}
-
-			for _, user_dirent := range user_dirs {
-				user_path := filepath.Join(alias_path, user_dirent.Name())
-				latest, err := latestFileInDir(user_path)
-				if err != nil {
-					return []string{}, err
-				}
-				if latest.Name() != "" {
-					creds[user_dirent.Name()+"@"+alias_dirent.Name()] += 1
-				}
-			}
+		for _, cred := range found {
+			creds[cred] = true
 		}
 	}
-
-	names := make([]string, len(creds))
-	i := 0
-	for k, _ := range creds {
-		names[i] = k
-		i++
-	}
-	sort.Strings(names)
-	return names, nil
+	return sortedKeys(creds), nil
 }
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
+
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
 	// "io/ioutil"
 	// "fmt"
 )
@@ -99,37 +103,19 @@ func TestGetDirs(t *testing.T) {
 	})
 }
 
-func TestFindDefaultDir(t *testing.T) {
-	Convey("Test Finding Default Dirs", t, func() {
-		Convey("With no files or directories", func() {
-			t := TestFileList{}
-			_, err := findDefaultDir(&t)
+func TestPickDefault(t *testing.T) {
+	Convey("Test picking a default", t, func() {
+		Convey("With nothing to pick", func() {
+			_, err := pickDefault(nil)
 			So(err.Error(), ShouldEqual, "No saved credentials found; please run 'credulous save' first")
 		})
-		Convey("With one file and no directories", func() {
-			i := []os.FileInfo{}
-			i = append(i, &TestFileInfo{isDir: false})
-			t := TestFileList{testList: i}
-			_, err := findDefaultDir(&t)
-			So(err, ShouldNotEqual, nil)
-			So(err.Error(), ShouldEqual, "No saved credentials found; please run 'credulous save' first")
-		})
-		Convey("With one file and one directory", func() {
-			i := []os.FileInfo{}
-			i = append(i, &TestFileInfo{isDir: false})
-			i = append(i, &TestFileInfo{isDir: true, name: "foo"})
-			t := TestFileList{testList: i}
-			name, err := findDefaultDir(&t)
+		Convey("With only one", func() {
+			name, err := pickDefault([]string{"foo"})
 			So(err, ShouldEqual, nil)
 			So(name, ShouldEqual, "foo")
 		})
-		Convey("With no files and more than one directory", func() {
-			i := []os.FileInfo{}
-			i = append(i, &TestFileInfo{isDir: true, name: "foo"})
-			i = append(i, &TestFileInfo{isDir: true, name: "bar"})
-			i = append(i, &TestFileInfo{isDir: true, name: "baz"})
-			t := TestFileList{testList: i}
-			_, err := findDefaultDir(&t)
+		Convey("With more than one", func() {
+			_, err := pickDefault([]string{"foo", "bar", "baz"})
 			So(err, ShouldNotEqual, nil)
 			So(err.Error(), ShouldEqual, "More than one account found; please specify account and user")
 		})
@@ -138,31 +124,137 @@ func TestFindDefaultDir(t *testing.T) {
 
 func TestValidateCredentials(t *testing.T) {
 	Convey("Test credential validation", t, func() {
-		// we can't really test ValidateCredentials directly,
-		// because it calls verifyUserAndAccount, which
-		// creates its own IAM connection. This is probably not
-		// the best way to have implemented that function.
-		// goamz provides an iamtest package, and we should
-		// use that.
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		keyId, secret := fake.AddUser("bob")
+		cred := Credentials{
+			IamUsername:      "bob",
+			AccountAliasOrId: "test-alias",
+			Encryptions: []Encryption{
+				{decoded: Credential{KeyId: keyId, SecretKey: secret}},
+			},
+		}
+
+		Convey("when everything matches", func() {
+			So(cred.ValidateCredentials("test-alias", "bob"), ShouldEqual, nil)
+		})
+		Convey("when the requested username differs", func() {
+			err := cred.ValidateCredentials("test-alias", "fred")
+			So(err.Error(), ShouldEqual, "FATAL: username in credential does not match requested username")
+		})
+		Convey("when the credential lies about its account", func() {
+			cred.AccountAliasOrId = "other-alias"
+			err := cred.ValidateCredentials("other-alias", "bob")
+			So(err.Error(), ShouldEqual, "Cannot verify account: does not match alias other-alias")
+		})
+		Convey("when the credential lies about its user", func() {
+			fake.AddUser("fred")
+			cred.IamUsername = "fred"
+			err := cred.ValidateCredentials("test-alias", "fred")
+			So(err.Error(), ShouldEqual, "Cannot verify user: access keys are not for user fred")
+		})
+	})
+}
+
+func TestSaveSourceRotate(t *testing.T) {
+	Convey("Test saving, sourcing and rotating against the fake IAM server", t, func() {
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		repo, err := ioutil.TempDir("", "credulous-test")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(repo)
+
+		pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		So(err, ShouldEqual, nil)
+
+		keyId, secret := fake.AddUser("bob")
+		cred := Credential{
+			KeyId:     keyId,
+			SecretKey: secret,
+			EnvVars:   map[string]string{"FOO": "bar"},
+		}
+		err = SaveCredentials(SaveData{
+			cred:    cred,
+			pubkeys: []ssh.PublicKey{pubkey},
+			repo:    repo,
+		})
+		So(err, ShouldEqual, nil)
+
+		Convey("Saved credentials can be sourced and validated", func() {
+			creds, err := RetrieveCredentials(repo, "test-alias", "bob", "testdata/testkey")
+			So(err, ShouldEqual, nil)
+			So(creds.IamUsername, ShouldEqual, "bob")
+			So(creds.AccountAliasOrId, ShouldEqual, "test-alias")
+			So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, keyId)
+			So(creds.Encryptions[0].decoded.SecretKey, ShouldEqual, secret)
+			So(creds.Encryptions[0].decoded.EnvVars["FOO"], ShouldEqual, "bar")
+			So(creds.ValidateCredentials("test-alias", "bob"), ShouldEqual, nil)
+		})
+
+		Convey("Rotating creates a new key and keeps the old one", func() {
+			err := (&cred).rotateCredentials("bob")
+			So(err, ShouldEqual, nil)
+			So(cred.KeyId, ShouldNotEqual, keyId)
+			So(len(fake.Keys("bob")), ShouldEqual, 2)
+
+			Convey("and rotating again deletes the oldest key", func() {
+				newKeyId := cred.KeyId
+				err := (&cred).rotateCredentials("bob")
+				So(err, ShouldEqual, nil)
+				keys := fake.Keys("bob")
+				So(len(keys), ShouldEqual, 2)
+				So(keys[keyId], ShouldEqual, "")
+				So(keys[newKeyId], ShouldEqual, "Active")
+				So(keys[cred.KeyId], ShouldEqual, "Active")
+			})
+
+			Convey("and the rotated credentials can be saved and sourced", func() {
+				err := SaveCredentials(SaveData{
+					cred:    cred,
+					pubkeys: []ssh.PublicKey{pubkey},
+					repo:    repo,
+				})
+				So(err, ShouldEqual, nil)
+				creds, err := RetrieveCredentials(repo, "test-alias", "bob", "testdata/testkey")
+				So(err, ShouldEqual, nil)
+				So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, cred.KeyId)
+				So(creds.ValidateCredentials("test-alias", "bob"), ShouldEqual, nil)
+			})
+		})
 	})
 }
 
+// readTestCredentials decrypts a credential file in testdata
+func readTestCredentials(filename, keyfile string) (*Credentials, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCredentialData(b, keyfile)
+}
+
 func TestReadFile(t *testing.T) {
 	Convey("Test Read File", t, func() {
 		Convey("Valid old Json returns Credential", func() {
-			cred, _ := readCredentialFile("testdata/credential.json", "testdata/testkey")
+			cred, _ := readTestCredentials("testdata/credential.json", "testdata/testkey")
 			So(cred.LifeTime, ShouldEqual, 22)
 			So(cred.Encryptions[0].decoded.KeyId, ShouldEqual, "some plaintext")
 		})
 		Convey("Old credentials display correctly", func() {
-			cred, _ := readCredentialFile("testdata/credential.json", "testdata/testkey")
+			cred, _ := readTestCredentials("testdata/credential.json", "testdata/testkey")
 			testWriter := TestWriter{}
 			cred.Display(&testWriter)
 			So(string(testWriter.Written), ShouldEqual, "export AWS_ACCESS_KEY_ID=\"some plaintext\"\nexport AWS_SECRET_ACCESS_KEY=\"some plaintext\"\n")
 		})
 
 		Convey("Valid new Json returns Credentials", func() {
-			cred, err := readCredentialFile("testdata/newcreds.json", "testdata/testkey")
+			cred, err := readTestCredentials("testdata/newcreds.json", "testdata/testkey")
 			So(err, ShouldEqual, nil)
 			So(cred.LifeTime, ShouldEqual, 0)
 			So(cred.CreateTime, ShouldEqual, "1401515273")
@@ -171,7 +263,7 @@ func TestReadFile(t *testing.T) {
 			So(cred.Encryptions[0].decoded.SecretKey, ShouldEqual, "plaintextsecret")
 		})
 		Convey("New credentials display correctly", func() {
-			cred, err := readCredentialFile("testdata/newcreds.json", "testdata/testkey")
+			cred, err := readTestCredentials("testdata/newcreds.json", "testdata/testkey")
 			testWriter := TestWriter{}
 			cred.Display(&testWriter)
 			So(string(testWriter.Written), ShouldEqual, "export AWS_ACCESS_KEY_ID=\"plaintextkeyid\"\nexport AWS_SECRET_ACCESS_KEY=\"plaintextsecret\"\n")
@@ -184,9 +276,40 @@ func TestListAvailableCreds(t *testing.T) {
 	Convey("Test listing available credentials", t, func() {
 		Convey("Test with no credentials", func() {
 			tmp := TestFileList{}
-			creds, err := listAvailableCredentials(&tmp)
+			creds, err := listAvailableCredentials(&tmp, RepoSettings{})
 			So(len(creds), ShouldEqual, 0)
 			So(err.Error(), ShouldEqual, "No saved credentials found; please run 'credulous save' first")
 		})
+		Convey("Test with credentials only in a store", func() {
+			dir, err := ioutil.TempDir("", "credulous-test")
+			So(err, ShouldEqual, nil)
+			defer os.RemoveAll(dir)
+			bundle := filepath.Join(dir, "team"+BUNDLE_SUFFIX)
+			So(bundleStore{file: bundle}.Put("acct", "bob", "1401515273-AAAAAAAA.json", []byte("{}")), ShouldEqual, nil)
+
+			tmp := TestFileList{}
+			creds, err := listAvailableCredentials(&tmp, RepoSettings{Stores: map[string]string{"team": bundle}})
+			So(err, ShouldEqual, nil)
+			So(creds, ShouldResemble, []string{"bob@acct"})
+		})
+	})
+}
+
+func TestParseCredentialFilename(t *testing.T) {
+	Convey("Test parsing credential filenames", t, func() {
+		Convey("A saved credential", func() {
+			created, suffix, err := parseCredentialFilename("acct/user/1401515273-ABCDEFGH.json")
+			So(err, ShouldEqual, nil)
+			So(created, ShouldEqual, 1401515273)
+			So(suffix, ShouldEqual, "ABCDEFGH")
+		})
+		Convey("A superseded credential", func() {
+			_, _, err := parseCredentialFilename("1401515273-ABCDEFGH.json.superseded")
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("Something else entirely", func() {
+			_, _, err := parseCredentialFilename("README")
+			So(err, ShouldNotEqual, nil)
+		})
 	})
 }
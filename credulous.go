@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -8,14 +9,16 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
-	"code.google.com/p/go.crypto/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 
-	"code.google.com/p/gopass"
 	"github.com/codegangsta/cli"
 )
 
@@ -27,16 +30,16 @@ func decryptPEM(pemblock *pem.Block, filename string) ([]byte, error) {
 		return []byte(""), err
 	}
 
-	// we already emit the prompt to stderr; GetPass only emits to stdout
-	var passwd string
-	passwd, err = gopass.GetPass("")
+	// we already emit the prompt to stderr
+	var passwd []byte
+	passwd, err = term.ReadPassword(int(os.Stdin.Fd()))
 	fmt.Fprintln(os.Stderr, "")
 	if err != nil {
 		return []byte(""), err
 	}
 
 	var decryptedBytes []byte
-	if decryptedBytes, err = x509.DecryptPEMBlock(pemblock, []byte(passwd)); err != nil {
+	if decryptedBytes, err = x509.DecryptPEMBlock(pemblock, passwd); err != nil {
 		return []byte(""), err
 	}
 
@@ -49,10 +52,16 @@ func decryptPEM(pemblock *pem.Block, filename string) ([]byte, error) {
 }
 
 func getPrivateKey(c *cli.Context) (filename string) {
-	if c.String("key") == "" {
-		filename = filepath.Join(os.Getenv("HOME"), "/.ssh/id_rsa")
-	} else {
+	return getPrivateKeyFor(c, "")
+}
+
+// getPrivateKeyFor is the private key for an account: the one given,
+// or else the one configured, or else ~/.ssh/id_rsa
+func getPrivateKeyFor(c *cli.Context, account string) (filename string) {
+	if c.String("key") != "" {
 		filename = c.String("key")
+	} else if filename = configString("key", account); filename == "" {
+		filename = filepath.Join(os.Getenv("HOME"), "/.ssh/id_rsa")
 	}
 	return filename
 }
@@ -86,6 +95,60 @@ func getAccountAndUserName(c *cli.Context) (string, string, error) {
 	}
 }
 
+// sourceCredentials writes out credentials to load, for source and
+// pick; pick always offers the picker when there's a terminal
+func sourceCredentials(c *cli.Context, pick bool) {
+	format, err := resolveEnvFormat(c.String("format"))
+	panic_the_err(err)
+	creds := retrieveSourceCredentials(c, pick)
+	if envFormats[format].unset != nil {
+		// these replace whatever the shell had loaded, attachments too
+		if err := removeAttachments(os.Getenv(ATTACHMENTS_DIR_ENV_VAR)); err != nil {
+			log.Print("WARNING: " + err.Error())
+		}
+	}
+	panic_the_err(creds.SourceAs(os.Stdout, format))
+}
+
+// retrieveSourceCredentials decrypts the AWS credentials asked for, and
+// unless forced, checks with AWS that they are whose they say they are
+func retrieveSourceCredentials(c *cli.Context, pick bool) Credentials {
+	account, username, err := resolveSourceIdentity(c, pick)
+	if err != nil {
+		panic_the_err(err)
+	}
+	keyfile := getPrivateKeyFor(c, account)
+	repo, err := parseSourceRepoArgs(c, account, username, SyncAuth{Keyfile: keyfile})
+	if err != nil {
+		panic_the_err(err)
+	}
+	var creds Credentials
+	if c.String("version") != "" {
+		if account == "" || username == "" {
+			panic_the_err(errors.New("Please specify which credentials to use an earlier version of, as username@account"))
+		}
+		creds, err = RetrieveCredentialVersion(repo, account, username, c.String("version"), keyfile)
+	} else {
+		creds, err = RetrieveCredentials(repo, account, username, keyfile)
+	}
+	if err != nil {
+		panic_the_err(err)
+	}
+
+	if kind := secretKind(creds.Kind); kind != SECRET_KIND_AWS {
+		panic_the_err(errors.New(storedIdentity(kind, creds.AccountAliasOrId, creds.IamUsername) + " is a " + kind +
+			" secret, not AWS credentials; please use 'credulous get'"))
+	}
+
+	if !c.Bool("force") {
+		err = creds.ValidateCredentials(account, username)
+		if err != nil {
+			panic_the_err(err)
+		}
+	}
+	return creds
+}
+
 func parseUserAndAccount(c *cli.Context) (username string, account string, err error) {
 	if (c.String("username") == "" || c.String("account") == "") && c.Bool("force") {
 		err = errors.New("Must specify both username and account with force")
@@ -150,18 +213,28 @@ func readSSHPubkeyFile(filename string) (pubkey ssh.PublicKey, err error) {
 	return pubkey, nil
 }
 
-func parseKeyArgs(c *cli.Context) (pubkeys []ssh.PublicKey, err error) {
+// parseKeyArgs reads the public keys to encrypt for: those given, any
+// @group among them standing for the keys the config file lists for it,
+// or else those configured for the account, or else the public half of
+// the private key
+func parseKeyArgs(c *cli.Context, account string) (pubkeys []ssh.PublicKey, err error) {
+	files := c.StringSlice("key")
+	if len(files) == 0 {
+		files = configValues("recipients", account)
+	}
 	// no args, so just use the default
-	if len(c.StringSlice("key")) == 0 {
-		pubkey, err := readSSHPubkeyFile(filepath.Join(os.Getenv("HOME"), "/.ssh/id_rsa.pub"))
-		if err != nil {
-			return nil, err
+	if len(files) == 0 {
+		files = []string{filepath.Join(os.Getenv("HOME"), "/.ssh/id_rsa.pub")}
+		if key := configString("key", account); key != "" {
+			files = []string{key + ".pub"}
 		}
-		pubkeys = append(pubkeys, pubkey)
-		return pubkeys, nil
 	}
 
-	for _, arg := range c.StringSlice("key") {
+	files, err = expandRecipients(files)
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range files {
 		pubkey, err := readSSHPubkeyFile(arg)
 		if err != nil {
 			return nil, err
@@ -174,7 +247,12 @@ func parseKeyArgs(c *cli.Context) (pubkeys []ssh.PublicKey, err error) {
 // parseLifetimeArgs attempts to be a little clever in determining what credential
 // lifetime you've chosen. It returns a number of hours and an error. It assumes that
 // the argument was passed in as hours.
-func parseLifetimeArgs(c *cli.Context) (lifetime int, err error) {
+func parseLifetimeArgs(c *cli.Context, account string) (lifetime int, err error) {
+	if !c.IsSet("lifetime") && !c.IsSet("l") {
+		if configured := configString("lifetime", account); configured != "" {
+			return strconv.Atoi(configured)
+		}
+	}
 	// the default is zero, which is our default
 	if c.Int("lifetime") < 0 {
 		return 0, nil
@@ -184,22 +262,62 @@ func parseLifetimeArgs(c *cli.Context) (lifetime int, err error) {
 }
 
 func parseRepoArgs(c *cli.Context) (repo string, err error) {
-	// the default is 'local' which is set below, so not much to do here
-	if c.String("repo") == "local" {
-		repo = path.Join(getRootPath(), "local")
-	} else {
-		repo = c.String("repo")
+	return parseAccountRepoArgs(c, "")
+}
+
+// parseAccountRepoArgs is the repo for an account: the one given, or
+// else the one configured for the account, or else the default
+func parseAccountRepoArgs(c *cli.Context, account string) (repo string, err error) {
+	name := c.String("repo")
+	if name == "" {
+		name = configString("repo", account)
+	}
+	if name == "" {
+		settings, err := loadRepoSettings()
+		if err != nil {
+			return "", err
+		}
+		name = settings.Default
+	}
+	return resolveRepo(name)
+}
+
+// parseSourceRepoArgs works out which repo to source from: the one
+// given, or else the first in search order that has the credentials,
+// after bringing any shared repos up to date
+func parseSourceRepoArgs(c *cli.Context, account, username string, auth SyncAuth) (repo string, err error) {
+	// a repo configured for the account is as good as one given
+	ownRepo := account != "" && configString("repo", account) != configString("repo", "")
+	if c.String("repo") != "" || account == "" || username == "" || ownRepo {
+		repo, err = parseAccountRepoArgs(c, account)
+		if err != nil {
+			return "", err
+		}
+		pullIfStale(repo, auth)
+		return repo, nil
+	}
+
+	order, err := repoSearchOrder()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range order {
+		repo, err := resolveRepo(name)
+		if err != nil {
+			return "", err
+		}
+		pullIfStale(repo, auth)
 	}
-	return repo, nil
+	return findRepoFor(account, username)
 }
 
 func parseSaveArgs(c *cli.Context) (cred Credential, username, account string, pubkeys []ssh.PublicKey, lifetime int, repo string, err error) {
-	pubkeys, err = parseKeyArgs(c)
+	username, account, err = parseUserAndAccount(c)
 	if err != nil {
 		return Credential{}, "", "", nil, 0, "", err
 	}
 
-	username, account, err = parseUserAndAccount(c)
+	pubkeys, err = parseKeyArgs(c, account)
 	if err != nil {
 		return Credential{}, "", "", nil, 0, "", err
 	}
@@ -209,12 +327,17 @@ func parseSaveArgs(c *cli.Context) (cred Credential, username, account string, p
 		return Credential{}, "", "", nil, 0, "", err
 	}
 
-	lifetime, err = parseLifetimeArgs(c)
+	attachments, err := parseAttachArgs(c)
+	if err != nil {
+		return Credential{}, "", "", nil, 0, "", err
+	}
+
+	lifetime, err = parseLifetimeArgs(c, account)
 	if err != nil {
 		return Credential{}, "", "", nil, 0, "", err
 	}
 
-	repo, err = parseRepoArgs(c)
+	repo, err = parseAccountRepoArgs(c, account)
 	if err != nil {
 		return Credential{}, "", "", nil, 0, "", err
 	}
@@ -231,12 +354,13 @@ func parseSaveArgs(c *cli.Context) (cred Credential, username, account string, p
 		KeyId:     AWSAccessKeyId,
 		SecretKey: AWSSecretAccessKey,
 		EnvVars:   envmap,
+		Files:     attachments,
 	}
 
 	return cred, username, account, pubkeys, lifetime, repo, nil
 }
 
-func main() {
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "credulous"
 	app.Usage = "Secure AWS Credential Management"
@@ -257,6 +381,18 @@ func main() {
 					Value: &cli.StringSlice{},
 					Usage: "\n        Environment variables to set in the form VAR=value",
 				},
+				cli.StringSliceFlag{
+					Name:  "attach",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Files to encrypt with the credentials, as VAR=path; source writes" +
+						"\n        them to a private directory and points VAR at each",
+				},
+				cli.StringSliceFlag{
+					Name:  "tag, t",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Tags to keep in plaintext with the credentials, as name=value" +
+						"\n        (those already saved are kept; an empty value removes one)",
+				},
 				cli.IntFlag{
 					Name:  "lifetime, l",
 					Value: 0,
@@ -279,13 +415,15 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:  "repo, r",
-					Value: "local",
-					Usage: "\n        Repository location ('local' by default)",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
 				},
 			},
 			Action: func(c *cli.Context) {
 				cred, username, account, pubkeys, lifetime, repo, err := parseSaveArgs(c)
 				panic_the_err(err)
+				tags, err := parseTagArgs(c, true)
+				panic_the_err(err)
 				err = SaveCredentials(SaveData{
 					cred:     cred,
 					username: username,
@@ -294,7 +432,76 @@ func main() {
 					lifetime: lifetime,
 					force:    c.Bool("force"),
 					repo:     repo,
+					tags:     tags,
+				})
+				panic_the_err(err)
+				refreshAWSExports(cred, account, username)
+				// without --force we don't know the identity until
+				// SaveCredentials has asked AWS, so don't claim one
+				auth := SyncAuth{Cred: &cred}
+				if username != "" && account != "" {
+					auth.Identity = filepath.Join(account, username)
+				}
+				pushIfShared(repo, auth)
+			},
+		},
+
+		{
+			Name:  "import",
+			Usage: "Save AWS credentials from an AWS credentials file or an IAM console CSV file",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "profile, p",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Profile to import from a credentials file (all of them if not given)",
+				},
+				cli.BoolFlag{
+					Name:  "scrub",
+					Usage: "\n        Remove the imported keys from the file afterwards",
+				},
+				cli.StringSliceFlag{
+					Name:  "key, k",
+					Value: &cli.StringSlice{},
+					Usage: "\n        SSH public keys for encryption",
+				},
+				cli.IntFlag{
+					Name:  "lifetime, l",
+					Value: 0,
+					Usage: "\n        Credential lifetime in seconds (0 means forever)",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
+				},
+			},
+			Action: func(c *cli.Context) {
+				filename := c.Args().First()
+				if filename == "" {
+					filename = awsCredentialsFile()
+				}
+				pubkeys, err := parseKeyArgs(c, "")
+				panic_the_err(err)
+				lifetime, err := parseLifetimeArgs(c, "")
+				panic_the_err(err)
+				repo, err := parseRepoArgs(c)
+				panic_the_err(err)
+
+				imported, err := importCredentials(ImportData{
+					filename: filename,
+					profiles: c.StringSlice("profile"),
+					pubkeys:  pubkeys,
+					lifetime: lifetime,
+					repo:     repo,
+					scrub:    c.Bool("scrub"),
 				})
+				for _, i := range imported {
+					account, username := splitIdentity(i.identity)
+					refreshAWSExports(i.cred, account, username)
+				}
+				if len(imported) > 0 {
+					pushIfShared(repo, SyncAuth{Cred: &imported[0].cred, Identity: imported[0].identity})
+				}
 				panic_the_err(err)
 			},
 		},
@@ -329,94 +536,159 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:  "repo, r",
-					Value: "local",
-					Usage: "\n        Repository location ('local' by default)",
+					Value: "",
+					Usage: "\n        Repository name or path (all repositories are searched if not given)",
+				},
+				cli.StringFlag{
+					Name:  "version",
+					Value: "",
+					Usage: "\n        An earlier version: a number from 'credulous history', or a git commit",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "\n        Output for bash, zsh, fish, powershell, cmd, dotenv or json" +
+						"\n        (the shell in $SHELL if not given)",
+				},
+				cli.StringSliceFlag{
+					Name:  "tag, t",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Choose among credentials tagged name=value (the value may be a pattern)",
 				},
 			},
 			Action: func(c *cli.Context) {
-				keyfile := getPrivateKey(c)
-				account, username, err := getAccountAndUserName(c)
-				if err != nil {
-					panic_the_err(err)
-				}
-				repo, err := parseRepoArgs(c)
-				if err != nil {
-					panic_the_err(err)
-				}
-				creds, err := RetrieveCredentials(repo, account, username, keyfile)
-				if err != nil {
-					panic_the_err(err)
-				}
-
-				if !c.Bool("force") {
-					err = creds.ValidateCredentials(account, username)
-					if err != nil {
-						panic_the_err(err)
-					}
-				}
-				creds.Display(os.Stdout)
+				sourceCredentials(c, false)
 			},
 		},
 
 		{
-			Name:  "current",
-			Usage: "Show the username and alias of the currently-loaded credentials",
+			Name:  "pick",
+			Usage: "Choose credentials to source from a list",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key, k",
+					Value: "",
+					Usage: "\n        SSH private key",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "\n        Force sourcing of credentials without validating username or account",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (all repositories are searched if not given)",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "\n        Output for bash, zsh, fish, powershell, cmd, dotenv or json" +
+						"\n        (the shell in $SHELL if not given)",
+				},
+				cli.StringSliceFlag{
+					Name:  "tag, t",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Only list credentials tagged name=value (the value may be a pattern)",
+				},
+			},
 			Action: func(c *cli.Context) {
-				AWSAccessKeyId := os.Getenv("AWS_ACCESS_KEY_ID")
-				AWSSecretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-				if AWSAccessKeyId == "" || AWSSecretAccessKey == "" {
-					err := errors.New("No amazon credentials are currently in your environment")
-					panic_the_err(err)
-				}
-				cred := Credential{
-					KeyId:     AWSAccessKeyId,
-					SecretKey: AWSSecretAccessKey,
-				}
-				username, alias, err := getAWSUsernameAndAlias(cred)
-				if err != nil {
-					panic_the_err(err)
-				}
-				fmt.Printf("%s@%s\n", username, alias)
+				sourceCredentials(c, true)
 			},
 		},
 
 		{
-			Name:  "display",
-			Usage: "Display loaded AWS credentials",
+			Name:  "exec",
+			Usage: "Run a command with AWS credentials: exec [options] <username@account> -- <command>...",
+			// options have to come before the credentials, which keeps
+			// the command's own options out of the way
+			SkipFlagParsing: true,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key, k",
+					Value: "",
+					Usage: "\n        SSH private key",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "\n        Force use of credentials without validating username or account",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (all repositories are searched if not given)",
+				},
+			},
 			Action: func(c *cli.Context) {
-				AWSAccessKeyId := os.Getenv("AWS_ACCESS_KEY_ID")
-				AWSSecretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-				fmt.Printf("AWS_ACCESS_KEY_ID: %s\n", AWSAccessKeyId)
-				fmt.Printf("AWS_SECRET_ACCESS_KEY: %s\n", AWSSecretAccessKey)
+				_, command, err := splitExecArgs(c.Args())
+				panic_the_err(err)
+				creds := retrieveSourceCredentials(c, false)
+				status, err := execWithCredentials(creds, command, os.Stdin, os.Stdout, os.Stderr)
+				panic_the_err(err)
+				os.Exit(status)
 			},
 		},
 
 		{
-			Name:  "list",
-			Usage: "List available AWS credentials",
+			Name:  "render",
+			Usage: "Fill in a template with AWS credentials: render <username@account> <template>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key, k",
+					Value: "",
+					Usage: "\n        SSH private key",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "\n        Force rendering of credentials without validating username or account",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (all repositories are searched if not given)",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "",
+					Usage: "\n        Write to this file, readable only by you, instead of stdout",
+				},
+			},
 			Action: func(c *cli.Context) {
-				rootDir, err := os.Open(getRootPath())
-				if err != nil {
-					panic_the_err(err)
+				if len(c.Args()) != 2 {
+					panic_the_err(errors.New("Please specify the credentials and the template: render <username@account> <template>"))
 				}
-				set, err := listAvailableCredentials(rootDir)
-				if err != nil {
-					panic_the_err(err)
+				name := c.Args()[1]
+				var text []byte
+				var err error
+				if name == "-" {
+					text, err = ioutil.ReadAll(os.Stdin)
+				} else {
+					text, err = ioutil.ReadFile(name)
 				}
-				for _, cred := range set {
-					fmt.Println(cred)
+				panic_the_err(err)
+				creds := retrieveSourceCredentials(c, false)
+				if c.String("output") == "" {
+					panic_the_err(renderTemplate(os.Stdout, name, text, creds))
+					return
 				}
+				var out bytes.Buffer
+				panic_the_err(renderTemplate(&out, name, text, creds))
+				panic_the_err(writeFileAtomic(c.String("output"), out.Bytes(), 0600))
 			},
 		},
 
 		{
-			Name:  "rotate",
-			Usage: "Rotate current AWS credentials, deleting the oldest",
+			Name:  "put",
+			Usage: "Save a secret other than AWS credentials: put <folder>/<name>",
 			Flags: []cli.Flag{
-				cli.IntFlag{
-					Name:  "lifetime, l",
-					Value: 0,
-					Usage: "\n        New credential lifetime in seconds (0 means forever)",
+				cli.StringSliceFlag{
+					Name:  "env, e",
+					Value: &cli.StringSlice{},
+					Usage: "\n        A variable to keep, as NAME=value, or NAME to take it from the environment",
+				},
+				cli.StringFlag{
+					Name:  "file",
+					Value: "",
+					Usage: "\n        A file to keep the contents of, or - to read them from stdin",
 				},
 				cli.StringSliceFlag{
 					Name:  "key, k",
@@ -424,38 +696,830 @@ func main() {
 					Usage: "\n        SSH public keys for encryption",
 				},
 				cli.StringSliceFlag{
-					Name:  "env, e",
+					Name:  "tag, t",
 					Value: &cli.StringSlice{},
-					Usage: "\n        Environment variables to set in the form VAR=value",
+					Usage: "\n        Tags to keep in plaintext with the secret, as name=value" +
+						"\n        (those already saved are kept; an empty value removes one)",
 				},
 				cli.StringFlag{
 					Name:  "repo, r",
-					Value: "local",
-					Usage: "\n        Repository location ('local' by default)",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
 				},
 			},
 			Action: func(c *cli.Context) {
-				cred, _, _, pubkeys, lifetime, repo, err := parseSaveArgs(c)
+				folder, name, err := splitSecretPath(c.Args().First())
 				panic_the_err(err)
-				username, account, err := getAWSUsernameAndAlias(cred)
+				secret, kind, err := parsePutArgs(c, os.Stdin)
 				panic_the_err(err)
-				err = (&cred).rotateCredentials(username)
+				pubkeys, err := parseKeyArgs(c, folder)
 				panic_the_err(err)
-				err = SaveCredentials(SaveData{
-					cred:     cred,
-					username: username,
-					alias:    account,
-					pubkeys:  pubkeys,
-					lifetime: lifetime,
-					force:    c.Bool("force"),
-					repo:     repo,
+				tags, err := parseTagArgs(c, true)
+				panic_the_err(err)
+				repo, err := parseAccountRepoArgs(c, folder)
+				panic_the_err(err)
+				err = SaveSecret(SecretData{
+					kind:    kind,
+					secret:  secret,
+					folder:  folder,
+					name:    name,
+					pubkeys: pubkeys,
+					repo:    repo,
+					tags:    tags,
 				})
 				panic_the_err(err)
+				pushIfShared(repo, SyncAuth{Identity: filepath.Join(folder, name)})
 			},
 		},
-	}
 
-	app.Run(os.Args)
+		{
+			Name:  "get",
+			Usage: "Decrypt a secret saved with put: get <folder>/<name>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key, k",
+					Value: "",
+					Usage: "\n        SSH private key",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (all repositories are searched if not given)",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "\n        Output for variables: bash, zsh, fish, powershell, cmd, dotenv or json" +
+						"\n        (the shell in $SHELL if not given)",
+				},
+				cli.StringFlag{
+					Name:  "field",
+					Value: "",
+					Usage: "\n        Print just the value of this variable",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "",
+					Usage: "\n        Write to this file, readable only by you, instead of stdout",
+				},
+			},
+			Action: func(c *cli.Context) {
+				folder, name, err := splitSecretPath(c.Args().First())
+				panic_the_err(err)
+				format, err := resolveEnvFormat(c.String("format"))
+				panic_the_err(err)
+				keyfile := getPrivateKeyFor(c, folder)
+				repo, err := parseSourceRepoArgs(c, folder, name, SyncAuth{Keyfile: keyfile})
+				panic_the_err(err)
+				creds, err := RetrieveCredentials(repo, folder, name, keyfile)
+				panic_the_err(err)
+				panic_the_err(creds.validateSecret(folder, name))
+				if c.String("output") == "" {
+					panic_the_err(writeSecret(os.Stdout, creds, format, c.String("field")))
+					return
+				}
+				var out bytes.Buffer
+				panic_the_err(writeSecret(&out, creds, format, c.String("field")))
+				panic_the_err(writeFileAtomic(c.String("output"), out.Bytes(), 0600))
+			},
+		},
+
+		{
+			Name:  "export",
+			Usage: "Export AWS credentials to a profile for tools that read ~/.aws",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "aws-profile, p",
+					Value: "",
+					Usage: "\n        The profile to write in ~/.aws/credentials",
+				},
+				cli.BoolFlag{
+					Name: "credential-process",
+					Usage: "\n        Instead point the profile in ~/.aws/config at credulous," +
+						"\n        so that the credentials are never written out",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "\n        Print the credentials as a credential_process command should",
+				},
+				cli.StringFlag{
+					Name:  "key, k",
+					Value: "",
+					Usage: "\n        SSH private key",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "\n        Force export of credentials without validating username or account",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (all repositories are searched if not given)",
+				},
+			},
+			Action: func(c *cli.Context) {
+				account, username, err := getAccountAndUserName(c)
+				panic_the_err(err)
+				if account == "" || username == "" {
+					panic_the_err(errors.New("Please specify which credentials to export, as username@account"))
+				}
+				keyfile := getPrivateKeyFor(c, account)
+				identity := username + "@" + account
+				profile := c.String("aws-profile")
+				if profile == "" && !c.Bool("json") {
+					panic_the_err(errors.New("Please name the profile to export to with --aws-profile"))
+				}
+				repo, err := parseSourceRepoArgs(c, account, username, SyncAuth{Keyfile: keyfile})
+				panic_the_err(err)
+
+				if c.Bool("credential-process") {
+					// the AWS tools won't run it from here
+					processRepo, processKey := "", ""
+					if c.String("repo") != "" {
+						processRepo = repo
+						if isDiskRepo(repo) {
+							processRepo, err = filepath.Abs(repo)
+							panic_the_err(err)
+						}
+					}
+					if c.String("key") != "" {
+						processKey, err = filepath.Abs(keyfile)
+						panic_the_err(err)
+					}
+					command, err := credentialProcessCommand(identity, processRepo, processKey)
+					panic_the_err(err)
+					err = exportCredentialProcess(awsConfigFile(), awsCredentialsFile(), profile, command)
+					panic_the_err(err)
+					fmt.Printf("profile %s in %s now sources %s from credulous\n", profile, awsConfigFile(), identity)
+					return
+				}
+
+				creds, err := RetrieveCredentials(repo, account, username, keyfile)
+				panic_the_err(err)
+				cred := creds.Encryptions[0].decoded
+				if c.Bool("json") {
+					// this runs every time the AWS tools want credentials,
+					// so it doesn't stop to ask IAM about them
+					panic_the_err(displayCredentialProcess(os.Stdout, cred))
+					return
+				}
+				if !c.Bool("force") {
+					panic_the_err(creds.ValidateCredentials(account, username))
+				}
+				err = exportToProfile(awsCredentialsFile(), profile, cred)
+				panic_the_err(err)
+				err = setAWSExport(awsCredentialsFile(), profile, identity)
+				panic_the_err(err)
+				fmt.Printf("exported %s to profile %s in %s\n", identity, profile, awsCredentialsFile())
+			},
+		},
+
+		{
+			Name:  "clear",
+			Usage: "Remove sourced AWS credentials from the shell",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "\n        Output for bash, zsh, fish, powershell or cmd" +
+						"\n        (the shell in $SHELL if not given)",
+				},
+			},
+			Action: func(c *cli.Context) {
+				format, err := resolveEnvFormat(c.String("format"))
+				panic_the_err(err)
+				names := loadedEnvNames(os.Getenv(LOADED_VARS_ENV_VAR))
+				panic_the_err(writeUnsetEnv(os.Stdout, format, names))
+				if err := removeAttachments(os.Getenv(ATTACHMENTS_DIR_ENV_VAR)); err != nil {
+					log.Print("WARNING: " + err.Error())
+				}
+			},
+		},
+
+		{
+			Name:  "shell-init",
+			Usage: "Set up a shell for credulous: shell-init [bash|zsh|fish]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "prompt",
+					Usage: "\n        Show the loaded credentials, and how long they have left, in the prompt",
+				},
+			},
+			Action: func(c *cli.Context) {
+				shell, err := resolveShellInitShell(c.Args().First())
+				panic_the_err(err)
+				fmt.Print(shellInit(shell, c.App.Commands, c.Bool("prompt")))
+			},
+		},
+
+		{
+			Name:  "current",
+			Usage: "Show the username and alias of the currently-loaded credentials",
+			Action: func(c *cli.Context) {
+				AWSAccessKeyId := os.Getenv("AWS_ACCESS_KEY_ID")
+				AWSSecretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+				if AWSAccessKeyId == "" || AWSSecretAccessKey == "" {
+					err := errors.New("No amazon credentials are currently in your environment")
+					panic_the_err(err)
+				}
+				cred := Credential{
+					KeyId:     AWSAccessKeyId,
+					SecretKey: AWSSecretAccessKey,
+				}
+				username, alias, err := getAWSUsernameAndAlias(cred)
+				if err != nil {
+					panic_the_err(err)
+				}
+				fmt.Printf("%s@%s\n", username, alias)
+			},
+		},
+
+		{
+			Name:  "display",
+			Usage: "Display loaded AWS credentials",
+			Action: func(c *cli.Context) {
+				AWSAccessKeyId := os.Getenv("AWS_ACCESS_KEY_ID")
+				AWSSecretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+				fmt.Printf("AWS_ACCESS_KEY_ID: %s\n", AWSAccessKeyId)
+				fmt.Printf("AWS_SECRET_ACCESS_KEY: %s\n", AWSSecretAccessKey)
+			},
+		},
+
+		{
+			Name:  "list",
+			Usage: "List available AWS credentials",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "long, l",
+					Usage: "\n        Show the repository, key, age, expiry, format and recipients of each",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "\n        Show the same as --long, as JSON",
+				},
+				cli.StringFlag{
+					Name:  "key, k",
+					Value: "",
+					Usage: "\n        SSH private key, to tell which credentials it can decrypt",
+				},
+				cli.StringFlag{
+					Name:  "account, a",
+					Value: "",
+					Usage: "\n        Only those for accounts matching a pattern, such as 'prod-*'",
+				},
+				cli.StringFlag{
+					Name:  "username, u",
+					Value: "",
+					Usage: "\n        Only those for IAM users matching a pattern",
+				},
+				cli.StringSliceFlag{
+					Name:  "tag, t",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Only those tagged name=value (the value may be a pattern)," +
+						"\n        or with a tag at all if just a name is given",
+				},
+				cli.StringSliceFlag{
+					Name:  "kind",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Only secrets of a kind: aws-iam, env or file",
+				},
+				cli.StringFlag{
+					Name:  "decryptable-by",
+					Value: "",
+					Usage: "\n        Only those a key can decrypt: 'me' for your own, a fingerprint," +
+						"\n        a public key file, or a name from the team keyring",
+				},
+			},
+			Action: func(c *cli.Context) {
+				repos, err := listRepos()
+				if err != nil {
+					panic_the_err(err)
+				}
+				for _, name := range repos {
+					repo, err := resolveRepo(name)
+					if err != nil {
+						panic_the_err(err)
+					}
+					pullIfStale(repo, SyncAuth{})
+				}
+				filter, err := parseFilterArgs(c)
+				panic_the_err(err)
+				if c.Bool("long") || c.Bool("json") || !filter.empty() {
+					mine := ""
+					if c.Bool("long") || c.Bool("json") {
+						mine = callerFingerprint(getPrivateKey(c))
+					}
+					listings, err := listCredentialDetails(mine)
+					panic_the_err(err)
+					listings = filterListings(listings, filter)
+					switch {
+					case c.Bool("json"):
+						panic_the_err(displayListingsJSON(os.Stdout, listings))
+					case c.Bool("long"):
+						panic_the_err(displayListings(os.Stdout, listings))
+					default:
+						for _, identity := range listingIdentities(listings) {
+							fmt.Println(identity)
+						}
+					}
+					return
+				}
+				rootDir, err := os.Open(getRootPath())
+				if err != nil {
+					panic_the_err(err)
+				}
+				settings, err := loadRepoSettings()
+				if err != nil {
+					panic_the_err(err)
+				}
+				set, err := listAvailableCredentials(rootDir, settings)
+				if err != nil {
+					panic_the_err(err)
+				}
+				for _, cred := range set {
+					fmt.Println(cred)
+				}
+			},
+		},
+
+		{
+			Name:  "rotate",
+			Usage: "Rotate current AWS credentials, deleting the oldest",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "lifetime, l",
+					Value: 0,
+					Usage: "\n        New credential lifetime in seconds (0 means forever)",
+				},
+				cli.StringSliceFlag{
+					Name:  "key, k",
+					Value: &cli.StringSlice{},
+					Usage: "\n        SSH public keys for encryption",
+				},
+				cli.StringSliceFlag{
+					Name:  "env, e",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Environment variables to set in the form VAR=value",
+				},
+				cli.StringSliceFlag{
+					Name:  "attach",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Files to encrypt with the credentials, as VAR=path; source writes" +
+						"\n        them to a private directory and points VAR at each",
+				},
+				cli.StringSliceFlag{
+					Name:  "tag, t",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Tags to keep in plaintext with the credentials, as name=value" +
+						"\n        (those already saved are kept; an empty value removes one)",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
+				},
+			},
+			Action: func(c *cli.Context) {
+				cred, _, _, pubkeys, lifetime, repo, err := parseSaveArgs(c)
+				panic_the_err(err)
+				tags, err := parseTagArgs(c, true)
+				panic_the_err(err)
+				username, account, err := getAWSUsernameAndAlias(cred)
+				panic_the_err(err)
+				err = (&cred).rotateCredentials(username)
+				panic_the_err(err)
+				err = SaveCredentials(SaveData{
+					cred:     cred,
+					username: username,
+					alias:    account,
+					pubkeys:  pubkeys,
+					lifetime: lifetime,
+					force:    c.Bool("force"),
+					repo:     repo,
+					tags:     tags,
+				})
+				panic_the_err(err)
+				refreshAWSExports(cred, account, username)
+				pushIfShared(repo, SyncAuth{
+					Cred:     &cred,
+					Identity: filepath.Join(account, username),
+				})
+			},
+		},
+
+		{
+			Name:  "history",
+			Usage: "List every saved version of a set of credentials: history username@account",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (all repositories are searched if not given)",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 1 {
+					panic_the_err(errors.New("Please specify the credentials, as username@account"))
+				}
+				account, username, err := getAccountAndUserName(c)
+				panic_the_err(err)
+				repo, err := parseSourceRepoArgs(c, account, username, SyncAuth{})
+				panic_the_err(err)
+				history, err := credentialHistory(repo, account, username)
+				panic_the_err(err)
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "#\tCREATED\tKEY\tSTATUS\tAUTHOR\tCOMMIT\tRECIPIENTS")
+				for _, version := range history {
+					status := ""
+					switch {
+					case version.Current:
+						status = "current"
+					case version.Superseded:
+						status = "superseded"
+					}
+					commit := version.Commit
+					if len(commit) > 8 {
+						commit = commit[:8]
+					}
+					fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", version.Number,
+						time.Unix(version.CreateTime, 0).Format("2006-01-02 15:04:05"),
+						version.KeySuffix, status, version.Author, commit,
+						strings.Join(version.Recipients, " "))
+				}
+				w.Flush()
+			},
+		},
+
+		{
+			Name:  "restore",
+			Usage: "Make an earlier version of a set of credentials current again: restore username@account --version <n|commit>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "version",
+					Value: "",
+					Usage: "\n        The version to restore: a number from 'credulous history', or a git commit",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (all repositories are searched if not given)",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 1 {
+					panic_the_err(errors.New("Please specify the credentials, as username@account"))
+				}
+				if c.String("version") == "" {
+					panic_the_err(errors.New("Please specify the version to restore with --version"))
+				}
+				account, username, err := getAccountAndUserName(c)
+				panic_the_err(err)
+				repo, err := parseSourceRepoArgs(c, account, username, SyncAuth{})
+				panic_the_err(err)
+				restored, err := restoreCredentials(repo, account, username, c.String("version"))
+				panic_the_err(err)
+				fmt.Printf("restored %s for %s@%s\n", restored, username, account)
+				pushIfShared(repo, SyncAuth{})
+			},
+		},
+
+		{
+			Name:  "prune",
+			Usage: "Remove saved credentials whose keys are no longer in IAM: prune [username@account]",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "keep",
+					Value: DEFAULT_KEEP,
+					Usage: "\n        Always keep this many of the newest versions of each set of credentials",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "\n        Show what would be removed, without removing anything",
+				},
+				cli.BoolFlag{
+					Name:  "rewrite-history",
+					Usage: "\n        Also purge the removed files from every commit in the repository's history",
+				},
+				cli.StringFlag{
+					Name:  "key, k",
+					Value: "",
+					Usage: "\n        SSH private key, to decrypt credentials with which to ask IAM",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path",
+				},
+			},
+			Action: func(c *cli.Context) {
+				identities := []string{}
+				if len(c.Args()) > 0 {
+					account, username, err := getAccountAndUserName(c)
+					panic_the_err(err)
+					identities = append(identities, filepath.Join(account, username))
+				}
+				repo, err := parseRepoArgs(c)
+				panic_the_err(err)
+				auth := SyncAuth{Keyfile: getPrivateKey(c)}
+				pullIfStale(repo, auth)
+
+				dryRun := c.Bool("dry-run")
+				removed, rewritten, err := pruneRepo(repo, identities, c.Int("keep"), auth, dryRun, c.Bool("rewrite-history"))
+				panic_the_err(err)
+				for _, file := range removed {
+					if dryRun {
+						fmt.Printf("would remove %s\n", file)
+					} else {
+						fmt.Printf("removed %s\n", file)
+					}
+				}
+				if dryRun && c.Bool("rewrite-history") && len(removed) > 0 {
+					fmt.Println("would purge these files from the repository's history")
+				}
+				if dryRun || len(removed) == 0 {
+					return
+				}
+				if !c.Bool("rewrite-history") {
+					pushIfShared(repo, auth)
+					return
+				}
+				fmt.Printf("rewrote %d commits; run 'git reflog expire --expire=now --all && git gc --prune=now' in %s to drop the old ones from disk\n", rewritten, repo)
+				if conf, err := getSyncConfig(repo); err == nil && conf.Remote != "" {
+					fmt.Printf("the remote still has them: force-push with 'git push --force %s' from %s, and have everyone else clone afresh\n", conf.Remote, repo)
+				}
+			},
+		},
+
+		{
+			Name:  "sync",
+			Usage: "Pull new credentials from, and push saved ones to, a shared repository",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
+				},
+				cli.StringFlag{
+					Name:  "remote",
+					Value: "",
+					Usage: "\n        URL of the remote repository, e.g. git@host:team/creds.git" +
+						"\n        or file:///path/to/creds.git (only needed the first time)",
+				},
+				cli.StringFlag{
+					Name:  "stale-after",
+					Value: "",
+					Usage: "\n        How long 'source' and 'list' trust the local copy before" +
+						"\n        pulling again, e.g. 15m (default " + DEFAULT_STALE_AFTER.String() + ")",
+				},
+				cli.StringFlag{
+					Name:  "key, k",
+					Value: "",
+					Usage: "\n        SSH private key, used to settle credentials saved concurrently",
+				},
+			},
+			Action: func(c *cli.Context) {
+				repo, err := parseRepoArgs(c)
+				panic_the_err(err)
+				isrepo, err := isGitRepo(repo)
+				panic_the_err(err)
+				if !isrepo {
+					panic_the_err(errors.New(repo + " is not a git repository"))
+				}
+				if c.String("remote") != "" {
+					err = setSyncRemote(repo, "origin", c.String("remote"))
+					panic_the_err(err)
+				}
+				if c.String("stale-after") != "" {
+					stale, err := time.ParseDuration(c.String("stale-after"))
+					panic_the_err(err)
+					err = setSyncStaleAfter(repo, stale)
+					panic_the_err(err)
+				}
+				err = syncRepo(repo, SyncAuth{Keyfile: getPrivateKey(c)})
+				panic_the_err(err)
+			},
+		},
+
+		{
+			Name:  "repo",
+			Usage: "Manage credential repositories",
+			Subcommands: []cli.Command{
+				{
+					Name:  "init",
+					Usage: "Create a new, empty repository: repo init <name>",
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 1 {
+							panic_the_err(errors.New("Please specify a name for the new repository"))
+						}
+						repo, err := initRepo(c.Args()[0])
+						panic_the_err(err)
+						fmt.Printf("Created %s\n", repo)
+					},
+				},
+				{
+					Name:  "clone",
+					Usage: "Clone a shared repository: repo clone <url> <name>",
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 2 {
+							panic_the_err(errors.New("Please specify the URL to clone and a name for the repository"))
+						}
+						repo, err := cloneRepo(c.Args()[0], c.Args()[1])
+						panic_the_err(err)
+						fmt.Printf("Cloned %s into %s\n", c.Args()[0], repo)
+					},
+				},
+				{
+					Name:  "add",
+					Usage: "Name a repository kept in S3 or a bundle file: repo add <name> <url>",
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 2 {
+							panic_the_err(errors.New("Please specify a name for the repository and its URL"))
+						}
+						err := addStoreRepo(c.Args()[0], c.Args()[1])
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "List repositories in search order, marking the default",
+					Action: func(c *cli.Context) {
+						settings, err := loadRepoSettings()
+						panic_the_err(err)
+						order, err := repoSearchOrder()
+						panic_the_err(err)
+						for _, name := range order {
+							marker := " "
+							if name == settings.defaultRepo() {
+								marker = "*"
+							}
+							remote := ""
+							if url, ok := settings.Stores[name]; ok {
+								remote = "\t" + url
+							} else if url, err := gitRemoteURL(filepath.Join(getRootPath(), name)); err == nil && url != "" {
+								remote = "\t" + url
+							}
+							fmt.Printf("%s %s%s\n", marker, name, remote)
+						}
+					},
+				},
+				{
+					Name:  "remove",
+					Usage: "Delete a repository and every credential in it, or forget a store: repo remove <name>",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "force, f",
+							Usage: "\n        Remove it even if it has commits that haven't been pushed",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 1 {
+							panic_the_err(errors.New("Please specify the repository to remove"))
+						}
+						err := removeRepo(c.Args()[0], c.Bool("force"))
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "default",
+					Usage: "Set the repository that credentials are saved to: repo default <name>",
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 1 {
+							panic_the_err(errors.New("Please specify the repository to use by default"))
+						}
+						err := setDefaultRepo(c.Args()[0])
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "order",
+					Usage: "Set the order repositories are searched in: repo order <name>...",
+					Action: func(c *cli.Context) {
+						err := setRepoOrder(c.Args())
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "sign",
+					Usage: "Sign commits and credentials saved to a repository with an SSH key: repo sign <name> [<private key>]",
+					Action: func(c *cli.Context) {
+						if len(c.Args()) < 1 || len(c.Args()) > 2 {
+							panic_the_err(errors.New("Please specify the repository, and the key to sign with"))
+						}
+						repo, err := resolveRepo(c.Args()[0])
+						panic_the_err(err)
+						keyfile := ""
+						if len(c.Args()) == 2 {
+							keyfile, err = filepath.Abs(c.Args()[1])
+							panic_the_err(err)
+						}
+						err = setSigningKey(repo, keyfile)
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "signatures",
+					Usage: "Set how strictly signatures are checked when sourcing: repo signatures <name> off|verify|require",
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 2 {
+							panic_the_err(errors.New("Please specify the repository and the signature policy"))
+						}
+						err := setSignaturePolicy(c.Args()[0], c.Args()[1])
+						panic_the_err(err)
+					},
+				},
+			},
+		},
+
+		{
+			Name:  "config",
+			Usage: "Show or change the defaults in ~/.credulous/config",
+			Subcommands: []cli.Command{
+				{
+					Name:  "get",
+					Usage: "Show a setting, as the environment or config file has it: config get <name>",
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 1 {
+							panic_the_err(errors.New("Please specify the setting to show"))
+						}
+						name := c.Args()[0]
+						if _, err := findConfigSetting(name); err != nil {
+							panic_the_err(err)
+						}
+						var values []string
+						if section, key := splitSettingName(name); section == "" {
+							values = configValues(key, "")
+						} else {
+							cfg, err := loadConfig()
+							panic_the_err(err)
+							values = cfg.rawValues(name)
+						}
+						if values == nil {
+							panic_the_err(errors.New(name + " is not set"))
+						}
+						for _, value := range values {
+							fmt.Println(value)
+						}
+					},
+				},
+				{
+					Name:  "set",
+					Usage: "Change a setting in the config file: config set <name> <value>...",
+					Action: func(c *cli.Context) {
+						if len(c.Args()) < 2 {
+							panic_the_err(errors.New("Please specify the setting to change and its value"))
+						}
+						cfg, err := loadConfig()
+						panic_the_err(err)
+						panic_the_err(cfg.set(c.Args()[0], c.Args()[1:]))
+						panic_the_err(cfg.save())
+						if env := configEnvName(c.Args()[0]); os.Getenv(env) != "" {
+							log.Print("WARNING: " + env + " is set, and overrides this")
+						}
+					},
+				},
+				{
+					Name:  "unset",
+					Usage: "Remove a setting from the config file: config unset <name>",
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 1 {
+							panic_the_err(errors.New("Please specify the setting to remove"))
+						}
+						cfg, err := loadConfig()
+						panic_the_err(err)
+						panic_the_err(cfg.unset(c.Args()[0]))
+						panic_the_err(cfg.save())
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "Show every setting in effect",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "\n        Describe every setting there is instead",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if c.Bool("all") {
+							describeConfigSettings(os.Stdout)
+							return
+						}
+						cfg, err := loadConfig()
+						panic_the_err(err)
+						listConfig(os.Stdout, cfg)
+					},
+				},
+			},
+		},
+	}
+
+	return app
+}
+
+func main() {
+	useConfiguredAgent()
+	newApp().Run(os.Args)
 }
 
 func rotate(cred Credential) (err error) {
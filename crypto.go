@@ -11,6 +11,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -19,7 +20,7 @@ import (
 	"reflect"
 	"strings"
 
-	"code.google.com/p/go.crypto/ssh"
+	"golang.org/x/crypto/ssh"
 )
 
 type Salter interface {
@@ -250,3 +251,29 @@ func SSHPrivateFingerprint(privkey rsa.PrivateKey) (fingerprint string, err erro
 	fingerprint = SSHFingerprint(sshPubkey)
 	return fingerprint, nil
 }
+
+// keyFingerprint is the fingerprint of a private key, read from the
+// public half beside it so as not to need the passphrase. A key without
+// a passphrase can do without.
+func keyFingerprint(keyfile string) (string, error) {
+	if pubkey, err := readSSHPubkeyFile(strings.TrimSuffix(keyfile, ".pub") + ".pub"); err == nil {
+		return SSHFingerprint(pubkey), nil
+	}
+	b, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return "", err
+	}
+	pemblock, _ := pem.Decode(b)
+	if pemblock == nil || x509.IsEncryptedPEMBlock(pemblock) {
+		return "", errors.New("Cannot tell the fingerprint of " + keyfile + " without its public key in " + keyfile + ".pub")
+	}
+	key, err := ssh.ParseRawPrivateKey(b)
+	if err != nil {
+		return "", err
+	}
+	privkey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New(keyfile + " is not an RSA key")
+	}
+	return SSHPrivateFingerprint(*privkey)
+}
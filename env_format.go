@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envVar is one environment variable for source to set
+type envVar struct {
+	Name  string
+	Value string
+}
+
+type envFormatter func(vars []envVar) (string, error)
+
+// envFormat is how to set variables in a format, and how to unset them
+// for clear; formats that aren't shells can't unset anything
+type envFormat struct {
+	set   envFormatter
+	unset func(names []string) string
+}
+
+// envFormats are the forms source can write variables in, by name
+var envFormats = map[string]envFormat{
+	"bash":       {formatPosixEnv, unsetPosixEnv},
+	"zsh":        {formatPosixEnv, unsetPosixEnv},
+	"sh":         {formatPosixEnv, unsetPosixEnv},
+	"fish":       {formatFishEnv, unsetFishEnv},
+	"powershell": {formatPowerShellEnv, unsetPowerShellEnv},
+	"pwsh":       {formatPowerShellEnv, unsetPowerShellEnv},
+	"cmd":        {formatCmdEnv, unsetCmdEnv},
+	"dotenv":     {formatDotenv, nil},
+	"json":       {formatJSONEnv, nil},
+}
+
+// source marks what it loads into a shell with these, so that clear
+// knows what to take out again, and a prompt can say what's loaded
+const LOADED_ENV_VAR string = "CREDULOUS_LOADED"
+const LOADED_VARS_ENV_VAR string = "CREDULOUS_LOADED_VARS"
+const EXPIRES_ENV_VAR string = "CREDULOUS_EXPIRES"
+
+// AWS_ENV_VARS are cleared whatever was loaded, so that nothing is left
+// for the AWS tools to pick up
+var AWS_ENV_VARS = []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_SECURITY_TOKEN"}
+
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// detectEnvFormat picks the format for the shell in $SHELL; anything we
+// don't know gets POSIX shell syntax, as it always has
+func detectEnvFormat() string {
+	shell := filepath.Base(os.Getenv("SHELL"))
+	if _, ok := envFormats[shell]; ok && shell != "cmd" {
+		return shell
+	}
+	return "bash"
+}
+
+// resolveEnvFormat checks a format given on the command line, using the
+// configured one if it wasn't, or else detecting one
+func resolveEnvFormat(format string) (string, error) {
+	if format == "" {
+		format = configString("format", "")
+	}
+	if format == "" {
+		return detectEnvFormat(), nil
+	}
+	format = strings.ToLower(format)
+	if _, ok := envFormats[format]; !ok {
+		names := []string{}
+		for name := range envFormats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", errors.New("Unknown format '" + format + "'; expected one of " + strings.Join(names, ", "))
+	}
+	return format, nil
+}
+
+// credentialEnvironment lists the variables for a set of credentials,
+// keys first and then the saved environment in name order
+func credentialEnvironment(cred Credential) []envVar {
+	vars := []envVar{
+		{"AWS_ACCESS_KEY_ID", cred.KeyId},
+		{"AWS_SECRET_ACCESS_KEY", cred.SecretKey},
+	}
+	names := []string{}
+	for name := range cred.EnvVars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		vars = append(vars, envVar{name, cred.EnvVars[name]})
+	}
+	return vars
+}
+
+// writeEnv writes the variables in one go, so that nothing is written
+// if any of them can't be. Names are checked here, not just when saved,
+// since anyone who can push to a shared repo can encrypt for your key,
+// and what's written is often eval'd.
+func writeEnv(output io.Writer, format string, vars []envVar) error {
+	f, ok := envFormats[format]
+	if !ok {
+		return errors.New("Unknown format '" + format + "'")
+	}
+	for _, v := range vars {
+		if !envVarName.MatchString(v.Name) {
+			return errors.New("Refusing to write the variable '" + v.Name + "', which is not a valid name")
+		}
+	}
+	text, err := f.set(vars)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(output, text)
+	return err
+}
+
+// loadedMarkers are the variables source sets alongside a set of
+// credentials in a shell: whose they are, the names of the environment
+// saved with them, when they expire, if they do, and where their
+// attachments were written, if they have any
+func loadedMarkers(creds Credentials, attachmentsDir string) []envVar {
+	names := []string{}
+	for name := range creds.Encryptions[0].decoded.EnvVars {
+		names = append(names, name)
+	}
+	for _, attachment := range creds.Encryptions[0].decoded.Files {
+		names = append(names, attachment.EnvVar)
+	}
+	sort.Strings(names)
+	expires := ""
+	if expiry := creds.expiryTime(); expiry > 0 {
+		expires = strconv.FormatInt(expiry, 10)
+	}
+	markers := []envVar{
+		{LOADED_ENV_VAR, creds.IamUsername + "@" + creds.AccountAliasOrId},
+		{LOADED_VARS_ENV_VAR, strings.Join(names, " ")},
+		{EXPIRES_ENV_VAR, expires},
+	}
+	if attachmentsDir != "" {
+		markers = append(markers, envVar{ATTACHMENTS_DIR_ENV_VAR, attachmentsDir})
+	}
+	return markers
+}
+
+// loadedEnvNames is everything clear takes out of a shell: the AWS
+// variables, those source said it loaded, and its markers. Names that
+// couldn't have been set are left out rather than written into a script.
+func loadedEnvNames(loadedVars string) []string {
+	names := append([]string{}, AWS_ENV_VARS...)
+	names = append(names, strings.Fields(loadedVars)...)
+	names = append(names, LOADED_ENV_VAR, LOADED_VARS_ENV_VAR, EXPIRES_ENV_VAR, ATTACHMENTS_DIR_ENV_VAR)
+
+	seen := make(map[string]bool)
+	unique := []string{}
+	for _, name := range names {
+		if !seen[name] && envVarName.MatchString(name) {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// writeUnsetEnv writes what a shell needs to unset the variables
+func writeUnsetEnv(output io.Writer, format string, names []string) error {
+	f, ok := envFormats[format]
+	if !ok {
+		return errors.New("Unknown format '" + format + "'")
+	}
+	if f.unset == nil {
+		return errors.New("There is nothing to clear in " + format + " format; it is only for shells")
+	}
+	_, err := io.WriteString(output, f.unset(names))
+	return err
+}
+
+// formatPosixEnv quotes for bash, zsh and sh, where only \, ", $ and `
+// mean anything inside double quotes
+func formatPosixEnv(vars []envVar) (string, error) {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+	text := ""
+	for _, v := range vars {
+		text += fmt.Sprintf("export %s=\"%s\"\n", v.Name, quote.Replace(v.Value))
+	}
+	return text, nil
+}
+
+// formatFishEnv quotes for fish, whose single quotes only need \ and '
+// escaped
+func formatFishEnv(vars []envVar) (string, error) {
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	text := ""
+	for _, v := range vars {
+		text += fmt.Sprintf("set -gx %s '%s'\n", v.Name, quote.Replace(v.Value))
+	}
+	return text, nil
+}
+
+// formatPowerShellEnv uses PowerShell's single quotes, which are literal
+// apart from a doubled quote; the curly single quotes count as quotes too
+func formatPowerShellEnv(vars []envVar) (string, error) {
+	quote := strings.NewReplacer("'", "''", "\u2018", "\u2018\u2018", "\u2019", "\u2019\u2019", "\u201A", "\u201A\u201A", "\u201B", "\u201B\u201B")
+	text := ""
+	for _, v := range vars {
+		text += fmt.Sprintf("$Env:%s = '%s'\n", v.Name, quote.Replace(v.Value))
+	}
+	return text, nil
+}
+
+// formatCmdEnv writes a batch file for cmd.exe. Quoting the whole
+// assignment covers everything but %, which has to be doubled, and line
+// breaks and double quotes, which can't be set at all. With delayed
+// expansion on, ! and ^ in a line with a ! need escaping with ^, which
+// would be kept with it off, so such values are set whichever way
+// "!!" shows it to be.
+func formatCmdEnv(vars []envVar) (string, error) {
+	delayed := strings.NewReplacer("^", "^^", "!", "^!")
+	text := ""
+	for _, v := range vars {
+		if strings.ContainsAny(v.Value, "\r\n") {
+			return "", errors.New("The value of " + v.Name + " has a line break, which cmd can't set")
+		}
+		if strings.Contains(v.Value, `"`) {
+			return "", errors.New("The value of " + v.Name + " has a double quote, which cmd can't set safely")
+		}
+		value := strings.Replace(v.Value, "%", "%%", -1)
+		if strings.Contains(value, "!") {
+			text += fmt.Sprintf("if \"!!\"==\"\" (set \"%s=%s\") else set \"%s=%s\"\n", v.Name, delayed.Replace(value), v.Name, value)
+		} else {
+			text += fmt.Sprintf("set \"%s=%s\"\n", v.Name, value)
+		}
+	}
+	return text, nil
+}
+
+// formatDotenv writes a .env file, double quoting with the escapes the
+// dotenv libraries agree on
+func formatDotenv(vars []envVar) (string, error) {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+	text := ""
+	for _, v := range vars {
+		text += fmt.Sprintf("%s=\"%s\"\n", v.Name, quote.Replace(v.Value))
+	}
+	return text, nil
+}
+
+func formatJSONEnv(vars []envVar) (string, error) {
+	env := make(map[string]string)
+	for _, v := range vars {
+		env[v.Name] = v.Value
+	}
+	b, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+func unsetPosixEnv(names []string) string {
+	return "unset " + strings.Join(names, " ") + "\n"
+}
+
+func unsetFishEnv(names []string) string {
+	return "set -e " + strings.Join(names, " ") + "\n"
+}
+
+// unsetPowerShellEnv doesn't complain about variables that weren't set
+func unsetPowerShellEnv(names []string) string {
+	text := ""
+	for _, name := range names {
+		text += "Remove-Item Env:" + name + " -ErrorAction SilentlyContinue\n"
+	}
+	return text
+}
+
+func unsetCmdEnv(names []string) string {
+	text := ""
+	for _, name := range names {
+		text += "set " + name + "=\n"
+	}
+	return text
+}
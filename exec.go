@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// EXEC_SIGNALS are passed on to the command exec runs, rather than
+// stopping credulous before it has cleaned up
+var EXEC_SIGNALS = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// splitExecArgs splits exec's arguments into the credentials and the
+// command to run with them, which may follow a --
+func splitExecArgs(args []string) (identity string, command []string, err error) {
+	if len(args) > 0 {
+		identity, command = args[0], args[1:]
+	}
+	if len(command) > 0 && command[0] == "--" {
+		command = command[1:]
+	}
+	if identity == "" || strings.HasPrefix(identity, "-") || len(command) == 0 {
+		return "", nil, errors.New("Please specify the credentials and a command: exec [options] <username@account> -- <command>...")
+	}
+	return identity, command, nil
+}
+
+// execEnvironment is our environment with the credentials in place of
+// any loaded already, and the variables pointing at their attachments
+func execEnvironment(environ []string, vars []envVar) ([]string, error) {
+	replaced := make(map[string]bool)
+	for _, name := range AWS_ENV_VARS {
+		replaced[name] = true
+	}
+	for _, v := range vars {
+		if !envVarName.MatchString(v.Name) {
+			return nil, errors.New("Refusing to set the variable '" + v.Name + "', which is not a valid name")
+		}
+		replaced[v.Name] = true
+	}
+	env := []string{}
+	for _, kv := range environ {
+		if !replaced[strings.SplitN(kv, "=", 2)[0]] {
+			env = append(env, kv)
+		}
+	}
+	for _, v := range vars {
+		env = append(env, v.Name+"="+v.Value)
+	}
+	return env, nil
+}
+
+// execWithCredentials runs a command with a set of credentials in its
+// environment, and their attachments written out for as long as it
+// runs, returning its exit status. Signals are passed on to it, so that
+// the attachments are removed however it ends.
+func execWithCredentials(creds Credentials, command []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	decoded := creds.Encryptions[0].decoded
+	dir, fileVars, err := writeAttachments(attachmentsRoot(), decoded.Files)
+	if err != nil {
+		return 0, err
+	}
+	defer removeAttachments(dir)
+
+	vars := append(credentialEnvironment(decoded), fileVars...)
+	vars = append(vars, loadedMarkers(creds, dir)...)
+	env, err := execEnvironment(os.Environ(), vars)
+	if err != nil {
+		return 0, err
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env, cmd.Stdin, cmd.Stdout, cmd.Stderr = env, stdin, stdout, stderr
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, EXEC_SIGNALS...)
+	defer signal.Stop(signals)
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExec(t *testing.T) {
+	Convey("Test running a command with credentials", t, func() {
+		if _, err := exec.LookPath("sh"); err != nil {
+			return
+		}
+		creds := Credentials{
+			IamUsername:      "bob",
+			AccountAliasOrId: "acct",
+			Encryptions: []Encryption{{decoded: Credential{
+				KeyId:     "AKIAEXAMPLE",
+				SecretKey: "secret",
+				EnvVars:   map[string]string{"DB_PASSWORD": "pw"},
+				Files:     []Attachment{{EnvVar: "KUBECONFIG", Name: "config", Data: []byte("apiVersion: v1\n")}},
+			}}},
+		}
+		origToken := os.Getenv("AWS_SESSION_TOKEN")
+		defer os.Setenv("AWS_SESSION_TOKEN", origToken)
+		os.Setenv("AWS_SESSION_TOKEN", "stale")
+
+		Convey("Arguments are the credentials, then the command", func() {
+			identity, command, err := splitExecArgs([]string{"bob@acct", "--", "aws", "s3", "ls", "--recursive"})
+			So(err, ShouldEqual, nil)
+			So(identity, ShouldEqual, "bob@acct")
+			So(command, ShouldResemble, []string{"aws", "s3", "ls", "--recursive"})
+
+			_, command, err = splitExecArgs([]string{"bob@acct", "env"})
+			So(err, ShouldEqual, nil)
+			So(command, ShouldResemble, []string{"env"})
+
+			for _, args := range [][]string{{}, {"bob@acct"}, {"bob@acct", "--"}, {"--", "env"}} {
+				_, _, err := splitExecArgs(args)
+				So(err, ShouldNotEqual, nil)
+			}
+		})
+
+		Convey("The command sees the credentials and attachments, which go when it ends", func() {
+			var out bytes.Buffer
+			status, err := execWithCredentials(creds, []string{"sh", "-c",
+				`echo "$CREDULOUS_FILES"; cat "$KUBECONFIG"; echo "$AWS_ACCESS_KEY_ID $DB_PASSWORD [$AWS_SESSION_TOKEN]"; exit 3`},
+				nil, &out, os.Stderr)
+			So(err, ShouldEqual, nil)
+			So(status, ShouldEqual, 3)
+			lines := strings.Split(out.String(), "\n")
+			So(lines[0], ShouldStartWith, attachmentsRoot())
+			So(lines[1:], ShouldResemble, []string{"apiVersion: v1", "AKIAEXAMPLE pw []", ""})
+			_, err = os.Stat(lines[0])
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Signals go to the command, and the attachments still go", func() {
+			var out bytes.Buffer
+			status, err := execWithCredentials(creds, []string{"sh", "-c",
+				`echo "$CREDULOUS_FILES"; kill -TERM $PPID; exec sleep 10`}, nil, &out, os.Stderr)
+			So(err, ShouldEqual, nil)
+			So(status, ShouldEqual, 143)
+			_, err = os.Stat(strings.TrimSpace(out.String()))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Names that aren't are refused", func() {
+			_, err := execEnvironment(nil, []envVar{{"X=1;Y", "v"}})
+			So(err.Error(), ShouldEqual, "Refusing to set the variable 'X=1;Y', which is not a valid name")
+		})
+	})
+}
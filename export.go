@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AWSExport records a profile that credentials were exported to in
+// plaintext, so that it can be kept up to date when they're rotated
+type AWSExport struct {
+	File     string
+	Profile  string
+	Identity string
+}
+
+// credentialProcessOutput is what the AWS tools expect from a
+// credential_process command
+type credentialProcessOutput struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+}
+
+func awsExportsFile() string {
+	return filepath.Join(getRootPath(), "exports.json")
+}
+
+func loadAWSExports() ([]AWSExport, error) {
+	exports := []AWSExport{}
+	b, err := ioutil.ReadFile(awsExportsFile())
+	if os.IsNotExist(err) {
+		return exports, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &exports); err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func saveAWSExports(exports []AWSExport) error {
+	b, err := json.MarshalIndent(exports, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(awsExportsFile(), b, 0600)
+}
+
+// setAWSExport records an export to a profile, or forgets it if the
+// identity is empty
+func setAWSExport(file, profile, identity string) error {
+	exports, err := loadAWSExports()
+	if err != nil {
+		return err
+	}
+	kept := []AWSExport{}
+	for _, export := range exports {
+		if export.File != file || export.Profile != profile {
+			kept = append(kept, export)
+		}
+	}
+	if identity != "" {
+		kept = append(kept, AWSExport{File: file, Profile: profile, Identity: identity})
+	}
+	return saveAWSExports(kept)
+}
+
+// writeINIFile writes an INI file back, keeping its permissions if it
+// already exists; new ones are private, as are new directories
+func writeINIFile(filename string, ini *iniFile) error {
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(filename); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, ini.Bytes(), perm)
+}
+
+// exportToProfile writes a set of credentials into a profile of an AWS
+// credentials file, leaving the rest of the file as it was
+func exportToProfile(filename, profile string, cred Credential) error {
+	ini, err := readINIFile(filename)
+	if err != nil {
+		return err
+	}
+	section := ini.section(profile)
+	if section == nil {
+		section = ini.addSection(profile)
+	}
+	section.set("aws_access_key_id", cred.KeyId)
+	section.set("aws_secret_access_key", cred.SecretKey)
+	// a token left over from temporary credentials would spoil these
+	section.unset("aws_session_token")
+	return writeINIFile(filename, ini)
+}
+
+// exportCredentialProcess points a profile in the AWS config file at a
+// command that sources credentials from credulous whenever they're
+// needed. Keys for the profile in the credentials file would be used
+// instead, so they're taken out.
+func exportCredentialProcess(configFile, credentialsFile, profile, command string) error {
+	ini, err := readINIFile(configFile)
+	if err != nil {
+		return err
+	}
+	name := awsConfigSection(profile)
+	section := ini.section(name)
+	if section == nil {
+		section = ini.addSection(name)
+	}
+	section.set("credential_process", command)
+	if err = writeINIFile(configFile, ini); err != nil {
+		return err
+	}
+
+	creds, err := readINIFile(credentialsFile)
+	if err != nil {
+		return err
+	}
+	if section := creds.section(profile); section != nil {
+		remaining := false
+		for _, key := range []string{"aws_access_key_id", "aws_secret_access_key", "aws_session_token"} {
+			remaining = section.unset(key)
+		}
+		if !remaining {
+			creds.removeSection(profile)
+		}
+		if err = writeINIFile(credentialsFile, creds); err != nil {
+			return err
+		}
+	}
+	return setAWSExport(credentialsFile, profile, "")
+}
+
+// credentialProcessCommand is the command line the AWS tools should run
+// to source an identity's credentials from credulous
+func credentialProcessCommand(identity, repo, keyfile string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	args := []string{exe, "export", "--json"}
+	if repo != "" {
+		args = append(args, "--repo", repo)
+	}
+	if keyfile != "" {
+		args = append(args, "--key", keyfile)
+	}
+	args = append(args, identity)
+	for i, arg := range args {
+		if strings.ContainsAny(arg, " \t\"'\\") {
+			args[i] = `"` + strings.Replace(strings.Replace(arg, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+		}
+	}
+	return strings.Join(args, " "), nil
+}
+
+// displayCredentialProcess writes credentials in the form a
+// credential_process command hands them to the AWS tools
+func displayCredentialProcess(output io.Writer, cred Credential) error {
+	b, err := json.Marshal(credentialProcessOutput{
+		Version:         1,
+		AccessKeyId:     cred.KeyId,
+		SecretAccessKey: cred.SecretKey,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(output, "%s\n", b)
+	return err
+}
+
+// refreshAWSExports rewrites the profiles an identity's credentials have
+// been exported to, after saving or rotating them. If we don't know yet
+// whose they are, AWS is asked, but only if there's anything to update.
+// The credentials are safely saved either way, so failure is only a
+// warning.
+func refreshAWSExports(cred Credential, account, username string) {
+	if err := updateAWSExports(cred, account, username); err != nil {
+		log.Print("WARNING: saved, but cannot update the AWS profiles these credentials were exported to: " + err.Error())
+	}
+}
+
+// updateAWSExports does the work of refreshAWSExports. A profile that
+// has gone from its file is forgotten.
+func updateAWSExports(cred Credential, account, username string) error {
+	exports, err := loadAWSExports()
+	if err != nil || len(exports) == 0 {
+		return err
+	}
+	if account == "" || username == "" {
+		if username, account, err = getAWSUsernameAndAlias(cred); err != nil {
+			return err
+		}
+	}
+	identity := username + "@" + account
+
+	kept := []AWSExport{}
+	for _, export := range exports {
+		if export.Identity != identity {
+			kept = append(kept, export)
+			continue
+		}
+		ini, err := readINIFile(export.File)
+		if err != nil {
+			return err
+		}
+		if ini.section(export.Profile) == nil {
+			log.Print("WARNING: profile " + export.Profile + " has gone from " + export.File + ", so it won't be updated again")
+			continue
+		}
+		if err = exportToProfile(export.File, export.Profile, cred); err != nil {
+			return err
+		}
+		fmt.Printf("updated profile %s in %s\n", export.Profile, export.File)
+		kept = append(kept, export)
+	}
+	return saveAWSExports(kept)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const TEST_EXPORT_CREDENTIALS string = `# hand written
+[default]
+aws_access_key_id = AKIAOTHER
+aws_secret_access_key = other
+
+[work]
+aws_access_key_id = AKIAOLD
+aws_secret_access_key = old
+aws_session_token = stale
+region = ap-southeast-2
+`
+
+func TestExportCredentials(t *testing.T) {
+	Convey("Test exporting credentials for the AWS tools", t, func() {
+		home, cleanup := withTempHome()
+		defer cleanup()
+		credentialsFile := filepath.Join(home, ".aws", "credentials")
+		configFile := filepath.Join(home, ".aws", "config")
+		cred := Credential{KeyId: "AKIANEW", SecretKey: "new/secret"}
+
+		Convey("A new file is private", func() {
+			So(exportToProfile(credentialsFile, "work", cred), ShouldEqual, nil)
+			b, err := ioutil.ReadFile(credentialsFile)
+			So(err, ShouldEqual, nil)
+			So(string(b), ShouldEqual, "[work]\naws_access_key_id = AKIANEW\naws_secret_access_key = new/secret\n")
+			info, err := os.Stat(credentialsFile)
+			So(err, ShouldEqual, nil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+		})
+
+		So(writeINIFile(credentialsFile, parseINI([]byte(TEST_EXPORT_CREDENTIALS))), ShouldEqual, nil)
+
+		Convey("Exporting to a profile leaves the others alone", func() {
+			So(exportToProfile(credentialsFile, "work", cred), ShouldEqual, nil)
+			b, err := ioutil.ReadFile(credentialsFile)
+			So(err, ShouldEqual, nil)
+			So(string(b), ShouldEqual, strings.Replace(strings.Replace(strings.Replace(TEST_EXPORT_CREDENTIALS,
+				"AKIAOLD", "AKIANEW", 1), "= old", "= new/secret", 1), "aws_session_token = stale\n", "", 1))
+		})
+
+		Convey("Exported profiles are kept up to date", func() {
+			So(exportToProfile(credentialsFile, "work", cred), ShouldEqual, nil)
+			So(setAWSExport(credentialsFile, "work", "bob@acct"), ShouldEqual, nil)
+			So(setAWSExport(credentialsFile, "default", "alice@acct"), ShouldEqual, nil)
+
+			rotated := Credential{KeyId: "AKIAROTATED", SecretKey: "rotated"}
+			So(updateAWSExports(rotated, "acct", "bob"), ShouldEqual, nil)
+			ini, err := readINIFile(credentialsFile)
+			So(err, ShouldEqual, nil)
+			So(ini.section("work").get("aws_access_key_id"), ShouldEqual, "AKIAROTATED")
+			So(ini.section("default").get("aws_access_key_id"), ShouldEqual, "AKIAOTHER")
+
+			Convey("until the profile is removed", func() {
+				ini.removeSection("work")
+				So(writeINIFile(credentialsFile, ini), ShouldEqual, nil)
+				So(updateAWSExports(cred, "acct", "bob"), ShouldEqual, nil)
+				ini, err := readINIFile(credentialsFile)
+				So(err, ShouldEqual, nil)
+				So(ini.section("work"), ShouldBeNil)
+
+				exports, err := loadAWSExports()
+				So(err, ShouldEqual, nil)
+				So(exports, ShouldResemble, []AWSExport{{File: credentialsFile, Profile: "default", Identity: "alice@acct"}})
+			})
+		})
+
+		Convey("A credential process replaces keys on disk", func() {
+			So(setAWSExport(credentialsFile, "work", "bob@acct"), ShouldEqual, nil)
+			command, err := credentialProcessCommand("bob@acct", "/my repos/team", "")
+			So(err, ShouldEqual, nil)
+			So(command, ShouldEndWith, ` export --json --repo "/my repos/team" bob@acct`)
+
+			So(exportCredentialProcess(configFile, credentialsFile, "work", command), ShouldEqual, nil)
+			So(exportCredentialProcess(configFile, credentialsFile, "default", command), ShouldEqual, nil)
+			config, err := readINIFile(configFile)
+			So(err, ShouldEqual, nil)
+			So(config.sectionNames(), ShouldResemble, []string{"profile work", "default"})
+			So(config.section("profile work").get("credential_process"), ShouldEqual, command)
+
+			creds, err := readINIFile(credentialsFile)
+			So(err, ShouldEqual, nil)
+			So(creds.section("default"), ShouldBeNil)
+			So(string(creds.Bytes()), ShouldEqual, "# hand written\n[work]\nregion = ap-southeast-2\n")
+
+			exports, err := loadAWSExports()
+			So(err, ShouldEqual, nil)
+			So(len(exports), ShouldEqual, 0)
+		})
+
+		Convey("The credential process prints what the AWS tools expect", func() {
+			var out bytes.Buffer
+			So(displayCredentialProcess(&out, cred), ShouldEqual, nil)
+			var parsed map[string]interface{}
+			So(json.Unmarshal(out.Bytes(), &parsed), ShouldEqual, nil)
+			So(parsed, ShouldResemble, map[string]interface{}{
+				"Version":         float64(1),
+				"AccessKeyId":     "AKIANEW",
+				"SecretAccessKey": "new/secret",
+			})
+		})
+	})
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/realestate-com-au/goamz/aws"
+	"github.com/realestate-com-au/goamz/iam"
+)
+
+// FakeIAM is a stateful stand-in for the IAM and STS query APIs, served
+// from an httptest server so that the save, source and rotate flows can
+// be exercised end-to-end without touching the network.
+type FakeIAM struct {
+	sync.Mutex
+	server    *httptest.Server
+	accountId string
+	aliases   []string
+	users     map[string]bool
+	keys      []*fakeAccessKey
+	keyCount  int
+	clock     time.Time
+	calls     map[string]int
+	throttle  int
+	pending   int
+}
+
+type fakeAccessKey struct {
+	user    string
+	id      string
+	secret  string
+	status  string
+	created time.Time
+	// requests to reject before the key has "propagated"
+	pending int
+}
+
+type fakeError struct {
+	status  int
+	code    string
+	message string
+}
+
+const fakeTimeFormat = "2006-01-02T15:04:05Z"
+
+func NewFakeIAM(accountId string, aliases ...string) *FakeIAM {
+	f := &FakeIAM{
+		accountId: accountId,
+		aliases:   aliases,
+		users:     make(map[string]bool),
+		calls:     make(map[string]int),
+		clock:     time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *FakeIAM) Close() {
+	f.server.Close()
+}
+
+// Region returns an aws.Region whose IAM and STS endpoints are this server
+func (f *FakeIAM) Region() aws.Region {
+	return aws.Region{
+		Name:        "fake",
+		IAMEndpoint: f.server.URL,
+		STSEndpoint: f.server.URL,
+	}
+}
+
+// Install points newIAM at this server, returning a function that puts
+// the original client factory back
+func (f *FakeIAM) Install() (restore func()) {
+	orig := newIAM
+	newIAM = func(auth aws.Auth) *iam.IAM {
+		return iam.New(auth, f.Region())
+	}
+	return func() { newIAM = orig }
+}
+
+// AddUser creates an IAM user with a single active access key
+func (f *FakeIAM) AddUser(name string) (keyId, secret string) {
+	f.Lock()
+	defer f.Unlock()
+	f.users[name] = true
+	key := f.createKey(name)
+	return key.id, key.secret
+}
+
+// Keys maps the IDs of the user's access keys to their statuses
+func (f *FakeIAM) Keys(user string) map[string]string {
+	f.Lock()
+	defer f.Unlock()
+	keys := make(map[string]string)
+	for _, key := range f.keys {
+		if key.user == user {
+			keys[key.id] = key.status
+		}
+	}
+	return keys
+}
+
+// SetKeyStatus marks a key Active or Inactive, as UpdateAccessKey would
+func (f *FakeIAM) SetKeyStatus(id, status string) {
+	f.Lock()
+	defer f.Unlock()
+	if key := f.findKey(id); key != nil {
+		key.status = status
+	}
+}
+
+// ThrottleNext makes the next n requests fail with a Throttling error
+func (f *FakeIAM) ThrottleNext(n int) {
+	f.Lock()
+	defer f.Unlock()
+	f.throttle = n
+}
+
+// DelayActivation makes keys created from now on be rejected as invalid
+// for their first n requests, as IAM does while a new key propagates
+func (f *FakeIAM) DelayActivation(n int) {
+	f.Lock()
+	defer f.Unlock()
+	f.pending = n
+}
+
+// Calls returns how many times the named action has been requested
+func (f *FakeIAM) Calls(action string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls[action]
+}
+
+func (f *FakeIAM) createKey(user string) *fakeAccessKey {
+	f.keyCount += 1
+	// every key is a second younger than the last, so "oldest" is well defined
+	f.clock = f.clock.Add(time.Second)
+	key := &fakeAccessKey{
+		user:    user,
+		id:      fmt.Sprintf("AKIAFAKE%012d", f.keyCount),
+		secret:  fmt.Sprintf("fake/secret/%028d", f.keyCount),
+		status:  "Active",
+		created: f.clock,
+		pending: f.pending,
+	}
+	f.keys = append(f.keys, key)
+	return key
+}
+
+func (f *FakeIAM) findKey(id string) *fakeAccessKey {
+	for _, key := range f.keys {
+		if key.id == id {
+			return key
+		}
+	}
+	return nil
+}
+
+func (f *FakeIAM) userKeys(user string) []*fakeAccessKey {
+	keys := []*fakeAccessKey{}
+	for _, key := range f.keys {
+		if key.user == user {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (f *FakeIAM) arn(user string) string {
+	return fmt.Sprintf("arn:aws:iam::%s:user/%s", f.accountId, user)
+}
+
+type fakeUser struct {
+	Arn      string
+	Path     string
+	UserId   string
+	UserName string
+}
+
+type fakeKeyMember struct {
+	UserName        string
+	AccessKeyId     string
+	SecretAccessKey string `xml:",omitempty"`
+	Status          string
+	CreateDate      string
+}
+
+type fakeResponseMetadata struct {
+	RequestId string
+}
+
+type fakeGetUserResponse struct {
+	XMLName          xml.Name `xml:"GetUserResponse"`
+	User             fakeUser `xml:"GetUserResult>User"`
+	ResponseMetadata fakeResponseMetadata
+}
+
+type fakeListAccessKeysResponse struct {
+	XMLName          xml.Name        `xml:"ListAccessKeysResponse"`
+	Members          []fakeKeyMember `xml:"ListAccessKeysResult>AccessKeyMetadata>member"`
+	IsTruncated      bool            `xml:"ListAccessKeysResult>IsTruncated"`
+	ResponseMetadata fakeResponseMetadata
+}
+
+type fakeCreateAccessKeyResponse struct {
+	XMLName          xml.Name      `xml:"CreateAccessKeyResponse"`
+	AccessKey        fakeKeyMember `xml:"CreateAccessKeyResult>AccessKey"`
+	ResponseMetadata fakeResponseMetadata
+}
+
+type fakeListAccountAliasesResponse struct {
+	XMLName          xml.Name `xml:"ListAccountAliasesResponse"`
+	Aliases          []string `xml:"ListAccountAliasesResult>AccountAliases>member"`
+	IsTruncated      bool     `xml:"ListAccountAliasesResult>IsTruncated"`
+	ResponseMetadata fakeResponseMetadata
+}
+
+type fakeGetCallerIdentityResponse struct {
+	XMLName          xml.Name `xml:"GetCallerIdentityResponse"`
+	Arn              string   `xml:"GetCallerIdentityResult>Arn"`
+	UserId           string   `xml:"GetCallerIdentityResult>UserId"`
+	Account          string   `xml:"GetCallerIdentityResult>Account"`
+	ResponseMetadata fakeResponseMetadata
+}
+
+type fakeSimpleResponse struct {
+	XMLName          xml.Name
+	ResponseMetadata fakeResponseMetadata
+}
+
+type fakeErrorResponse struct {
+	XMLName   xml.Name `xml:"ErrorResponse"`
+	Type      string   `xml:"Error>Type"`
+	Code      string   `xml:"Error>Code"`
+	Message   string   `xml:"Error>Message"`
+	RequestId string
+}
+
+func (f *FakeIAM) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		f.writeError(w, &fakeError{http.StatusBadRequest, "MalformedQueryString", err.Error()})
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	resp, ferr := f.dispatch(r.Form.Get("Action"), r.Form.Get("AWSAccessKeyId"), r)
+	if ferr != nil {
+		f.writeError(w, ferr)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	xml.NewEncoder(w).Encode(resp)
+}
+
+func (f *FakeIAM) dispatch(action, accessKey string, r *http.Request) (interface{}, *fakeError) {
+	f.calls[action] += 1
+	if f.throttle > 0 {
+		f.throttle -= 1
+		return nil, &fakeError{http.StatusBadRequest, "Throttling", "Rate exceeded"}
+	}
+
+	caller := f.findKey(accessKey)
+	if caller == nil || caller.status != "Active" || caller.pending > 0 {
+		if caller != nil && caller.pending > 0 {
+			caller.pending -= 1
+		}
+		return nil, &fakeError{http.StatusForbidden, "InvalidClientTokenId",
+			"The security token included in the request is invalid."}
+	}
+
+	user := r.Form.Get("UserName")
+	if user == "" {
+		user = caller.user
+	}
+	if !f.users[user] {
+		return nil, &fakeError{http.StatusNotFound, "NoSuchEntity",
+			"The user with name " + user + " cannot be found."}
+	}
+	meta := fakeResponseMetadata{RequestId: fmt.Sprintf("fake-%d", f.keyCount)}
+
+	switch action {
+	case "GetUser":
+		return fakeGetUserResponse{
+			User: fakeUser{
+				Arn:      f.arn(user),
+				Path:     "/",
+				UserId:   "AIDAFAKE" + user,
+				UserName: user,
+			},
+			ResponseMetadata: meta,
+		}, nil
+
+	case "GetCallerIdentity":
+		return fakeGetCallerIdentityResponse{
+			Arn:              f.arn(caller.user),
+			UserId:           "AIDAFAKE" + caller.user,
+			Account:          f.accountId,
+			ResponseMetadata: meta,
+		}, nil
+
+	case "ListAccessKeys":
+		members := []fakeKeyMember{}
+		for _, key := range f.userKeys(user) {
+			members = append(members, fakeKeyMember{
+				UserName:    key.user,
+				AccessKeyId: key.id,
+				Status:      key.status,
+				CreateDate:  key.created.Format(fakeTimeFormat),
+			})
+		}
+		return fakeListAccessKeysResponse{Members: members, ResponseMetadata: meta}, nil
+
+	case "CreateAccessKey":
+		if len(f.userKeys(user)) >= 2 {
+			return nil, &fakeError{http.StatusConflict, "LimitExceeded",
+				"Cannot exceed quota for AccessKeysPerUser: 2"}
+		}
+		key := f.createKey(user)
+		return fakeCreateAccessKeyResponse{
+			AccessKey: fakeKeyMember{
+				UserName:        key.user,
+				AccessKeyId:     key.id,
+				SecretAccessKey: key.secret,
+				Status:          key.status,
+				CreateDate:      key.created.Format(fakeTimeFormat),
+			},
+			ResponseMetadata: meta,
+		}, nil
+
+	case "DeleteAccessKey", "UpdateAccessKey":
+		key := f.findKey(r.Form.Get("AccessKeyId"))
+		if key == nil || key.user != user {
+			return nil, &fakeError{http.StatusNotFound, "NoSuchEntity",
+				"The Access Key with id " + r.Form.Get("AccessKeyId") + " cannot be found."}
+		}
+		if action == "UpdateAccessKey" {
+			status := r.Form.Get("Status")
+			if status != "Active" && status != "Inactive" {
+				return nil, &fakeError{http.StatusBadRequest, "ValidationError",
+					"Status must be Active or Inactive"}
+			}
+			key.status = status
+		} else {
+			keys := f.keys[:0]
+			for _, k := range f.keys {
+				if k != key {
+					keys = append(keys, k)
+				}
+			}
+			f.keys = keys
+		}
+		return fakeSimpleResponse{
+			XMLName:          xml.Name{Local: action + "Response"},
+			ResponseMetadata: meta,
+		}, nil
+
+	case "ListAccountAliases":
+		return fakeListAccountAliasesResponse{
+			Aliases:          append([]string{}, f.aliases...),
+			ResponseMetadata: meta,
+		}, nil
+	}
+
+	return nil, &fakeError{http.StatusBadRequest, "InvalidAction",
+		"Could not find operation " + action}
+}
+
+func (f *FakeIAM) writeError(w http.ResponseWriter, ferr *fakeError) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(ferr.status)
+	xml.NewEncoder(w).Encode(fakeErrorResponse{
+		Type:      "Sender",
+		Code:      ferr.code,
+		Message:   ferr.message,
+		RequestId: "fake-error",
+	})
+}
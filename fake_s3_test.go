@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakeS3 is a stand-in for an S3-compatible object store, addressed by
+// path like MinIO, keeping its objects in memory
+type FakeS3 struct {
+	sync.Mutex
+	server  *httptest.Server
+	buckets map[string]map[string][]byte
+	// the most keys any one listing returns, to exercise paging
+	pageSize int
+}
+
+func NewFakeS3(buckets ...string) *FakeS3 {
+	f := &FakeS3{
+		buckets:  make(map[string]map[string][]byte),
+		pageSize: 1000,
+	}
+	for _, bucket := range buckets {
+		f.buckets[bucket] = make(map[string][]byte)
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *FakeS3) Close() {
+	f.server.Close()
+}
+
+// URL returns the s3:// repo URL for a prefix in one of this server's
+// buckets
+func (f *FakeS3) URL(bucket, prefix string) string {
+	return S3_SCHEME + path.Join(bucket, prefix) + "?endpoint=" + url.QueryEscape(f.server.URL)
+}
+
+// Keys lists every object in a bucket
+func (f *FakeS3) Keys(bucket string) []string {
+	f.Lock()
+	defer f.Unlock()
+	keys := []string{}
+	for key := range f.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type fakeS3Key struct {
+	Key  string
+	Size int
+}
+
+type fakeS3ListResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	Marker         string
+	NextMarker     string `xml:",omitempty"`
+	MaxKeys        int
+	IsTruncated    bool
+	Contents       []fakeS3Key
+	CommonPrefixes []string `xml:"CommonPrefixes>Prefix"`
+}
+
+type fakeS3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+func (f *FakeS3) writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(fakeS3Error{Code: code, Message: message})
+}
+
+func (f *FakeS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	objects, ok := f.buckets[parts[0]]
+	if !ok {
+		f.writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	switch {
+	case r.Method == "GET" && key == "":
+		f.list(w, parts[0], objects, r.URL.Query())
+	case r.Method == "GET":
+		data, ok := objects[key]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Write(data)
+	case r.Method == "PUT" && key != "":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			f.writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		objects[key] = data
+	case r.Method == "DELETE" && key != "":
+		// S3 doesn't mind deleting what isn't there
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" is not allowed here")
+	}
+}
+
+func (f *FakeS3) list(w http.ResponseWriter, bucket string, objects map[string][]byte, query url.Values) {
+	result := fakeS3ListResult{
+		Name:    bucket,
+		Prefix:  query.Get("prefix"),
+		Marker:  query.Get("marker"),
+		MaxKeys: f.pageSize,
+	}
+	if max, err := strconv.Atoi(query.Get("max-keys")); err == nil && max < result.MaxKeys {
+		result.MaxKeys = max
+	}
+	delimiter := query.Get("delimiter")
+
+	keys := []string{}
+	for key := range objects {
+		if strings.HasPrefix(key, result.Prefix) && key > result.Marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	prefixes := make(map[string]bool)
+	for _, key := range keys {
+		if len(result.Contents)+len(result.CommonPrefixes) == result.MaxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if delimiter != "" {
+			rest := strings.TrimPrefix(key, result.Prefix)
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				common := result.Prefix + rest[:i+len(delimiter)]
+				if !prefixes[common] {
+					prefixes[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, common)
+				}
+				result.NextMarker = key
+				continue
+			}
+		}
+		result.Contents = append(result.Contents, fakeS3Key{Key: key, Size: len(objects[key])})
+		result.NextMarker = key
+	}
+	if !result.IsTruncated {
+		result.NextMarker = ""
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
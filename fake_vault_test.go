@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeVault is a stand-in for a Vault server with a KV version 2 engine
+// mounted at "secret" and AppRole auth at "approle", keeping everything
+// in memory
+type FakeVault struct {
+	sync.Mutex
+	server   *httptest.Server
+	mount    string
+	tokens   map[string]bool
+	roles    map[string]string
+	secrets  map[string][]*fakeVaultVersion
+	logins   int
+	requests int
+}
+
+type fakeVaultVersion struct {
+	data      map[string]interface{}
+	created   time.Time
+	destroyed bool
+}
+
+const FAKE_VAULT_ROOT_TOKEN string = "root"
+
+func NewFakeVault() *FakeVault {
+	f := &FakeVault{
+		mount:   "secret",
+		tokens:  map[string]bool{FAKE_VAULT_ROOT_TOKEN: true},
+		roles:   make(map[string]string),
+		secrets: make(map[string][]*fakeVaultVersion),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *FakeVault) Close() {
+	f.server.Close()
+}
+
+// URL returns the vault:// repo URL for a prefix in this server's KV
+// engine
+func (f *FakeVault) URL(prefix string) string {
+	repo := VAULT_SCHEME + f.mount
+	if prefix != "" {
+		repo += "/" + prefix
+	}
+	return repo + "?address=" + url.QueryEscape(f.server.URL)
+}
+
+// AddRole sets up an AppRole that can log in with the given ids
+func (f *FakeVault) AddRole(roleId, secretId string) {
+	f.Lock()
+	defer f.Unlock()
+	f.roles[roleId] = secretId
+}
+
+// Versions returns how many versions a secret has had, destroyed or not
+func (f *FakeVault) Versions(secret string) int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.secrets[secret])
+}
+
+// Requests returns how many requests the server has had
+func (f *FakeVault) Requests() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.requests
+}
+
+func (f *FakeVault) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *FakeVault) writeError(w http.ResponseWriter, status int, messages ...string) {
+	f.writeJSON(w, status, map[string][]string{"errors": messages})
+}
+
+func (f *FakeVault) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests++
+
+	apipath := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if apipath == "auth/approle/login" && r.Method == "POST" {
+		f.login(w, r)
+		return
+	}
+	if !f.tokens[r.Header.Get("X-Vault-Token")] {
+		f.writeError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	parts := strings.SplitN(apipath, "/", 3)
+	if len(parts) < 2 || parts[0] != f.mount {
+		f.writeError(w, http.StatusNotFound, "no handler for route '"+apipath+"'")
+		return
+	}
+	secret := ""
+	if len(parts) == 3 {
+		secret = strings.TrimSuffix(parts[2], "/")
+	}
+	query := r.URL.Query()
+
+	switch {
+	case parts[1] == "metadata" && query.Get("list") == "true":
+		f.list(w, secret)
+	case parts[1] == "metadata" && r.Method == "GET":
+		f.metadata(w, secret)
+	case parts[1] == "data" && r.Method == "GET":
+		f.read(w, secret, query.Get("version"))
+	case parts[1] == "data" && (r.Method == "POST" || r.Method == "PUT"):
+		f.write(w, r, secret)
+	case parts[1] == "destroy" && (r.Method == "POST" || r.Method == "PUT"):
+		f.destroy(w, r, secret)
+	default:
+		f.writeError(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+func (f *FakeVault) login(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RoleId   string `json:"role_id"`
+		SecretId string `json:"secret_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		f.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	secretId, ok := f.roles[body.RoleId]
+	if !ok || secretId != body.SecretId {
+		f.writeError(w, http.StatusBadRequest, "invalid role or secret ID")
+		return
+	}
+	f.logins++
+	token := fmt.Sprintf("approle-token-%d", f.logins)
+	f.tokens[token] = true
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"auth": map[string]interface{}{"client_token": token},
+	})
+}
+
+func (f *FakeVault) list(w http.ResponseWriter, dir string) {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	keys := make(map[string]bool)
+	for secret := range f.secrets {
+		if !strings.HasPrefix(secret, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(secret, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			keys[rest[:i+1]] = true
+		} else {
+			keys[rest] = true
+		}
+	}
+	if len(keys) == 0 {
+		f.writeError(w, http.StatusNotFound)
+		return
+	}
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{"keys": sortedKeys(keys)},
+	})
+}
+
+func (f *FakeVault) metadata(w http.ResponseWriter, secret string) {
+	versions, ok := f.secrets[secret]
+	if !ok {
+		f.writeError(w, http.StatusNotFound)
+		return
+	}
+	meta := make(map[string]interface{})
+	for i, version := range versions {
+		meta[strconv.Itoa(i+1)] = map[string]interface{}{
+			"created_time":  version.created.Format(time.RFC3339Nano),
+			"deletion_time": "",
+			"destroyed":     version.destroyed,
+		}
+	}
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"current_version": len(versions),
+			"versions":        meta,
+		},
+	})
+}
+
+func (f *FakeVault) read(w http.ResponseWriter, secret, version string) {
+	versions := f.secrets[secret]
+	n := len(versions)
+	if version != "" && version != "0" {
+		var err error
+		if n, err = strconv.Atoi(version); err != nil {
+			f.writeError(w, http.StatusBadRequest, "invalid version")
+			return
+		}
+	}
+	if n < 1 || n > len(versions) || versions[n-1].destroyed {
+		f.writeError(w, http.StatusNotFound)
+		return
+	}
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"data":     versions[n-1].data,
+			"metadata": map[string]interface{}{"version": n},
+		},
+	})
+}
+
+func (f *FakeVault) write(w http.ResponseWriter, r *http.Request, secret string) {
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Data == nil {
+		f.writeError(w, http.StatusBadRequest, "no data provided")
+		return
+	}
+	f.secrets[secret] = append(f.secrets[secret], &fakeVaultVersion{data: body.Data, created: time.Now()})
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{"version": len(f.secrets[secret])},
+	})
+}
+
+func (f *FakeVault) destroy(w http.ResponseWriter, r *http.Request, secret string) {
+	var body struct {
+		Versions []int `json:"versions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Versions) == 0 {
+		f.writeError(w, http.StatusBadRequest, "no versions provided")
+		return
+	}
+	versions := f.secrets[secret]
+	for _, n := range body.Versions {
+		if n >= 1 && n <= len(versions) {
+			versions[n-1].destroyed = true
+			versions[n-1].data = nil
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
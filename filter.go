@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// CredentialFilter picks out credentials for list and source. Account,
+// Username and tag values are globs; a tag given without a value only
+// has to be there.
+type CredentialFilter struct {
+	Account  string
+	Username string
+	Tags     map[string]string
+	// Kinds lists the kinds of secret wanted, any of which will do
+	Kinds []string
+	// DecryptableBy lists fingerprints, any of which will do
+	DecryptableBy []string
+}
+
+func (filter CredentialFilter) empty() bool {
+	return filter.Account == "" && filter.Username == "" && len(filter.Tags) == 0 && filter.DecryptableBy == nil &&
+		len(filter.Kinds) == 0
+}
+
+// matches tells whether a listing is one the filter picks out. Globs
+// have already been checked by parseFilterArgs, so a bad one just
+// doesn't match.
+func (filter CredentialFilter) matches(listing CredentialListing) bool {
+	if ok, _ := path.Match(orAll(filter.Account), listing.Account); !ok {
+		return false
+	}
+	if ok, _ := path.Match(orAll(filter.Username), listing.Username); !ok {
+		return false
+	}
+	for name, pattern := range filter.Tags {
+		value, ok := listing.Tags[name]
+		if !ok {
+			return false
+		}
+		if ok, _ := path.Match(orAll(pattern), value); !ok {
+			return false
+		}
+	}
+	if len(filter.Kinds) > 0 {
+		found := false
+		for _, kind := range filter.Kinds {
+			found = found || listing.Kind == kind
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.DecryptableBy != nil {
+		found := false
+		for _, fingerprint := range filter.DecryptableBy {
+			found = found || listing.hasRecipient(fingerprint)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func orAll(pattern string) string {
+	if pattern == "" {
+		return "*"
+	}
+	return pattern
+}
+
+func filterListings(listings []CredentialListing, filter CredentialFilter) []CredentialListing {
+	matched := []CredentialListing{}
+	for _, listing := range listings {
+		if filter.matches(listing) {
+			matched = append(matched, listing)
+		}
+	}
+	return matched
+}
+
+// listingIdentities lists the identities in listings once each, in order
+func listingIdentities(listings []CredentialListing) []string {
+	identities := []string{}
+	seen := make(map[string]bool)
+	for _, listing := range listings {
+		if !seen[listing.Identity] {
+			seen[listing.Identity] = true
+			identities = append(identities, listing.Identity)
+		}
+	}
+	return identities
+}
+
+// parseTagArgs reads --tag name=value arguments. Saving needs a value,
+// though an empty one removes the tag; filters can do without.
+func parseTagArgs(c *cli.Context, needValue bool) (map[string]string, error) {
+	if len(c.StringSlice("tag")) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string)
+	for _, arg := range c.StringSlice("tag") {
+		parts := strings.SplitN(arg, "=", 2)
+		if parts[0] == "" || (needValue && len(parts) == 1) {
+			return nil, errors.New("Invalid tag '" + arg + "'; please give tags as name=value")
+		}
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
+// mergeTags works out the tags to save credentials with: those of the
+// identity's current credentials, changed by any given. An empty value
+// removes a tag.
+func mergeTags(repo, account, username string, given map[string]string) map[string]string {
+	tags := make(map[string]string)
+	if store, err := openStore(repo); err == nil {
+		if file, err := store.Latest(account, username); err == nil {
+			if creds, _, err := readCredentialMetadata(file.Data); err == nil {
+				for name, value := range creds.Tags {
+					tags[name] = value
+				}
+			}
+		}
+	}
+	for name, value := range given {
+		if value == "" {
+			delete(tags, name)
+		} else {
+			tags[name] = value
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// parseFilterArgs reads the --account, --username, --tag, --kind and
+// --decryptable-by arguments to list
+func parseFilterArgs(c *cli.Context) (CredentialFilter, error) {
+	filter := CredentialFilter{Account: c.String("account"), Username: c.String("username")}
+	for _, kind := range c.StringSlice("kind") {
+		if !isSecretKind(kind) {
+			return filter, errors.New("Unknown kind '" + kind + "'; expected one of " + strings.Join(SECRET_KINDS, ", "))
+		}
+		filter.Kinds = append(filter.Kinds, kind)
+	}
+	for _, pattern := range []string{filter.Account, filter.Username} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return filter, errors.New("Invalid pattern '" + pattern + "'")
+		}
+	}
+	tags, err := parseTagArgs(c, false)
+	if err != nil {
+		return filter, err
+	}
+	filter.Tags = tags
+	if c.String("decryptable-by") != "" {
+		filter.DecryptableBy, err = resolveRecipient(c.String("decryptable-by"), getPrivateKey(c))
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// resolveRecipient turns a --decryptable-by argument into fingerprints:
+// "me" is the fingerprint of our own key, and otherwise it may be a
+// fingerprint, a public key file, or a principal in the team keyring
+func resolveRecipient(who, keyfile string) ([]string, error) {
+	if who == "me" {
+		fingerprint, err := keyFingerprint(keyfile)
+		if err != nil {
+			return nil, err
+		}
+		return []string{fingerprint}, nil
+	}
+	if strings.Count(who, ":") == 15 {
+		return []string{strings.ToLower(who)}, nil
+	}
+	if pubkey, err := readSSHPubkeyFile(who); err == nil {
+		return []string{SSHFingerprint(pubkey)}, nil
+	}
+	names, err := recipientNames()
+	if err != nil {
+		return nil, err
+	}
+	fingerprints := []string{}
+	for fingerprint, principals := range names {
+		for _, principal := range principals {
+			if principal == who {
+				fingerprints = append(fingerprints, fingerprint)
+			}
+		}
+	}
+	if len(fingerprints) == 0 {
+		return nil, errors.New("No key for '" + who + "'; give 'me', a fingerprint, a public key file, or a name from " + allowedSignersFile())
+	}
+	sort.Strings(fingerprints)
+	return fingerprints, nil
+}
+
+// matchIdentities finds the identities a partial username@account could
+// mean: those containing it if any do, or failing that, those with its
+// letters in order
+func matchIdentities(arg string, identities []string) []string {
+	arg = strings.ToLower(arg)
+	contains := []string{}
+	inOrder := []string{}
+	for _, identity := range identities {
+		lower := strings.ToLower(identity)
+		if strings.Contains(lower, arg) {
+			contains = append(contains, identity)
+		} else if isSubsequence(arg, lower) {
+			inOrder = append(inOrder, identity)
+		}
+	}
+	if len(contains) > 0 {
+		return contains
+	}
+	return inOrder
+}
+
+func isSubsequence(short, long string) bool {
+	want := []rune(short)
+	i := 0
+	for _, r := range long {
+		if i < len(want) && want[i] == r {
+			i++
+		}
+	}
+	return i == len(want)
+}
+
+// pickIdentity works out which identity source means by a partial
+// username@account. Only an exact match is taken as it is: anything
+// else, even a single match, is put to choose, if there's a terminal to
+// ask on, since a typo shouldn't quietly load another account's
+// credentials; otherwise the choices are in the error.
+func pickIdentity(arg string, identities []string, choose func([]string) (string, error)) (string, error) {
+	for _, identity := range identities {
+		if identity == arg {
+			return arg, nil
+		}
+	}
+	candidates := identities
+	if arg != "" {
+		candidates = matchIdentities(arg, identities)
+	}
+	switch {
+	case len(candidates) == 0 && arg == "":
+		return "", errors.New("No credentials match; see 'credulous list'")
+	case len(candidates) == 0:
+		return "", errors.New("No credentials match '" + arg + "'; see 'credulous list'")
+	case len(candidates) == 1 && arg == "":
+		// nothing asked for, and only one to give
+		return candidates[0], nil
+	case len(candidates) == 1 && choose == nil:
+		return "", errors.New("No credentials are saved as '" + arg + "'; did you mean " + candidates[0] + "?")
+	case choose == nil:
+		return "", errors.New("More than one set of credentials matches; please give one of " +
+			strings.Join(candidates, ", "))
+	}
+	return choose(candidates)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalChooser shows the picker for which of several identities to
+// use, or is nil if there's no terminal to show it on
+func terminalChooser(listings []CredentialListing) func([]string) (string, error) {
+	if !canPick() {
+		return nil
+	}
+	return func(candidates []string) (string, error) {
+		wanted := make(map[string]bool)
+		for _, candidate := range candidates {
+			wanted[candidate] = true
+		}
+		choices := []CredentialListing{}
+		for _, listing := range listings {
+			if wanted[listing.Identity] {
+				choices = append(choices, listing)
+			}
+		}
+		return pickOnTerminal(choices, "")
+	}
+}
+
+func chooseIdentity(candidates []string, in io.Reader, out io.Writer) (string, error) {
+	fmt.Fprintln(out, "These credentials match:")
+	for i, candidate := range candidates {
+		fmt.Fprintf(out, "  %d) %s\n", i+1, candidate)
+	}
+	fmt.Fprintf(out, "Which one? ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || n < 1 || n > len(candidates) {
+		return "", errors.New("Please choose a number from 1 to " + strconv.Itoa(len(candidates)))
+	}
+	return candidates[n-1], nil
+}
+
+// resolveSourceIdentity works out which credentials source and pick
+// should load. A username@account that's saved somewhere is taken as it
+// is; anything else is matched against what's saved, narrowed by any
+// tags given. With nothing given, or for pick, the picker is shown if
+// there's a terminal and more than one to choose from; otherwise it's
+// the default, as ever.
+func resolveSourceIdentity(c *cli.Context, pick bool) (account, username string, err error) {
+	arg := c.Args().First()
+	if arg == "" {
+		arg = c.String("credentials")
+	}
+	tags, err := parseTagArgs(c, false)
+	if err != nil {
+		return "", "", err
+	}
+	interactive := canPick()
+	if tags == nil && !(pick && interactive) {
+		if arg == "" && (!interactive || c.String("account") != "" || c.String("username") != "") {
+			return getAccountAndUserName(c)
+		}
+		if strings.Contains(arg, "@") {
+			account, username, err = splitUserAndAccount(arg)
+			if err != nil {
+				return "", "", err
+			}
+			if _, err = findRepoFor(account, username); err == nil || c.String("repo") != "" {
+				return account, username, nil
+			}
+		}
+	}
+
+	listings, err := listCredentialDetails("")
+	if err != nil {
+		if arg == "" && tags == nil {
+			return getAccountAndUserName(c)
+		}
+		return "", "", err
+	}
+	listings = uniqueListings(filterListings(listings, CredentialFilter{Tags: tags, Kinds: []string{SECRET_KIND_AWS}}))
+	var identity string
+	if interactive && (pick || arg == "") && len(listings) > 1 {
+		identity, err = pickOnTerminal(listings, arg)
+	} else {
+		identity, err = pickIdentity(arg, listingIdentities(listings), terminalChooser(listings))
+		if err == nil && identity != arg {
+			log.Print("INFO: using " + identity)
+		}
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return splitUserAndAccount(identity)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+const TEST_FINGERPRINT string = "c0:61:84:fc:e8:c9:52:dc:cd:a9:8e:82:a2:70:0a:30"
+
+func TestCredentialFilter(t *testing.T) {
+	Convey("Test picking out credentials", t, func() {
+		listing := CredentialListing{
+			Account:    "prod-payments",
+			Username:   "deploy",
+			Tags:       map[string]string{"team": "payments"},
+			Recipients: []Recipient{{Fingerprint: TEST_FINGERPRINT}},
+		}
+
+		Convey("Accounts and usernames are globs", func() {
+			So(CredentialFilter{}.matches(listing), ShouldBeTrue)
+			So(CredentialFilter{Account: "prod-*"}.matches(listing), ShouldBeTrue)
+			So(CredentialFilter{Account: "staging-*"}.matches(listing), ShouldBeFalse)
+			So(CredentialFilter{Account: "prod-*", Username: "dep*"}.matches(listing), ShouldBeTrue)
+			So(CredentialFilter{Username: "admin"}.matches(listing), ShouldBeFalse)
+		})
+
+		Convey("Tags must all be there, with matching values if given", func() {
+			So(CredentialFilter{Tags: map[string]string{"team": "payments"}}.matches(listing), ShouldBeTrue)
+			So(CredentialFilter{Tags: map[string]string{"team": "pay*"}}.matches(listing), ShouldBeTrue)
+			So(CredentialFilter{Tags: map[string]string{"team": ""}}.matches(listing), ShouldBeTrue)
+			So(CredentialFilter{Tags: map[string]string{"team": "search"}}.matches(listing), ShouldBeFalse)
+			So(CredentialFilter{Tags: map[string]string{"team": "payments", "env": ""}}.matches(listing), ShouldBeFalse)
+		})
+
+		Convey("Any of the keys given must be a recipient", func() {
+			So(CredentialFilter{DecryptableBy: []string{"00:11", TEST_FINGERPRINT}}.matches(listing), ShouldBeTrue)
+			So(CredentialFilter{DecryptableBy: []string{"00:11"}}.matches(listing), ShouldBeFalse)
+			So(CredentialFilter{DecryptableBy: []string{}}.matches(listing), ShouldBeFalse)
+		})
+
+		Convey("Keys are named in several ways", func() {
+			_, cleanup := withTempHome()
+			defer cleanup()
+			b, err := ioutil.ReadFile("testdata/testkey.pub")
+			So(err, ShouldEqual, nil)
+			So(ioutil.WriteFile(allowedSignersFile(), append([]byte("hoopy@frood,ford "), b...), 0600), ShouldEqual, nil)
+
+			for _, who := range []string{"me", strings.ToUpper(TEST_FINGERPRINT), "testdata/testkey.pub", "ford"} {
+				fingerprints, err := resolveRecipient(who, "testdata/testkey")
+				So(err, ShouldEqual, nil)
+				So(fingerprints, ShouldResemble, []string{TEST_FINGERPRINT})
+			}
+			_, err = resolveRecipient("arthur", "testdata/testkey")
+			So(err.Error(), ShouldStartWith, "No key for 'arthur'")
+		})
+	})
+}
+
+func TestSavedTags(t *testing.T) {
+	Convey("Test tagging credentials", t, func() {
+		_, cleanup := withTempHome()
+		defer cleanup()
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		So(err, ShouldEqual, nil)
+		keyId, secret := fake.AddUser("bob")
+		repo := filepath.Join(getRootPath(), "local")
+		save := func(tags map[string]string) map[string]string {
+			cred := Credential{KeyId: keyId, SecretKey: secret}
+			So(SaveCredentials(SaveData{cred: cred, pubkeys: []ssh.PublicKey{pubkey}, repo: repo, tags: tags}), ShouldEqual, nil)
+			listings, err := listCredentialDetails("")
+			So(err, ShouldEqual, nil)
+			return listings[0].Tags
+		}
+
+		So(save(map[string]string{"team": "payments"}), ShouldResemble, map[string]string{"team": "payments"})
+
+		Convey("Tags are kept when saving again, and can be changed or removed", func() {
+			So(save(nil), ShouldResemble, map[string]string{"team": "payments"})
+			So(save(map[string]string{"env": "prod"}), ShouldResemble, map[string]string{"team": "payments", "env": "prod"})
+			So(save(map[string]string{"team": ""}), ShouldResemble, map[string]string{"env": "prod"})
+		})
+
+		Convey("Tags are saved in plaintext", func() {
+			store, err := openStore(repo)
+			So(err, ShouldEqual, nil)
+			file, err := latestStored(store, "test-alias", "bob")
+			So(err, ShouldEqual, nil)
+			So(string(file.Data), ShouldContainSubstring, `"Tags":{"team":"payments"}`)
+		})
+	})
+}
+
+func TestPickIdentity(t *testing.T) {
+	Convey("Test working out which credentials are meant", t, func() {
+		identities := []string{"bob@prod-payments", "bob@staging", "deploy@prod-search"}
+
+		Convey("Only exact matches are taken as they are", func() {
+			identity, err := pickIdentity("bob@staging", identities, nil)
+			So(err, ShouldEqual, nil)
+			So(identity, ShouldEqual, "bob@staging")
+
+			identity, err = pickIdentity("", identities[:1], nil)
+			So(err, ShouldEqual, nil)
+			So(identity, ShouldEqual, "bob@prod-payments")
+		})
+
+		Convey("A single fuzzy match is still asked about, or is an error", func() {
+			_, err := pickIdentity("search", identities, nil)
+			So(err.Error(), ShouldEqual, "No credentials are saved as 'search'; did you mean deploy@prod-search?")
+			_, err = pickIdentity("bob@stag", identities, nil)
+			So(err.Error(), ShouldEqual, "No credentials are saved as 'bob@stag'; did you mean bob@staging?")
+
+			var asked []string
+			identity, err := pickIdentity("bstg", identities, func(candidates []string) (string, error) {
+				asked = candidates
+				return candidates[0], nil
+			})
+			So(err, ShouldEqual, nil)
+			So(identity, ShouldEqual, "bob@staging")
+			So(asked, ShouldResemble, []string{"bob@staging"})
+		})
+
+		Convey("Substrings are preferred to letters in order", func() {
+			So(matchIdentities("prod", identities), ShouldResemble, []string{"bob@prod-payments", "deploy@prod-search"})
+			So(matchIdentities("BOB", identities), ShouldResemble, []string{"bob@prod-payments", "bob@staging"})
+			So(len(matchIdentities("zz", identities)), ShouldEqual, 0)
+		})
+
+		Convey("Without a terminal, ambiguity is an error naming the choices", func() {
+			_, err := pickIdentity("bob", identities, nil)
+			So(err.Error(), ShouldEqual, "More than one set of credentials matches; please give one of bob@prod-payments, bob@staging")
+			_, err = pickIdentity("zz", identities, nil)
+			So(err.Error(), ShouldEqual, "No credentials match 'zz'; see 'credulous list'")
+		})
+
+		Convey("With one, the user chooses", func() {
+			var asked []string
+			identity, err := pickIdentity("bob", identities, func(candidates []string) (string, error) {
+				asked = candidates
+				return candidates[1], nil
+			})
+			So(err, ShouldEqual, nil)
+			So(identity, ShouldEqual, "bob@staging")
+			So(asked, ShouldResemble, []string{"bob@prod-payments", "bob@staging"})
+
+			_, err = pickIdentity("", identities, func(candidates []string) (string, error) {
+				return "", errors.New("asked about " + strings.Join(candidates, " "))
+			})
+			So(err.Error(), ShouldEqual, "asked about "+strings.Join(identities, " "))
+		})
+
+		Convey("Choices are numbered", func() {
+			var out bytes.Buffer
+			identity, err := chooseIdentity(identities, strings.NewReader("3\n"), &out)
+			So(err, ShouldEqual, nil)
+			So(identity, ShouldEqual, "deploy@prod-search")
+			So(out.String(), ShouldContainSubstring, "  2) bob@staging\n")
+
+			_, err = chooseIdentity(identities, strings.NewReader("4\n"), &out)
+			So(err.Error(), ShouldEqual, "Please choose a number from 1 to 3")
+		})
+	})
+}
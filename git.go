@@ -2,49 +2,142 @@ package main
 
 import (
 	"errors"
-	"path"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/libgit2/git2go"
 )
 
+// GitRepo is what credulous needs from a git repository. Paths are
+// relative to the top of the repo's working tree.
+type GitRepo interface {
+	// Config returns a config value, as git would see it from the repo,
+	// or an empty string if it isn't set
+	Config(name string) (string, error)
+	// SetConfig sets a value in the repo's own config
+	SetConfig(name, value string) error
+	// Commit stages the added and removed paths and commits them in
+	// one go, signed if git is set up to sign commits with SSH keys
+	Commit(added, removed []string, message string) (commitId string, err error)
+
+	SetRemote(name, url string) error
+	RemoteURL(name string) (string, error)
+	Fetch(remote string) error
+	// Rebase replays any local commits on top of the remote's copy of
+	// the current branch
+	Rebase(remote string) error
+	Push(remote string) error
+	// DivergedFiles lists the files added locally and on the remote
+	// since the two last had a commit in common
+	DivergedFiles(remote string) (local, remoteFiles []string, err error)
+	// Unpushed reports whether the current branch has commits that the
+	// remote's copy of it, as last fetched, doesn't; with no remote,
+	// any commit at all is unpushed
+	Unpushed(remote string) (bool, error)
+
+	// FileOrigins finds the commit that first added each file under dir
+	FileOrigins(dir string) (map[string]GitCommitInfo, error)
+	// ReadDirAt returns the contents of the files in dir as they were
+	// at the given revision, and the commit that names
+	ReadDirAt(revision, dir string) (files map[string][]byte, commitId string, err error)
+	// PurgePaths rewrites every commit on the current branch as if the
+	// paths had never been committed, and returns how many changed
+	PurgePaths(paths []string) (rewritten int, err error)
+}
+
+// GitBackend opens and creates GitRepos
+type GitBackend interface {
+	// IsRepo reports whether path is the top of a git working tree
+	IsRepo(path string) (bool, error)
+	Open(path string) (GitRepo, error)
+	Init(path string, bare bool) (GitRepo, error)
+	Clone(url, path string) (GitRepo, error)
+}
+
+const GIT_BACKEND_ENV = "CREDULOUS_GIT_BACKEND"
+
+// in order of preference, when CREDULOUS_GIT_BACKEND doesn't say
+var GIT_BACKEND_PREFERENCE = []string{"gogit", "exec"}
+
+var gitBackends = make(map[string]GitBackend)
+
+// registerGitBackend makes a backend available by name; backends
+// register themselves when they're built in
+func registerGitBackend(name string, backend GitBackend) {
+	gitBackends[name] = backend
+}
+
+func gitBackendNames() []string {
+	names := []string{}
+	for name := range gitBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func gitBackend() (GitBackend, error) {
+	if name := os.Getenv(GIT_BACKEND_ENV); name != "" {
+		backend, ok := gitBackends[name]
+		if !ok {
+			return nil, errors.New("Unknown git backend '" + name + "' in " + GIT_BACKEND_ENV +
+				"; expected one of " + strings.Join(gitBackendNames(), ", "))
+		}
+		return backend, nil
+	}
+	for _, name := range GIT_BACKEND_PREFERENCE {
+		if backend, ok := gitBackends[name]; ok {
+			return backend, nil
+		}
+	}
+	return nil, errors.New("Credulous was built without any git backends")
+}
+
+func openGitRepo(repopath string) (GitRepo, error) {
+	backend, err := gitBackend()
+	if err != nil {
+		return nil, err
+	}
+	return backend.Open(repopath)
+}
+
+// parseGitBool reads a boolean config value the way git does
+func parseGitBool(value string) bool {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true
+	}
+	return false
+}
+
 type RepoConfig struct {
 	Name  string
 	Email string
 }
 
 func isGitRepo(checkpath string) (bool, error) {
-	ceiling := []string{checkpath}
-
-	repopath, err := git.Discover(checkpath, false, ceiling)
-	nonRepoErr := errors.New("Could not find repository from '" + checkpath + "'")
-	if err != nil && err.Error() != nonRepoErr.Error() {
-		return false, err
-	}
-	if err != nil && err.Error() == nonRepoErr.Error() {
+	if !isDiskRepo(checkpath) {
 		return false, nil
 	}
-	// the path is the parent of the repo, which appends '.git'
-	// to the path
-	dirpath := path.Dir(path.Clean(repopath))
-	if dirpath == checkpath {
-		return true, nil
+	backend, err := gitBackend()
+	if err != nil {
+		return false, err
 	}
-	return false, nil
+	return backend.IsRepo(checkpath)
 }
 
-func getRepoConfig(repo *git.Repository) (RepoConfig, error) {
-	config, err := repo.Config()
+func getRepoConfig(repo GitRepo) (RepoConfig, error) {
+	name, err := repo.Config("user.name")
 	if err != nil {
 		return RepoConfig{}, err
 	}
-	name, err := config.LookupString("user.name")
+	email, err := repo.Config("user.email")
 	if err != nil {
 		return RepoConfig{}, err
 	}
-	email, err := config.LookupString("user.email")
-	if err != nil {
-		return RepoConfig{}, err
+	if name == "" || email == "" {
+		return RepoConfig{}, errors.New("Please set user.name and user.email in your git config")
 	}
 	repoconf := RepoConfig{
 		Name:  name,
@@ -53,75 +146,269 @@ func getRepoConfig(repo *git.Repository) (RepoConfig, error) {
 	return repoconf, nil
 }
 
-func gitAddCommitFile(repopath, filename, message string) (commitId string, err error) {
-	repo, err := git.OpenRepository(repopath)
+// gitCommitPaths stages the added and removed paths (relative to the
+// repo) and commits them in one go
+func gitCommitPaths(repopath string, added, removed []string, message string) (commitId string, err error) {
+	repo, err := openGitRepo(repopath)
 	if err != nil {
 		return "", err
 	}
+	return repo.Commit(added, removed, message)
+}
 
-	config, err := getRepoConfig(repo)
-	if err != nil {
+// getSigningKey returns the key to sign commits with, if git is set up
+// to sign them with SSH keys, or an empty string if not
+func getSigningKey(repo GitRepo) (string, error) {
+	sign, err := repo.Config("commit.gpgsign")
+	if err != nil || !parseGitBool(sign) {
 		return "", err
 	}
-
-	index, err := repo.Index()
-	if err != nil {
+	format, err := repo.Config("gpg.format")
+	if err != nil || format != "ssh" {
 		return "", err
 	}
+	return repo.Config("user.signingkey")
+}
 
-	err = index.AddByPath(filename)
+func getRepoSigningKey(repopath string) (string, error) {
+	repo, err := openGitRepo(repopath)
 	if err != nil {
 		return "", err
 	}
+	return getSigningKey(repo)
+}
 
-	err = index.Write()
+// setSigningKey sets the repo up to sign commits, and the credential
+// files in them, with an SSH key, the same way git itself would be
+func setSigningKey(repopath, keyfile string) error {
+	repo, err := openGitRepo(repopath)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if keyfile == "" {
+		return repo.SetConfig("commit.gpgsign", "false")
 	}
+	if err = repo.SetConfig("gpg.format", "ssh"); err != nil {
+		return err
+	}
+	if err = repo.SetConfig("user.signingkey", keyfile); err != nil {
+		return err
+	}
+	return repo.SetConfig("commit.gpgsign", "true")
+}
+
+type SyncConfig struct {
+	// Remote is the name of the git remote to sync with; empty if the
+	// repo isn't shared
+	Remote string
+	// StaleAfter is how long source and list trust the local copy
+	// before pulling again
+	StaleAfter time.Duration
+	LastSync   time.Time
+}
+
+const DEFAULT_STALE_AFTER = 15 * time.Minute
 
-	treeId, err := index.WriteTree()
+func getSyncConfig(repopath string) (SyncConfig, error) {
+	repo, err := openGitRepo(repopath)
 	if err != nil {
-		return "", err
+		return SyncConfig{}, err
 	}
 
-	// new file is now staged, so we have to create a commit
-	sig := &git.Signature{
-		Name:  config.Name,
-		Email: config.Email,
-		When:  time.Now(),
+	syncconf := SyncConfig{StaleAfter: DEFAULT_STALE_AFTER}
+	if syncconf.Remote, err = repo.Config("credulous.remote"); err != nil {
+		return SyncConfig{}, err
 	}
 
-	tree, err := repo.LookupTree(treeId)
+	stale, err := repo.Config("credulous.staleafter")
 	if err != nil {
-		return "", err
+		return SyncConfig{}, err
+	}
+	if stale != "" {
+		if syncconf.StaleAfter, err = time.ParseDuration(stale); err != nil {
+			return SyncConfig{}, err
+		}
 	}
 
-	var commit *git.Oid
-	haslog, err := repo.HasLog("HEAD")
+	last, err := repo.Config("credulous.lastsync")
 	if err != nil {
-		return "", err
+		return SyncConfig{}, err
 	}
-	if !haslog {
-		// In this case, the repo has been initialized, but nothing has ever been committed
-		commit, err = repo.CreateCommit("HEAD", sig, sig, message, tree)
-		if err != nil {
-			return "", err
-		}
-	} else {
-		// In this case, the repo has commits
-		currentBranch, err := repo.Head()
-		if err != nil {
-			return "", err
-		}
-		currentTip, err := repo.LookupCommit(currentBranch.Target())
-		if err != nil {
-			return "", err
-		}
-		commit, err = repo.CreateCommit("HEAD", sig, sig, message, tree, currentTip)
+	if last != "" {
+		secs, err := strconv.ParseInt(last, 10, 64)
 		if err != nil {
-			return "", err
+			return SyncConfig{}, err
 		}
+		syncconf.LastSync = time.Unix(secs, 0)
+	}
+	return syncconf, nil
+}
+
+// setSyncRemote points the named git remote at url, creating it if
+// needed, and records it as the remote credulous syncs with
+func setSyncRemote(repopath, remote, url string) error {
+	repo, err := openGitRepo(repopath)
+	if err != nil {
+		return err
+	}
+	if err = repo.SetRemote(remote, url); err != nil {
+		return err
 	}
+	return repo.SetConfig("credulous.remote", remote)
+}
 
-	return commit.String(), nil
+func setSyncStaleAfter(repopath string, stale time.Duration) error {
+	repo, err := openGitRepo(repopath)
+	if err != nil {
+		return err
+	}
+	return repo.SetConfig("credulous.staleafter", stale.String())
+}
+
+func setLastSync(repo GitRepo, when time.Time) error {
+	return repo.SetConfig("credulous.lastsync", strconv.FormatInt(when.Unix(), 10))
+}
+
+func gitFetch(repopath, remotename string) error {
+	repo, err := openGitRepo(repopath)
+	if err != nil {
+		return err
+	}
+	if err = repo.Fetch(remotename); err != nil {
+		return err
+	}
+	return setLastSync(repo, time.Now())
+}
+
+// gitRebase replays any local commits on top of the remote's copy of the
+// current branch. Credulous only ever adds new files, so the replay
+// can't conflict unless someone has been editing the repo by hand.
+func gitRebase(repopath, remotename string) error {
+	repo, err := openGitRepo(repopath)
+	if err != nil {
+		return err
+	}
+	return repo.Rebase(remotename)
+}
+
+func gitPush(repopath, remotename string) error {
+	repo, err := openGitRepo(repopath)
+	if err != nil {
+		return err
+	}
+	return repo.Push(remotename)
+}
+
+// gitDivergedFiles lists the files added locally and on the remote since
+// the two last had a commit in common
+func gitDivergedFiles(repopath, remotename string) (local, remote []string, err error) {
+	repo, err := openGitRepo(repopath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return repo.DivergedFiles(remotename)
+}
+
+// gitUnpushed reports whether a repo has commits that haven't been
+// pushed to the remote it syncs with, if it has one
+func gitUnpushed(repopath string) (bool, error) {
+	syncconf, err := getSyncConfig(repopath)
+	if err != nil {
+		return false, err
+	}
+	repo, err := openGitRepo(repopath)
+	if err != nil {
+		return false, err
+	}
+	return repo.Unpushed(syncconf.Remote)
+}
+
+func uncommittedChangesError(repopath string) error {
+	return errors.New("Cannot sync: " + repopath + " has changes that aren't committed; please commit or discard them with git first")
+}
+
+func rebaseConflictError(repopath string) error {
+	return errors.New("Cannot sync: local changes conflict with the remote; please resolve them with git in " + repopath)
+}
+
+type GitCommitInfo struct {
+	Id     string
+	Author string
+	When   time.Time
+}
+
+// gitFileOrigins finds the commit that first added each file under dir
+// (relative to the repo)
+func gitFileOrigins(repopath, dir string) (map[string]GitCommitInfo, error) {
+	repo, err := openGitRepo(repopath)
+	if err != nil {
+		return nil, err
+	}
+	return repo.FileOrigins(dir)
+}
+
+// gitReadDirAt returns the contents of the files in dir (relative to the
+// repo) as they were at the given revision, and the commit that names
+func gitReadDirAt(repopath, revision, dir string) (files map[string][]byte, commitId string, err error) {
+	repo, err := openGitRepo(repopath)
+	if err != nil {
+		return nil, "", err
+	}
+	return repo.ReadDirAt(revision, dir)
+}
+
+func unknownRevisionError(repopath, revision string) error {
+	return errors.New("Unknown revision '" + revision + "' in " + repopath)
+}
+
+func gitInit(repopath string) error {
+	backend, err := gitBackend()
+	if err != nil {
+		return err
+	}
+	_, err = backend.Init(repopath, false)
+	return err
+}
+
+// gitClone clones a shared repo and sets it up to sync with where it
+// came from
+func gitClone(url, repopath string) error {
+	backend, err := gitBackend()
+	if err != nil {
+		return err
+	}
+	repo, err := backend.Clone(url, repopath)
+	if err != nil {
+		return err
+	}
+	if err = repo.SetConfig("credulous.remote", "origin"); err != nil {
+		return err
+	}
+	return setLastSync(repo, time.Now())
+}
+
+// gitRemoteURL returns the URL of the remote a repo syncs with, if any
+func gitRemoteURL(repopath string) (string, error) {
+	conf, err := getSyncConfig(repopath)
+	if err != nil || conf.Remote == "" {
+		return "", err
+	}
+	repo, err := openGitRepo(repopath)
+	if err != nil {
+		return "", err
+	}
+	return repo.RemoteURL(conf.Remote)
+}
+
+// gitPurgePaths rewrites every commit on the current branch as if the
+// given paths (relative to the repo) had never been committed, and
+// returns how many commits changed. Like 'git filter-branch', rewritten
+// commits lose any signatures, and the old objects stay on disk until
+// git garbage-collects them.
+func gitPurgePaths(repopath string, paths []string) (rewritten int, err error) {
+	repo, err := openGitRepo(repopath)
+	if err != nil {
+		return 0, err
+	}
+	return repo.PurgePaths(paths)
 }
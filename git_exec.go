@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the exec backend runs the git binary, so it behaves exactly as git
+// does for the user, including signing commits and talking to remotes
+type execGitBackend struct{}
+
+type execGitRepo struct {
+	path string
+}
+
+func init() {
+	registerGitBackend("exec", execGitBackend{})
+}
+
+// runGit runs git in dir (or the current directory if empty), with any
+// extra environment and standard input, and returns what it printed
+func runGit(dir string, env []string, stdin string, args ...string) (string, error) {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "LC_ALL=C")
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return stdout.String(), &gitExecError{err: err, msg: msg}
+		}
+		return stdout.String(), &gitExecError{err: err, msg: err.Error()}
+	}
+	return stdout.String(), nil
+}
+
+type gitExecError struct {
+	err error
+	msg string
+}
+
+func (e *gitExecError) Error() string {
+	return e.msg
+}
+
+// exitedWith tells whether git ran, but exited with the given status
+func exitedWith(err error, status int) bool {
+	execErr, ok := err.(*gitExecError)
+	if !ok {
+		return false
+	}
+	exitErr, ok := execErr.err.(*exec.ExitError)
+	return ok && exitErr.ExitCode() == status
+}
+
+func (g execGitRepo) git(args ...string) (string, error) {
+	return runGit(g.path, nil, "", args...)
+}
+
+func (b execGitBackend) IsRepo(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		return false, nil
+	}
+	out, err := runGit(path, nil, "", "rev-parse", "--is-inside-work-tree", "--show-prefix")
+	if err != nil {
+		if strings.Contains(err.Error(), "not a git repository") {
+			return false, nil
+		}
+		return false, err
+	}
+	lines := strings.Split(out, "\n")
+	return lines[0] == "true" && len(lines) > 1 && lines[1] == "", nil
+}
+
+func (b execGitBackend) Open(path string) (GitRepo, error) {
+	if _, err := runGit(path, nil, "", "rev-parse", "--git-dir"); err != nil {
+		return nil, err
+	}
+	return execGitRepo{path: path}, nil
+}
+
+func (b execGitBackend) Init(path string, bare bool) (GitRepo, error) {
+	args := []string{"init", "-q"}
+	if bare {
+		args = append(args, "--bare")
+	}
+	if _, err := runGit("", nil, "", append(args, path)...); err != nil {
+		return nil, err
+	}
+	return execGitRepo{path: path}, nil
+}
+
+func (b execGitBackend) Clone(url, path string) (GitRepo, error) {
+	if _, err := runGit("", nil, "", "clone", "-q", url, path); err != nil {
+		return nil, err
+	}
+	return execGitRepo{path: path}, nil
+}
+
+func (g execGitRepo) Config(name string) (string, error) {
+	out, err := g.git("config", "--get", name)
+	if exitedWith(err, 1) {
+		return "", nil
+	}
+	return strings.TrimSpace(out), err
+}
+
+func (g execGitRepo) SetConfig(name, value string) error {
+	_, err := g.git("config", name, value)
+	return err
+}
+
+func (g execGitRepo) Commit(added, removed []string, message string) (string, error) {
+	if len(added) > 0 {
+		if _, err := g.git(append([]string{"add", "--"}, added...)...); err != nil {
+			return "", err
+		}
+	}
+	if len(removed) > 0 {
+		if _, err := g.git(append([]string{"rm", "--cached", "--ignore-unmatch", "-q", "--"}, removed...)...); err != nil {
+			return "", err
+		}
+	}
+	if _, err := g.git("commit", "-q", "--allow-empty", "-m", message); err != nil {
+		return "", err
+	}
+	out, err := g.git("rev-parse", "HEAD")
+	return strings.TrimSpace(out), err
+}
+
+func (g execGitRepo) SetRemote(name, url string) error {
+	if _, err := g.git("remote", "get-url", name); err != nil {
+		_, err = g.git("remote", "add", name, url)
+		return err
+	}
+	_, err := g.git("remote", "set-url", name, url)
+	return err
+}
+
+func (g execGitRepo) RemoteURL(name string) (string, error) {
+	out, err := g.git("remote", "get-url", name)
+	return strings.TrimSpace(out), err
+}
+
+func (g execGitRepo) Fetch(remote string) error {
+	_, err := g.git("fetch", "-q", remote)
+	return err
+}
+
+// resolve returns the commit a revision names, or an empty string if
+// there isn't one
+func (g execGitRepo) resolve(revision string) (string, error) {
+	out, err := g.git("rev-parse", "-q", "--verify", revision+"^{commit}")
+	if exitedWith(err, 1) {
+		return "", nil
+	}
+	return strings.TrimSpace(out), err
+}
+
+// upstream returns the remote's copy of the current branch, and the
+// local branch's tip, either of which may be empty
+func (g execGitRepo) upstream(remote string) (upstream, local string, err error) {
+	out, err := g.git("symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return "", "", err
+	}
+	branch := strings.TrimSpace(out)
+	if upstream, err = g.resolve("refs/remotes/" + remote + "/" + branch); err != nil {
+		return "", "", err
+	}
+	local, err = g.resolve("HEAD")
+	return upstream, local, err
+}
+
+func (g execGitRepo) Rebase(remote string) error {
+	upstream, local, err := g.upstream(remote)
+	if err != nil || upstream == "" {
+		// the remote is empty, or hasn't got our branch yet
+		return err
+	}
+	if local == upstream {
+		return nil
+	}
+	// refuse to throw away changes to tracked files, which reset would
+	// do silently
+	if changed, err := g.git("status", "--porcelain", "--untracked-files=no"); err != nil {
+		return err
+	} else if strings.TrimSpace(changed) != "" {
+		return uncommittedChangesError(g.path)
+	}
+	if local == "" {
+		// nothing local yet, so just take what the remote has
+		_, err = g.git("reset", "-q", "--hard", upstream)
+		return err
+	}
+	if _, err = g.git("rebase", "-q", upstream); err != nil {
+		g.git("rebase", "--abort")
+		return rebaseConflictError(g.path)
+	}
+	return nil
+}
+
+func (g execGitRepo) Push(remote string) error {
+	out, err := g.git("symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return err
+	}
+	branch := strings.TrimSpace(out)
+	if local, err := g.resolve("HEAD"); err != nil || local == "" {
+		// nothing to push yet
+		return err
+	}
+	_, err = g.git("push", "-q", remote, "refs/heads/"+branch+":refs/heads/"+branch)
+	return err
+}
+
+func (g execGitRepo) addedFiles(from, to string) ([]string, error) {
+	if from == to {
+		return []string{}, nil
+	}
+	out, err := g.git("diff", "--name-only", "-z", "--diff-filter=A", from, to)
+	if err != nil {
+		return nil, err
+	}
+	return splitNul(out), nil
+}
+
+func splitNul(out string) []string {
+	files := []string{}
+	for _, file := range strings.Split(out, "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func (g execGitRepo) DivergedFiles(remote string) (local, remoteFiles []string, err error) {
+	upstream, tip, err := g.upstream(remote)
+	if err != nil || upstream == "" || tip == "" {
+		return nil, nil, err
+	}
+	out, err := g.git("merge-base", tip, upstream)
+	if err != nil {
+		return nil, nil, err
+	}
+	base := strings.TrimSpace(out)
+	if local, err = g.addedFiles(base, tip); err != nil {
+		return nil, nil, err
+	}
+	if remoteFiles, err = g.addedFiles(base, upstream); err != nil {
+		return nil, nil, err
+	}
+	return local, remoteFiles, nil
+}
+
+func (g execGitRepo) Unpushed(remote string) (bool, error) {
+	tip, err := g.resolve("HEAD")
+	if err != nil || tip == "" {
+		return false, err
+	}
+	if remote == "" {
+		return true, nil
+	}
+	upstream, _, err := g.upstream(remote)
+	if err != nil || upstream == "" {
+		return upstream == "", err
+	}
+	out, err := g.git("merge-base", tip, upstream)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) != tip, nil
+}
+
+func (g execGitRepo) FileOrigins(dir string) (map[string]GitCommitInfo, error) {
+	origins := make(map[string]GitCommitInfo)
+	if tip, err := g.resolve("HEAD"); err != nil || tip == "" {
+		return origins, err
+	}
+	out, err := g.git("-c", "core.quotepath=off", "log", "--diff-filter=A", "--name-only",
+		"--format=%x01%H%x09%an <%ae>%x09%at", "HEAD", "--", filepath.ToSlash(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var commit GitCommitInfo
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "\x01") {
+			fields := strings.Split(line[1:], "\t")
+			if len(fields) != 3 {
+				return nil, errors.New("Cannot read the git log of " + g.path)
+			}
+			secs, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			commit = GitCommitInfo{Id: fields[0], Author: fields[1], When: time.Unix(secs, 0)}
+		} else if line != "" {
+			// the log is newest first, so older commits win
+			origins[line] = commit
+		}
+	}
+	return origins, nil
+}
+
+func (g execGitRepo) ReadDirAt(revision, dir string) (map[string][]byte, string, error) {
+	commit, err := g.resolve(revision)
+	if err != nil || commit == "" {
+		return nil, "", unknownRevisionError(g.path, revision)
+	}
+	out, err := g.git("ls-tree", "-z", commit, "--", filepath.ToSlash(dir)+"/")
+	if err != nil {
+		return nil, "", err
+	}
+	files := make(map[string][]byte)
+	for _, entry := range splitNul(out) {
+		// <mode> SP <type> SP <object> TAB <file>
+		parts := strings.SplitN(entry, "\t", 2)
+		fields := strings.Fields(parts[0])
+		if len(parts) != 2 || len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		contents, err := g.git("cat-file", "blob", fields[2])
+		if err != nil {
+			return nil, "", err
+		}
+		files[filepath.Base(parts[1])] = []byte(contents)
+	}
+	return files, commit, nil
+}
+
+func (g execGitRepo) PurgePaths(paths []string) (int, error) {
+	tip, err := g.resolve("HEAD")
+	if err != nil || tip == "" {
+		return 0, err
+	}
+	out, err := g.git("rev-list", "--reverse", "--topo-order", "--parents", "HEAD")
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempDir("", "credulous-purge")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+	index := []string{"GIT_INDEX_FILE=" + filepath.Join(tmp, "index")}
+
+	// old commit ids to their rewritten ones
+	mapped := make(map[string]string)
+	rewritten := 0
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		ids := strings.Fields(line)
+		commit := ids[0]
+		changed := false
+		parents := []string{}
+		for _, parent := range ids[1:] {
+			if mapped[parent] != parent {
+				changed = true
+			}
+			parents = append(parents, "-p", mapped[parent])
+		}
+
+		if _, err = runGit(g.path, index, "", "read-tree", commit); err != nil {
+			return 0, err
+		}
+		rmArgs := append([]string{"rm", "--cached", "--ignore-unmatch", "-q", "--"}, paths...)
+		if _, err = runGit(g.path, index, "", rmArgs...); err != nil {
+			return 0, err
+		}
+		treeOut, err := runGit(g.path, index, "", "write-tree")
+		if err != nil {
+			return 0, err
+		}
+		tree := strings.TrimSpace(treeOut)
+		oldTree, err := g.git("rev-parse", commit+"^{tree}")
+		if err != nil {
+			return 0, err
+		}
+		if tree != strings.TrimSpace(oldTree) {
+			changed = true
+		}
+		if !changed {
+			mapped[commit] = commit
+			continue
+		}
+
+		raw, err := g.git("cat-file", "commit", commit)
+		if err != nil {
+			return 0, err
+		}
+		env, message := commitEnv(raw)
+		newCommit, err := runGit(g.path, env, message, append([]string{"commit-tree", "--no-gpg-sign", tree}, parents...)...)
+		if err != nil {
+			return 0, err
+		}
+		mapped[commit] = strings.TrimSpace(newCommit)
+		rewritten++
+	}
+	if rewritten == 0 {
+		return 0, nil
+	}
+	_, err = g.git("update-ref", "-m", "credulous: purged pruned credentials from history", "HEAD", mapped[tip])
+	return rewritten, err
+}
+
+// commitEnv reads a raw commit, and returns the environment that makes
+// git commit-tree reuse its author and committer, and its message
+func commitEnv(raw string) (env []string, message string) {
+	parts := strings.SplitN(raw, "\n\n", 2)
+	if len(parts) == 2 {
+		message = parts[1]
+	}
+	for _, line := range strings.Split(parts[0], "\n") {
+		var prefix string
+		switch {
+		case strings.HasPrefix(line, "author "):
+			prefix = "GIT_AUTHOR_"
+		case strings.HasPrefix(line, "committer "):
+			prefix = "GIT_COMMITTER_"
+		default:
+			continue
+		}
+		// <role> SP <name> SP <<email>> SP <seconds> SP <zone>
+		ident := line[strings.Index(line, " ")+1:]
+		open, close := strings.Index(ident, "<"), strings.LastIndex(ident, ">")
+		if open < 0 || close < open {
+			continue
+		}
+		env = append(env,
+			prefix+"NAME="+strings.TrimSpace(ident[:open]),
+			prefix+"EMAIL="+ident[open+1:close],
+			prefix+"DATE="+strings.TrimSpace(ident[close+1:]))
+	}
+	return env, message
+}
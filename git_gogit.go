@@ -0,0 +1,913 @@
+//go:build !nogogit
+// +build !nogogit
+
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+)
+
+// the gogit backend is pure Go, so credulous needs neither libgit2 nor
+// a git binary to use it
+type goGitBackend struct{}
+
+type goGitRepo struct {
+	path string
+	repo *git.Repository
+}
+
+func init() {
+	registerGitBackend("gogit", goGitBackend{})
+	// go-git would run git-upload-pack for file:// remotes otherwise
+	client.InstallProtocol("file", goGitFileTransport{server.NewServer(goGitFileLoader{})})
+}
+
+// goGitFileTransport serves file:// remotes in process. go-git's server
+// gives up when asked for a pack by a client that has commits it hasn't,
+// so it's only told about the ones it has.
+type goGitFileTransport struct {
+	transport.Transport
+}
+
+type knownHavesSession struct {
+	transport.UploadPackSession
+	storer storer.EncodedObjectStorer
+}
+
+func (t goGitFileTransport) NewUploadPackSession(endpoint *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	session, err := t.Transport.NewUploadPackSession(endpoint, auth)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := goGitFileLoader{}.Load(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return knownHavesSession{UploadPackSession: session, storer: storage}, nil
+}
+
+func (s knownHavesSession) UploadPack(ctx context.Context, req *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	haves := []plumbing.Hash{}
+	for _, have := range req.Haves {
+		if s.storer.HasEncodedObject(have) == nil {
+			haves = append(haves, have)
+		}
+	}
+	req.Haves = haves
+	return s.UploadPackSession.UploadPack(ctx, req)
+}
+
+// goGitFileLoader finds the repos file:// remotes point at, whether
+// bare or not
+type goGitFileLoader struct{}
+
+func (l goGitFileLoader) Load(endpoint *transport.Endpoint) (storer.Storer, error) {
+	dir := endpoint.Path
+	if _, err := os.Stat(filepath.Join(dir, git.GitDirName)); err == nil {
+		dir = filepath.Join(dir, git.GitDirName)
+	} else if _, err := os.Stat(filepath.Join(dir, "config")); err != nil {
+		return nil, transport.ErrRepositoryNotFound
+	}
+	return filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault()), nil
+}
+
+func (b goGitBackend) IsRepo(repopath string) (bool, error) {
+	repo, err := git.PlainOpen(repopath)
+	if err == git.ErrRepositoryNotExists {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// a bare repo has no working tree to keep credentials in
+	if _, err = repo.Worktree(); err == git.ErrIsBareRepository {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b goGitBackend) Open(repopath string) (GitRepo, error) {
+	repo, err := git.PlainOpen(repopath)
+	if err != nil {
+		return nil, errors.New("Cannot open git repository " + repopath + ": " + err.Error())
+	}
+	return &goGitRepo{path: repopath, repo: repo}, nil
+}
+
+func (b goGitBackend) Init(repopath string, bare bool) (GitRepo, error) {
+	repo, err := git.PlainInit(repopath, bare)
+	if err == git.ErrRepositoryAlreadyExists {
+		// as 'git init' does, leave an existing repo as it is
+		repo, err = git.PlainOpen(repopath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &goGitRepo{path: repopath, repo: repo}, nil
+}
+
+func (b goGitBackend) Clone(url, repopath string) (GitRepo, error) {
+	auth, err := goGitAuth(url)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := git.PlainClone(repopath, false, &git.CloneOptions{URL: url, Auth: auth})
+	if err == transport.ErrEmptyRemoteRepository {
+		// nothing has been shared yet; set up to push the first save
+		if repo, err = git.PlainInit(repopath, false); err != nil {
+			return nil, err
+		}
+		_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{url}})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &goGitRepo{path: repopath, repo: repo}, nil
+}
+
+// goGitAuth authenticates SSH remotes through the user's ssh-agent; go-git
+// checks their host keys against ~/.ssh/known_hosts
+func goGitAuth(url string) (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Protocol != "ssh" {
+		return nil, nil
+	}
+	user := endpoint.User
+	if user == "" {
+		user = "git"
+	}
+	return gitssh.NewSSHAgentAuth(user)
+}
+
+func (g *goGitRepo) remoteAuth(remote string) (transport.AuthMethod, error) {
+	url, err := g.RemoteURL(remote)
+	if err != nil {
+		return nil, err
+	}
+	return goGitAuth(url)
+}
+
+// splitConfigName splits section.key or section.subsection.key
+func splitConfigName(name string) (section, subsection, key string) {
+	first, last := strings.Index(name, "."), strings.LastIndex(name, ".")
+	if first < 0 {
+		return name, "", ""
+	}
+	section, key = name[:first], name[last+1:]
+	if first != last {
+		subsection = name[first+1 : last]
+	}
+	return section, subsection, key
+}
+
+func configOption(raw *config.Config, name string) (string, bool) {
+	section, subsection, key := splitConfigName(name)
+	if !raw.Raw.HasSection(section) {
+		return "", false
+	}
+	options := raw.Raw.Section(section).Options
+	if subsection != "" {
+		if !raw.Raw.Section(section).HasSubsection(subsection) {
+			return "", false
+		}
+		options = raw.Raw.Section(section).Subsection(subsection).Options
+	}
+	if !options.Has(key) {
+		return "", false
+	}
+	return options.Get(key), true
+}
+
+func (g *goGitRepo) Config(name string) (string, error) {
+	local, err := g.repo.Config()
+	if err != nil {
+		return "", err
+	}
+	if value, ok := configOption(local, name); ok {
+		return value, nil
+	}
+	for _, scope := range []config.Scope{config.GlobalScope, config.SystemScope} {
+		conf, err := config.LoadConfig(scope)
+		if err != nil {
+			return "", err
+		}
+		if value, ok := configOption(conf, name); ok {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+func (g *goGitRepo) SetConfig(name, value string) error {
+	conf, err := g.repo.Config()
+	if err != nil {
+		return err
+	}
+	section, subsection, key := splitConfigName(name)
+	if subsection == "" {
+		conf.Raw.Section(section).SetOption(key, value)
+	} else {
+		conf.Raw.Section(section).Subsection(subsection).SetOption(key, value)
+	}
+	return g.repo.SetConfig(conf)
+}
+
+// goGitSigner signs commits with an SSH key, as 'git commit -S' does
+// with gpg.format=ssh
+type goGitSigner struct {
+	key *rsa.PrivateKey
+}
+
+func (s goGitSigner) Sign(message io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(message)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := sshSign(b, GIT_NAMESPACE, s.key)
+	return []byte(signature), err
+}
+
+// signingKey loads the key commits should be signed with, if any
+func (g *goGitRepo) signingKey() (*rsa.PrivateKey, error) {
+	keyfile, err := getSigningKey(g)
+	if err != nil || keyfile == "" {
+		return nil, err
+	}
+	return loadSigningKey(keyfile)
+}
+
+func (g *goGitRepo) Commit(added, removed []string, message string) (string, error) {
+	repoconf, err := getRepoConfig(g)
+	if err != nil {
+		return "", err
+	}
+	worktree, err := g.repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+	for _, filename := range added {
+		if _, err = worktree.Add(filepath.ToSlash(filename)); err != nil {
+			return "", err
+		}
+	}
+
+	if len(removed) > 0 {
+		idx, err := g.repo.Storer.Index()
+		if err != nil {
+			return "", err
+		}
+		for _, filename := range removed {
+			_, err = idx.Remove(filepath.ToSlash(filename))
+			if err != nil && err != index.ErrEntryNotFound {
+				return "", err
+			}
+		}
+		if err = g.repo.Storer.SetIndex(idx); err != nil {
+			return "", err
+		}
+	}
+
+	opts := &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  repoconf.Name,
+			Email: repoconf.Email,
+			When:  time.Now(),
+		},
+		AllowEmptyCommits: true,
+	}
+	key, err := g.signingKey()
+	if err != nil {
+		return "", err
+	}
+	if key != nil {
+		opts.Signer = goGitSigner{key: key}
+	}
+	commit, err := worktree.Commit(message, opts)
+	if err != nil {
+		return "", err
+	}
+	return commit.String(), nil
+}
+
+func (g *goGitRepo) SetRemote(name, url string) error {
+	remote, err := g.repo.Remote(name)
+	if err == git.ErrRemoteNotFound {
+		_, err = g.repo.CreateRemote(&config.RemoteConfig{Name: name, URLs: []string{url}})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	conf, err := g.repo.Config()
+	if err != nil {
+		return err
+	}
+	conf.Remotes[remote.Config().Name].URLs = []string{url}
+	return g.repo.SetConfig(conf)
+}
+
+func (g *goGitRepo) RemoteURL(name string) (string, error) {
+	remote, err := g.repo.Remote(name)
+	if err != nil {
+		return "", err
+	}
+	urls := remote.Config().URLs
+	if len(urls) == 0 {
+		return "", errors.New("Remote " + name + " has no URL")
+	}
+	return urls[0], nil
+}
+
+func (g *goGitRepo) Fetch(remote string) error {
+	auth, err := g.remoteAuth(remote)
+	if err != nil {
+		return err
+	}
+	err = g.repo.Fetch(&git.FetchOptions{RemoteName: remote, Auth: auth})
+	if err == git.NoErrAlreadyUpToDate || err == transport.ErrEmptyRemoteRepository {
+		return nil
+	}
+	return err
+}
+
+// branch returns the name of the branch HEAD points at, and its tip,
+// which is nil until something has been committed
+func (g *goGitRepo) branch() (plumbing.ReferenceName, *object.Commit, error) {
+	head, err := g.repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return "", nil, err
+	}
+	name := head.Target()
+	ref, err := g.repo.Storer.Reference(name)
+	if err == plumbing.ErrReferenceNotFound {
+		return name, nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	tip, err := g.repo.CommitObject(ref.Hash())
+	return name, tip, err
+}
+
+// upstream returns the remote's copy of the current branch, if it has one
+func (g *goGitRepo) upstream(remote string, branch plumbing.ReferenceName) (*object.Commit, error) {
+	ref, err := g.repo.Storer.Reference(plumbing.NewRemoteReferenceName(remote, branch.Short()))
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g.repo.CommitObject(ref.Hash())
+}
+
+func mergeBase(a, b *object.Commit) (*object.Commit, error) {
+	bases, err := a.MergeBase(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) == 0 {
+		return nil, errors.New("Local and remote copies have no commits in common")
+	}
+	return bases[0], nil
+}
+
+// moveBranch points the branch at commit, and checks it out, refusing if
+// that would throw away changes to tracked files, as git rebase does
+func (g *goGitRepo) moveBranch(branch plumbing.ReferenceName, commit plumbing.Hash) error {
+	worktree, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return err
+	}
+	for _, file := range status {
+		if file.Worktree != git.Untracked || file.Staging != git.Untracked {
+			return uncommittedChangesError(g.path)
+		}
+	}
+	if err := g.repo.Storer.SetReference(plumbing.NewHashReference(branch, commit)); err != nil {
+		return err
+	}
+	return worktree.Reset(&git.ResetOptions{Commit: commit, Mode: git.HardReset})
+}
+
+func (g *goGitRepo) Rebase(remote string) error {
+	branch, local, err := g.branch()
+	if err != nil {
+		return err
+	}
+	upstream, err := g.upstream(remote, branch)
+	if err != nil || upstream == nil {
+		// the remote is empty, or hasn't got our branch yet
+		return err
+	}
+	if local == nil {
+		// nothing local yet, so just take what the remote has
+		return g.moveBranch(branch, upstream.Hash)
+	}
+	if local.Hash == upstream.Hash {
+		return nil
+	}
+	base, err := mergeBase(local, upstream)
+	if err != nil {
+		return err
+	}
+	switch base.Hash {
+	case upstream.Hash:
+		// we're ahead of the remote; nothing to pull
+		return nil
+	case local.Hash:
+		// we're behind the remote; fast-forward
+		return g.moveBranch(branch, upstream.Hash)
+	}
+
+	// replay our commits since the merge base, oldest first
+	replay := []*object.Commit{}
+	for commit := local; commit.Hash != base.Hash; {
+		if commit.NumParents() == 0 {
+			return rebaseConflictError(g.path)
+		}
+		replay = append([]*object.Commit{commit}, replay...)
+		if commit, err = commit.Parent(0); err != nil {
+			return err
+		}
+	}
+	key, err := g.signingKey()
+	if err != nil {
+		return err
+	}
+	tip := upstream
+	for _, commit := range replay {
+		if tip, err = g.replayCommit(commit, tip, key); err != nil {
+			return err
+		}
+	}
+	return g.moveBranch(branch, tip.Hash)
+}
+
+// replayCommit applies the changes one commit made to its first parent on
+// top of onto, and returns the new commit. Changes already made upstream
+// are skipped, e.g. where someone resolved the same concurrent saves.
+func (g *goGitRepo) replayCommit(commit, onto *object.Commit, key *rsa.PrivateKey) (*object.Commit, error) {
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return nil, err
+	}
+	from, err := parent.Tree()
+	if err != nil {
+		return nil, err
+	}
+	to, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	current, err := onto.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTree(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	edits := make(map[string]*object.TreeEntry)
+	for _, change := range changes {
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		want := treeEntryAt(to, name)
+		have := treeEntryAt(current, name)
+		if sameTreeEntry(have, want) {
+			continue
+		}
+		if !sameTreeEntry(have, treeEntryAt(from, name)) {
+			return nil, rebaseConflictError(g.path)
+		}
+		edits[name] = want
+	}
+	if len(edits) == 0 {
+		return onto, nil
+	}
+
+	tree, err := editTree(g.repo.Storer, current, edits)
+	if err != nil {
+		return nil, err
+	}
+	replayed := &object.Commit{
+		Author:       commit.Author,
+		Committer:    commit.Committer,
+		Message:      commit.Message,
+		TreeHash:     tree,
+		ParentHashes: []plumbing.Hash{onto.Hash},
+	}
+	hash, err := storeCommit(g.repo.Storer, replayed, key)
+	if err != nil {
+		return nil, err
+	}
+	return g.repo.CommitObject(hash)
+}
+
+func treeEntryAt(tree *object.Tree, name string) *object.TreeEntry {
+	entry, err := tree.FindEntry(name)
+	if err != nil {
+		return nil
+	}
+	return entry
+}
+
+func sameTreeEntry(a, b *object.TreeEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Hash == b.Hash && a.Mode == b.Mode
+}
+
+// storeCommit writes a commit object, signed if there's a key
+func storeCommit(s storer.EncodedObjectStorer, commit *object.Commit, key *rsa.PrivateKey) (plumbing.Hash, error) {
+	if key != nil {
+		unsigned := s.NewEncodedObject()
+		if err := commit.EncodeWithoutSignature(unsigned); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		reader, err := unsigned.Reader()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		signature, err := goGitSigner{key: key}.Sign(reader)
+		reader.Close()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		commit.PGPSignature = string(signature)
+	}
+	obj := s.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+// editTree writes a copy of tree (which may be nil, for the empty tree)
+// with the entries at the given paths replaced, or removed where the
+// entry is nil, and returns the new tree's id. Directories left empty
+// are dropped, as git does.
+func editTree(s storer.EncodedObjectStorer, tree *object.Tree, edits map[string]*object.TreeEntry) (plumbing.Hash, error) {
+	entries := make(map[string]object.TreeEntry)
+	if tree != nil {
+		for _, entry := range tree.Entries {
+			entries[entry.Name] = entry
+		}
+	}
+
+	// edits for files in subdirectories, by subdirectory
+	subedits := make(map[string]map[string]*object.TreeEntry)
+	for name, entry := range edits {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) == 1 {
+			if entry == nil {
+				delete(entries, name)
+			} else {
+				entries[name] = object.TreeEntry{Name: name, Mode: entry.Mode, Hash: entry.Hash}
+			}
+			continue
+		}
+		if subedits[parts[0]] == nil {
+			subedits[parts[0]] = make(map[string]*object.TreeEntry)
+		}
+		subedits[parts[0]][parts[1]] = entry
+	}
+	for dir, dirEdits := range subedits {
+		var subtree *object.Tree
+		if entry, ok := entries[dir]; ok && entry.Mode == filemode.Dir {
+			var err error
+			if subtree, err = object.GetTree(s, entry.Hash); err != nil {
+				return plumbing.ZeroHash, err
+			}
+		}
+		hash, err := editTree(s, subtree, dirEdits)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if hash == emptyTreeHash {
+			delete(entries, dir)
+		} else {
+			entries[dir] = object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: hash}
+		}
+	}
+
+	edited := &object.Tree{}
+	for _, entry := range entries {
+		edited.Entries = append(edited.Entries, entry)
+	}
+	sort.Sort(byGitTreeOrder(edited.Entries))
+	obj := s.NewEncodedObject()
+	if err := edited.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+var emptyTreeHash = plumbing.NewHash("4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+
+// byGitTreeOrder sorts tree entries as git does, with directories
+// compared as though their names ended in a slash
+type byGitTreeOrder []object.TreeEntry
+
+func (t byGitTreeOrder) Len() int      { return len(t) }
+func (t byGitTreeOrder) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t byGitTreeOrder) Less(i, j int) bool {
+	return gitTreeSortName(t[i]) < gitTreeSortName(t[j])
+}
+
+func gitTreeSortName(entry object.TreeEntry) string {
+	if entry.Mode == filemode.Dir {
+		return entry.Name + "/"
+	}
+	return entry.Name
+}
+
+func (g *goGitRepo) Push(remote string) error {
+	branch, local, err := g.branch()
+	if err != nil || local == nil {
+		// nothing to push yet
+		return err
+	}
+	auth, err := g.remoteAuth(remote)
+	if err != nil {
+		return err
+	}
+	refspec := config.RefSpec(branch.String() + ":" + branch.String())
+	err = g.repo.Push(&git.PushOptions{RemoteName: remote, RefSpecs: []config.RefSpec{refspec}, Auth: auth})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+// addedFiles lists the files in one commit's tree that aren't in the
+// other's, which may be nil for the empty tree
+func addedFiles(from, to *object.Commit) ([]string, error) {
+	added := []string{}
+	var fromTree *object.Tree
+	if from != nil {
+		if from.Hash == to.Hash {
+			return added, nil
+		}
+		var err error
+		if fromTree, err = from.Tree(); err != nil {
+			return nil, err
+		}
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return nil, err
+		}
+		if action == merkletrie.Insert {
+			added = append(added, change.To.Name)
+		}
+	}
+	return added, nil
+}
+
+func (g *goGitRepo) DivergedFiles(remote string) (local, remoteFiles []string, err error) {
+	branch, tip, err := g.branch()
+	if err != nil || tip == nil {
+		return nil, nil, err
+	}
+	upstream, err := g.upstream(remote, branch)
+	if err != nil || upstream == nil {
+		return nil, nil, err
+	}
+	base, err := mergeBase(tip, upstream)
+	if err != nil {
+		return nil, nil, err
+	}
+	if local, err = addedFiles(base, tip); err != nil {
+		return nil, nil, err
+	}
+	if remoteFiles, err = addedFiles(base, upstream); err != nil {
+		return nil, nil, err
+	}
+	return local, remoteFiles, nil
+}
+
+func (g *goGitRepo) Unpushed(remote string) (bool, error) {
+	branch, tip, err := g.branch()
+	if err != nil || tip == nil {
+		return false, err
+	}
+	if remote == "" {
+		return true, nil
+	}
+	upstream, err := g.upstream(remote, branch)
+	if err != nil || upstream == nil {
+		return upstream == nil, err
+	}
+	base, err := mergeBase(tip, upstream)
+	if err != nil {
+		return false, err
+	}
+	return base.Hash != tip.Hash, nil
+}
+
+func (g *goGitRepo) FileOrigins(dir string) (map[string]GitCommitInfo, error) {
+	origins := make(map[string]GitCommitInfo)
+	_, tip, err := g.branch()
+	if err != nil || tip == nil {
+		return origins, err
+	}
+	commits, err := g.repo.Log(&git.LogOptions{From: tip.Hash, Order: git.LogOrderCommitterTime})
+	if err != nil {
+		return nil, err
+	}
+	defer commits.Close()
+
+	prefix := filepath.ToSlash(dir) + "/"
+	err = commits.ForEach(func(commit *object.Commit) error {
+		var parent *object.Commit
+		if commit.NumParents() > 0 {
+			var err error
+			if parent, err = commit.Parent(0); err != nil {
+				return err
+			}
+		}
+		added, err := addedFiles(parent, commit)
+		if err != nil {
+			return err
+		}
+		for _, file := range added {
+			// we're walking newest first, so older commits win
+			if strings.HasPrefix(file, prefix) {
+				origins[file] = GitCommitInfo{
+					Id:     commit.Hash.String(),
+					Author: commit.Author.Name + " <" + commit.Author.Email + ">",
+					When:   commit.Author.When,
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return origins, nil
+}
+
+func (g *goGitRepo) ReadDirAt(revision, dir string) (map[string][]byte, string, error) {
+	hash, err := g.repo.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, "", unknownRevisionError(g.path, revision)
+	}
+	commit, err := g.repo.CommitObject(*hash)
+	if err != nil {
+		return nil, "", unknownRevisionError(g.path, revision)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, "", err
+	}
+
+	files := make(map[string][]byte)
+	subtree, err := tree.Tree(filepath.ToSlash(dir))
+	if err == object.ErrDirectoryNotFound {
+		// nothing had been saved there yet
+		return files, commit.Hash.String(), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range subtree.Entries {
+		entry := &subtree.Entries[i]
+		if !entry.Mode.IsFile() {
+			continue
+		}
+		file, err := subtree.TreeEntryFile(entry)
+		if err != nil {
+			return nil, "", err
+		}
+		contents, err := file.Contents()
+		if err != nil {
+			return nil, "", err
+		}
+		files[entry.Name] = []byte(contents)
+	}
+	return files, commit.Hash.String(), nil
+}
+
+func (g *goGitRepo) PurgePaths(paths []string) (int, error) {
+	branch, tip, err := g.branch()
+	if err != nil || tip == nil {
+		return 0, err
+	}
+	edits := make(map[string]*object.TreeEntry)
+	for _, purged := range paths {
+		edits[path.Clean(purged)] = nil
+	}
+
+	// old commit ids to their rewritten ones
+	mapped := make(map[plumbing.Hash]plumbing.Hash)
+	rewritten := 0
+	var purge func(commit *object.Commit) (plumbing.Hash, error)
+	purge = func(commit *object.Commit) (plumbing.Hash, error) {
+		if newId, ok := mapped[commit.Hash]; ok {
+			return newId, nil
+		}
+		changed := false
+		parents := []plumbing.Hash{}
+		for _, parentId := range commit.ParentHashes {
+			parent, err := g.repo.CommitObject(parentId)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			newId, err := purge(parent)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			changed = changed || newId != parentId
+			parents = append(parents, newId)
+		}
+
+		treeId := commit.TreeHash
+		tree, err := commit.Tree()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		for name := range edits {
+			if treeEntryAt(tree, name) != nil {
+				if treeId, err = editTree(g.repo.Storer, tree, edits); err != nil {
+					return plumbing.ZeroHash, err
+				}
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			mapped[commit.Hash] = commit.Hash
+			return commit.Hash, nil
+		}
+
+		purged := &object.Commit{
+			Author:       commit.Author,
+			Committer:    commit.Committer,
+			Message:      commit.Message,
+			TreeHash:     treeId,
+			ParentHashes: parents,
+		}
+		newId, err := storeCommit(g.repo.Storer, purged, nil)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		mapped[commit.Hash] = newId
+		rewritten++
+		return newId, nil
+	}
+
+	newTip, err := purge(tip)
+	if err != nil || rewritten == 0 {
+		return 0, err
+	}
+	return rewritten, g.repo.Storer.SetReference(plumbing.NewHashReference(branch, newTip))
+}
@@ -2,12 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"testing"
 
-	"github.com/libgit2/git2go"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -16,23 +16,23 @@ func TestGitAdd(t *testing.T) {
 	repopath := path.Join("testrepo." + fmt.Sprintf("%d", os.Getpid()))
 
 	// need to create a new repo first
-	repo, err := git.InitRepository(repopath, false)
-	panic_the_err(err)
-	defer os.RemoveAll(path.Clean(path.Join(repo.Path(), "..")))
+	panic_the_err(gitInit(repopath))
+	defer os.RemoveAll(repopath)
 
 	// Need to add some basic config so that tests will pass
-	config, _ := repo.Config()
-	_ = config.SetString("user.name", "Test User")
-	_ = config.SetString("user.email", "test.user@nowhere")
+	repo, err := openGitRepo(repopath)
+	panic_the_err(err)
+	_ = repo.SetConfig("user.name", "Test User")
+	_ = repo.SetConfig("user.email", "test.user@nowhere")
 
 	Convey("Testing gitAdd", t, func() {
 		Convey("Test add to non-existent repository", func() {
-			_, err := gitAddCommitFile("/no/such/repo", "testdata/newcreds.json", "message")
+			_, err := gitCommitPaths("/no/such/repo", []string{"testdata/newcreds.json"}, nil, "message")
 			So(err, ShouldNotEqual, nil)
 		})
 
 		Convey("Test add non-existent file to a repo", func() {
-			_, err := gitAddCommitFile(repo.Path(), "/no/such/file", "message")
+			_, err := gitCommitPaths(repopath, []string{"/no/such/file"}, nil, "message")
 			// fmt.Println("gitAdd returned " + fmt.Sprintf("%s", err))
 			So(err, ShouldNotEqual, nil)
 		})
@@ -41,7 +41,7 @@ func TestGitAdd(t *testing.T) {
 			fp, _ := os.Create(path.Join(repopath, "testfile"))
 			_, _ = fp.WriteString("A test string")
 			_ = fp.Close()
-			commitId, err := gitAddCommitFile(repo.Path(), "testfile", "first commit")
+			commitId, err := gitCommitPaths(repopath, []string{"testfile"}, nil, "first commit")
 			So(err, ShouldEqual, nil)
 			So(commitId, ShouldNotEqual, nil)
 			So(commitId, ShouldNotBeBlank)
@@ -51,7 +51,7 @@ func TestGitAdd(t *testing.T) {
 			fp, _ := os.Create(path.Join(repopath, "testfile"))
 			_, _ = fp.WriteString("A second test string")
 			_ = fp.Close()
-			commitId, err := gitAddCommitFile(repo.Path(), "testfile", "second commit")
+			commitId, err := gitCommitPaths(repopath, []string{"testfile"}, nil, "second commit")
 			So(err, ShouldEqual, nil)
 			So(commitId, ShouldNotEqual, nil)
 			So(commitId, ShouldNotBeBlank)
@@ -72,3 +72,127 @@ func TestGitAdd(t *testing.T) {
 
 	})
 }
+
+// withGitBackend runs f with CREDULOUS_GIT_BACKEND set to name
+func withGitBackend(name string, f func()) {
+	old := os.Getenv(GIT_BACKEND_ENV)
+	os.Setenv(GIT_BACKEND_ENV, name)
+	defer os.Setenv(GIT_BACKEND_ENV, old)
+	f()
+}
+
+func TestGitBackends(t *testing.T) {
+	for _, name := range gitBackendNames() {
+		withGitBackend(name, func() {
+			Convey("Test the "+name+" git backend", t, func() {
+				tmp, err := ioutil.TempDir("", "credulous-git")
+				So(err, ShouldEqual, nil)
+				defer os.RemoveAll(tmp)
+
+				remote := filepath.Join(tmp, "remote.git")
+				So(initBareTestRepo(remote), ShouldEqual, nil)
+				alice := filepath.Join(tmp, "alice")
+				bob := filepath.Join(tmp, "bob")
+				for _, repo := range []string{alice, bob} {
+					initTestRepo(repo)
+					So(setSyncRemote(repo, "origin", "file://"+remote), ShouldEqual, nil)
+				}
+
+				Convey("Config values are read back, or empty if unset", func() {
+					repo, err := openGitRepo(alice)
+					So(err, ShouldEqual, nil)
+					value, err := repo.Config("credulous.nosuch")
+					So(err, ShouldEqual, nil)
+					So(value, ShouldEqual, "")
+					url, err := repo.Config("remote.origin.url")
+					So(err, ShouldEqual, nil)
+					So(url, ShouldEqual, "file://"+remote)
+					So(repo.SetRemote("mirror", "file:///elsewhere"), ShouldEqual, nil)
+					So(repo.SetRemote("mirror", "file:///mirror"), ShouldEqual, nil)
+					url, err = repo.RemoteURL("mirror")
+					So(err, ShouldEqual, nil)
+					So(url, ShouldEqual, "file:///mirror")
+				})
+
+				addTestFile(alice, "acct/alice/1-aaaa.json", "first")
+				So(gitPush(alice, "origin"), ShouldEqual, nil)
+				So(gitFetch(bob, "origin"), ShouldEqual, nil)
+				So(gitRebase(bob, "origin"), ShouldEqual, nil)
+				So(fileExists(filepath.Join(bob, "acct/alice/1-aaaa.json")), ShouldBeTrue)
+
+				Convey("Diverged repos are replayed onto each other", func() {
+					addTestFile(alice, "acct/alice/2-aaaa.json", "from alice")
+					addTestFile(bob, "acct/bob/2-bbbb.json", "from bob")
+					So(gitPush(alice, "origin"), ShouldEqual, nil)
+					So(gitFetch(bob, "origin"), ShouldEqual, nil)
+
+					local, theirs, err := gitDivergedFiles(bob, "origin")
+					So(err, ShouldEqual, nil)
+					So(local, ShouldResemble, []string{"acct/bob/2-bbbb.json"})
+					So(theirs, ShouldResemble, []string{"acct/alice/2-aaaa.json"})
+
+					So(gitRebase(bob, "origin"), ShouldEqual, nil)
+					So(fileExists(filepath.Join(bob, "acct/alice/2-aaaa.json")), ShouldBeTrue)
+					So(fileExists(filepath.Join(bob, "acct/bob/2-bbbb.json")), ShouldBeTrue)
+					So(gitPush(bob, "origin"), ShouldEqual, nil)
+				})
+
+				Convey("Conflicting changes are refused", func() {
+					addTestFile(alice, "acct/alice/1-aaaa.json", "edited by alice")
+					addTestFile(bob, "acct/alice/1-aaaa.json", "edited by bob")
+					So(gitPush(alice, "origin"), ShouldEqual, nil)
+					So(gitFetch(bob, "origin"), ShouldEqual, nil)
+					err := gitRebase(bob, "origin")
+					So(err.Error(), ShouldEqual, "Cannot sync: local changes conflict with the remote; please resolve them with git in "+bob)
+				})
+
+				Convey("Uncommitted changes are not thrown away", func() {
+					addTestFile(alice, "acct/alice/2-aaaa.json", "from alice")
+					So(gitPush(alice, "origin"), ShouldEqual, nil)
+					So(gitFetch(bob, "origin"), ShouldEqual, nil)
+					edited := filepath.Join(bob, "acct/alice/1-aaaa.json")
+					So(ioutil.WriteFile(edited, []byte("edited by bob"), 0600), ShouldEqual, nil)
+
+					err := gitRebase(bob, "origin")
+					So(err, ShouldResemble, uncommittedChangesError(bob))
+					b, err := ioutil.ReadFile(edited)
+					So(err, ShouldEqual, nil)
+					So(string(b), ShouldEqual, "edited by bob")
+					So(fileExists(filepath.Join(bob, "acct/alice/2-aaaa.json")), ShouldBeFalse)
+
+					// files git doesn't know about are no reason to refuse
+					So(ioutil.WriteFile(edited, []byte("first"), 0600), ShouldEqual, nil)
+					So(ioutil.WriteFile(filepath.Join(bob, "notes.txt"), []byte("x"), 0600), ShouldEqual, nil)
+					So(gitRebase(bob, "origin"), ShouldEqual, nil)
+					So(fileExists(filepath.Join(bob, "acct/alice/2-aaaa.json")), ShouldBeTrue)
+				})
+
+				Convey("Files are read as of earlier commits, and can be purged", func() {
+					first, err := gitCommitPaths(alice, []string{"acct/alice/1-aaaa.json"}, nil, "no change")
+					So(err, ShouldEqual, nil)
+					addTestFile(alice, "acct/alice/2-aaaa.json", "second")
+
+					files, commitId, err := gitReadDirAt(alice, first, "acct/alice")
+					So(err, ShouldEqual, nil)
+					So(commitId, ShouldEqual, first)
+					So(files, ShouldResemble, map[string][]byte{"1-aaaa.json": []byte("first")})
+					_, _, err = gitReadDirAt(alice, "nosuchrevision", "acct/alice")
+					So(err.Error(), ShouldEqual, "Unknown revision 'nosuchrevision' in "+alice)
+
+					origins, err := gitFileOrigins(alice, "acct/alice")
+					So(err, ShouldEqual, nil)
+					So(len(origins), ShouldEqual, 2)
+					So(origins["acct/alice/1-aaaa.json"].Author, ShouldEqual, "Test User <test.user@nowhere>")
+
+					rewritten, err := gitPurgePaths(alice, []string{"acct/alice/1-aaaa.json"})
+					So(err, ShouldEqual, nil)
+					So(rewritten, ShouldEqual, 3)
+					origins, err = gitFileOrigins(alice, "acct/alice")
+					So(err, ShouldEqual, nil)
+					So(len(origins), ShouldEqual, 1)
+					So(fileExists(filepath.Join(alice, "acct/alice/2-aaaa.json")), ShouldBeTrue)
+				})
+			})
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CredentialVersion describes one saved credential file for an identity,
+// without decrypting it
+type CredentialVersion struct {
+	// Number counts back from the newest, which is 0
+	Number     int
+	Name       string
+	CreateTime int64
+	KeySuffix  string
+	Current    bool
+	Superseded bool
+	// Commit and Author are those of the commit that added the file,
+	// if the repo is in git
+	Commit     string
+	Author     string
+	Recipients []string
+}
+
+// VersionData is the contents of a credential file picked out of the
+// history, and its signature if it has one
+type VersionData struct {
+	Name string
+	Data []byte
+	Sig  []byte
+	// Commit is set if the file came from git history rather than disk
+	Commit string
+}
+
+func credentialRecipients(b []byte) []string {
+	_, recipients, err := readCredentialMetadata(b)
+	if err != nil {
+		return nil
+	}
+	return recipients
+}
+
+// credentialHistory lists every credential file saved for an identity,
+// newest first, including those that have been superseded
+func credentialHistory(repo, account, username string) ([]CredentialVersion, error) {
+	store, err := openStore(repo)
+	if err != nil {
+		return nil, err
+	}
+	names, err := store.History(account, username)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []CredentialVersion{}
+	for _, name := range names {
+		superseded := strings.HasSuffix(name, SUPERSEDED_SUFFIX)
+		created, suffix, err := parseCredentialFilename(strings.TrimSuffix(name, SUPERSEDED_SUFFIX))
+		if err != nil {
+			continue
+		}
+		file, err := store.Get(account, username, name)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, CredentialVersion{
+			Name:       name,
+			CreateTime: created,
+			KeySuffix:  suffix,
+			Superseded: superseded,
+			Recipients: credentialRecipients(file.Data),
+		})
+	}
+	if len(versions) == 0 {
+		return nil, errors.New("No credentials have been saved for " + username + "@" + account)
+	}
+	sort.Sort(sort.Reverse(byCreateTime(versions)))
+
+	pointer, _ := store.Current(account, username)
+	current, _ := currentName(username+"@"+account, names, pointer)
+	for i := range versions {
+		versions[i].Number = i
+		versions[i].Current = versions[i].Name == current
+	}
+
+	isrepo, err := isGitRepo(repo)
+	if err != nil || !isrepo {
+		return versions, err
+	}
+	origins, err := gitFileOrigins(repo, filepath.Join(account, username))
+	if err != nil {
+		return nil, err
+	}
+	for i, version := range versions {
+		// a superseded file was added under its original name
+		name := strings.TrimSuffix(version.Name, SUPERSEDED_SUFFIX)
+		origin, ok := origins[filepath.ToSlash(filepath.Join(account, username, name))]
+		if !ok {
+			origin = origins[filepath.ToSlash(filepath.Join(account, username, version.Name))]
+		}
+		versions[i].Commit = origin.Id
+		versions[i].Author = origin.Author
+	}
+	return versions, nil
+}
+
+type byCreateTime []CredentialVersion
+
+func (v byCreateTime) Len() int      { return len(v) }
+func (v byCreateTime) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v byCreateTime) Less(i, j int) bool {
+	if v[i].CreateTime == v[j].CreateTime {
+		return v[i].Name < v[j].Name
+	}
+	return v[i].CreateTime < v[j].CreateTime
+}
+
+// isVersionNumber tells history numbers from (abbreviated) commit ids,
+// which are never shorter than seven characters
+func isVersionNumber(version string) bool {
+	_, err := strconv.Atoi(version)
+	return err == nil && len(version) < 7
+}
+
+// findCredentialVersion picks out a credential file by its number in the
+// history, or as it stood at a git revision
+func findCredentialVersion(repo, account, username, version string) (VersionData, error) {
+	name := username + "@" + account
+	if isVersionNumber(version) {
+		n, _ := strconv.Atoi(version)
+		history, err := credentialHistory(repo, account, username)
+		if err != nil {
+			return VersionData{}, err
+		}
+		if n < 0 || n >= len(history) {
+			return VersionData{}, fmt.Errorf("No version %d of %s; see 'credulous history %s'", n, name, name)
+		}
+		store, err := openStore(repo)
+		if err != nil {
+			return VersionData{}, err
+		}
+		file, err := store.Get(account, username, history[n].Name)
+		if err != nil {
+			return VersionData{}, err
+		}
+		return VersionData{Name: file.Name, Data: file.Data, Sig: file.Sig}, nil
+	}
+
+	isrepo, err := isGitRepo(repo)
+	if err != nil {
+		return VersionData{}, err
+	}
+	if !isrepo {
+		return VersionData{}, errors.New(repo + " is not a git repository, so versions can only be numbers from 'credulous history'")
+	}
+	files, commit, err := gitReadDirAt(repo, version, filepath.Join(account, username))
+	if err != nil {
+		return VersionData{}, err
+	}
+	names := []string{}
+	for filename := range files {
+		names = append(names, filename)
+	}
+	latest, err := latestName(name, names)
+	if err == noSavedCredentialsError {
+		return VersionData{}, errors.New("No credentials had been saved for " + name + " as of " + version)
+	}
+	if err != nil {
+		return VersionData{}, err
+	}
+	return VersionData{Name: latest, Data: files[latest], Sig: files[latest+SIGNATURE_SUFFIX], Commit: commit}, nil
+}
+
+// RetrieveCredentialVersion is RetrieveCredentials for an earlier
+// version of the credentials
+func RetrieveCredentialVersion(repo, account, username, version, keyfile string) (Credentials, error) {
+	found, err := findCredentialVersion(repo, account, username, version)
+	if err != nil {
+		return Credentials{}, err
+	}
+	policy, err := signaturePolicy(repo)
+	if err != nil {
+		return Credentials{}, err
+	}
+	if err = verifyCredentialData(found.Name, found.Data, found.Sig, policy); err != nil {
+		return Credentials{}, err
+	}
+	creds, err := decodeCredentialData(found.Data, keyfile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return *creds, nil
+}
+
+// restoreCredentials makes an earlier version the current credential
+// again: it is brought back if it was superseded or has since been
+// deleted, anything saved after it is superseded, and the identity is
+// pointed at it
+func restoreCredentials(repo, account, username, version string) (restored string, err error) {
+	if !isDiskRepo(repo) {
+		return "", errors.New(repo + " is not a repository on disk; earlier versions can be sourced from it, but not restored")
+	}
+	unlock, err := lockRepo(repo)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	found, err := findCredentialVersion(repo, account, username, version)
+	if err != nil {
+		return "", err
+	}
+	identity := filepath.Join(account, username)
+	dir := filepath.Join(repo, identity)
+	restored = strings.TrimSuffix(found.Name, SUPERSEDED_SUFFIX)
+
+	added, removed := []string{}, []string{}
+	if _, err := os.Stat(filepath.Join(dir, restored)); os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(dir, restored+SUPERSEDED_SUFFIX)); err == nil {
+			a, r, err := renameWithSignature(repo, filepath.Join(identity, restored+SUPERSEDED_SUFFIX), filepath.Join(identity, restored))
+			if err != nil {
+				return "", err
+			}
+			added, removed = append(added, a...), append(removed, r...)
+		} else {
+			// it only survives in git history
+			if err = os.MkdirAll(dir, 0700); err != nil {
+				return "", err
+			}
+			if err = writeFileAtomic(filepath.Join(dir, restored), found.Data, 0600); err != nil {
+				return "", err
+			}
+			added = append(added, filepath.Join(identity, restored))
+			if found.Sig != nil {
+				if err = writeFileAtomic(filepath.Join(dir, restored+SIGNATURE_SUFFIX), found.Sig, 0600); err != nil {
+					return "", err
+				}
+				added = append(added, filepath.Join(identity, restored+SIGNATURE_SUFFIX))
+			}
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	superseded := []string{}
+	for _, entry := range entries {
+		if _, err := credentialCreated(entry.Name()); err != nil || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		if !newerCredential(entry.Name(), restored) {
+			continue
+		}
+		file := filepath.Join(identity, entry.Name())
+		a, r, err := renameWithSignature(repo, file, file+SUPERSEDED_SUFFIX)
+		if err != nil {
+			return "", err
+		}
+		added, removed = append(added, a...), append(removed, r...)
+		superseded = append(superseded, entry.Name())
+	}
+	if len(added) == 0 {
+		if current, _ := storedCurrentName(fsStore{root: repo}, account, username); current == restored {
+			return "", errors.New(restored + " is already the current credential for " + username + "@" + account)
+		}
+	}
+	if err = setCurrentPointer(repo, account, username, restored); err != nil {
+		return "", err
+	}
+
+	isrepo, err := isGitRepo(repo)
+	if err != nil || !isrepo || len(added) == 0 {
+		return restored, err
+	}
+	message := fmt.Sprintf("Restored credentials for %s@%s\n\nRestored %s.\n", username, account, restored)
+	if len(superseded) > 0 {
+		message += "Superseded " + strings.Join(superseded, ", ") + ".\n"
+	}
+	_, err = gitCommitPaths(repo, added, removed, message)
+	return restored, err
+}
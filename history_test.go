@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+// saveTestVersions saves a user's credentials, then rotates and saves
+// them again, returning the key ids oldest first
+func saveTestVersions(fake *FakeIAM, repo, username string, count int) []string {
+	pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+	panic_the_err(err)
+	keyId, secret := fake.AddUser(username)
+	cred := Credential{KeyId: keyId, SecretKey: secret}
+	keyIds := []string{}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			panic_the_err((&cred).rotateCredentials(username))
+		}
+		panic_the_err(SaveCredentials(SaveData{cred: cred, pubkeys: []ssh.PublicKey{pubkey}, repo: repo}))
+		keyIds = append(keyIds, cred.KeyId)
+	}
+	return keyIds
+}
+
+func TestCredentialHistory(t *testing.T) {
+	Convey("Test listing and restoring earlier credentials", t, func() {
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		repo, err := ioutil.TempDir("", "credulous-history")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(repo)
+
+		keyIds := saveTestVersions(fake, repo, "bob", 3)
+
+		history, err := credentialHistory(repo, "test-alias", "bob")
+		So(err, ShouldEqual, nil)
+		So(len(history), ShouldEqual, 3)
+		So(history[0].Number, ShouldEqual, 0)
+		So(history[0].KeySuffix, ShouldEqual, keyIds[2][12:])
+		So(history[0].Current, ShouldBeTrue)
+		So(history[2].KeySuffix, ShouldEqual, keyIds[0][12:])
+		So(history[2].Current, ShouldBeFalse)
+		So(history[0].Recipients, ShouldResemble, []string{"c0:61:84:fc:e8:c9:52:dc:cd:a9:8e:82:a2:70:0a:30"})
+
+		Convey("Earlier versions can be sourced by number", func() {
+			creds, err := RetrieveCredentialVersion(repo, "test-alias", "bob", "1", "testdata/testkey")
+			So(err, ShouldEqual, nil)
+			So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, keyIds[1])
+
+			_, err = RetrieveCredentialVersion(repo, "test-alias", "bob", "3", "testdata/testkey")
+			So(err.Error(), ShouldEqual, "No version 3 of bob@test-alias; see 'credulous history bob@test-alias'")
+		})
+
+		Convey("Commits need a git repository", func() {
+			_, err := RetrieveCredentialVersion(repo, "test-alias", "bob", "deadbeef", "testdata/testkey")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Restoring supersedes everything newer", func() {
+			restored, err := restoreCredentials(repo, "test-alias", "bob", "2")
+			So(err, ShouldEqual, nil)
+			So(restored, ShouldEqual, history[2].Name)
+
+			creds, err := RetrieveCredentials(repo, "test-alias", "bob", "testdata/testkey")
+			So(err, ShouldEqual, nil)
+			So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, keyIds[0])
+
+			history, err := credentialHistory(repo, "test-alias", "bob")
+			So(err, ShouldEqual, nil)
+			So(history[0].Superseded, ShouldBeTrue)
+			So(history[1].Superseded, ShouldBeTrue)
+			So(history[2].Current, ShouldBeTrue)
+
+			Convey("and a superseded version can be restored in turn", func() {
+				_, err := restoreCredentials(repo, "test-alias", "bob", "1")
+				So(err, ShouldEqual, nil)
+				creds, err := RetrieveCredentials(repo, "test-alias", "bob", "testdata/testkey")
+				So(err, ShouldEqual, nil)
+				So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, keyIds[1])
+				So(fileExists(filepath.Join(repo, "test-alias", "bob", history[0].Name)), ShouldBeTrue)
+			})
+		})
+
+		Convey("Restoring the current version is an error", func() {
+			_, err := restoreCredentials(repo, "test-alias", "bob", "0")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Unknown identities have no history", func() {
+			_, err := credentialHistory(repo, "test-alias", "nobody")
+			So(err.Error(), ShouldEqual, "No credentials have been saved for nobody@test-alias")
+		})
+	})
+}
+
+func TestRestoreByCreateTime(t *testing.T) {
+	Convey("Test restoring goes by create time rather than name", t, func() {
+		repo, err := ioutil.TempDir("", "credulous-history")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(repo)
+		dir := filepath.Join(repo, "acct", "bob")
+		So(os.MkdirAll(dir, 0700), ShouldEqual, nil)
+		for _, name := range []string{"999-AAAA.json", "1000-BBBB.json"} {
+			So(ioutil.WriteFile(filepath.Join(dir, name), []byte("{}"), 0600), ShouldEqual, nil)
+		}
+
+		history, err := credentialHistory(repo, "acct", "bob")
+		So(err, ShouldEqual, nil)
+		So(history[0].Name, ShouldEqual, "1000-BBBB.json")
+		So(history[0].Current, ShouldBeTrue)
+
+		restored, err := restoreCredentials(repo, "acct", "bob", "1")
+		So(err, ShouldEqual, nil)
+		So(restored, ShouldEqual, "999-AAAA.json")
+		So(fileExists(filepath.Join(dir, "1000-BBBB.json"+SUPERSEDED_SUFFIX)), ShouldBeTrue)
+
+		current, err := fsStore{root: repo}.Current("acct", "bob")
+		So(err, ShouldEqual, nil)
+		So(current, ShouldEqual, "999-AAAA.json")
+	})
+}
+
+func TestCredentialHistoryFromGit(t *testing.T) {
+	Convey("Test credential history kept in git", t, func() {
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		repo, err := ioutil.TempDir("", "credulous-history")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(repo)
+		initTestRepo(repo)
+
+		keyIds := saveTestVersions(fake, repo, "bob", 2)
+		history, err := credentialHistory(repo, "test-alias", "bob")
+		So(err, ShouldEqual, nil)
+		So(history[0].Author, ShouldEqual, "Test User <test.user@nowhere>")
+		So(history[0].Commit, ShouldNotEqual, history[1].Commit)
+
+		Convey("Versions can be sourced as of a commit", func() {
+			creds, err := RetrieveCredentialVersion(repo, "test-alias", "bob", history[1].Commit, "testdata/testkey")
+			So(err, ShouldEqual, nil)
+			So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, keyIds[0])
+		})
+
+		Convey("Deleted versions can be restored from git", func() {
+			oldest := filepath.Join("test-alias", "bob", history[1].Name)
+			So(os.Remove(filepath.Join(repo, oldest)), ShouldEqual, nil)
+			_, err := gitCommitPaths(repo, nil, []string{oldest}, "Removed by test")
+			So(err, ShouldEqual, nil)
+
+			_, err = restoreCredentials(repo, "test-alias", "bob", history[1].Commit)
+			So(err, ShouldEqual, nil)
+			creds, err := RetrieveCredentials(repo, "test-alias", "bob", "testdata/testkey")
+			So(err, ShouldEqual, nil)
+			So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, keyIds[0])
+		})
+	})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ImportData is what 'credulous import' needs: where to read plaintext
+// credentials from, and how to save them
+type ImportData struct {
+	filename string
+	// profiles picks sections of a credentials file; all of them if
+	// empty
+	profiles []string
+	pubkeys  []ssh.PublicKey
+	lifetime int
+	repo     string
+	scrub    bool
+}
+
+// importedCredential is one set of credentials read from a file
+type importedCredential struct {
+	// source says where in the file it came from, for messages
+	source string
+	// profile is the credentials file section it came from
+	profile string
+	// username is the IAM user the file says it belongs to, if it says
+	username string
+	cred     Credential
+	// identity is <account>/<username>, once it's been saved
+	identity string
+}
+
+// isCSVFile tells the access key CSV files the IAM console hands out
+// from everything else, which we take to be INI
+func isCSVFile(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".csv")
+}
+
+// readCredentialsINI reads the named profiles from an AWS credentials
+// file, or every profile with keys in it if none are named
+func readCredentialsINI(filename string, profiles []string) ([]importedCredential, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	ini := parseINI(data)
+	names := profiles
+	if len(names) == 0 {
+		names = ini.sectionNames()
+	}
+
+	explicit := len(profiles) > 0
+	found := []importedCredential{}
+	for _, name := range names {
+		section := ini.section(name)
+		if section == nil {
+			return nil, errors.New("No profile '" + name + "' in " + filename)
+		}
+		keyId, secret := section.get("aws_access_key_id"), section.get("aws_secret_access_key")
+		switch {
+		case section.get("aws_session_token") != "":
+			// they'll have expired long before anyone sources them
+			if explicit {
+				return nil, errors.New("Profile '" + name + "' in " + filename + " has temporary credentials, which can't be saved")
+			}
+			log.Print("WARNING: skipping profile '" + name + "', which has temporary credentials")
+			continue
+		case keyId == "" || secret == "":
+			if explicit {
+				return nil, errors.New("Profile '" + name + "' in " + filename + " has no access key")
+			}
+			continue
+		}
+		found = append(found, importedCredential{
+			source:  "profile '" + name + "'",
+			profile: name,
+			cred:    Credential{KeyId: keyId, SecretKey: secret},
+		})
+	}
+	if len(found) == 0 {
+		return nil, errors.New("No access keys found in " + filename)
+	}
+	return found, nil
+}
+
+// readCredentialsCSV reads an access key file downloaded from the IAM
+// console. Newer ones have just the key id and secret; older ones lead
+// with the user name.
+func readCredentialsCSV(filename string) ([]importedCredential, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	// Excel likes a byte order mark, and so does the IAM console
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, errors.New("Cannot read " + filename + ": " + err.Error())
+	}
+	if len(records) < 2 {
+		return nil, errors.New("No access keys found in " + filename)
+	}
+
+	columns := make(map[string]int)
+	for i, heading := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(heading))] = i
+	}
+	keyCol, hasKey := columns["access key id"]
+	secretCol, hasSecret := columns["secret access key"]
+	userCol, hasUser := columns["user name"]
+	if !hasKey || !hasSecret {
+		return nil, errors.New(filename + " doesn't look like an access key file from the IAM console")
+	}
+
+	found := []importedCredential{}
+	for i, record := range records[1:] {
+		if keyCol >= len(record) || secretCol >= len(record) || record[keyCol] == "" {
+			continue
+		}
+		imported := importedCredential{
+			source: fmt.Sprintf("line %d", i+2),
+			cred:   Credential{KeyId: strings.TrimSpace(record[keyCol]), SecretKey: strings.TrimSpace(record[secretCol])},
+		}
+		if hasUser && userCol < len(record) {
+			imported.username = strings.TrimSpace(record[userCol])
+		}
+		found = append(found, imported)
+	}
+	if len(found) == 0 {
+		return nil, errors.New("No access keys found in " + filename)
+	}
+	return found, nil
+}
+
+// importCredentials saves credentials read from a plaintext file, once
+// AWS has confirmed whose they are. One bad set doesn't stop the rest,
+// but is an error at the end; only what was saved is scrubbed.
+func importCredentials(data ImportData) (imported []importedCredential, err error) {
+	var found []importedCredential
+	if isCSVFile(data.filename) {
+		if len(data.profiles) > 0 {
+			return nil, errors.New("Profiles can only be picked from an AWS credentials file, not a CSV file")
+		}
+		found, err = readCredentialsCSV(data.filename)
+	} else {
+		found, err = readCredentialsINI(data.filename, data.profiles)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range found {
+		username, alias, err := getAWSUsernameAndAlias(c.cred)
+		if err != nil {
+			log.Print("WARNING: cannot import " + c.source + " of " + data.filename + ": " + err.Error())
+			continue
+		}
+		if c.username != "" && c.username != username {
+			log.Print("WARNING: cannot import " + c.source + " of " + data.filename + ": the key belongs to " +
+				username + ", not " + c.username)
+			continue
+		}
+		err = SaveCredentials(SaveData{
+			cred:     c.cred,
+			username: username,
+			alias:    alias,
+			pubkeys:  data.pubkeys,
+			lifetime: data.lifetime,
+			repo:     data.repo,
+		})
+		if err != nil {
+			log.Print("WARNING: cannot import " + c.source + " of " + data.filename + ": " + err.Error())
+			continue
+		}
+		c.identity = filepath.Join(alias, username)
+		imported = append(imported, c)
+	}
+
+	if data.scrub && len(imported) > 0 {
+		if err = scrubImported(data.filename, imported, len(imported) == len(found)); err != nil {
+			return imported, err
+		}
+	}
+	if len(imported) < len(found) {
+		return imported, fmt.Errorf("%d of %d sets of credentials in %s could not be imported",
+			len(found)-len(imported), len(found), data.filename)
+	}
+	return imported, nil
+}
+
+// scrubImported takes the plaintext keys we've saved out of the file
+// they came from. A CSV file is nothing but keys, so it goes altogether,
+// but only once all of them are saved; a credentials file loses the keys
+// from each imported profile, and the profile too if nothing else is
+// left in it.
+func scrubImported(filename string, imported []importedCredential, all bool) error {
+	if isCSVFile(filename) {
+		if !all {
+			log.Print("WARNING: not removing " + filename + ", since some of its keys weren't imported")
+			return nil
+		}
+		return os.Remove(filename)
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	ini, err := readINIFile(filename)
+	if err != nil {
+		return err
+	}
+	for _, c := range imported {
+		section := ini.section(c.profile)
+		if section == nil {
+			continue
+		}
+		section.unset("aws_access_key_id")
+		if !section.unset("aws_secret_access_key") {
+			ini.removeSection(c.profile)
+		}
+	}
+	return writeFileAtomic(filename, ini.Bytes(), info.Mode().Perm())
+}
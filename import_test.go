@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestImportCredentials(t *testing.T) {
+	Convey("Test importing plaintext credentials", t, func() {
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		tmp, err := ioutil.TempDir("", "credulous-import")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(tmp)
+		repo := filepath.Join(tmp, "repo")
+		So(os.MkdirAll(repo, 0700), ShouldEqual, nil)
+
+		pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		So(err, ShouldEqual, nil)
+		data := ImportData{pubkeys: []ssh.PublicKey{pubkey}, repo: repo}
+
+		aliceKey, aliceSecret := fake.AddUser("alice")
+		bobKey, bobSecret := fake.AddUser("bob")
+
+		Convey("From an AWS credentials file", func() {
+			data.filename = filepath.Join(tmp, "credentials")
+			contents := fmt.Sprintf(`[alice]
+aws_access_key_id = %s
+aws_secret_access_key = %s
+region = us-east-1
+
+[bob]
+aws_access_key_id = %s
+aws_secret_access_key = %s
+
+[temporary]
+aws_access_key_id = ASIATEMPORARY
+aws_secret_access_key = secret
+aws_session_token = token
+
+[settings]
+region = us-west-2
+`, aliceKey, aliceSecret, bobKey, bobSecret)
+			So(ioutil.WriteFile(data.filename, []byte(contents), 0600), ShouldEqual, nil)
+
+			Convey("every profile with keys is saved", func() {
+				imported, err := importCredentials(data)
+				So(err, ShouldEqual, nil)
+				So(len(imported), ShouldEqual, 2)
+				So(imported[0].identity, ShouldEqual, filepath.Join("test-alias", "alice"))
+
+				creds, err := RetrieveCredentials(repo, "test-alias", "bob", "testdata/testkey")
+				So(err, ShouldEqual, nil)
+				So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, bobKey)
+
+				after, err := ioutil.ReadFile(data.filename)
+				So(err, ShouldEqual, nil)
+				So(string(after), ShouldEqual, contents)
+			})
+
+			Convey("or just those picked", func() {
+				data.profiles = []string{"bob"}
+				imported, err := importCredentials(data)
+				So(err, ShouldEqual, nil)
+				So(len(imported), ShouldEqual, 1)
+				_, err = RetrieveCredentials(repo, "test-alias", "alice", "testdata/testkey")
+				So(err, ShouldNotEqual, nil)
+
+				data.profiles = []string{"temporary"}
+				_, err = importCredentials(data)
+				So(err, ShouldNotEqual, nil)
+
+				data.profiles = []string{"nosuch"}
+				_, err = importCredentials(data)
+				So(err.Error(), ShouldEqual, "No profile 'nosuch' in "+data.filename)
+			})
+
+			Convey("scrubbing takes out the imported keys", func() {
+				data.scrub = true
+				_, err := importCredentials(data)
+				So(err, ShouldEqual, nil)
+
+				after, err := ioutil.ReadFile(data.filename)
+				So(err, ShouldEqual, nil)
+				So(string(after), ShouldEqual, `[alice]
+region = us-east-1
+
+[temporary]
+aws_access_key_id = ASIATEMPORARY
+aws_secret_access_key = secret
+aws_session_token = token
+
+[settings]
+region = us-west-2
+`)
+			})
+		})
+
+		Convey("From an IAM console CSV file", func() {
+			data.filename = filepath.Join(tmp, "accessKeys.csv")
+			contents := fmt.Sprintf("\xef\xbb\xbfUser name,Password,Access key ID,Secret access key,Console login link\n"+
+				"alice,,%s,%s,https://test-alias.signin.aws.amazon.com/console\n", aliceKey, aliceSecret)
+			So(ioutil.WriteFile(data.filename, []byte(contents), 0600), ShouldEqual, nil)
+
+			Convey("the keys are saved and the file scrubbed", func() {
+				data.scrub = true
+				imported, err := importCredentials(data)
+				So(err, ShouldEqual, nil)
+				So(len(imported), ShouldEqual, 1)
+				So(fileExists(data.filename), ShouldBeFalse)
+
+				creds, err := RetrieveCredentials(repo, "test-alias", "alice", "testdata/testkey")
+				So(err, ShouldEqual, nil)
+				So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, aliceKey)
+			})
+
+			Convey("keys that AWS doesn't know, or that belong to somebody else, aren't", func() {
+				contents += "alice,," + bobKey + "," + bobSecret + ",\n"
+				contents += "carol,,AKIANOSUCHKEY0000000,nosuchsecret,\n"
+				So(ioutil.WriteFile(data.filename, []byte(contents), 0600), ShouldEqual, nil)
+				data.scrub = true
+
+				imported, err := importCredentials(data)
+				So(err.Error(), ShouldEqual, "2 of 3 sets of credentials in "+data.filename+" could not be imported")
+				So(len(imported), ShouldEqual, 1)
+				So(fileExists(data.filename), ShouldBeTrue)
+				_, err = RetrieveCredentials(repo, "test-alias", "bob", "testdata/testkey")
+				So(err, ShouldNotEqual, nil)
+			})
+
+			Convey("profiles can't be picked", func() {
+				data.profiles = []string{"alice"}
+				_, err := importCredentials(data)
+				So(err, ShouldNotEqual, nil)
+			})
+		})
+
+		Convey("Files without keys are an error", func() {
+			data.filename = filepath.Join(tmp, "config")
+			So(ioutil.WriteFile(data.filename, []byte("[default]\nregion = us-east-1\n"), 0600), ShouldEqual, nil)
+			_, err := importCredentials(data)
+			So(err.Error(), ShouldEqual, "No access keys found in "+data.filename)
+		})
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CredentialListing describes the current credentials for an identity in
+// a repo, from what's saved in plaintext alongside the encrypted keys, so
+// that nothing needs decrypting
+type CredentialListing struct {
+	Identity   string
+	Kind       string
+	Repo       string
+	Account    string
+	Username   string
+	Name       string
+	KeySuffix  string
+	CreateTime int64
+	LifeTime   int
+	// Expires is when the credentials should be rotated by, or 0 if
+	// they don't expire
+	Expires     int64
+	Version     string
+	Tags        map[string]string
+	Recipients  []Recipient
+	Decryptable bool
+}
+
+// Recipient is a key that credentials are encrypted for, and the names
+// the team keyring gives it
+type Recipient struct {
+	Fingerprint string
+	Names       []string
+}
+
+// readCredentialMetadata reads what a credential file says about itself
+// without decrypting anything: the Credentials with no decoded keys, and
+// the fingerprints of the keys they are encrypted for
+func readCredentialMetadata(b []byte) (Credentials, []string, error) {
+	if !strings.Contains(string(b), "Version") {
+		var old OldCredential
+		if err := json.Unmarshal(b, &old); err != nil {
+			return Credentials{}, nil, err
+		}
+		return Credentials{
+			Version:          "noversion",
+			IamUsername:      old.IamUsername,
+			AccountAliasOrId: old.AccountAliasOrId,
+			CreateTime:       old.CreateTime,
+			LifeTime:         old.LifeTime,
+		}, []string{old.FingerPrint}, nil
+	}
+
+	var creds Credentials
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return Credentials{}, nil, err
+	}
+	fingerprints := []string{}
+	for _, enc := range creds.Encryptions {
+		fingerprints = append(fingerprints, enc.Fingerprint)
+	}
+	return creds, fingerprints, nil
+}
+
+// recipientNames maps the fingerprints of the keys in the team keyring
+// to their principals
+func recipientNames() (map[string][]string, error) {
+	signers, err := loadAllowedSigners(allowedSignersFile())
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string][]string)
+	for _, signer := range signers {
+		fingerprint := SSHFingerprint(signer.Key)
+		names[fingerprint] = append(names[fingerprint], signer.Principals...)
+	}
+	return names, nil
+}
+
+// callerFingerprint is the fingerprint of our own key, for telling what
+// it can decrypt, or "" if it can't be worked out
+func callerFingerprint(keyfile string) string {
+	fingerprint, err := keyFingerprint(keyfile)
+	if err != nil {
+		log.Print("WARNING: cannot tell which credentials your key can decrypt: " + err.Error())
+	}
+	return fingerprint
+}
+
+// listCredentialDetails describes the current credentials for every
+// identity in every repo, and whether the key with the given fingerprint
+// can decrypt them
+func listCredentialDetails(mine string) ([]CredentialListing, error) {
+	repos, err := listRepos()
+	if err != nil {
+		return nil, err
+	}
+	if len(repos) == 0 {
+		return nil, errors.New("No saved credentials found; please run 'credulous save' first")
+	}
+	names, err := recipientNames()
+	if err != nil {
+		return nil, err
+	}
+
+	listings := []CredentialListing{}
+	for _, repoName := range repos {
+		repo, err := resolveRepo(repoName)
+		if err != nil {
+			return nil, err
+		}
+		store, err := openStore(repo)
+		if err != nil {
+			return nil, err
+		}
+		identities, err := store.Identities()
+		if err != nil {
+			return nil, err
+		}
+		for _, identity := range identities {
+			account, username := splitIdentity(identity)
+			name, err := storedCurrentName(store, account, username)
+			if err == noSavedCredentialsError {
+				continue
+			}
+			var listing CredentialListing
+			if err == nil {
+				listing, err = describeCredentials(store, account, username, name)
+			}
+			if err != nil {
+				log.Print("WARNING: " + err.Error())
+				continue
+			}
+			listing.Repo = repoName
+			listing.Decryptable = listing.hasRecipient(mine)
+			listing.nameRecipients(names)
+			listings = append(listings, listing)
+		}
+	}
+	sort.Stable(byIdentity(listings))
+	return listings, nil
+}
+
+// describeCredentials reads the listing for one credential file
+func describeCredentials(store Store, account, username, name string) (CredentialListing, error) {
+	listing := CredentialListing{
+		Identity:   username + "@" + account,
+		Account:    account,
+		Username:   username,
+		Name:       name,
+		Recipients: []Recipient{},
+	}
+	created, suffix, err := parseCredentialFilename(name)
+	if err != nil {
+		return listing, err
+	}
+	listing.KeySuffix = suffix
+	file, err := store.Get(account, username, name)
+	if err != nil {
+		return listing, err
+	}
+	creds, fingerprints, err := readCredentialMetadata(file.Data)
+	if err != nil {
+		return listing, errors.New("Cannot read " + name + " for " + listing.Identity + ": " + err.Error())
+	}
+	// files from before create times were numbers go by their name
+	if t, err := strconv.ParseInt(creds.CreateTime, 10, 64); err == nil {
+		created = t
+	}
+	listing.CreateTime = created
+	listing.LifeTime = creds.LifeTime
+	listing.Expires = creds.expiryTime()
+	listing.Version = creds.Version
+	listing.Kind = secretKind(creds.Kind)
+	listing.Identity = storedIdentity(creds.Kind, account, username)
+	listing.Tags = creds.Tags
+	if listing.Tags == nil {
+		listing.Tags = map[string]string{}
+	}
+	for _, fingerprint := range fingerprints {
+		listing.Recipients = append(listing.Recipients, Recipient{Fingerprint: fingerprint, Names: []string{}})
+	}
+	return listing, nil
+}
+
+func (listing CredentialListing) hasRecipient(fingerprint string) bool {
+	for _, recipient := range listing.Recipients {
+		if fingerprint != "" && recipient.Fingerprint == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+func (listing *CredentialListing) nameRecipients(names map[string][]string) {
+	for i, recipient := range listing.Recipients {
+		if principals, ok := names[recipient.Fingerprint]; ok {
+			listing.Recipients[i].Names = principals
+		}
+	}
+}
+
+type byIdentity []CredentialListing
+
+func (l byIdentity) Len() int           { return len(l) }
+func (l byIdentity) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byIdentity) Less(i, j int) bool { return l[i].Identity < l[j].Identity }
+
+// displayListings writes listings as a table, naming recipients by
+// their principals where the team keyring knows them
+func displayListings(output io.Writer, listings []CredentialListing) error {
+	w := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IDENTITY\tKIND\tREPO\tKEY\tCREATED\tEXPIRES\tVERSION\tDECRYPTABLE\tRECIPIENTS\tTAGS")
+	for _, listing := range listings {
+		expires := "never"
+		if listing.Expires > 0 {
+			expires = time.Unix(listing.Expires, 0).Format("2006-01-02 15:04:05")
+		}
+		decryptable := "no"
+		if listing.Decryptable {
+			decryptable = "yes"
+		}
+		recipients := []string{}
+		for _, recipient := range listing.Recipients {
+			if len(recipient.Names) > 0 {
+				recipients = append(recipients, strings.Join(recipient.Names, ","))
+			} else {
+				recipients = append(recipients, recipient.Fingerprint)
+			}
+		}
+		tags := []string{}
+		for name, value := range listing.Tags {
+			tags = append(tags, name+"="+value)
+		}
+		sort.Strings(tags)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", listing.Identity, listing.Kind, listing.Repo,
+			listing.KeySuffix, time.Unix(listing.CreateTime, 0).Format("2006-01-02 15:04:05"),
+			expires, listing.Version, decryptable, strings.Join(recipients, " "), strings.Join(tags, ","))
+	}
+	return w.Flush()
+}
+
+func displayListingsJSON(output io.Writer, listings []CredentialListing) error {
+	b, err := json.MarshalIndent(listings, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(output, "%s\n", b)
+	return err
+}
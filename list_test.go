@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestListCredentialDetails(t *testing.T) {
+	Convey("Test listing credentials in detail", t, func() {
+		_, cleanup := withTempHome()
+		defer cleanup()
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		So(err, ShouldEqual, nil)
+		keyId, secret := fake.AddUser("bob")
+		cred := Credential{KeyId: keyId, SecretKey: secret}
+		So(SaveCredentials(SaveData{cred: cred, pubkeys: []ssh.PublicKey{pubkey},
+			lifetime: 3600, repo: filepath.Join(getRootPath(), "local")}), ShouldEqual, nil)
+
+		old, err := ioutil.ReadFile("testdata/credential.json")
+		So(err, ShouldEqual, nil)
+		oldDir := filepath.Join(getRootPath(), "team", "acct", "alice")
+		So(os.MkdirAll(oldDir, 0700), ShouldEqual, nil)
+		So(ioutil.WriteFile(filepath.Join(oldDir, "1401515273-OLDKEY.json"), old, 0600), ShouldEqual, nil)
+
+		b, err := ioutil.ReadFile("testdata/testkey.pub")
+		So(err, ShouldEqual, nil)
+		So(ioutil.WriteFile(allowedSignersFile(), append([]byte("hoopy@frood "), b...), 0600), ShouldEqual, nil)
+
+		Convey("Each identity is described without decrypting anything", func() {
+			listings, err := listCredentialDetails(callerFingerprint("testdata/testkey"))
+			So(err, ShouldEqual, nil)
+			So(len(listings), ShouldEqual, 2)
+
+			So(listings[0].Identity, ShouldEqual, "alice@acct")
+			So(listings[0].Repo, ShouldEqual, "team")
+			So(listings[0].KeySuffix, ShouldEqual, "OLDKEY")
+			So(listings[0].CreateTime, ShouldEqual, 1401515273)
+			So(listings[0].Version, ShouldEqual, "noversion")
+			So(listings[0].Expires, ShouldEqual, 0)
+
+			bob := listings[1]
+			So(bob.Identity, ShouldEqual, "bob@test-alias")
+			So(bob.Repo, ShouldEqual, "local")
+			So(bob.KeySuffix, ShouldEqual, keyId[12:])
+			So(bob.LifeTime, ShouldEqual, 3600)
+			So(bob.Expires, ShouldEqual, bob.CreateTime+3600)
+			So(bob.Version, ShouldEqual, "2014-06-12")
+			So(bob.Decryptable, ShouldBeTrue)
+			So(bob.Recipients, ShouldResemble, []Recipient{{
+				Fingerprint: "c0:61:84:fc:e8:c9:52:dc:cd:a9:8e:82:a2:70:0a:30",
+				Names:       []string{"hoopy@frood"},
+			}})
+		})
+
+		Convey("Nothing is decryptable by a key that isn't a recipient", func() {
+			listings, err := listCredentialDetails(callerFingerprint(filepath.Join(getRootPath(), "nosuchkey")))
+			So(err, ShouldEqual, nil)
+			So(listings[1].Decryptable, ShouldBeFalse)
+		})
+
+		Convey("Listings are shown as a table or as JSON", func() {
+			listings, err := listCredentialDetails(callerFingerprint("testdata/testkey"))
+			So(err, ShouldEqual, nil)
+
+			var out bytes.Buffer
+			So(displayListings(&out, listings), ShouldEqual, nil)
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			So(len(lines), ShouldEqual, 3)
+			So(strings.Fields(lines[0])[0], ShouldEqual, "IDENTITY")
+			So(lines[2], ShouldStartWith, "bob@test-alias")
+			fields := strings.Fields(lines[2])
+			So(fields[len(fields)-2:], ShouldResemble, []string{"yes", "hoopy@frood"})
+
+			out.Reset()
+			So(displayListingsJSON(&out, listings), ShouldEqual, nil)
+			var parsed []map[string]interface{}
+			So(json.Unmarshal(out.Bytes(), &parsed), ShouldEqual, nil)
+			So(parsed[1]["Identity"], ShouldEqual, "bob@test-alias")
+			So(parsed[1]["Decryptable"], ShouldEqual, true)
+		})
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// How long to wait for another credulous to finish with a repo
+const REPO_LOCK_TIMEOUT = 30 * time.Second
+
+// how often to check whether the lock is free
+const REPO_LOCK_POLL = 50 * time.Millisecond
+
+// repoStateFile is where credulous keeps its own state for a repo on
+// disk: inside .git if it's a git repo, so that it's never committed, or
+// else in a dotfile alongside the credentials
+func repoStateFile(repo, name string) string {
+	if info, err := os.Stat(filepath.Join(repo, ".git")); err == nil && info.IsDir() {
+		return filepath.Join(repo, ".git", "credulous."+name)
+	}
+	return filepath.Join(repo, ".credulous."+name)
+}
+
+// repoLockFile is where the lock for a repo lives
+func repoLockFile(repo string) string {
+	if !isDiskRepo(repo) {
+		return repo + ".lock"
+	}
+	return repoStateFile(repo, "lock")
+}
+
+// lockRepo takes an advisory lock on a repo for the length of an
+// operation that changes it and commits the result, so that two
+// credulous processes (say, a cron rotate and a save) can't interleave
+// their writes. The lock is released if the process dies. Locks don't
+// nest: anything that takes one mustn't call something else that does.
+func lockRepo(repo string) (unlock func(), err error) {
+	lockfile := repoLockFile(repo)
+	if err = os.MkdirAll(filepath.Dir(lockfile), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(lockfile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(REPO_LOCK_TIMEOUT)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				err = errors.New("Timed out waiting for another credulous to finish with " + repo)
+			}
+			return nil, err
+		}
+		time.Sleep(REPO_LOCK_POLL)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// writeFileAtomic writes a file so that readers see either the old
+// contents or the new, never half of them: the data goes to a temporary
+// file in the same directory, which is synced and then renamed into
+// place
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	// a leading dot keeps it out of directory listings
+	tmp, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+
+	// make the rename itself durable; not every filesystem can
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
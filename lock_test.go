@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	Convey("Test writing files atomically", t, func() {
+		tmp, err := ioutil.TempDir("", "credulous-atomic")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(tmp)
+		filename := filepath.Join(tmp, "1-aaaa.json")
+
+		So(writeFileAtomic(filename, []byte("first"), 0600), ShouldEqual, nil)
+		So(writeFileAtomic(filename, []byte("second"), 0600), ShouldEqual, nil)
+
+		b, err := ioutil.ReadFile(filename)
+		So(err, ShouldEqual, nil)
+		So(string(b), ShouldEqual, "second")
+		info, err := os.Stat(filename)
+		So(err, ShouldEqual, nil)
+		So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+
+		Convey("Nothing is left behind", func() {
+			entries, err := ioutil.ReadDir(tmp)
+			So(err, ShouldEqual, nil)
+			So(len(entries), ShouldEqual, 1)
+		})
+		Convey("A failed write leaves nothing behind", func() {
+			So(writeFileAtomic(filepath.Join(tmp, "nosuchdir", "x.json"), []byte("x"), 0600), ShouldNotEqual, nil)
+			entries, err := ioutil.ReadDir(tmp)
+			So(err, ShouldEqual, nil)
+			So(len(entries), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestLockRepo(t *testing.T) {
+	Convey("Test locking repositories", t, func() {
+		tmp, err := ioutil.TempDir("", "credulous-lock")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(tmp)
+
+		Convey("Git repos are locked inside .git", func() {
+			repo := filepath.Join(tmp, "repo")
+			initTestRepo(repo)
+			So(repoLockFile(repo), ShouldEqual, filepath.Join(repo, ".git", "credulous.lock"))
+			So(repoLockFile(tmp), ShouldEqual, filepath.Join(tmp, ".credulous.lock"))
+			So(repoLockFile(filepath.Join(tmp, "creds.bundle")), ShouldEqual, filepath.Join(tmp, "creds.bundle.lock"))
+		})
+
+		Convey("A second lock waits for the first", func() {
+			unlock, err := lockRepo(tmp)
+			So(err, ShouldEqual, nil)
+
+			locked := make(chan func())
+			go func() {
+				unlock2, err := lockRepo(tmp)
+				panic_the_err(err)
+				locked <- unlock2
+			}()
+
+			select {
+			case <-locked:
+				t.Error("took a lock that was already held")
+			case <-time.After(200 * time.Millisecond):
+			}
+			unlock()
+			select {
+			case unlock2 := <-locked:
+				unlock2()
+			case <-time.After(5 * time.Second):
+				t.Error("lock was never released")
+			}
+		})
+	})
+}
+
+// saveConcurrently saves credentials for several users into a repo at
+// once, returning the first error
+func saveConcurrently(fake *FakeIAM, repo string, users int) error {
+	pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, users)
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		keyId, secret := fake.AddUser(fmt.Sprintf("user%d", i))
+		wg.Add(1)
+		go func(cred Credential) {
+			defer wg.Done()
+			errs <- SaveCredentials(SaveData{cred: cred, pubkeys: []ssh.PublicKey{pubkey}, repo: repo})
+		}(Credential{KeyId: keyId, SecretKey: secret})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestConcurrentStoreWrites(t *testing.T) {
+	Convey("Test saving credentials concurrently", t, func() {
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		tmp, err := ioutil.TempDir("", "credulous-concurrent")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(tmp)
+
+		const users = 8
+
+		Convey("Every save to a git repo is committed", func() {
+			repo := filepath.Join(tmp, "repo")
+			initTestRepo(repo)
+			So(saveConcurrently(fake, repo, users), ShouldEqual, nil)
+
+			origins, err := gitFileOrigins(repo, "test-alias")
+			So(err, ShouldEqual, nil)
+			So(len(origins), ShouldEqual, users)
+
+			status, err := runGit(repo, nil, "", "status", "--porcelain")
+			So(err, ShouldEqual, nil)
+			So(status, ShouldEqual, "")
+		})
+
+		Convey("No save to a bundle is lost", func() {
+			bundle := filepath.Join(tmp, "creds"+BUNDLE_SUFFIX)
+			So(saveConcurrently(fake, bundle, users), ShouldEqual, nil)
+
+			creds, err := storeCredentials(bundleStore{file: bundle})
+			So(err, ShouldEqual, nil)
+			So(len(creds), ShouldEqual, users)
+		})
+	})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"golang.org/x/term"
+)
+
+// PICKER_ROWS is how many credentials the picker shows at once
+const PICKER_ROWS int = 10
+
+var noCredentialsChosenError = errors.New("No credentials chosen")
+
+// picker is the state of the terminal selector: the credentials to
+// choose from, what's been typed to narrow them down, and which of
+// those left is selected
+type picker struct {
+	listings []CredentialListing
+	rows     []string
+	query    string
+	selected int
+	offset   int
+	// drawn is how many lines the last render left above the cursor
+	drawn int
+}
+
+func newPicker(listings []CredentialListing, query string, now time.Time) *picker {
+	p := &picker{listings: uniqueListings(listings), query: query}
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	for _, listing := range p.listings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", listing.Username, listing.Account,
+			describeExpiry(listing.Expires, now), describeTags(listing.Tags))
+	}
+	w.Flush()
+	p.rows = strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	return p
+}
+
+// uniqueListings keeps the first listing for each identity, which is
+// the one from the repo source would search first
+func uniqueListings(listings []CredentialListing) []CredentialListing {
+	unique := []CredentialListing{}
+	seen := make(map[string]bool)
+	for _, listing := range listings {
+		if !seen[listing.Identity] {
+			seen[listing.Identity] = true
+			unique = append(unique, listing)
+		}
+	}
+	return unique
+}
+
+func describeExpiry(expires int64, now time.Time) string {
+	switch {
+	case expires == 0:
+		return "never expires"
+	case expires <= now.Unix():
+		return "expired"
+	}
+	return "expires " + time.Unix(expires, 0).Format("2006-01-02 15:04")
+}
+
+func describeTags(tags map[string]string) string {
+	described := []string{}
+	for name, value := range tags {
+		described = append(described, name+"="+value)
+	}
+	sort.Strings(described)
+	return strings.Join(described, " ")
+}
+
+// visible lists the indexes of the listings that what's been typed
+// matches, going by identity and tags
+func (p *picker) visible() []int {
+	if p.query == "" {
+		all := make([]int, len(p.listings))
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+	keys := []string{}
+	index := make(map[string]int)
+	for i, listing := range p.listings {
+		key := listing.Identity + " " + describeTags(listing.Tags)
+		keys = append(keys, key)
+		index[key] = i
+	}
+	matched := []int{}
+	for _, key := range matchIdentities(p.query, keys) {
+		matched = append(matched, index[key])
+	}
+	return matched
+}
+
+// handleKey acts on one key press, given as what the terminal sent for
+// it. It returns the chosen identity once enter is pressed, or
+// noCredentialsChosenError if the picker is given up on.
+func (p *picker) handleKey(key string) (string, error) {
+	visible := p.visible()
+	switch key {
+	case "\r", "\n":
+		if len(visible) == 0 {
+			return "", nil
+		}
+		return p.listings[visible[p.selected]].Identity, nil
+	case "\x03", "\x04", "\x1b":
+		return "", noCredentialsChosenError
+	case "\x1b[A", "\x1bOA", "\x10":
+		if p.selected > 0 {
+			p.selected--
+		}
+	case "\x1b[B", "\x1bOB", "\x0e", "\t":
+		if p.selected < len(visible)-1 {
+			p.selected++
+		}
+	case "\x7f", "\b":
+		if query := []rune(p.query); len(query) > 0 {
+			p.query = string(query[:len(query)-1])
+			p.selected = 0
+		}
+	case "\x15":
+		p.query = ""
+		p.selected = 0
+	default:
+		// other escape sequences are keys we don't use
+		if strings.HasPrefix(key, "\x1b") {
+			break
+		}
+		for _, r := range key {
+			if unicode.IsPrint(r) {
+				p.query += string(r)
+				p.selected = 0
+			}
+		}
+	}
+	return "", nil
+}
+
+// render draws the picker, leaving the cursor after what's been typed.
+// The terminal is raw, so lines end in \r\n.
+func (p *picker) render(out io.Writer) {
+	visible := p.visible()
+	if p.selected < p.offset {
+		p.offset = p.selected
+	} else if p.selected >= p.offset+PICKER_ROWS {
+		p.offset = p.selected - PICKER_ROWS + 1
+	}
+	if p.offset > len(visible) {
+		p.offset = 0
+	}
+
+	var buf bytes.Buffer
+	p.moveToTop(&buf)
+	fmt.Fprintf(&buf, "Credentials (%d/%d; type to filter, enter to choose, esc to cancel)\r\n", len(visible), len(p.listings))
+	lines := 0
+	for i := p.offset; i < len(visible) && i < p.offset+PICKER_ROWS; i++ {
+		if i == p.selected {
+			fmt.Fprintf(&buf, "\x1b[7m> %s\x1b[0m\r\n", p.rows[visible[i]])
+		} else {
+			fmt.Fprintf(&buf, "  %s\r\n", p.rows[visible[i]])
+		}
+		lines++
+	}
+	if len(visible) == 0 {
+		buf.WriteString("  (nothing matches)\r\n")
+		lines++
+	}
+	fmt.Fprintf(&buf, "> %s", p.query)
+	p.drawn = lines + 1
+	out.Write(buf.Bytes())
+}
+
+// moveToTop goes back to where the picker was first drawn, and wipes
+// everything below
+func (p *picker) moveToTop(out io.Writer) {
+	fmt.Fprint(out, "\r")
+	if p.drawn > 0 {
+		fmt.Fprintf(out, "\x1b[%dA", p.drawn)
+	}
+	fmt.Fprint(out, "\x1b[J")
+}
+
+// clear wipes the picker off the screen
+func (p *picker) clear(out io.Writer) {
+	p.moveToTop(out)
+	p.drawn = 0
+}
+
+// run shows the picker until something is chosen. Each read from in is
+// taken as one key press, which is how a raw terminal sends them.
+func (p *picker) run(in io.Reader, out io.Writer) (string, error) {
+	buf := make([]byte, 64)
+	p.render(out)
+	for {
+		n, err := in.Read(buf)
+		if n == 0 && err != nil {
+			p.clear(out)
+			if err == io.EOF {
+				return "", noCredentialsChosenError
+			}
+			return "", err
+		}
+		identity, err := p.handleKey(string(buf[:n]))
+		if identity != "" || err != nil {
+			p.clear(out)
+			return identity, err
+		}
+		p.render(out)
+	}
+}
+
+// rawTerminal puts the terminal on f into raw mode, so that keys come
+// as they are pressed, and returns what puts it back
+func rawTerminal(f *os.File) (func(), error) {
+	saved, err := term.MakeRaw(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	return func() { term.Restore(int(f.Fd()), saved) }, nil
+}
+
+// canPick tells whether there's a terminal to show the picker on. It is
+// drawn on stderr, since what source writes to stdout is for the shell.
+func canPick() bool {
+	return isTerminal(os.Stdin) && isTerminal(os.Stderr)
+}
+
+// pickOnTerminal shows the picker for listings, starting off filtered by
+// query. Where the terminal can't be put into raw mode, it asks for a
+// number instead.
+func pickOnTerminal(listings []CredentialListing, query string) (string, error) {
+	p := newPicker(listings, query, time.Now())
+	restore, err := rawTerminal(os.Stdin)
+	if err != nil {
+		candidates := []string{}
+		for _, i := range p.visible() {
+			candidates = append(candidates, p.listings[i].Identity)
+		}
+		if len(candidates) == 0 {
+			return "", errors.New("No credentials match '" + query + "'; see 'credulous list'")
+		}
+		return chooseIdentity(candidates, os.Stdin, os.Stderr)
+	}
+	defer restore()
+	return p.run(os.Stdin, os.Stderr)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// keyPresses reads as a raw terminal does, a key at a time
+type keyPresses []string
+
+func (keys *keyPresses) Read(b []byte) (int, error) {
+	if len(*keys) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, (*keys)[0])
+	*keys = (*keys)[1:]
+	return n, nil
+}
+
+func TestPicker(t *testing.T) {
+	Convey("Test picking credentials on the terminal", t, func() {
+		now := time.Unix(1401515273, 0)
+		listings := []CredentialListing{
+			{Identity: "alice@dev", Account: "dev", Username: "alice", Expires: 0},
+			{Identity: "bob@prod", Account: "prod", Username: "bob", Expires: 1401515000,
+				Tags: map[string]string{"env": "production"}},
+			{Identity: "bob@staging", Account: "staging", Username: "bob", Expires: 1401600000,
+				Tags: map[string]string{"env": "staging", "team": "web"}},
+			{Identity: "bob@prod", Account: "prod", Username: "bob", Repo: "other"},
+		}
+		run := func(query string, keys ...string) (string, error) {
+			presses := keyPresses(keys)
+			return newPicker(listings, query, now).run(&presses, &bytes.Buffer{})
+		}
+
+		Convey("Each identity is listed once, with its expiry and tags", func() {
+			p := newPicker(listings, "", now)
+			So(len(p.listings), ShouldEqual, 3)
+			So(strings.Fields(p.rows[0]), ShouldResemble, []string{"alice", "dev", "never", "expires"})
+			So(strings.Fields(p.rows[1]), ShouldResemble, []string{"bob", "prod", "expired", "env=production"})
+			So(p.rows[2], ShouldContainSubstring, "expires "+time.Unix(1401600000, 0).Format("2006-01-02 15:04"))
+			So(p.rows[2], ShouldEndWith, "env=staging team=web")
+		})
+
+		Convey("Enter chooses the selected credentials", func() {
+			identity, err := run("", "\r")
+			So(err, ShouldEqual, nil)
+			So(identity, ShouldEqual, "alice@dev")
+
+			identity, err = run("", "\x1b[B", "\x1b[B", "\x1b[B", "\x1b[A", "\r")
+			So(err, ShouldEqual, nil)
+			So(identity, ShouldEqual, "bob@prod")
+		})
+
+		Convey("Typing narrows them down, by identity or tag", func() {
+			identity, err := run("", "s", "t", "g", "\r")
+			So(err, ShouldEqual, nil)
+			So(identity, ShouldEqual, "bob@staging")
+
+			identity, err = run("web", "\r")
+			So(err, ShouldEqual, nil)
+			So(identity, ShouldEqual, "bob@staging")
+
+			identity, err = run("bob", "\x7f", "\x7f", "\x7f", "a", "\r")
+			So(err, ShouldEqual, nil)
+			So(identity, ShouldEqual, "alice@dev")
+		})
+
+		Convey("Enter does nothing when nothing matches", func() {
+			identity, err := run("zzz", "\r", "\x15", "\r")
+			So(err, ShouldEqual, nil)
+			So(identity, ShouldEqual, "alice@dev")
+		})
+
+		Convey("Escape gives up", func() {
+			_, err := run("", "\x1b")
+			So(err, ShouldEqual, noCredentialsChosenError)
+			_, err = run("", "x")
+			So(err, ShouldEqual, noCredentialsChosenError)
+		})
+
+		Convey("It is wiped off the screen when done", func() {
+			presses := keyPresses{"b", "\r"}
+			var out bytes.Buffer
+			_, err := newPicker(listings, "", now).run(&presses, &out)
+			So(err, ShouldEqual, nil)
+			So(out.String(), ShouldContainSubstring, "Credentials (3/3;")
+			So(out.String(), ShouldContainSubstring, "Credentials (2/3;")
+			So(out.String(), ShouldEndWith, "\r\x1b[3A\x1b[J")
+		})
+	})
+}
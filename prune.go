@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/realestate-com-au/goamz/iam"
+)
+
+const DEFAULT_KEEP int = 1
+
+// prunableVersions picks out the versions of an identity's credentials
+// that can safely go: anything but the current version and the newest
+// keep, whose key IAM no longer has at all
+func prunableVersions(history []CredentialVersion, keys []iam.AccessKey, keep int) []CredentialVersion {
+	prunable := []CredentialVersion{}
+	for _, version := range history {
+		if version.Current || version.Number < keep {
+			continue
+		}
+		inIAM := false
+		for _, key := range keys {
+			if strings.HasSuffix(key.Id, version.KeySuffix) {
+				inIAM = true
+			}
+		}
+		if !inIAM {
+			prunable = append(prunable, version)
+		}
+	}
+	return prunable
+}
+
+// repoIdentities lists the <account>/<user> directories in a repo
+func repoIdentities(repo string) ([]string, error) {
+	identities := []string{}
+	accounts, err := ioutil.ReadDir(repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range accounts {
+		if !account.IsDir() || strings.HasPrefix(account.Name(), ".") {
+			continue
+		}
+		users, err := ioutil.ReadDir(filepath.Join(repo, account.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			if user.IsDir() {
+				identities = append(identities, filepath.Join(account.Name(), user.Name()))
+			}
+		}
+	}
+	return identities, nil
+}
+
+// pruneIdentity works out which of an identity's credential files hold
+// keys that IAM has forgotten, and unless this is a dry run, removes
+// them along with their signatures. Secrets other than AWS credentials
+// have no keys in IAM, so all but the newest keep of them go. It
+// returns the paths removed, relative to the repo.
+func pruneIdentity(repo, identity string, keep int, auth SyncAuth, dryRun bool) ([]string, error) {
+	account, username := filepath.Dir(identity), filepath.Base(identity)
+	history, err := credentialHistory(repo, account, username)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) <= keep {
+		return []string{}, nil
+	}
+
+	// newest first, since the current credentials are the likeliest to
+	// be accepted
+	var keys []iam.AccessKey
+	if storedKind(repo, account, username) == SECRET_KIND_AWS {
+		files := []string{}
+		for _, version := range history {
+			files = append(files, filepath.Join(identity, version.Name))
+		}
+		keys, err = listKeysFor(repo, identity, iamUsernameFor(account, username), files, auth)
+		if err != nil {
+			return nil, errors.New("Cannot list the keys for " + username + "@" + account + ": " + err.Error())
+		}
+	}
+
+	prunable := prunableVersions(history, keys, keep)
+	if !isDiskRepo(repo) {
+		// the store takes the signatures along with the files
+		store, err := openStore(repo)
+		if err != nil {
+			return nil, err
+		}
+		removed := []string{}
+		for _, version := range prunable {
+			removed = append(removed, filepath.Join(identity, version.Name))
+			if dryRun {
+				continue
+			}
+			if err = store.Delete(account, username, version.Name); err != nil {
+				return nil, err
+			}
+		}
+		return removed, nil
+	}
+
+	removed := []string{}
+	for _, version := range prunable {
+		file := filepath.Join(identity, version.Name)
+		removed = append(removed, file)
+		sigfile := file + SIGNATURE_SUFFIX
+		if _, err := os.Stat(filepath.Join(repo, sigfile)); err == nil {
+			removed = append(removed, sigfile)
+		}
+	}
+	if dryRun {
+		return removed, nil
+	}
+	for _, file := range removed {
+		if err = os.Remove(filepath.Join(repo, file)); err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
+
+// pruneRepo prunes each of the given identities (or all of them) and
+// commits the result. With rewriteHistory, the removed files are also
+// purged from every commit on the current branch, along with the
+// names they had before being superseded.
+func pruneRepo(repo string, identities []string, keep int, auth SyncAuth, dryRun, rewriteHistory bool) (removed []string, rewritten int, err error) {
+	if keep < 0 {
+		return nil, 0, errors.New("Cannot keep fewer than no credentials")
+	}
+	isrepo, err := isGitRepo(repo)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rewriteHistory && !isrepo {
+		return nil, 0, errors.New(repo + " is not a git repository, so has no history to rewrite")
+	}
+	if isDiskRepo(repo) && !dryRun {
+		unlock, err := lockRepo(repo)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer unlock()
+	}
+	if len(identities) == 0 {
+		store, err := openStore(repo)
+		if err != nil {
+			return nil, 0, err
+		}
+		if identities, err = store.Identities(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	removed = []string{}
+	for _, identity := range identities {
+		files, err := pruneIdentity(repo, identity, keep, auth, dryRun)
+		if err != nil {
+			return nil, 0, err
+		}
+		removed = append(removed, files...)
+	}
+	if dryRun || !isrepo || len(removed) == 0 {
+		return removed, 0, nil
+	}
+
+	message := fmt.Sprintf("Pruned credentials whose keys are no longer in IAM\n\nRemoved %s.\n", strings.Join(removed, ", "))
+	if _, err = gitCommitPaths(repo, nil, removed, message); err != nil {
+		return nil, 0, err
+	}
+	if !rewriteHistory {
+		return removed, 0, nil
+	}
+
+	purge := []string{}
+	for _, file := range removed {
+		purge = append(purge, filepath.ToSlash(file))
+		original := strings.Replace(file, SUPERSEDED_SUFFIX, "", 1)
+		if original != file {
+			purge = append(purge, filepath.ToSlash(original))
+		}
+	}
+	rewritten, err = gitPurgePaths(repo, purge)
+	return removed, rewritten, err
+}
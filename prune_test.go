@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/realestate-com-au/goamz/iam"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPrunableVersions(t *testing.T) {
+	Convey("Test picking credentials to prune", t, func() {
+		history := []CredentialVersion{
+			{Number: 0, Name: "300-KEYCCCCC.json", KeySuffix: "KEYCCCCC", Current: true},
+			{Number: 1, Name: "200-KEYBBBBB.json", KeySuffix: "KEYBBBBB"},
+			{Number: 2, Name: "100-KEYAAAAA.json", KeySuffix: "KEYAAAAA"},
+		}
+		keys := []iam.AccessKey{
+			{Id: "AKIAFAKE0000KEYBBBBB", Status: "Inactive"},
+			{Id: "AKIAFAKE0000KEYCCCCC", Status: "Active"},
+		}
+
+		Convey("Keys that IAM still has are kept, even if inactive", func() {
+			prunable := prunableVersions(history, keys, 1)
+			So(len(prunable), ShouldEqual, 1)
+			So(prunable[0].Name, ShouldEqual, "100-KEYAAAAA.json")
+		})
+		Convey("The newest are kept regardless", func() {
+			So(len(prunableVersions(history, nil, 3)), ShouldEqual, 0)
+			So(len(prunableVersions(history, nil, 2)), ShouldEqual, 1)
+		})
+		Convey("The current version is always kept", func() {
+			history[0].Current = false
+			history[2].Current = true
+			prunable := prunableVersions(history, nil, 0)
+			So(len(prunable), ShouldEqual, 2)
+			So(prunable[0].Name, ShouldEqual, "300-KEYCCCCC.json")
+			So(prunable[1].Name, ShouldEqual, "200-KEYBBBBB.json")
+		})
+	})
+}
+
+func TestPrune(t *testing.T) {
+	Convey("Test pruning credentials against the fake IAM server", t, func() {
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		repo, err := ioutil.TempDir("", "credulous-prune")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(repo)
+
+		// rotating twice deletes the first key from IAM
+		saveTestVersions(fake, repo, "bob", 3)
+		history, err := credentialHistory(repo, "test-alias", "bob")
+		So(err, ShouldEqual, nil)
+		oldest := filepath.Join("test-alias", "bob", history[2].Name)
+		auth := SyncAuth{Keyfile: "testdata/testkey"}
+
+		Convey("A dry run removes nothing", func() {
+			removed, _, err := pruneRepo(repo, nil, DEFAULT_KEEP, auth, true, false)
+			So(err, ShouldEqual, nil)
+			So(removed, ShouldResemble, []string{oldest})
+			So(fileExists(filepath.Join(repo, oldest)), ShouldBeTrue)
+		})
+
+		Convey("Credentials whose keys IAM has forgotten are removed", func() {
+			removed, _, err := pruneRepo(repo, []string{"test-alias/bob"}, DEFAULT_KEEP, auth, false, false)
+			So(err, ShouldEqual, nil)
+			So(removed, ShouldResemble, []string{oldest})
+			So(fileExists(filepath.Join(repo, oldest)), ShouldBeFalse)
+
+			history, err := credentialHistory(repo, "test-alias", "bob")
+			So(err, ShouldEqual, nil)
+			So(len(history), ShouldEqual, 2)
+		})
+
+		Convey("Secrets have no keys in IAM, so only the newest are kept", func() {
+			pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+			So(err, ShouldEqual, nil)
+			for i := 0; i < 3; i++ {
+				So(SaveSecret(SecretData{
+					kind:    SECRET_KIND_ENV,
+					secret:  Credential{EnvVars: map[string]string{"DB_PASS": fmt.Sprint(i)}},
+					folder:  "prod",
+					name:    "db",
+					pubkeys: []ssh.PublicKey{pubkey},
+					repo:    repo,
+				}), ShouldEqual, nil)
+			}
+
+			removed, _, err := pruneRepo(repo, nil, DEFAULT_KEEP, auth, false, false)
+			So(err, ShouldEqual, nil)
+			So(removed, ShouldContain, oldest)
+			So(len(removed), ShouldEqual, 3)
+			history, err := credentialHistory(repo, "prod", "db")
+			So(err, ShouldEqual, nil)
+			So(len(history), ShouldEqual, 1)
+			So(history[0].Current, ShouldBeTrue)
+		})
+
+		Convey("Keeping more keeps them", func() {
+			removed, _, err := pruneRepo(repo, nil, 3, auth, false, false)
+			So(err, ShouldEqual, nil)
+			So(len(removed), ShouldEqual, 0)
+		})
+
+		Convey("Without a key to ask IAM with, nothing is removed", func() {
+			_, _, err := pruneRepo(repo, nil, DEFAULT_KEEP, SyncAuth{}, false, false)
+			So(err, ShouldNotEqual, nil)
+			So(fileExists(filepath.Join(repo, oldest)), ShouldBeTrue)
+		})
+
+		Convey("Only git repositories have history to rewrite", func() {
+			_, _, err := pruneRepo(repo, nil, DEFAULT_KEEP, auth, false, true)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestPruneRewriteHistory(t *testing.T) {
+	Convey("Test purging pruned credentials from git history", t, func() {
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		repo, err := ioutil.TempDir("", "credulous-prune")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(repo)
+		initTestRepo(repo)
+
+		saveTestVersions(fake, repo, "bob", 3)
+		history, err := credentialHistory(repo, "test-alias", "bob")
+		So(err, ShouldEqual, nil)
+		oldest := filepath.Join("test-alias", "bob", history[2].Name)
+
+		removed, rewritten, err := pruneRepo(repo, nil, DEFAULT_KEEP, SyncAuth{Keyfile: "testdata/testkey"}, false, true)
+		So(err, ShouldEqual, nil)
+		So(removed, ShouldResemble, []string{oldest})
+		So(rewritten, ShouldBeGreaterThan, 0)
+
+		// no commit on the branch has the file any more
+		origins, err := gitFileOrigins(repo, filepath.Join("test-alias", "bob"))
+		So(err, ShouldEqual, nil)
+		So(len(origins), ShouldEqual, 2)
+		_, found := origins[filepath.ToSlash(oldest)]
+		So(found, ShouldBeFalse)
+
+		creds, err := RetrieveCredentials(repo, "test-alias", "bob", "testdata/testkey")
+		So(err, ShouldEqual, nil)
+		So(creds.IamUsername, ShouldEqual, "bob")
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// TemplateData is what a template given to render can use
+type TemplateData struct {
+	KeyId     string
+	SecretKey string
+	// SessionToken is always empty, since credulous keeps long-lived
+	// IAM keys, but is here for templates shared with tools that have one
+	SessionToken string
+	EnvVars      map[string]string
+	Username     string
+	Account      string
+	Created      time.Time
+	// Expires is zero for credentials saved without a lifetime
+	Expires time.Time
+	Tags    map[string]string
+}
+
+func newTemplateData(creds Credentials) TemplateData {
+	decoded := creds.Encryptions[0].decoded
+	data := TemplateData{
+		KeyId:     decoded.KeyId,
+		SecretKey: decoded.SecretKey,
+		EnvVars:   decoded.EnvVars,
+		Username:  creds.IamUsername,
+		Account:   creds.AccountAliasOrId,
+		Tags:      creds.Tags,
+	}
+	if data.EnvVars == nil {
+		data.EnvVars = map[string]string{}
+	}
+	if data.Tags == nil {
+		data.Tags = map[string]string{}
+	}
+	if created, err := strconv.ParseInt(creds.CreateTime, 10, 64); err == nil {
+		data.Created = time.Unix(created, 0)
+	}
+	if expiry := creds.expiryTime(); expiry > 0 {
+		data.Expires = time.Unix(expiry, 0)
+	}
+	return data
+}
+
+// renderTemplate fills in a template with a set of credentials. A
+// variable or tag the template uses but the credentials lack is an
+// error, rather than a blank in a config file, and nothing is written
+// unless all of it renders.
+func renderTemplate(output io.Writer, name string, text []byte, creds Credentials) error {
+	tmpl, err := template.New(filepath.Base(name)).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err = tmpl.Execute(&out, newTemplateData(creds)); err != nil {
+		return err
+	}
+	_, err = output.Write(out.Bytes())
+	return err
+}
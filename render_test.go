@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const TEST_BOTO_TEMPLATE string = `[Credentials]
+aws_access_key_id = {{.KeyId}}
+aws_secret_access_key = {{.SecretKey}}
+{{- with .SessionToken}}
+aws_session_token = {{.}}
+{{- end}}
+
+[Boto]
+ec2_region_name = {{index .EnvVars "AWS_DEFAULT_REGION"}}
+# {{.Username}}@{{.Account}}, {{.Tags.team}}, expires {{.Expires.UTC.Format "2006-01-02"}}
+`
+
+func TestRender(t *testing.T) {
+	Convey("Test rendering credentials into a template", t, func() {
+		creds := Credentials{
+			IamUsername:      "bob",
+			AccountAliasOrId: "acct",
+			CreateTime:       "1401515273",
+			LifeTime:         86400,
+			Tags:             map[string]string{"team": "payments"},
+			Encryptions: []Encryption{{decoded: Credential{
+				KeyId:     "AKIAEXAMPLE",
+				SecretKey: "secret",
+				EnvVars:   map[string]string{"AWS_DEFAULT_REGION": "ap-southeast-2"},
+			}}},
+		}
+		render := func(text string) (string, error) {
+			var out bytes.Buffer
+			err := renderTemplate(&out, "/some/boto.tmpl", []byte(text), creds)
+			return out.String(), err
+		}
+
+		Convey("Keys, variables and metadata are filled in", func() {
+			out, err := render(TEST_BOTO_TEMPLATE)
+			So(err, ShouldEqual, nil)
+			So(out, ShouldEqual, `[Credentials]
+aws_access_key_id = AKIAEXAMPLE
+aws_secret_access_key = secret
+
+[Boto]
+ec2_region_name = ap-southeast-2
+# bob@acct, payments, expires 2014-06-01
+`)
+		})
+
+		Convey("Credentials without a lifetime never expire", func() {
+			creds.LifeTime = 0
+			out, err := render(`{{if .Expires.IsZero}}never{{end}} {{.Created.Unix}}`)
+			So(err, ShouldEqual, nil)
+			So(out, ShouldEqual, "never 1401515273")
+		})
+
+		Convey("Anything missing is an error, and nothing is written", func() {
+			out, err := render(`region = {{.EnvVars.AWS_REGION}}`)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "boto.tmpl")
+			So(err.Error(), ShouldContainSubstring, `map has no entry for key "AWS_REGION"`)
+			So(out, ShouldEqual, "")
+
+			_, err = render(`{{.Nonsense}}`)
+			So(err, ShouldNotEqual, nil)
+			_, err = render(`{{.KeyId`)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
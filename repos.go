@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The repo that credentials are saved to if nothing else is configured
+const LOCAL_REPO string = "local"
+
+// RepoSettings records which of the repos under the root path is the
+// default, the order in which they are searched when sourcing, and how
+// strictly each one's signatures are checked. Stores maps the names of
+// repos kept elsewhere, such as in S3 or a bundle file, to their URLs.
+type RepoSettings struct {
+	Default    string
+	Order      []string
+	Signatures map[string]string `json:",omitempty"`
+	Stores     map[string]string `json:",omitempty"`
+}
+
+func repoSettingsFile() string {
+	return filepath.Join(getRootPath(), "repos.json")
+}
+
+func loadRepoSettings() (RepoSettings, error) {
+	settings := RepoSettings{Default: LOCAL_REPO}
+	b, err := ioutil.ReadFile(repoSettingsFile())
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return RepoSettings{}, err
+	}
+	if err = json.Unmarshal(b, &settings); err != nil {
+		return RepoSettings{}, err
+	}
+	if settings.Default == "" {
+		settings.Default = LOCAL_REPO
+	}
+	return settings, nil
+}
+
+// defaultRepo is the repo to save to when none is given: the one in the
+// config file or environment, or else the one set with 'repo default'
+func (settings RepoSettings) defaultRepo() string {
+	if name := configString("repo", ""); name != "" {
+		return name
+	}
+	return settings.Default
+}
+
+// searchOrder is the order repos are searched in, as configured, or
+// else as set with 'repo order'
+func (settings RepoSettings) searchOrder() []string {
+	if order := configValues("repo_order", ""); order != nil {
+		return order
+	}
+	return settings.Order
+}
+
+func (settings RepoSettings) save() error {
+	b, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(repoSettingsFile(), b, 0600)
+}
+
+func validRepoName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return errors.New("Invalid repository name '" + name + "'")
+	}
+	return nil
+}
+
+func sortedStoreNames(settings RepoSettings) []string {
+	names := []string{}
+	for name := range settings.Stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// listRepos returns the names of all the repos under the root path, and
+// of the stores added elsewhere
+func listRepos() ([]string, error) {
+	entries, err := ioutil.ReadDir(getRootPath())
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	settings, err := loadRepoSettings()
+	if err != nil {
+		return nil, err
+	}
+	return append(names, sortedStoreNames(settings)...), nil
+}
+
+// resolveRepo turns a --repo argument into a path or store URL. Plain
+// names are looked up among the stores and then under the root path;
+// anything with a path separator in it is taken as a path or URL, as it
+// always has been.
+func resolveRepo(name string) (string, error) {
+	if strings.ContainsRune(name, filepath.Separator) || isStoreURL(name) {
+		return name, nil
+	}
+	if err := validRepoName(name); err != nil {
+		return "", err
+	}
+	settings, err := loadRepoSettings()
+	if err != nil {
+		return "", err
+	}
+	if url, ok := settings.Stores[name]; ok {
+		return url, nil
+	}
+	repo := filepath.Join(getRootPath(), name)
+	// the local repo springs into being the first time we save to it
+	if name == LOCAL_REPO {
+		return repo, nil
+	}
+	if _, err := os.Stat(repo); err != nil {
+		return "", errors.New("No repository named '" + name + "'; see 'credulous repo list'")
+	}
+	return repo, nil
+}
+
+// repoSearchOrder lists the repos to look through for credentials:
+// those in the configured order first, then the default, then the rest
+// alphabetically
+func repoSearchOrder() ([]string, error) {
+	settings, err := loadRepoSettings()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := listRepos()
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool)
+	for _, name := range existing {
+		exists[name] = true
+	}
+
+	order := []string{}
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if exists[name] && !seen[name] {
+			seen[name] = true
+			order = append(order, name)
+		}
+	}
+	for _, name := range settings.searchOrder() {
+		add(name)
+	}
+	add(settings.defaultRepo())
+	sort.Strings(existing)
+	for _, name := range existing {
+		add(name)
+	}
+	return order, nil
+}
+
+// findRepoFor returns the path of the first repo, in search order, that
+// holds credentials for the given account and user
+func findRepoFor(account, username string) (string, error) {
+	order, err := repoSearchOrder()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range order {
+		repo, err := resolveRepo(name)
+		if err != nil {
+			return "", err
+		}
+		store, err := openStore(repo)
+		if err != nil {
+			log.Print("WARNING: cannot search " + name + ": " + err.Error())
+			continue
+		}
+		identities, err := store.Identities()
+		if err != nil {
+			log.Print("WARNING: cannot search " + name + ": " + err.Error())
+			continue
+		}
+		for _, identity := range identities {
+			if identity == path.Join(account, username) {
+				return repo, nil
+			}
+		}
+	}
+	return "", errors.New("No credentials for " + username + "@" + account + " found in any repository")
+}
+
+func initRepo(name string) (string, error) {
+	if err := validRepoName(name); err != nil {
+		return "", err
+	}
+	repo := filepath.Join(getRootPath(), name)
+	if _, err := os.Stat(repo); err == nil {
+		return "", errors.New("Repository '" + name + "' already exists")
+	}
+	if err := gitInit(repo); err != nil {
+		return "", err
+	}
+	return repo, nil
+}
+
+func cloneRepo(url, name string) (string, error) {
+	if err := validRepoName(name); err != nil {
+		return "", err
+	}
+	repo := filepath.Join(getRootPath(), name)
+	if _, err := os.Stat(repo); err == nil {
+		return "", errors.New("Repository '" + name + "' already exists")
+	}
+	if err := gitClone(url, repo); err != nil {
+		os.RemoveAll(repo)
+		return "", err
+	}
+	return repo, nil
+}
+
+// addStoreRepo names a store kept somewhere other than under the root
+// path, so that it can be saved to and searched like any other repo
+func addStoreRepo(name, url string) error {
+	if err := validRepoName(name); err != nil {
+		return err
+	}
+	if isDiskRepo(url) {
+		return errors.New("'" + url + "' is not an " + S3_SCHEME + " or " + VAULT_SCHEME + " URL, or a " + BUNDLE_SUFFIX +
+			" file; use 'credulous repo clone' for git repositories")
+	}
+	if !isStoreURL(url) {
+		abs, err := filepath.Abs(url)
+		if err != nil {
+			return err
+		}
+		url = abs
+	}
+	if _, err := openStore(url); err != nil {
+		return err
+	}
+	settings, err := loadRepoSettings()
+	if err != nil {
+		return err
+	}
+	_, isStore := settings.Stores[name]
+	if _, err := os.Stat(filepath.Join(getRootPath(), name)); err == nil || isStore {
+		return errors.New("Repository '" + name + "' already exists")
+	}
+	if settings.Stores == nil {
+		settings.Stores = make(map[string]string)
+	}
+	settings.Stores[name] = url
+	return settings.save()
+}
+
+// removeRepo deletes a repo under the root path; for a store, only the
+// name is forgotten, and what's in it is left alone. Unless forced, a
+// repo with commits that haven't been pushed anywhere is kept, as is a
+// directory that isn't a git repository, since then nothing in it has
+// been.
+func removeRepo(name string, force bool) error {
+	if err := validRepoName(name); err != nil {
+		return err
+	}
+	settings, err := loadRepoSettings()
+	if err != nil {
+		return err
+	}
+	if _, ok := settings.Stores[name]; ok {
+		delete(settings.Stores, name)
+	} else {
+		repos, err := listRepos()
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, repo := range repos {
+			found = found || repo == name
+		}
+		if !found {
+			return errors.New("No repository named '" + name + "'; see 'credulous repo list'")
+		}
+		repo := filepath.Join(getRootPath(), name)
+		if !force {
+			if err := checkNothingUnpushed(repo); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(repo); err != nil {
+			return err
+		}
+	}
+
+	order := []string{}
+	for _, n := range settings.Order {
+		if n != name {
+			order = append(order, n)
+		}
+	}
+	settings.Order = order
+	delete(settings.Signatures, name)
+	if settings.Default == name {
+		settings.Default = LOCAL_REPO
+	}
+	return settings.save()
+}
+
+// checkNothingUnpushed makes sure that everything in a repo is somewhere
+// else too
+func checkNothingUnpushed(repo string) error {
+	name := filepath.Base(repo)
+	isrepo, err := isGitRepo(repo)
+	if err != nil {
+		return err
+	}
+	if !isrepo {
+		return errors.New("'" + name + "' is not a git repository, so its credentials are nowhere else; use --force to remove it anyway")
+	}
+	unpushed, err := gitUnpushed(repo)
+	if err != nil {
+		return errors.New("Cannot tell whether '" + name + "' has unpushed commits (" + err.Error() + "); use --force to remove it anyway")
+	}
+	if unpushed {
+		return errors.New("'" + name + "' has commits that haven't been pushed; use --force to remove it anyway")
+	}
+	return nil
+}
+
+func setDefaultRepo(name string) error {
+	if _, err := resolveRepo(name); err != nil {
+		return err
+	}
+	settings, err := loadRepoSettings()
+	if err != nil {
+		return err
+	}
+	settings.Default = name
+	return settings.save()
+}
+
+func setRepoOrder(names []string) error {
+	for _, name := range names {
+		if _, err := resolveRepo(name); err != nil {
+			return err
+		}
+	}
+	settings, err := loadRepoSettings()
+	if err != nil {
+		return err
+	}
+	settings.Order = names
+	return settings.save()
+}
+
+func setSignaturePolicy(name, policy string) error {
+	repo, err := resolveRepo(name)
+	if err != nil {
+		return err
+	}
+	if err := validSignaturePolicy(policy); err != nil {
+		return err
+	}
+	if policy == SIGNATURES_REQUIRE && strings.HasPrefix(repo, VAULT_SCHEME) {
+		return errors.New("Vault doesn't keep signatures, so '" + name + "' can't require them")
+	}
+	settings, err := loadRepoSettings()
+	if err != nil {
+		return err
+	}
+	if settings.Signatures == nil {
+		settings.Signatures = make(map[string]string)
+	}
+	settings.Signatures[name] = policy
+	return settings.save()
+}
+
+// signaturePolicy returns how strictly to check signatures in the repo
+// at the given path or URL. Repos given by path rather than by name get
+// the default.
+func signaturePolicy(repo string) (string, error) {
+	settings, err := loadRepoSettings()
+	if err != nil {
+		return "", err
+	}
+	for name, url := range settings.Stores {
+		if url != repo {
+			continue
+		}
+		if policy, ok := settings.Signatures[name]; ok {
+			return policy, nil
+		}
+		return SIGNATURES_VERIFY, nil
+	}
+	if filepath.Clean(filepath.Dir(repo)) != filepath.Clean(getRootPath()) {
+		return SIGNATURES_VERIFY, nil
+	}
+	if policy, ok := settings.Signatures[filepath.Base(repo)]; ok {
+		return policy, nil
+	}
+	return SIGNATURES_VERIFY, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// withTempHome points $HOME, and so the credulous root path, at a fresh
+// directory for the duration of a test
+func withTempHome() (home string, cleanup func()) {
+	home, err := ioutil.TempDir("", "credulous-home")
+	panic_the_err(err)
+	origHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	return home, func() {
+		os.Setenv("HOME", origHome)
+		os.RemoveAll(home)
+	}
+}
+
+func TestRepos(t *testing.T) {
+	Convey("Test managing repositories", t, func() {
+		_, cleanup := withTempHome()
+		defer cleanup()
+
+		for _, dir := range []string{"local/acct/alice", "team/acct/bob", "ops/acct/bob", ".hidden"} {
+			So(os.MkdirAll(filepath.Join(getRootPath(), dir), 0700), ShouldEqual, nil)
+		}
+
+		Convey("Repos are the visible directories under the root", func() {
+			repos, err := listRepos()
+			So(err, ShouldEqual, nil)
+			So(repos, ShouldResemble, []string{"local", "ops", "team"})
+		})
+
+		Convey("Names resolve under the root path", func() {
+			repo, err := resolveRepo("team")
+			So(err, ShouldEqual, nil)
+			So(repo, ShouldEqual, filepath.Join(getRootPath(), "team"))
+		})
+		Convey("Paths are taken as they are", func() {
+			repo, err := resolveRepo("/some/where/else")
+			So(err, ShouldEqual, nil)
+			So(repo, ShouldEqual, "/some/where/else")
+		})
+		Convey("Unknown names are an error", func() {
+			_, err := resolveRepo("nosuch")
+			So(err.Error(), ShouldEqual, "No repository named 'nosuch'; see 'credulous repo list'")
+		})
+		Convey("The local repo needn't exist yet", func() {
+			So(os.RemoveAll(filepath.Join(getRootPath(), "local")), ShouldEqual, nil)
+			_, err := resolveRepo(LOCAL_REPO)
+			So(err, ShouldEqual, nil)
+		})
+
+		Convey("The default repo is searched first", func() {
+			order, err := repoSearchOrder()
+			So(err, ShouldEqual, nil)
+			So(order, ShouldResemble, []string{"local", "ops", "team"})
+
+			So(setDefaultRepo("team"), ShouldEqual, nil)
+			order, err = repoSearchOrder()
+			So(err, ShouldEqual, nil)
+			So(order, ShouldResemble, []string{"team", "local", "ops"})
+
+			repo, err := findRepoFor("acct", "bob")
+			So(err, ShouldEqual, nil)
+			So(repo, ShouldEqual, filepath.Join(getRootPath(), "team"))
+		})
+
+		Convey("A configured order comes before the default", func() {
+			So(setRepoOrder([]string{"ops", "team"}), ShouldEqual, nil)
+			order, err := repoSearchOrder()
+			So(err, ShouldEqual, nil)
+			So(order, ShouldResemble, []string{"ops", "team", "local"})
+
+			repo, err := findRepoFor("acct", "bob")
+			So(err, ShouldEqual, nil)
+			So(repo, ShouldEqual, filepath.Join(getRootPath(), "ops"))
+		})
+
+		Convey("Credentials that aren't anywhere are an error", func() {
+			_, err := findRepoFor("acct", "carol")
+			So(err.Error(), ShouldEqual, "No credentials for carol@acct found in any repository")
+		})
+
+		Convey("Removing the default repo reverts to local", func() {
+			So(setDefaultRepo("team"), ShouldEqual, nil)
+			So(setRepoOrder([]string{"team", "ops"}), ShouldEqual, nil)
+			So(removeRepo("team", true), ShouldEqual, nil)
+
+			settings, err := loadRepoSettings()
+			So(err, ShouldEqual, nil)
+			So(settings.Default, ShouldEqual, LOCAL_REPO)
+			So(settings.Order, ShouldResemble, []string{"ops"})
+			So(fileExists(filepath.Join(getRootPath(), "team")), ShouldBeFalse)
+		})
+
+		Convey("Repo names can't escape the root path", func() {
+			So(removeRepo("../elsewhere", true), ShouldNotEqual, nil)
+			So(removeRepo(".hidden", true), ShouldNotEqual, nil)
+		})
+
+		Convey("Only repos can be removed, not the files beside them", func() {
+			for _, file := range []string{"config", "allowed_signers"} {
+				So(ioutil.WriteFile(filepath.Join(getRootPath(), file), []byte("x"), 0600), ShouldEqual, nil)
+				So(removeRepo(file, true).Error(), ShouldEqual, "No repository named '"+file+"'; see 'credulous repo list'")
+				So(fileExists(filepath.Join(getRootPath(), file)), ShouldBeTrue)
+			}
+		})
+
+		Convey("Credentials that are nowhere else aren't removed without --force", func() {
+			So(removeRepo("local", false).Error(), ShouldEqual,
+				"'local' is not a git repository, so its credentials are nowhere else; use --force to remove it anyway")
+			So(fileExists(filepath.Join(getRootPath(), "local")), ShouldBeTrue)
+
+			team := filepath.Join(getRootPath(), "team")
+			initTestRepo(team)
+			So(ioutil.WriteFile(filepath.Join(team, "acct", "bob", "1-AAAA.json"), []byte("x"), 0600), ShouldEqual, nil)
+			_, err := gitCommitPaths(team, []string{filepath.Join("acct", "bob", "1-AAAA.json")}, nil, "saved")
+			So(err, ShouldEqual, nil)
+			So(removeRepo("team", false).Error(), ShouldEqual, "'team' has commits that haven't been pushed; use --force to remove it anyway")
+
+			remote := filepath.Join(getRootPath(), ".remote.git")
+			So(initBareTestRepo(remote), ShouldEqual, nil)
+			So(setSyncRemote(team, "origin", remote), ShouldEqual, nil)
+			So(gitPush(team, "origin"), ShouldEqual, nil)
+			So(removeRepo("team", false), ShouldEqual, nil)
+			So(fileExists(team), ShouldBeFalse)
+
+			So(removeRepo("local", true), ShouldEqual, nil)
+			So(fileExists(filepath.Join(getRootPath(), "local")), ShouldBeFalse)
+		})
+	})
+}
+
+func TestRepoInitClone(t *testing.T) {
+	Convey("Test creating and cloning repositories", t, func() {
+		_, cleanup := withTempHome()
+		defer cleanup()
+
+		repo, err := initRepo("shared")
+		So(err, ShouldEqual, nil)
+		isrepo, err := isGitRepo(repo)
+		So(err, ShouldEqual, nil)
+		So(isrepo, ShouldBeTrue)
+
+		_, err = initRepo("shared")
+		So(err.Error(), ShouldEqual, "Repository 'shared' already exists")
+
+		Convey("A clone syncs with where it came from", func() {
+			initTestRepo(repo)
+			addTestFile(repo, "acct/alice/1-aaaa.json", "alice's first")
+
+			clone, err := cloneRepo("file://"+repo, "copy")
+			So(err, ShouldEqual, nil)
+			So(fileExists(filepath.Join(clone, "acct/alice/1-aaaa.json")), ShouldBeTrue)
+
+			url, err := gitRemoteURL(clone)
+			So(err, ShouldEqual, nil)
+			So(url, ShouldEqual, "file://"+repo)
+		})
+	})
+}
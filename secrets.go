@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// The kinds of secret credulous keeps: AWS credentials, which source
+// loads, a bundle of environment variables, such as a database's user
+// and password, and the contents of a file, such as a TLS key
+const (
+	SECRET_KIND_AWS  string = "aws-iam"
+	SECRET_KIND_ENV  string = "env"
+	SECRET_KIND_FILE string = "file"
+)
+
+var SECRET_KINDS = []string{SECRET_KIND_AWS, SECRET_KIND_ENV, SECRET_KIND_FILE}
+
+// SecretData is what put saves
+type SecretData struct {
+	kind    string
+	secret  Credential
+	folder  string
+	name    string
+	pubkeys []ssh.PublicKey
+	repo    string
+	tags    map[string]string
+}
+
+func isSecretKind(kind string) bool {
+	for _, known := range SECRET_KINDS {
+		if kind == known {
+			return true
+		}
+	}
+	return false
+}
+
+// secretKind is the kind of secret saved credentials are; those saved
+// before there were kinds are AWS credentials
+func secretKind(kind string) string {
+	if kind == "" {
+		return SECRET_KIND_AWS
+	}
+	return kind
+}
+
+// splitSecretPath splits a secret's <folder>/<name>. Secrets are kept
+// where credentials for <name>@<folder> would be, so a folder can be an
+// account, keeping its secrets with its credentials.
+func splitSecretPath(secretPath string) (folder, name string, err error) {
+	parts := strings.Split(secretPath, "/")
+	if len(parts) != 2 || validRepoName(parts[0]) != nil || validRepoName(parts[1]) != nil || strings.Contains(secretPath, "@") {
+		return "", "", errors.New("Invalid secret path '" + secretPath + "'; please give it as <folder>/<name>")
+	}
+	return parts[0], parts[1], nil
+}
+
+// storedIdentity names what's saved for an account and username as it
+// is asked for: username@account for AWS credentials, and folder/name
+// for other secrets
+func storedIdentity(kind, account, username string) string {
+	if secretKind(kind) == SECRET_KIND_AWS {
+		return username + "@" + account
+	}
+	return account + "/" + username
+}
+
+// storedKind is the kind of secret saved for an account and username,
+// taking anything it can't read to be AWS credentials
+func storedKind(repo, account, username string) string {
+	store, err := openStore(repo)
+	if err != nil {
+		return SECRET_KIND_AWS
+	}
+	file, err := store.Latest(account, username)
+	if err != nil {
+		return SECRET_KIND_AWS
+	}
+	creds, _, err := readCredentialMetadata(file.Data)
+	if err != nil {
+		return SECRET_KIND_AWS
+	}
+	return secretKind(creds.Kind)
+}
+
+// checkKindUnchanged makes sure that saving a kind of secret won't
+// replace a different kind saved under the same name
+func checkKindUnchanged(repo, account, username, kind string) error {
+	store, err := openStore(repo)
+	if err != nil {
+		return err
+	}
+	file, err := store.Latest(account, username)
+	if err != nil {
+		return nil
+	}
+	creds, _, err := readCredentialMetadata(file.Data)
+	if err != nil || secretKind(creds.Kind) == kind {
+		return nil
+	}
+	if secretKind(creds.Kind) == SECRET_KIND_AWS {
+		return errors.New(account + "/" + username + " is where the AWS credentials for " +
+			username + "@" + account + " are kept; please choose another name")
+	}
+	return errors.New(account + "/" + username + " holds a secret of kind '" + creds.Kind + "', not '" + kind +
+		"'; please choose another name")
+}
+
+// secretFilename names a secret's file as credential files are named,
+// though with the nanoseconds as the suffix, since there's no key ID;
+// they keep secrets saved within a second in the order they were saved
+func secretFilename(created time.Time) string {
+	return fmt.Sprintf("%d-%08X.json", created.Unix(), created.Nanosecond())
+}
+
+// SaveSecret encrypts and saves a secret that isn't AWS credentials
+func SaveSecret(data SecretData) error {
+	fmt.Printf("saving %s secret %s/%s\n", data.kind, data.folder, data.name)
+	if err := checkKindUnchanged(data.repo, data.folder, data.name, data.kind); err != nil {
+		return err
+	}
+	encryptions, err := encryptCredential(data.secret, data.pubkeys)
+	if err != nil {
+		return err
+	}
+	created := time.Now()
+	creds := Credentials{
+		Version:          FORMAT_VERSION,
+		Kind:             data.kind,
+		AccountAliasOrId: data.folder,
+		IamUsername:      data.name,
+		CreateTime:       fmt.Sprintf("%d", created.Unix()),
+		Encryptions:      encryptions,
+		Tags:             mergeTags(data.repo, data.folder, data.name, data.tags),
+	}
+	return creds.WriteToDisk(data.repo, secretFilename(created))
+}
+
+// parsePutArgs reads the secret put is to save: variables given with
+// --env as NAME=value, or as NAME to take the value from the
+// environment and keep it out of shell history, or a file given with
+// --file, which is read from stdin if it's -
+func parsePutArgs(c *cli.Context, stdin io.Reader) (secret Credential, kind string, err error) {
+	envArgs, file := c.StringSlice("env"), c.String("file")
+	switch {
+	case len(envArgs) > 0 && file != "":
+		return Credential{}, "", errors.New("Please give the secret with either --env or --file, not both")
+	case file == "-":
+		secret.Data, err = ioutil.ReadAll(stdin)
+		return secret, SECRET_KIND_FILE, err
+	case file != "":
+		secret.Data, err = ioutil.ReadFile(file)
+		return secret, SECRET_KIND_FILE, err
+	case len(envArgs) == 0:
+		return Credential{}, "", errors.New("Please give the secret with --env NAME=value or --file <file>")
+	}
+
+	secret.EnvVars = make(map[string]string)
+	for _, arg := range envArgs {
+		parts := strings.SplitN(arg, "=", 2)
+		if !envVarName.MatchString(parts[0]) {
+			return Credential{}, "", errors.New("Invalid variable name '" + parts[0] + "'")
+		}
+		if len(parts) == 1 {
+			value, ok := os.LookupEnv(parts[0])
+			if !ok {
+				return Credential{}, "", errors.New(parts[0] + " is not set in the environment")
+			}
+			parts = append(parts, value)
+		}
+		secret.EnvVars[parts[0]] = parts[1]
+	}
+	return secret, SECRET_KIND_ENV, nil
+}
+
+// writeSecret writes out what get was asked for: for variables, all of
+// them in the given format, or just the value of one field; for a file,
+// its contents
+func writeSecret(output io.Writer, creds Credentials, format, field string) error {
+	secret := creds.Encryptions[0].decoded
+	identity := storedIdentity(creds.Kind, creds.AccountAliasOrId, creds.IamUsername)
+	switch secretKind(creds.Kind) {
+	case SECRET_KIND_AWS:
+		return errors.New(creds.AccountAliasOrId + "/" + creds.IamUsername + " holds AWS credentials; please use 'credulous source " + identity + "'")
+	case SECRET_KIND_FILE:
+		if field != "" {
+			return errors.New(identity + " is a file, which has no fields")
+		}
+		_, err := output.Write(secret.Data)
+		return err
+	case SECRET_KIND_ENV:
+		if field != "" {
+			value, ok := secret.EnvVars[field]
+			if !ok {
+				return errors.New("There is no " + field + " in " + identity)
+			}
+			_, err := fmt.Fprintln(output, value)
+			return err
+		}
+		names := []string{}
+		for name := range secret.EnvVars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		vars := []envVar{}
+		for _, name := range names {
+			vars = append(vars, envVar{name, secret.EnvVars[name]})
+		}
+		return writeEnv(output, format, vars)
+	}
+	return errors.New(identity + " is a " + creds.Kind + " secret, which this version of credulous doesn't know")
+}
+
+// validateSecret makes sure a secret is the one asked for, as
+// ValidateCredentials does for AWS credentials, short of asking AWS
+func (cred Credentials) validateSecret(folder, name string) error {
+	if cred.AccountAliasOrId != folder || cred.IamUsername != name {
+		return errors.New("FATAL: the secret saved as " + folder + "/" + name + " says it is " +
+			cred.AccountAliasOrId + "/" + cred.IamUsername)
+	}
+	return nil
+}
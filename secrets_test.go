@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSecrets(t *testing.T) {
+	Convey("Test saving and getting secrets", t, func() {
+		_, cleanup := withTempHome()
+		defer cleanup()
+		repo := filepath.Join(getRootPath(), "local")
+		pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		So(err, ShouldEqual, nil)
+		put := func(kind, folder, name string, secret Credential) error {
+			return SaveSecret(SecretData{
+				kind:    kind,
+				secret:  secret,
+				folder:  folder,
+				name:    name,
+				pubkeys: []ssh.PublicKey{pubkey},
+				repo:    repo,
+			})
+		}
+		So(put(SECRET_KIND_ENV, "prod", "db", Credential{EnvVars: map[string]string{"DB_USER": "app", "DB_PASS": "s3cret"}}), ShouldEqual, nil)
+		So(put(SECRET_KIND_FILE, "prod", "tls", Credential{Data: []byte("-----BEGIN KEY-----\n")}), ShouldEqual, nil)
+
+		Convey("Secrets are named <folder>/<name>", func() {
+			folder, name, err := splitSecretPath("prod/db")
+			So(err, ShouldEqual, nil)
+			So(folder+" "+name, ShouldEqual, "prod db")
+			for _, bad := range []string{"", "db", "prod/db/extra", "db@prod", "../db", "prod/"} {
+				_, _, err := splitSecretPath(bad)
+				So(err.Error(), ShouldEqual, "Invalid secret path '"+bad+"'; please give it as <folder>/<name>")
+			}
+		})
+
+		Convey("Variables come back in any format, or one at a time", func() {
+			creds, err := RetrieveCredentials(repo, "prod", "db", "testdata/testkey")
+			So(err, ShouldEqual, nil)
+			So(creds.Kind, ShouldEqual, SECRET_KIND_ENV)
+			So(creds.validateSecret("prod", "db"), ShouldEqual, nil)
+
+			var out bytes.Buffer
+			So(writeSecret(&out, creds, "dotenv", ""), ShouldEqual, nil)
+			So(out.String(), ShouldEqual, `DB_PASS="s3cret"`+"\n"+`DB_USER="app"`+"\n")
+
+			out.Reset()
+			So(writeSecret(&out, creds, "dotenv", "DB_USER"), ShouldEqual, nil)
+			So(out.String(), ShouldEqual, "app\n")
+			So(writeSecret(&out, creds, "dotenv", "DB_HOST").Error(), ShouldEqual, "There is no DB_HOST in prod/db")
+		})
+
+		Convey("Files come back as they were", func() {
+			creds, err := RetrieveCredentials(repo, "prod", "tls", "testdata/testkey")
+			So(err, ShouldEqual, nil)
+			var out bytes.Buffer
+			So(writeSecret(&out, creds, "bash", ""), ShouldEqual, nil)
+			So(out.String(), ShouldEqual, "-----BEGIN KEY-----\n")
+			So(writeSecret(&out, creds, "bash", "KEY").Error(), ShouldEqual, "prod/tls is a file, which has no fields")
+		})
+
+		Convey("They are listed by path, with their kind", func() {
+			rootDir, err := os.Open(getRootPath())
+			So(err, ShouldEqual, nil)
+			settings, err := loadRepoSettings()
+			So(err, ShouldEqual, nil)
+			set, err := listAvailableCredentials(rootDir, settings)
+			So(err, ShouldEqual, nil)
+			So(set, ShouldResemble, []string{"prod/db", "prod/tls"})
+
+			listings, err := listCredentialDetails("")
+			So(err, ShouldEqual, nil)
+			listings = filterListings(listings, CredentialFilter{Kinds: []string{SECRET_KIND_FILE}})
+			So(len(listings), ShouldEqual, 1)
+			So(listings[0].Identity, ShouldEqual, "prod/tls")
+			So(listings[0].Kind, ShouldEqual, SECRET_KIND_FILE)
+		})
+
+		Convey("One kind isn't saved over another", func() {
+			err := put(SECRET_KIND_FILE, "prod", "db", Credential{Data: []byte("x")})
+			So(err.Error(), ShouldEqual, "prod/db holds a secret of kind 'env', not 'file'; please choose another name")
+			So(checkKindUnchanged(repo, "prod", "tls", SECRET_KIND_AWS), ShouldNotEqual, nil)
+			So(checkKindUnchanged(repo, "prod", "tls", SECRET_KIND_FILE), ShouldEqual, nil)
+		})
+	})
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// SHELL_INIT_SHELLS are the shells shell-init can set up
+var SHELL_INIT_SHELLS = []string{"bash", "zsh", "fish"}
+
+// COMPLETE_ARGS says what the arguments to each command are, by its
+// name under credulous, so that they can be completed. Commands that
+// aren't here take no arguments, or none that we can suggest.
+var COMPLETE_ARGS = map[string]string{
+	"import":          "file",
+	"source":          "identity",
+	"pick":            "identity",
+	"render":          "identity",
+	"exec":            "identity",
+	"export":          "identity",
+	"history":         "identity",
+	"restore":         "identity",
+	"prune":           "identity",
+	"get":             "secret",
+	"put":             "secret",
+	"shell-init":      "shell",
+	"repo remove":     "repo",
+	"repo default":    "repo",
+	"repo order":      "repo",
+	"repo sign":       "repo",
+	"repo signatures": "repo",
+}
+
+// COMPLETE_FLAG_VALUES says what the values of flags are, by long name;
+// other flags that take a value get no suggestions
+var COMPLETE_FLAG_VALUES = map[string]string{
+	"credentials": "identity",
+	"repo":        "repo",
+	"key":         "file",
+	"format":      "format",
+	"kind":        "kind",
+}
+
+// completionFlag is what completion needs to know about a flag
+type completionFlag struct {
+	names      []string
+	takesValue bool
+	usage      string
+	values     string
+}
+
+func newCompletionFlag(name, usage string, takesValue bool) completionFlag {
+	flag := completionFlag{takesValue: takesValue, usage: strings.Join(strings.Fields(usage), " ")}
+	for _, part := range strings.Split(name, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 1 {
+			flag.names = append(flag.names, "-"+part)
+		} else {
+			flag.names = append(flag.names, "--"+part)
+		}
+	}
+	if takesValue {
+		flag.values = COMPLETE_FLAG_VALUES[strings.TrimPrefix(flag.names[0], "--")]
+	}
+	return flag
+}
+
+func commandFlags(cmd cli.Command) []completionFlag {
+	flags := []completionFlag{}
+	for _, f := range cmd.Flags {
+		switch f := f.(type) {
+		case cli.BoolFlag:
+			flags = append(flags, newCompletionFlag(f.Name, f.Usage, false))
+		case cli.BoolTFlag:
+			flags = append(flags, newCompletionFlag(f.Name, f.Usage, false))
+		case cli.StringFlag:
+			flags = append(flags, newCompletionFlag(f.Name, f.Usage, true))
+		case cli.StringSliceFlag:
+			flags = append(flags, newCompletionFlag(f.Name, f.Usage, true))
+		case cli.IntFlag:
+			flags = append(flags, newCompletionFlag(f.Name, f.Usage, true))
+		case cli.IntSliceFlag:
+			flags = append(flags, newCompletionFlag(f.Name, f.Usage, true))
+		case cli.Float64Flag:
+			flags = append(flags, newCompletionFlag(f.Name, f.Usage, true))
+		}
+	}
+	return flags
+}
+
+func commandNames(commands []cli.Command) []string {
+	names := []string{}
+	for _, cmd := range commands {
+		names = append(names, cmd.Name)
+	}
+	return names
+}
+
+func formatNames() []string {
+	names := []string{}
+	for name := range envFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveShellInitShell checks the shell given to shell-init, or takes
+// the one in $SHELL
+func resolveShellInitShell(shell string) (string, error) {
+	if shell == "" {
+		shell = filepath.Base(os.Getenv("SHELL"))
+	}
+	for _, known := range SHELL_INIT_SHELLS {
+		if shell == known {
+			return shell, nil
+		}
+	}
+	return "", errors.New("Please specify the shell to set up: " + strings.Join(SHELL_INIT_SHELLS, ", "))
+}
+
+// shellInit writes the script that sets up a shell for credulous: a
+// wrapper that evals what source, pick and clear write, completion for every
+// command and flag, and if asked, a prompt segment showing what's loaded
+func shellInit(shell string, commands []cli.Command, prompt bool) string {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "# credulous shell integration for %s, from 'credulous shell-init'\n\n", shell)
+	if shell == "fish" {
+		writeFishWrapper(&out)
+		writeFishCompletion(&out, commands)
+		if prompt {
+			writeFishPrompt(&out)
+		}
+		return out.String()
+	}
+
+	writePosixWrapper(&out, shell)
+	if shell == "zsh" {
+		out.WriteString("(( $+functions[compdef] )) || { autoload -U +X compinit && compinit }\n")
+		out.WriteString("autoload -U +X bashcompinit && bashcompinit\n\n")
+	}
+	writeBashCompletion(&out, commands)
+	if prompt {
+		writePosixPrompt(&out, shell)
+	}
+	return out.String()
+}
+
+// writePosixWrapper leaves source, pick and clear alone if given a format,
+// which mightn't be for this shell. The shell's format goes in the
+// environment rather than the arguments, since flags after the
+// credentials wouldn't be parsed after one put before them.
+func writePosixWrapper(out *bytes.Buffer, shell string) {
+	fmt.Fprintf(out, `credulous()
+{
+    case "$1" in
+        source|pick|clear)
+            case " $* " in
+                *" --format"*)
+                    command credulous "$@"
+                    return $?
+                    ;;
+            esac
+            local out
+            out=$(CREDULOUS_FORMAT=%s command credulous "$@") || return $?
+            eval "$out"
+            ;;
+        *)
+            command credulous "$@"
+            ;;
+    esac
+}
+
+`, shell)
+}
+
+func writeBashCompletion(out *bytes.Buffer, commands []cli.Command) {
+	fmt.Fprintf(out, `_credulous_values()
+{
+    case "$1" in
+        identity)
+            COMPREPLY=( $(compgen -W "$(command credulous list --kind aws-iam 2>/dev/null)" -- "$cur") )
+            ;;
+        secret)
+            COMPREPLY=( $(compgen -W "$(command credulous list --kind env --kind file 2>/dev/null)" -- "$cur") )
+            ;;
+        repo)
+            COMPREPLY=( $(compgen -W "$(command credulous repo list 2>/dev/null | cut -c3- | cut -f1)" -- "$cur") )
+            ;;
+        file)
+            COMPREPLY=( $(compgen -f -- "$cur") )
+            ;;
+        format)
+            COMPREPLY=( $(compgen -W "%s" -- "$cur") )
+            ;;
+        kind)
+            COMPREPLY=( $(compgen -W "%s" -- "$cur") )
+            ;;
+        shell)
+            COMPREPLY=( $(compgen -W "%s" -- "$cur") )
+            ;;
+    esac
+}
+
+_credulous_args()
+{
+    if [[ "$cur" == -* ]]; then
+        COMPREPLY=( $(compgen -W "$2" -- "$cur") )
+    else
+        _credulous_values "$1"
+    fi
+}
+
+_credulous()
+{
+    local cur prev
+    COMPREPLY=()
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+
+`, strings.Join(formatNames(), " "), strings.Join(SECRET_KINDS, " "), strings.Join(SHELL_INIT_SHELLS, " "))
+	writeBashCommands(out, commands, "", 1, "    ")
+	out.WriteString("}\ncomplete -F _credulous credulous\n")
+}
+
+// writeBashCommands completes the command at a word, and then what
+// follows it, recursing into subcommands
+func writeBashCommands(out *bytes.Buffer, commands []cli.Command, path string, word int, indent string) {
+	fmt.Fprintf(out, "%sif [ $COMP_CWORD -eq %d ]; then\n", indent, word)
+	fmt.Fprintf(out, "%s    COMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n", indent, strings.Join(commandNames(commands), " "))
+	fmt.Fprintf(out, "%s    return 0\n%sfi\n", indent, indent)
+	fmt.Fprintf(out, "%scase \"${COMP_WORDS[%d]}\" in\n", indent, word)
+	for _, cmd := range commands {
+		name := strings.TrimSpace(path + " " + cmd.Name)
+		fmt.Fprintf(out, "%s    %s)\n", indent, cmd.Name)
+		if len(cmd.Subcommands) > 0 {
+			writeBashCommands(out, cmd.Subcommands, name, word+1, indent+"        ")
+			fmt.Fprintf(out, "%s        ;;\n", indent)
+			continue
+		}
+
+		flags := commandFlags(cmd)
+		names := []string{}
+		byValues := make(map[string][]string)
+		kinds := make(map[string]bool)
+		for _, flag := range flags {
+			names = append(names, flag.names...)
+			if flag.takesValue {
+				byValues[flag.values] = append(byValues[flag.values], flag.names...)
+				kinds[flag.values] = true
+			}
+		}
+		if len(byValues) > 0 {
+			fmt.Fprintf(out, "%s        case \"$prev\" in\n", indent)
+			for _, values := range sortedKeys(kinds) {
+				fmt.Fprintf(out, "%s            %s)\n", indent, strings.Join(byValues[values], "|"))
+				if values != "" {
+					fmt.Fprintf(out, "%s                _credulous_values %s\n", indent, values)
+				}
+				fmt.Fprintf(out, "%s                return 0\n%s                ;;\n", indent, indent)
+			}
+			fmt.Fprintf(out, "%s        esac\n", indent)
+		}
+		fmt.Fprintf(out, "%s        _credulous_args \"%s\" \"%s\"\n", indent, COMPLETE_ARGS[name], strings.Join(names, " "))
+		fmt.Fprintf(out, "%s        ;;\n", indent)
+	}
+	fmt.Fprintf(out, "%sesac\n", indent)
+}
+
+// writePosixPrompt adds a segment like "[bob@acct 3d] " to the prompt,
+// with the time left if the credentials expire
+func writePosixPrompt(out *bytes.Buffer, shell string) {
+	out.WriteString(`
+credulous_prompt()
+{
+    [ -n "$CREDULOUS_LOADED" ] || return 0
+    local left=""
+    case "$CREDULOUS_EXPIRES" in
+        ""|*[!0-9]*)
+            ;;
+        *)
+            left=$(( CREDULOUS_EXPIRES - $(date +%s) ))
+            if [ $left -le 0 ]; then
+                left=" expired"
+            elif [ $left -ge 86400 ]; then
+                left=" $(( left / 86400 ))d"
+            elif [ $left -ge 3600 ]; then
+                left=" $(( left / 3600 ))h"
+            else
+                left=" $(( left / 60 ))m"
+            fi
+            ;;
+    esac
+    printf '[%s%s] ' "$CREDULOUS_LOADED" "$left"
+}
+
+`)
+	if shell == "zsh" {
+		out.WriteString("setopt PROMPT_SUBST\nPROMPT='$(credulous_prompt)'\"$PROMPT\"\n")
+	} else {
+		out.WriteString("PS1='$(credulous_prompt)'\"$PS1\"\n")
+	}
+}
+
+func writeFishWrapper(out *bytes.Buffer) {
+	out.WriteString(`function credulous
+    switch "$argv[1]"
+        case source pick clear
+            if contains -- --format $argv
+                command credulous $argv
+                return
+            end
+            set -l out (env CREDULOUS_FORMAT=fish credulous $argv); or return
+            string join \n -- $out | source
+        case '*'
+            command credulous $argv
+    end
+end
+
+function __credulous_values
+    switch $argv[1]
+        case identity
+            command credulous list --kind aws-iam 2>/dev/null
+        case secret
+            command credulous list --kind env --kind file 2>/dev/null
+        case repo
+            command credulous repo list 2>/dev/null | cut -c3- | cut -f1
+        case format
+            printf '%s\n' ` + strings.Join(formatNames(), " ") + `
+        case kind
+            printf '%s\n' ` + strings.Join(SECRET_KINDS, " ") + `
+        case shell
+            printf '%s\n' ` + strings.Join(SHELL_INIT_SHELLS, " ") + `
+    end
+end
+
+`)
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `'`, `\'`, -1) + "'"
+}
+
+func writeFishCompletion(out *bytes.Buffer, commands []cli.Command) {
+	out.WriteString("complete -c credulous -f\n")
+	writeFishCommands(out, commands, nil)
+}
+
+// writeFishCommands completes commands once those in path have been
+// seen, and what follows them
+func writeFishCommands(out *bytes.Buffer, commands []cli.Command, path []string) {
+	seen := "__fish_use_subcommand"
+	if len(path) > 0 {
+		seen = "__fish_seen_subcommand_from " + strings.Join(path, "; and __fish_seen_subcommand_from ") +
+			"; and not __fish_seen_subcommand_from " + strings.Join(commandNames(commands), " ")
+	}
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "complete -c credulous -n %s -a %s -d %s\n", fishQuote(seen), cmd.Name, fishQuote(cmd.Usage))
+	}
+	for _, cmd := range commands {
+		cmdPath := append(append([]string{}, path...), cmd.Name)
+		if len(cmd.Subcommands) > 0 {
+			writeFishCommands(out, cmd.Subcommands, cmdPath)
+			continue
+		}
+		condition := fishQuote("__fish_seen_subcommand_from " + strings.Join(cmdPath, "; and __fish_seen_subcommand_from "))
+		for _, flag := range commandFlags(cmd) {
+			line := "complete -c credulous -n " + condition
+			for _, name := range flag.names {
+				if strings.HasPrefix(name, "--") {
+					line += " -l " + strings.TrimPrefix(name, "--")
+				} else {
+					line += " -s " + strings.TrimPrefix(name, "-")
+				}
+			}
+			if flag.values == "file" {
+				line += " -r -F"
+			} else if flag.values != "" {
+				line += " -x -a " + fishQuote("(__credulous_values "+flag.values+")")
+			} else if flag.takesValue {
+				line += " -x"
+			}
+			fmt.Fprintf(out, "%s -d %s\n", line, fishQuote(flag.usage))
+		}
+		switch args := COMPLETE_ARGS[strings.Join(cmdPath, " ")]; args {
+		case "":
+		case "file":
+			fmt.Fprintf(out, "complete -c credulous -n %s -F\n", condition)
+		default:
+			fmt.Fprintf(out, "complete -c credulous -n %s -a %s\n", condition, fishQuote("(__credulous_values "+args+")"))
+		}
+	}
+}
+
+func writeFishPrompt(out *bytes.Buffer) {
+	out.WriteString(`
+function credulous_prompt
+    test -n "$CREDULOUS_LOADED"; or return
+    set -l left ""
+    if string match -qr '^[0-9]+$' -- "$CREDULOUS_EXPIRES"
+        set -l secs (math $CREDULOUS_EXPIRES - (date +%s))
+        if test $secs -le 0
+            set left " expired"
+        else if test $secs -ge 86400
+            set left " "(math "floor($secs / 86400)")"d"
+        else if test $secs -ge 3600
+            set left " "(math "floor($secs / 3600)")"h"
+        else
+            set left " "(math "floor($secs / 60)")"m"
+        end
+    end
+    printf '[%s%s] ' $CREDULOUS_LOADED $left
+end
+
+if functions -q fish_prompt; and not functions -q __credulous_fish_prompt
+    functions -c fish_prompt __credulous_fish_prompt
+    function fish_prompt
+        credulous_prompt
+        __credulous_fish_prompt
+    end
+end
+`)
+}
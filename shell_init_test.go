@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// completeInBash runs the generated completion for a command line, the
+// last word of which is being completed
+func completeInBash(script string, words ...string) (string, error) {
+	args := append([]string{"-c", script + `
+COMP_WORDS=("$@")
+COMP_CWORD=$(( $# - 1 ))
+_credulous
+echo "${COMPREPLY[*]}"`, "bash", "credulous"}, words...)
+	cmd := exec.Command("bash", args...)
+	cmd.Env = []string{"PATH=/nonexistent"}
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func findCommand(commands []cli.Command, path []string) *cli.Command {
+	for i := range commands {
+		if commands[i].Name == path[0] {
+			if len(path) == 1 {
+				return &commands[i]
+			}
+			return findCommand(commands[i].Subcommands, path[1:])
+		}
+	}
+	return nil
+}
+
+func TestShellInit(t *testing.T) {
+	Convey("Test setting up shells", t, func() {
+		commands := newApp().Commands
+
+		Convey("Arguments are completed for commands that exist", func() {
+			for name := range COMPLETE_ARGS {
+				So(findCommand(commands, strings.Split(name, " ")), ShouldNotBeNil)
+			}
+		})
+
+		Convey("Flags are found in the command definitions", func() {
+			flags := commandFlags(*findCommand(commands, []string{"source"}))
+			So(flags[0], ShouldResemble, completionFlag{
+				names:      []string{"--account", "-a"},
+				takesValue: true,
+				usage:      "AWS Account alias or id",
+			})
+			So(flags[4].names, ShouldResemble, []string{"--force", "-f"})
+			So(flags[4].takesValue, ShouldBeFalse)
+			So(flags[5].values, ShouldEqual, "repo")
+		})
+
+		Convey("The shell comes from $SHELL if not given", func() {
+			origShell := os.Getenv("SHELL")
+			defer os.Setenv("SHELL", origShell)
+			os.Setenv("SHELL", "/usr/bin/zsh")
+			shell, err := resolveShellInitShell("")
+			So(err, ShouldEqual, nil)
+			So(shell, ShouldEqual, "zsh")
+
+			_, err = resolveShellInitShell("tcsh")
+			So(err.Error(), ShouldEqual, "Please specify the shell to set up: bash, zsh, fish")
+		})
+
+		Convey("Scripts name the shell's format for source and clear", func() {
+			So(shellInit("zsh", commands, false), ShouldContainSubstring, `CREDULOUS_FORMAT=zsh command credulous "$@"`)
+			So(shellInit("zsh", commands, false), ShouldNotContainSubstring, "credulous_prompt")
+			fish := shellInit("fish", commands, true)
+			So(fish, ShouldContainSubstring, "env CREDULOUS_FORMAT=fish credulous $argv")
+			So(fish, ShouldContainSubstring, "complete -c credulous -n '__fish_seen_subcommand_from source' -l repo -s r -x -a '(__credulous_values repo)'")
+			So(fish, ShouldContainSubstring, "complete -c credulous -n '__fish_seen_subcommand_from repo; and __fish_seen_subcommand_from default' -a '(__credulous_values repo)'")
+			So(fish, ShouldContainSubstring, "function credulous_prompt")
+		})
+
+		if _, err := exec.LookPath("bash"); err != nil {
+			return
+		}
+		script := shellInit("bash", commands, true)
+
+		Convey("bash completes commands, subcommands and flags", func() {
+			cmd := exec.Command("bash", "-n")
+			cmd.Stdin = strings.NewReader(script)
+			So(cmd.Run(), ShouldEqual, nil)
+
+			out, err := completeInBash(script, "sh")
+			So(err, ShouldEqual, nil)
+			So(out, ShouldEqual, "shell-init")
+
+			out, err = completeInBash(script, "source", "--re")
+			So(err, ShouldEqual, nil)
+			So(out, ShouldEqual, "--repo")
+
+			out, err = completeInBash(script, "source", "--format", "p")
+			So(err, ShouldEqual, nil)
+			So(out, ShouldEqual, "powershell pwsh")
+
+			out, err = completeInBash(script, "repo", "si")
+			So(err, ShouldEqual, nil)
+			So(out, ShouldEqual, "sign signatures")
+
+			out, err = completeInBash(script, "shell-init", "f")
+			So(err, ShouldEqual, nil)
+			So(out, ShouldEqual, "fish")
+		})
+
+		Convey("Flags after the credentials reach credulous, with the shell's format", func() {
+			bin, err := ioutil.TempDir("", "credulous-test")
+			So(err, ShouldEqual, nil)
+			defer os.RemoveAll(bin)
+			fake := "#!/bin/sh\nprintf 'echo %s:%s\\n' \"$CREDULOUS_FORMAT\" \"$*\"\n"
+			So(ioutil.WriteFile(filepath.Join(bin, "credulous"), []byte(fake), 0755), ShouldEqual, nil)
+
+			cmd := exec.Command("bash", "-c", script+"\ncredulous source bob@acct --version 3 -r team")
+			cmd.Env = []string{"PATH=" + bin + ":" + os.Getenv("PATH")}
+			out, err := cmd.Output()
+			So(err, ShouldEqual, nil)
+			So(string(out), ShouldEqual, "bash:source bob@acct --version 3 -r team\n")
+		})
+
+		Convey("The bash prompt shows what's loaded", func() {
+			cmd := exec.Command("bash", "-c", script+"\ncredulous_prompt")
+			cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "CREDULOUS_LOADED=bob@acct", "CREDULOUS_EXPIRES=1"}
+			out, err := cmd.Output()
+			So(err, ShouldEqual, nil)
+			So(string(out), ShouldEqual, "[bob@acct expired] ")
+		})
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Signatures use OpenSSH's SSHSIG format (see PROTOCOL.sshsig in the
+// OpenSSH sources), so they can be checked with 'ssh-keygen -Y verify',
+// and commits signed this way are understood by git's gpg.format=ssh.
+const (
+	SSHSIG_MAGIC        string = "SSHSIG"
+	SSHSIG_VERSION      uint32 = 1
+	SSHSIG_HASH         string = "sha512"
+	SSHSIG_RSA_ALGO     string = "rsa-sha2-512"
+	SSHSIG_BEGIN        string = "-----BEGIN SSH SIGNATURE-----"
+	SSHSIG_END          string = "-----END SSH SIGNATURE-----"
+	SIGNATURE_NAMESPACE string = "credulous"
+	GIT_NAMESPACE       string = "git"
+	SIGNATURE_SUFFIX    string = ".sig"
+)
+
+// How strictly source checks credential file signatures
+const (
+	// don't look at signatures at all
+	SIGNATURES_OFF string = "off"
+	// a bad signature is fatal, but unsigned files are fine
+	SIGNATURES_VERIFY string = "verify"
+	// files must be signed by someone in the allowed signers file
+	SIGNATURES_REQUIRE string = "require"
+)
+
+func sshString(b []byte) []byte {
+	out := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(out, uint32(len(b)))
+	copy(out[4:], b)
+	return out
+}
+
+func readSSHString(in []byte) (value, rest []byte, err error) {
+	if len(in) < 4 {
+		return nil, nil, errors.New("Malformed SSH signature")
+	}
+	length := binary.BigEndian.Uint32(in)
+	if uint32(len(in)-4) < length {
+		return nil, nil, errors.New("Malformed SSH signature")
+	}
+	return in[4 : 4+length], in[4+length:], nil
+}
+
+// the blob that actually gets signed
+func sshsigSignedData(message []byte, namespace string) []byte {
+	hash := sha512.Sum512(message)
+	var buf bytes.Buffer
+	buf.WriteString(SSHSIG_MAGIC)
+	buf.Write(sshString([]byte(namespace)))
+	buf.Write(sshString([]byte{}))
+	buf.Write(sshString([]byte(SSHSIG_HASH)))
+	buf.Write(sshString(hash[:]))
+	return buf.Bytes()
+}
+
+// sshSign returns an armored SSH signature over message
+func sshSign(message []byte, namespace string, privkey *rsa.PrivateKey) (string, error) {
+	pubkey, err := rsaPubkeyToSSHPubkey(privkey.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	digest := sha512.Sum512(sshsigSignedData(message, namespace))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, privkey, crypto.SHA512, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	var blob bytes.Buffer
+	blob.WriteString(SSHSIG_MAGIC)
+	binary.Write(&blob, binary.BigEndian, SSHSIG_VERSION)
+	blob.Write(sshString(pubkey.Marshal()))
+	blob.Write(sshString([]byte(namespace)))
+	blob.Write(sshString([]byte{}))
+	blob.Write(sshString([]byte(SSHSIG_HASH)))
+	blob.Write(sshString(append(sshString([]byte(SSHSIG_RSA_ALGO)), sshString(sig)...)))
+
+	encoded := base64.StdEncoding.EncodeToString(blob.Bytes())
+	lines := []string{SSHSIG_BEGIN}
+	for len(encoded) > 70 {
+		lines = append(lines, encoded[:70])
+		encoded = encoded[70:]
+	}
+	lines = append(lines, encoded, SSHSIG_END)
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// sshVerify checks an armored SSH signature over message, returning the
+// key that made it
+func sshVerify(message []byte, namespace string, armored string) (ssh.PublicKey, error) {
+	armored = strings.TrimSpace(armored)
+	if !strings.HasPrefix(armored, SSHSIG_BEGIN) || !strings.HasSuffix(armored, SSHSIG_END) {
+		return nil, errors.New("Not an SSH signature")
+	}
+	body := strings.TrimSuffix(strings.TrimPrefix(armored, SSHSIG_BEGIN), SSHSIG_END)
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(blob) < len(SSHSIG_MAGIC)+4 || string(blob[:len(SSHSIG_MAGIC)]) != SSHSIG_MAGIC {
+		return nil, errors.New("Malformed SSH signature")
+	}
+	rest := blob[len(SSHSIG_MAGIC):]
+	if binary.BigEndian.Uint32(rest) != SSHSIG_VERSION {
+		return nil, errors.New("Unsupported SSH signature version")
+	}
+	rest = rest[4:]
+
+	fields := make([][]byte, 5)
+	for i := range fields {
+		if fields[i], rest, err = readSSHString(rest); err != nil {
+			return nil, err
+		}
+	}
+	keyBlob, sigNamespace, hashAlgo, sigBlob := fields[0], fields[1], fields[3], fields[4]
+	if string(sigNamespace) != namespace {
+		return nil, errors.New("SSH signature is for '" + string(sigNamespace) + "', not '" + namespace + "'")
+	}
+	if string(hashAlgo) != SSHSIG_HASH {
+		return nil, errors.New("Unsupported SSH signature hash " + string(hashAlgo))
+	}
+
+	pubkey, err := ssh.ParsePublicKey(keyBlob)
+	if err != nil {
+		return nil, err
+	}
+	if pubkey.Type() != "ssh-rsa" {
+		return nil, errors.New("Only RSA signatures are supported")
+	}
+	algo, sigBlob, err := readSSHString(sigBlob)
+	if err != nil {
+		return nil, err
+	}
+	if string(algo) != SSHSIG_RSA_ALGO {
+		return nil, errors.New("Unsupported SSH signature algorithm " + string(algo))
+	}
+	sig, _, err := readSSHString(sigBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey := sshPubkeyToRsaPubkey(pubkey)
+	digest := sha512.Sum512(sshsigSignedData(message, namespace))
+	if err = rsa.VerifyPKCS1v15(&rsaKey, crypto.SHA512, digest[:], sig); err != nil {
+		return nil, errors.New("SSH signature does not match")
+	}
+	return pubkey, nil
+}
+
+type AllowedSigner struct {
+	Principals []string
+	Key        ssh.PublicKey
+}
+
+func allowedSignersFile() string {
+	return filepath.Join(getRootPath(), "allowed_signers")
+}
+
+// loadAllowedSigners reads the team keyring, in the same format as
+// OpenSSH's allowed_signers file (and so git's
+// gpg.ssh.allowedSignersFile): "principal[,principal...] [options]
+// keytype base64-key [comment]"
+func loadAllowedSigners(filename string) ([]AllowedSigner, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return []AllowedSigner{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signers := []AllowedSigner{}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		// the key starts at the first field that parses as one
+		for i := 1; i < len(fields); i++ {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[i:], " ")))
+			if err == nil {
+				signers = append(signers, AllowedSigner{
+					Principals: strings.Split(fields[0], ","),
+					Key:        key,
+				})
+				break
+			}
+		}
+	}
+	return signers, nil
+}
+
+func signerFor(signers []AllowedSigner, key ssh.PublicKey) (AllowedSigner, bool) {
+	for _, signer := range signers {
+		if bytes.Equal(signer.Key.Marshal(), key.Marshal()) {
+			return signer, true
+		}
+	}
+	return AllowedSigner{}, false
+}
+
+// keys are cached so that signing the credential file and then the
+// commit only asks for the passphrase once
+var signingKeys = make(map[string]*rsa.PrivateKey)
+
+func loadSigningKey(filename string) (*rsa.PrivateKey, error) {
+	// git lets user.signingkey name the public half
+	filename = strings.TrimSuffix(filename, ".pub")
+	if key, ok := signingKeys[filename]; ok {
+		return key, nil
+	}
+	key, err := loadPrivateKey(filename)
+	if err != nil {
+		return nil, err
+	}
+	signingKeys[filename] = key
+	return key, nil
+}
+
+// verifyCredentialData checks the signature on a set of credentials,
+// wherever they came from, against the allowed signers, as strictly as
+// the policy asks, before anything is decrypted; sig is nil if they
+// weren't signed
+func verifyCredentialData(name string, b, sig []byte, policy string) error {
+	if policy == SIGNATURES_OFF {
+		return nil
+	}
+	if sig == nil {
+		if policy == SIGNATURES_REQUIRE {
+			return errors.New("Refusing to use unsigned credentials in " + name)
+		}
+		return nil
+	}
+
+	key, err := sshVerify(b, SIGNATURE_NAMESPACE, string(sig))
+	if err != nil {
+		return errors.New("Bad signature on " + name + ": " + err.Error())
+	}
+
+	signers, err := loadAllowedSigners(allowedSignersFile())
+	if err != nil {
+		return err
+	}
+	if _, ok := signerFor(signers, key); !ok {
+		if policy == SIGNATURES_REQUIRE {
+			return errors.New("Refusing to use credentials in " + name + ": signed by untrusted key " + SSHFingerprint(key))
+		}
+		log.Print("WARNING: credentials in " + name + " are signed by a key not in " + allowedSignersFile())
+	}
+	return nil
+}
+
+func validSignaturePolicy(policy string) error {
+	switch policy {
+	case SIGNATURES_OFF, SIGNATURES_VERIFY, SIGNATURES_REQUIRE:
+		return nil
+	}
+	return errors.New("Signature policy must be one of off, verify or require")
+}
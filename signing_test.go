@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// verifyTestFile checks the signature on a credential file, as source
+// does once a store has read it and its signature
+func verifyTestFile(filename, policy string) error {
+	sig, err := ioutil.ReadFile(filename + SIGNATURE_SUFFIX)
+	if os.IsNotExist(err) {
+		sig, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return verifyCredentialData(filename, b, sig, policy)
+}
+
+func TestSSHSignature(t *testing.T) {
+	Convey("Test signing and verifying with SSH signatures", t, func() {
+		privkey, err := loadPrivateKey("testdata/testkey")
+		So(err, ShouldEqual, nil)
+		message := []byte("some credentials")
+
+		sig, err := sshSign(message, SIGNATURE_NAMESPACE, privkey)
+		So(err, ShouldEqual, nil)
+		So(strings.HasPrefix(sig, SSHSIG_BEGIN+"\n"), ShouldBeTrue)
+		So(strings.HasSuffix(sig, SSHSIG_END+"\n"), ShouldBeTrue)
+
+		Convey("A good signature verifies as the signing key", func() {
+			key, err := sshVerify(message, SIGNATURE_NAMESPACE, sig)
+			So(err, ShouldEqual, nil)
+			So(SSHFingerprint(key), ShouldEqual, "c0:61:84:fc:e8:c9:52:dc:cd:a9:8e:82:a2:70:0a:30")
+		})
+		Convey("A changed message doesn't verify", func() {
+			_, err := sshVerify([]byte("some other credentials"), SIGNATURE_NAMESPACE, sig)
+			So(err.Error(), ShouldEqual, "SSH signature does not match")
+		})
+		Convey("A signature from another namespace doesn't verify", func() {
+			_, err := sshVerify(message, GIT_NAMESPACE, sig)
+			So(err.Error(), ShouldEqual, "SSH signature is for 'credulous', not 'git'")
+		})
+		Convey("Garbage isn't a signature", func() {
+			_, err := sshVerify(message, SIGNATURE_NAMESPACE, "not a signature")
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestAllowedSigners(t *testing.T) {
+	Convey("Test reading the allowed signers file", t, func() {
+		tmp, err := ioutil.TempDir("", "credulous-signers")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(tmp)
+
+		pubkey, err := ioutil.ReadFile("testdata/testkey.pub")
+		So(err, ShouldEqual, nil)
+		signersFile := filepath.Join(tmp, "allowed_signers")
+		contents := "# the team\n\n" +
+			"alice@example.com,alice@example.org namespaces=\"credulous,git\" " + string(pubkey) +
+			"bob@example.com garbage\n"
+		So(ioutil.WriteFile(signersFile, []byte(contents), 0600), ShouldEqual, nil)
+
+		signers, err := loadAllowedSigners(signersFile)
+		So(err, ShouldEqual, nil)
+		So(len(signers), ShouldEqual, 1)
+		So(signers[0].Principals, ShouldResemble, []string{"alice@example.com", "alice@example.org"})
+
+		key, err := readSSHPubkeyFile("testdata/testkey.pub")
+		So(err, ShouldEqual, nil)
+		_, ok := signerFor(signers, key)
+		So(ok, ShouldBeTrue)
+
+		Convey("A missing file allows nobody", func() {
+			signers, err := loadAllowedSigners(filepath.Join(tmp, "nosuch"))
+			So(err, ShouldEqual, nil)
+			So(len(signers), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestVerifyCredentialFile(t *testing.T) {
+	Convey("Test checking credential file signatures", t, func() {
+		_, cleanup := withTempHome()
+		defer cleanup()
+		So(os.MkdirAll(getRootPath(), 0700), ShouldEqual, nil)
+
+		credfile := filepath.Join(getRootPath(), "1-aaaa.json")
+		So(ioutil.WriteFile(credfile, []byte(`{"Version": "2014-06-12"}`), 0600), ShouldEqual, nil)
+
+		Convey("Unsigned files are only refused if signatures are required", func() {
+			So(verifyTestFile(credfile, SIGNATURES_OFF), ShouldEqual, nil)
+			So(verifyTestFile(credfile, SIGNATURES_VERIFY), ShouldEqual, nil)
+			err := verifyTestFile(credfile, SIGNATURES_REQUIRE)
+			So(err.Error(), ShouldEqual, "Refusing to use unsigned credentials in "+credfile)
+		})
+
+		privkey, err := loadPrivateKey("testdata/testkey")
+		So(err, ShouldEqual, nil)
+		sig, err := sshSign([]byte(`{"Version": "2014-06-12"}`), SIGNATURE_NAMESPACE, privkey)
+		So(err, ShouldEqual, nil)
+		So(ioutil.WriteFile(credfile+SIGNATURE_SUFFIX, []byte(sig), 0600), ShouldEqual, nil)
+
+		Convey("Files signed by an unknown key are only refused if signatures are required", func() {
+			So(verifyTestFile(credfile, SIGNATURES_VERIFY), ShouldEqual, nil)
+			err := verifyTestFile(credfile, SIGNATURES_REQUIRE)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "signed by untrusted key")
+		})
+
+		Convey("Files signed by an allowed signer pass", func() {
+			pubkey, err := ioutil.ReadFile("testdata/testkey.pub")
+			So(err, ShouldEqual, nil)
+			So(ioutil.WriteFile(allowedSignersFile(), append([]byte("alice@example.com "), pubkey...), 0600), ShouldEqual, nil)
+			So(verifyTestFile(credfile, SIGNATURES_REQUIRE), ShouldEqual, nil)
+		})
+
+		Convey("Tampered files are refused unless signatures are off", func() {
+			So(ioutil.WriteFile(credfile, []byte(`{"Version": "tampered"}`), 0600), ShouldEqual, nil)
+			So(verifyTestFile(credfile, SIGNATURES_OFF), ShouldEqual, nil)
+			So(verifyTestFile(credfile, SIGNATURES_VERIFY), ShouldNotEqual, nil)
+			So(verifyTestFile(credfile, SIGNATURES_REQUIRE), ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestSignaturePolicy(t *testing.T) {
+	Convey("Test per-repo signature policies", t, func() {
+		_, cleanup := withTempHome()
+		defer cleanup()
+		So(os.MkdirAll(filepath.Join(getRootPath(), "team"), 0700), ShouldEqual, nil)
+
+		policy, err := signaturePolicy(filepath.Join(getRootPath(), "team"))
+		So(err, ShouldEqual, nil)
+		So(policy, ShouldEqual, SIGNATURES_VERIFY)
+
+		So(setSignaturePolicy("team", SIGNATURES_REQUIRE), ShouldEqual, nil)
+		policy, err = signaturePolicy(filepath.Join(getRootPath(), "team"))
+		So(err, ShouldEqual, nil)
+		So(policy, ShouldEqual, SIGNATURES_REQUIRE)
+
+		So(setSignaturePolicy("team", "sometimes"), ShouldNotEqual, nil)
+		So(setSignaturePolicy("nosuch", SIGNATURES_OFF), ShouldNotEqual, nil)
+
+		restoreVault := withVaultEnv(map[string]string{VAULT_TOKEN_ENV: "token"})
+		defer restoreVault()
+		So(addStoreRepo("vault", VAULT_SCHEME+"secret?address=http://127.0.0.1:8200"), ShouldEqual, nil)
+		err = setSignaturePolicy("vault", SIGNATURES_REQUIRE)
+		So(err.Error(), ShouldEqual, "Vault doesn't keep signatures, so 'vault' can't require them")
+		So(setSignaturePolicy("vault", SIGNATURES_OFF), ShouldEqual, nil)
+	})
+}
+
+// splitCommitSignature pulls the gpgsig header out of a raw commit,
+// leaving what was signed
+func splitCommitSignature(commit string) (signature, signed string) {
+	headers, message := commit, ""
+	if i := strings.Index(commit, "\n\n"); i >= 0 {
+		headers, message = commit[:i+1], commit[i+1:]
+	}
+	insig := false
+	for _, line := range strings.SplitAfter(headers, "\n") {
+		switch {
+		case strings.HasPrefix(line, "gpgsig "):
+			insig = true
+			signature += strings.TrimPrefix(line, "gpgsig ")
+		case insig && strings.HasPrefix(line, " "):
+			signature += line[1:]
+		default:
+			insig = false
+			signed += line
+		}
+	}
+	return signature, signed + message
+}
+
+func TestSignedCommits(t *testing.T) {
+	Convey("Test signing commits and credential files", t, func() {
+		tmp, err := ioutil.TempDir("", "credulous-signed")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(tmp)
+
+		initTestRepo(tmp)
+		// ssh-keygen, which git signs with, won't use a key others can read
+		keydir, err := ioutil.TempDir("", "credulous-signingkey")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(keydir)
+		keyfile := filepath.Join(keydir, "testkey")
+		for _, suffix := range []string{"", ".pub"} {
+			b, err := ioutil.ReadFile("testdata/testkey" + suffix)
+			So(err, ShouldEqual, nil)
+			So(ioutil.WriteFile(keyfile+suffix, b, 0600), ShouldEqual, nil)
+		}
+		So(setSigningKey(tmp, keyfile), ShouldEqual, nil)
+
+		cred := Credentials{Version: FORMAT_VERSION, AccountAliasOrId: "acct", IamUsername: "alice"}
+		So(cred.WriteToDisk(tmp, "1-aaaa.json"), ShouldEqual, nil)
+		So(fileExists(filepath.Join(tmp, "acct/alice/1-aaaa.json.sig")), ShouldBeTrue)
+		So(verifyTestFile(filepath.Join(tmp, "acct/alice/1-aaaa.json"), SIGNATURES_VERIFY), ShouldEqual, nil)
+
+		commit, err := runGit(tmp, nil, "", "cat-file", "commit", "HEAD")
+		So(err, ShouldEqual, nil)
+		signature, signed := splitCommitSignature(commit)
+		key, err := sshVerify([]byte(signed), GIT_NAMESPACE, signature)
+		So(err, ShouldEqual, nil)
+		So(SSHFingerprint(key), ShouldEqual, "c0:61:84:fc:e8:c9:52:dc:cd:a9:8e:82:a2:70:0a:30")
+	})
+}
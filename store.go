@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StoredFile is a saved credential file, and its signature if it has one
+type StoredFile struct {
+	Name string
+	Data []byte
+	Sig  []byte
+}
+
+// Store keeps the credential files saved for each identity, by account
+// and username. Each is named <create time>-<end of key ID>.json, with
+// a .superseded suffix once it should no longer be sourced.
+type Store interface {
+	// Put saves a credential file and makes it the identity's current
+	// one, as saving and rotating should
+	Put(account, username, name string, data []byte) error
+	// Latest returns the current credential file for an identity
+	Latest(account, username string) (StoredFile, error)
+	// Current returns the name of the file an identity was last pointed
+	// at by SetCurrent, or "" if it hasn't been
+	Current(account, username string) (string, error)
+	// SetCurrent points an identity at one of its credential files
+	SetCurrent(account, username, name string) error
+	// Identities lists the identities with anything saved, as
+	// <account>/<username>
+	Identities() ([]string, error)
+	// History lists the names of every file saved for an identity,
+	// including superseded ones, in name order
+	History(account, username string) ([]string, error)
+	Get(account, username, name string) (StoredFile, error)
+	// Delete removes a credential file and its signature
+	Delete(account, username, name string) error
+}
+
+// openStore returns the store a repo names: an s3:// or vault:// URL, a
+// .bundle file, or otherwise a directory on disk, which may be in git
+func openStore(repo string) (Store, error) {
+	switch {
+	case strings.HasPrefix(repo, S3_SCHEME):
+		return newS3Store(repo)
+	case strings.HasPrefix(repo, VAULT_SCHEME):
+		return newVaultStore(repo)
+	case strings.HasSuffix(repo, BUNDLE_SUFFIX):
+		return bundleStore{file: repo}, nil
+	}
+	return fsStore{root: repo}, nil
+}
+
+// isStoreURL tells whether a repo is kept by a service rather than in a
+// file
+func isStoreURL(repo string) bool {
+	return strings.HasPrefix(repo, S3_SCHEME) || strings.HasPrefix(repo, VAULT_SCHEME)
+}
+
+// isDiskRepo tells whether a repo is a directory on disk, which history,
+// restoring and syncing need
+func isDiskRepo(repo string) bool {
+	return !isStoreURL(repo) && !strings.HasSuffix(repo, BUNDLE_SUFFIX)
+}
+
+// describeStoredFile names a credential file in messages
+func describeStoredFile(repo, account, username, name string) string {
+	if isDiskRepo(repo) {
+		return filepath.Join(repo, account, username, name)
+	}
+	return path.Join(account, username, name) + " in " + repo
+}
+
+var noSavedCredentialsError = errors.New("No credentials have been saved for that user and account; please run 'credulous save' first")
+
+// credentialCreated is the create time in a credential file's name,
+// superseded or not
+func credentialCreated(name string) (int64, error) {
+	created, _, err := parseCredentialFilename(strings.TrimSuffix(name, SUPERSEDED_SUFFIX))
+	return created, err
+}
+
+// newerCredential tells whether one credential file was created after
+// another, going by the times in their names, which needn't have the
+// same number of digits; the name settles ties
+func newerCredential(name, than string) bool {
+	created, _ := credentialCreated(name)
+	thanCreated, _ := credentialCreated(than)
+	if created == thanCreated {
+		return name > than
+	}
+	return created > thanCreated
+}
+
+// latestName picks the newest credential file out of an identity's
+// history; superseded credentials are kept for the record, but never
+// used. A .json file we can't make sense of is an error rather than a
+// guess, since it may well be newer than anything we can.
+func latestName(identity string, names []string) (string, error) {
+	latest := ""
+	unparseable := []string{}
+	for _, name := range names {
+		if !strings.HasSuffix(strings.TrimSuffix(name, SUPERSEDED_SUFFIX), ".json") {
+			continue
+		}
+		if _, err := credentialCreated(name); err != nil {
+			unparseable = append(unparseable, name)
+			continue
+		}
+		if !strings.HasSuffix(name, SUPERSEDED_SUFFIX) && (latest == "" || newerCredential(name, latest)) {
+			latest = name
+		}
+	}
+	if len(unparseable) > 0 {
+		return "", errors.New("Cannot tell which credentials for " + identity + " are current; " +
+			"these are not named <create time>-<key id>.json: " + strings.Join(unparseable, ", "))
+	}
+	if latest == "" {
+		return "", noSavedCredentialsError
+	}
+	return latest, nil
+}
+
+// currentName picks the current credential file out of an identity's
+// history: the one it was last pointed at, if that's still there and
+// not superseded, or else the newest
+func currentName(identity string, names []string, pointer string) (string, error) {
+	latest, err := latestName(identity, names)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(pointer, ".json") {
+		for _, name := range names {
+			if name == pointer {
+				return pointer, nil
+			}
+		}
+	}
+	return latest, nil
+}
+
+// storedCurrentName is currentName for an identity in a store
+func storedCurrentName(store Store, account, username string) (string, error) {
+	names, err := store.History(account, username)
+	if err != nil {
+		return "", err
+	}
+	pointer, err := store.Current(account, username)
+	if err != nil {
+		return "", err
+	}
+	return currentName(username+"@"+account, names, pointer)
+}
+
+// latestStored returns the current credential file for an identity in
+// a store
+func latestStored(store Store, account, username string) (StoredFile, error) {
+	name, err := storedCurrentName(store, account, username)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	return store.Get(account, username, name)
+}
+
+// splitIdentity splits <account>/<username>
+func splitIdentity(identity string) (account, username string) {
+	account, username = path.Split(filepath.ToSlash(identity))
+	return strings.TrimSuffix(account, "/"), username
+}
+
+// storeCredentials lists the identities in a store that have current
+// credentials, as <username>@<account>, or <folder>/<name> for secrets
+func storeCredentials(store Store) ([]string, error) {
+	identities, err := store.Identities()
+	if err != nil {
+		return nil, err
+	}
+	creds := []string{}
+	for _, identity := range identities {
+		account, username := splitIdentity(identity)
+		file, err := store.Latest(account, username)
+		if err == noSavedCredentialsError {
+			continue
+		}
+		if err != nil {
+			log.Print("WARNING: " + err.Error())
+			continue
+		}
+		// secrets other than AWS credentials are named folder/name;
+		// anything unreadable is left to source to complain about
+		saved, _, _ := readCredentialMetadata(file.Data)
+		creds = append(creds, storedIdentity(saved.Kind, account, username))
+	}
+	return creds, nil
+}
+
+// fsStore keeps credentials in <root>/<account>/<username>/, committing
+// them if the root is a git repository and signing them if it's set up
+// to sign commits
+type fsStore struct {
+	root string
+}
+
+func (s fsStore) Put(account, username, name string, data []byte) error {
+	unlock, err := lockRepo(s.root)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dir := filepath.Join(s.root, account, username)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	isrepo, err := isGitRepo(s.root)
+	if err != nil {
+		return err
+	}
+	relpath := filepath.Join(account, username, name)
+	added := []string{relpath}
+	if isrepo {
+		// the signature goes first, so that nobody reads the file
+		// without it
+		signingKey, err := getRepoSigningKey(s.root)
+		if err != nil {
+			return err
+		}
+		if signingKey != "" {
+			privkey, err := loadSigningKey(signingKey)
+			if err != nil {
+				return err
+			}
+			sig, err := sshSign(data, SIGNATURE_NAMESPACE, privkey)
+			if err != nil {
+				return err
+			}
+			if err = writeFileAtomic(filepath.Join(dir, name+SIGNATURE_SUFFIX), []byte(sig), 0600); err != nil {
+				return err
+			}
+			added = append(added, relpath+SIGNATURE_SUFFIX)
+		}
+	}
+	if err := writeFileAtomic(filepath.Join(dir, name), data, 0600); err != nil {
+		return err
+	}
+	if err := setCurrentPointer(s.root, account, username, name); err != nil {
+		return err
+	}
+	if !isrepo {
+		return nil
+	}
+	_, err = gitCommitPaths(s.root, added, nil, "Added by Credulous")
+	return err
+}
+
+func (s fsStore) Latest(account, username string) (StoredFile, error) {
+	return latestStored(s, account, username)
+}
+
+// The current pointers for a repo on disk are kept with the lock rather
+// than committed: two clones saving at once would both change them, and
+// their syncs would conflict. Sync forgets them instead; see
+// forgetCurrentPointers.
+func (s fsStore) Current(account, username string) (string, error) {
+	return loadCurrentPointers(s.root)[path.Join(account, username)], nil
+}
+
+func (s fsStore) SetCurrent(account, username, name string) error {
+	unlock, err := lockRepo(s.root)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return setCurrentPointer(s.root, account, username, name)
+}
+
+func (s fsStore) Identities() ([]string, error) {
+	identities, err := repoIdentities(s.root)
+	if err != nil {
+		return nil, err
+	}
+	for i := range identities {
+		identities[i] = filepath.ToSlash(identities[i])
+	}
+	return identities, nil
+}
+
+func (s fsStore) History(account, username string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.root, account, username))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		// dotfiles are half-written
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || strings.HasSuffix(entry.Name(), SIGNATURE_SUFFIX) {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+func (s fsStore) Get(account, username, name string) (StoredFile, error) {
+	filename := filepath.Join(s.root, account, username, name)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	sig, err := ioutil.ReadFile(filename + SIGNATURE_SUFFIX)
+	if err != nil && !os.IsNotExist(err) {
+		return StoredFile{}, err
+	}
+	return StoredFile{Name: name, Data: b, Sig: sig}, nil
+}
+
+func (s fsStore) Delete(account, username, name string) error {
+	unlock, err := lockRepo(s.root)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	relpath := filepath.Join(account, username, name)
+	removed := []string{}
+	for _, file := range []string{relpath, relpath + SIGNATURE_SUFFIX} {
+		err := os.Remove(filepath.Join(s.root, file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		removed = append(removed, file)
+	}
+	if len(removed) == 0 {
+		return errors.New("No credential file " + relpath + " in " + s.root)
+	}
+	isrepo, err := isGitRepo(s.root)
+	if err != nil || !isrepo {
+		return err
+	}
+	_, err = gitCommitPaths(s.root, nil, removed, "Removed by Credulous")
+	return err
+}
+
+// loadCurrentPointers reads the current pointers for a repo on disk,
+// keyed by <account>/<username>. Losing them only means falling back to
+// the newest credentials, so an unreadable file is just a warning.
+func loadCurrentPointers(repo string) map[string]string {
+	pointers := make(map[string]string)
+	filename := repoStateFile(repo, "current")
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return pointers
+	}
+	if err = json.Unmarshal(b, &pointers); err != nil {
+		log.Print("WARNING: ignoring unreadable " + filename)
+	}
+	return pointers
+}
+
+func saveCurrentPointers(repo string, pointers map[string]string) error {
+	filename := repoStateFile(repo, "current")
+	if len(pointers) == 0 {
+		err := os.Remove(filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	b, err := json.Marshal(pointers)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, b, 0600)
+}
+
+// setCurrentPointer is SetCurrent for a repo on disk, for callers that
+// already hold its lock
+func setCurrentPointer(repo, account, username, name string) error {
+	if _, err := os.Stat(filepath.Join(repo, account, username, name)); err != nil {
+		return err
+	}
+	pointers := loadCurrentPointers(repo)
+	pointers[path.Join(account, username)] = name
+	return saveCurrentPointers(repo, pointers)
+}
+
+// sortedKeys returns a map's keys in order
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
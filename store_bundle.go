@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const BUNDLE_SUFFIX string = ".bundle"
+
+// bundleStore keeps every credential file in a single JSON file, which
+// is easy to copy around or keep somewhere git can't go
+type bundleStore struct {
+	file string
+}
+
+type bundle struct {
+	// Files are keyed by <account>/<username>/<name>
+	Files map[string]bundleFile
+	// Current holds each identity's current pointer, keyed by
+	// <account>/<username>
+	Current map[string]string `json:",omitempty"`
+}
+
+type bundleFile struct {
+	Data []byte
+	Sig  []byte `json:",omitempty"`
+}
+
+func (s bundleStore) load() (bundle, error) {
+	b := bundle{Files: make(map[string]bundleFile), Current: make(map[string]string)}
+	data, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return bundle{}, err
+	}
+	if err = json.Unmarshal(data, &b); err != nil {
+		return bundle{}, errors.New("Cannot read bundle " + s.file + ": " + err.Error())
+	}
+	if b.Files == nil {
+		b.Files = make(map[string]bundleFile)
+	}
+	if b.Current == nil {
+		b.Current = make(map[string]string)
+	}
+	return b, nil
+}
+
+func (s bundleStore) save(b bundle) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.file, data, 0600)
+}
+
+func (s bundleStore) Put(account, username, name string, data []byte) error {
+	unlock, err := lockRepo(s.file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	b, err := s.load()
+	if err != nil {
+		return err
+	}
+	b.Files[path.Join(account, username, name)] = bundleFile{Data: data}
+	b.Current[path.Join(account, username)] = name
+	return s.save(b)
+}
+
+func (s bundleStore) Latest(account, username string) (StoredFile, error) {
+	return latestStored(s, account, username)
+}
+
+func (s bundleStore) Current(account, username string) (string, error) {
+	b, err := s.load()
+	if err != nil {
+		return "", err
+	}
+	return b.Current[path.Join(account, username)], nil
+}
+
+func (s bundleStore) SetCurrent(account, username, name string) error {
+	unlock, err := lockRepo(s.file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	b, err := s.load()
+	if err != nil {
+		return err
+	}
+	key := path.Join(account, username, name)
+	if _, ok := b.Files[key]; !ok {
+		return errors.New("No credential file " + key + " in " + s.file)
+	}
+	b.Current[path.Join(account, username)] = name
+	return s.save(b)
+}
+
+func (s bundleStore) Identities() ([]string, error) {
+	b, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	identities := make(map[string]bool)
+	for key := range b.Files {
+		identities[path.Dir(key)] = true
+	}
+	return sortedKeys(identities), nil
+}
+
+func (s bundleStore) History(account, username string) ([]string, error) {
+	b, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	prefix := path.Join(account, username) + "/"
+	names := []string{}
+	for key := range b.Files {
+		if strings.HasPrefix(key, prefix) {
+			names = append(names, strings.TrimPrefix(key, prefix))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s bundleStore) Get(account, username, name string) (StoredFile, error) {
+	b, err := s.load()
+	if err != nil {
+		return StoredFile{}, err
+	}
+	key := path.Join(account, username, name)
+	file, ok := b.Files[key]
+	if !ok {
+		return StoredFile{}, errors.New("No credential file " + key + " in " + s.file)
+	}
+	return StoredFile{Name: name, Data: file.Data, Sig: file.Sig}, nil
+}
+
+func (s bundleStore) Delete(account, username, name string) error {
+	unlock, err := lockRepo(s.file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	b, err := s.load()
+	if err != nil {
+		return err
+	}
+	key := path.Join(account, username, name)
+	if _, ok := b.Files[key]; !ok {
+		return errors.New("No credential file " + key + " in " + s.file)
+	}
+	delete(b.Files, key)
+	if b.Current[path.Join(account, username)] == name {
+		delete(b.Current, path.Join(account, username))
+	}
+	return s.save(b)
+}
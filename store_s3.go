@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/realestate-com-au/goamz/aws"
+	"github.com/realestate-com-au/goamz/s3"
+)
+
+const S3_SCHEME string = "s3://"
+
+// The S3 store has its own credentials, since those in the environment
+// are usually the ones just sourced
+const S3_ACCESS_KEY_ENV string = "CREDULOUS_S3_ACCESS_KEY_ID"
+const S3_SECRET_KEY_ENV string = "CREDULOUS_S3_SECRET_ACCESS_KEY"
+
+// how many keys to ask for in each page of a listing
+const S3_LIST_PAGE int = 1000
+
+// s3Store keeps credential files as objects under a prefix in an S3
+// bucket, or in anything else that speaks the S3 API
+type s3Store struct {
+	bucket *s3.Bucket
+	prefix string
+}
+
+// newS3Store opens s3://<bucket>[/<prefix>][?region=<region>][&endpoint=<url>],
+// in the configured region unless one is given; the endpoint is for
+// S3-compatible servers, which are addressed by path
+func newS3Store(repo string) (Store, error) {
+	u, err := url.Parse(repo)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("Invalid S3 repository '" + repo + "'; expected s3://<bucket>[/<prefix>]")
+	}
+	region := configuredRegion()
+	query := u.Query()
+	if name := query.Get("region"); name != "" {
+		var ok bool
+		if region, ok = aws.Regions[name]; !ok {
+			return nil, errors.New("Unknown AWS region '" + name + "' in " + repo)
+		}
+	}
+	if endpoint := query.Get("endpoint"); endpoint != "" {
+		region.S3Endpoint = endpoint
+		region.S3BucketEndpoint = ""
+	}
+	auth, err := s3Auth()
+	if err != nil {
+		return nil, err
+	}
+	return s3Store{
+		bucket: s3.New(auth, region).Bucket(u.Host),
+		prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+func s3Auth() (aws.Auth, error) {
+	access, secret := os.Getenv(S3_ACCESS_KEY_ENV), os.Getenv(S3_SECRET_KEY_ENV)
+	if access != "" && secret != "" {
+		return aws.Auth{AccessKey: access, SecretKey: secret}, nil
+	}
+	auth, err := aws.EnvAuth()
+	if err != nil {
+		return aws.Auth{}, errors.New("No credentials for S3; please set " + S3_ACCESS_KEY_ENV + " and " + S3_SECRET_KEY_ENV)
+	}
+	return auth, nil
+}
+
+func (s s3Store) key(parts ...string) string {
+	return path.Join(append([]string{s.prefix}, parts...)...)
+}
+
+func isS3NotFound(err error) bool {
+	s3err, ok := err.(*s3.Error)
+	return ok && s3err.StatusCode == 404
+}
+
+// list returns every key under prefix, following the listing across
+// pages
+func (s s3Store) list(prefix string) ([]string, error) {
+	keys := []string{}
+	marker := ""
+	for {
+		resp, err := s.bucket.List(prefix, "", marker, S3_LIST_PAGE)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range resp.Contents {
+			keys = append(keys, key.Key)
+		}
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			return keys, nil
+		}
+		marker = resp.NextMarker
+		if marker == "" {
+			marker = resp.Contents[len(resp.Contents)-1].Key
+		}
+	}
+}
+
+func (s s3Store) Put(account, username, name string, data []byte) error {
+	if err := s.bucket.Put(s.key(account, username, name), data, "application/json", s3.Private); err != nil {
+		return err
+	}
+	return s.SetCurrent(account, username, name)
+}
+
+func (s s3Store) Latest(account, username string) (StoredFile, error) {
+	return latestStored(s, account, username)
+}
+
+// Each identity's current pointer is an object beside its folder, named
+// <username>.current and holding a file name, so that listing the
+// folder only finds credentials
+func (s s3Store) pointerKey(account, username string) string {
+	return s.key(account, username+".current")
+}
+
+func (s s3Store) Current(account, username string) (string, error) {
+	data, err := s.bucket.Get(s.pointerKey(account, username))
+	if isS3NotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (s s3Store) SetCurrent(account, username, name string) error {
+	return s.bucket.Put(s.pointerKey(account, username), []byte(name), "text/plain", s3.Private)
+}
+
+func (s s3Store) Identities() ([]string, error) {
+	root := ""
+	if s.prefix != "" {
+		root = s.prefix + "/"
+	}
+	keys, err := s.list(root)
+	if err != nil {
+		return nil, err
+	}
+	identities := make(map[string]bool)
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, root), "/")
+		if len(parts) == 3 {
+			identities[parts[0]+"/"+parts[1]] = true
+		}
+	}
+	return sortedKeys(identities), nil
+}
+
+func (s s3Store) History(account, username string) ([]string, error) {
+	dir := s.key(account, username) + "/"
+	keys, err := s.list(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, dir)
+		if !strings.Contains(name, "/") && !strings.HasSuffix(name, SIGNATURE_SUFFIX) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s s3Store) Get(account, username, name string) (StoredFile, error) {
+	key := s.key(account, username, name)
+	data, err := s.bucket.Get(key)
+	if isS3NotFound(err) {
+		return StoredFile{}, errors.New("No credential file " + key + " in bucket " + s.bucket.Name)
+	}
+	if err != nil {
+		return StoredFile{}, err
+	}
+	sig, err := s.bucket.Get(key + SIGNATURE_SUFFIX)
+	if isS3NotFound(err) {
+		sig, err = nil, nil
+	}
+	if err != nil {
+		return StoredFile{}, err
+	}
+	return StoredFile{Name: name, Data: data, Sig: sig}, nil
+}
+
+func (s s3Store) Delete(account, username, name string) error {
+	key := s.key(account, username, name)
+	if err := s.bucket.Del(key); err != nil {
+		return err
+	}
+	return s.bucket.Del(key + SIGNATURE_SUFFIX)
+}
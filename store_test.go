@@ -0,0 +1,455 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// withS3Credentials gives the S3 store something to sign its requests
+// with, returning a function that puts the environment back
+func withS3Credentials() (restore func()) {
+	origAccess, origSecret := os.Getenv(S3_ACCESS_KEY_ENV), os.Getenv(S3_SECRET_KEY_ENV)
+	os.Setenv(S3_ACCESS_KEY_ENV, "minio")
+	os.Setenv(S3_SECRET_KEY_ENV, "minio123")
+	return func() {
+		os.Setenv(S3_ACCESS_KEY_ENV, origAccess)
+		os.Setenv(S3_SECRET_KEY_ENV, origSecret)
+	}
+}
+
+// withVaultEnv sets the Vault variables for a test, returning a function
+// that puts the environment back
+func withVaultEnv(vars map[string]string) (restore func()) {
+	names := []string{VAULT_ADDR_ENV, VAULT_TOKEN_ENV, VAULT_ROLE_ID_ENV, VAULT_SECRET_ID_ENV}
+	orig := make(map[string]string)
+	for _, name := range names {
+		orig[name] = os.Getenv(name)
+		os.Setenv(name, vars[name])
+	}
+	return func() {
+		for _, name := range names {
+			os.Setenv(name, orig[name])
+		}
+	}
+}
+
+// testStoreContract checks the behaviour every store has to share
+func testStoreContract(store Store) {
+	Convey("An empty store has no identities", func() {
+		identities, err := store.Identities()
+		So(err, ShouldEqual, nil)
+		So(len(identities), ShouldEqual, 0)
+
+		names, err := store.History("acct", "bob")
+		So(err, ShouldEqual, nil)
+		So(len(names), ShouldEqual, 0)
+
+		_, err = store.Latest("acct", "bob")
+		So(err, ShouldEqual, noSavedCredentialsError)
+	})
+
+	Convey("Saved files can be read back", func() {
+		So(store.Put("acct", "bob", "100-AAAA.json", []byte("first")), ShouldEqual, nil)
+		So(store.Put("acct", "bob", "200-BBBB.json", []byte("second")), ShouldEqual, nil)
+		So(store.Put("acct", "alice", "150-CCCC.json", []byte("alice's")), ShouldEqual, nil)
+		So(store.Put("other", "bob", "50-DDDD.json.superseded", []byte("old")), ShouldEqual, nil)
+
+		identities, err := store.Identities()
+		So(err, ShouldEqual, nil)
+		So(identities, ShouldResemble, []string{"acct/alice", "acct/bob", "other/bob"})
+
+		names, err := store.History("acct", "bob")
+		So(err, ShouldEqual, nil)
+		So(names, ShouldResemble, []string{"100-AAAA.json", "200-BBBB.json"})
+
+		file, err := store.Get("acct", "bob", "100-AAAA.json")
+		So(err, ShouldEqual, nil)
+		So(string(file.Data), ShouldEqual, "first")
+		So(file.Sig, ShouldBeNil)
+
+		_, err = store.Get("acct", "bob", "300-EEEE.json")
+		So(err, ShouldNotEqual, nil)
+
+		Convey("The newest file is the latest", func() {
+			latest, err := store.Latest("acct", "bob")
+			So(err, ShouldEqual, nil)
+			So(latest.Name, ShouldEqual, "200-BBBB.json")
+			So(string(latest.Data), ShouldEqual, "second")
+		})
+
+		Convey("Superseded files are history, but never the latest", func() {
+			names, err := store.History("other", "bob")
+			So(err, ShouldEqual, nil)
+			So(names, ShouldResemble, []string{"50-DDDD.json.superseded"})
+
+			_, err = store.Latest("other", "bob")
+			So(err, ShouldEqual, noSavedCredentialsError)
+
+			creds, err := storeCredentials(store)
+			So(err, ShouldEqual, nil)
+			So(creds, ShouldResemble, []string{"alice@acct", "bob@acct"})
+		})
+
+		Convey("An identity can be pointed at an older file", func() {
+			So(store.SetCurrent("acct", "bob", "100-AAAA.json"), ShouldEqual, nil)
+			latest, err := store.Latest("acct", "bob")
+			So(err, ShouldEqual, nil)
+			So(latest.Name, ShouldEqual, "100-AAAA.json")
+
+			Convey("until another is saved", func() {
+				So(store.Put("acct", "bob", "300-EEEE.json", []byte("third")), ShouldEqual, nil)
+				latest, err := store.Latest("acct", "bob")
+				So(err, ShouldEqual, nil)
+				So(latest.Name, ShouldEqual, "300-EEEE.json")
+			})
+
+			Convey("or it's deleted", func() {
+				So(store.Delete("acct", "bob", "100-AAAA.json"), ShouldEqual, nil)
+				latest, err := store.Latest("acct", "bob")
+				So(err, ShouldEqual, nil)
+				So(latest.Name, ShouldEqual, "200-BBBB.json")
+			})
+		})
+
+		Convey("Deleted files are gone", func() {
+			So(store.Delete("acct", "bob", "200-BBBB.json"), ShouldEqual, nil)
+			latest, err := store.Latest("acct", "bob")
+			So(err, ShouldEqual, nil)
+			So(latest.Name, ShouldEqual, "100-AAAA.json")
+
+			So(store.Delete("acct", "alice", "150-CCCC.json"), ShouldEqual, nil)
+			creds, err := storeCredentials(store)
+			So(err, ShouldEqual, nil)
+			So(creds, ShouldResemble, []string{"bob@acct"})
+		})
+	})
+
+	Convey("Create times are compared as numbers", func() {
+		So(store.Put("acct", "carol", "999-FFFF.json", []byte("older")), ShouldEqual, nil)
+		So(store.Put("acct", "carol", "1000-GGGG.json", []byte("newer")), ShouldEqual, nil)
+		latest, err := store.Latest("acct", "carol")
+		So(err, ShouldEqual, nil)
+		So(latest.Name, ShouldEqual, "1000-GGGG.json")
+	})
+
+	Convey("Files not named for their create time are an error", func() {
+		So(store.Put("acct", "carol", "latest.json", []byte("copied")), ShouldEqual, nil)
+		So(store.Put("acct", "carol", "300-HHHH.json", []byte("saved")), ShouldEqual, nil)
+		_, err := store.Latest("acct", "carol")
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldEqual, "Cannot tell which credentials for carol@acct are current; "+
+			"these are not named <create time>-<key id>.json: latest.json")
+
+		creds, err := storeCredentials(store)
+		So(err, ShouldEqual, nil)
+		So(creds, ShouldNotContain, "carol@acct")
+	})
+}
+
+func TestLatestName(t *testing.T) {
+	Convey("Test picking the current credential file", t, func() {
+		Convey("Newer times win whatever their length", func() {
+			latest, err := latestName("bob@acct", []string{"1000-BBBB.json", "999-AAAA.json", "README"})
+			So(err, ShouldEqual, nil)
+			So(latest, ShouldEqual, "1000-BBBB.json")
+		})
+
+		Convey("The name settles ties", func() {
+			latest, err := latestName("bob@acct", []string{"100-BBBB.json", "100-AAAA.json"})
+			So(err, ShouldEqual, nil)
+			So(latest, ShouldEqual, "100-BBBB.json")
+		})
+
+		Convey("A pointer wins if it names a live file", func() {
+			names := []string{"100-AAAA.json", "200-BBBB.json", "300-CCCC.json.superseded"}
+			current, err := currentName("bob@acct", names, "100-AAAA.json")
+			So(err, ShouldEqual, nil)
+			So(current, ShouldEqual, "100-AAAA.json")
+
+			current, err = currentName("bob@acct", names, "300-CCCC.json.superseded")
+			So(err, ShouldEqual, nil)
+			So(current, ShouldEqual, "200-BBBB.json")
+
+			current, err = currentName("bob@acct", names, "400-DDDD.json")
+			So(err, ShouldEqual, nil)
+			So(current, ShouldEqual, "200-BBBB.json")
+		})
+
+		Convey("Unparseable files are an error, even superseded", func() {
+			_, err := latestName("bob@acct", []string{"100-AAAA.json", "copy.json.superseded"})
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestStores(t *testing.T) {
+	Convey("Test the credential stores", t, func() {
+		tmp, err := ioutil.TempDir("", "credulous-store")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(tmp)
+
+		Convey("A directory on disk", func() {
+			store, err := openStore(filepath.Join(tmp, "repo"))
+			So(err, ShouldEqual, nil)
+			So(store, ShouldHaveSameTypeAs, fsStore{})
+			So(os.MkdirAll(filepath.Join(tmp, "repo"), 0700), ShouldEqual, nil)
+			testStoreContract(store)
+		})
+
+		Convey("A directory in git", func() {
+			repo := filepath.Join(tmp, "repo")
+			initTestRepo(repo)
+			store, err := openStore(repo)
+			So(err, ShouldEqual, nil)
+			testStoreContract(store)
+
+			Convey("commits what it saves", func() {
+				So(store.Put("acct", "bob", "1-AAAA.json", []byte("x")), ShouldEqual, nil)
+				origins, err := gitFileOrigins(repo, "acct/bob")
+				So(err, ShouldEqual, nil)
+				So(origins, ShouldContainKey, "acct/bob/1-AAAA.json")
+			})
+		})
+
+		Convey("A bundle file", func() {
+			bundle := filepath.Join(tmp, "creds"+BUNDLE_SUFFIX)
+			store, err := openStore(bundle)
+			So(err, ShouldEqual, nil)
+			So(store, ShouldHaveSameTypeAs, bundleStore{})
+			So(isDiskRepo(bundle), ShouldBeFalse)
+			testStoreContract(store)
+
+			Convey("is only readable by its owner", func() {
+				So(store.Put("acct", "bob", "1-AAAA.json", []byte("x")), ShouldEqual, nil)
+				info, err := os.Stat(bundle)
+				So(err, ShouldEqual, nil)
+				So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+			})
+		})
+
+		Convey("An S3-compatible object store", func() {
+			restore := withS3Credentials()
+			defer restore()
+			fake := NewFakeS3("creds")
+			defer fake.Close()
+			// make the store page through its listings
+			fake.pageSize = 2
+
+			url := fake.URL("creds", "team")
+			So(isDiskRepo(url), ShouldBeFalse)
+			store, err := openStore(url)
+			So(err, ShouldEqual, nil)
+			So(store, ShouldHaveSameTypeAs, s3Store{})
+			testStoreContract(store)
+
+			Convey("keeps its files under the prefix", func() {
+				So(store.Put("acct", "bob", "1-AAAA.json", []byte("x")), ShouldEqual, nil)
+				So(fake.Keys("creds"), ShouldContain, "team/acct/bob/1-AAAA.json")
+			})
+		})
+
+		Convey("A Vault KV engine", func() {
+			restore := withVaultEnv(map[string]string{VAULT_TOKEN_ENV: FAKE_VAULT_ROOT_TOKEN})
+			defer restore()
+			fake := NewFakeVault()
+			defer fake.Close()
+
+			url := fake.URL("team")
+			So(isDiskRepo(url), ShouldBeFalse)
+			store, err := openStore(url)
+			So(err, ShouldEqual, nil)
+			So(store, ShouldHaveSameTypeAs, vaultStore{})
+			testStoreContract(store)
+
+			Convey("keeps each identity's files as versions of one secret", func() {
+				So(store.Put("acct", "bob", "1-AAAA.json", []byte("x")), ShouldEqual, nil)
+				So(store.Put("acct", "bob", "2-BBBB.json", []byte("y")), ShouldEqual, nil)
+				So(fake.Versions("team/acct/bob"), ShouldEqual, 2)
+
+				So(store.Delete("acct", "bob", "1-AAAA.json"), ShouldEqual, nil)
+				So(fake.Versions("team/acct/bob"), ShouldEqual, 2)
+				names, err := store.History("acct", "bob")
+				So(err, ShouldEqual, nil)
+				So(names, ShouldResemble, []string{"2-BBBB.json"})
+			})
+
+			Convey("reads only the versions it needs", func() {
+				So(store.Put("acct", "bob", "1-AAAA.json", []byte("x")), ShouldEqual, nil)
+				So(store.Put("acct", "bob", "2-BBBB.json", []byte("y")), ShouldEqual, nil)
+				So(store.Put("acct", "bob", "3-CCCC.json", []byte("z")), ShouldEqual, nil)
+
+				before := fake.Requests()
+				latest, err := store.Latest("acct", "bob")
+				So(err, ShouldEqual, nil)
+				So(latest.Name, ShouldEqual, "3-CCCC.json")
+				So(fake.Requests()-before, ShouldEqual, 4)
+
+				before = fake.Requests()
+				current, err := store.Current("acct", "bob")
+				So(err, ShouldEqual, nil)
+				So(current, ShouldEqual, "3-CCCC.json")
+				So(fake.Requests()-before, ShouldEqual, 2)
+
+				before = fake.Requests()
+				file, err := store.Get("acct", "bob", "2-BBBB.json")
+				So(err, ShouldEqual, nil)
+				So(string(file.Data), ShouldEqual, "y")
+				So(fake.Requests()-before, ShouldEqual, 3)
+			})
+
+			Convey("keeps credentials byte for byte", func() {
+				data := []byte(`{"Version":"2014-06-12",  "Encryptions":[]}` + "\n")
+				So(store.Put("acct", "bob", "1-AAAA.json", data), ShouldEqual, nil)
+				file, err := store.Get("acct", "bob", "1-AAAA.json")
+				So(err, ShouldEqual, nil)
+				So(file.Data, ShouldResemble, data)
+			})
+		})
+
+		Convey("Vault logs in with an AppRole when there's no token", func() {
+			fake := NewFakeVault()
+			defer fake.Close()
+			fake.AddRole("role", "secret")
+
+			restore := withVaultEnv(map[string]string{VAULT_ROLE_ID_ENV: "role", VAULT_SECRET_ID_ENV: "secret"})
+			defer restore()
+			store, err := openStore(fake.URL(""))
+			So(err, ShouldEqual, nil)
+			So(store.Put("acct", "bob", "1-AAAA.json", []byte("x")), ShouldEqual, nil)
+			identities, err := store.Identities()
+			So(err, ShouldEqual, nil)
+			So(identities, ShouldResemble, []string{"acct/bob"})
+
+			os.Setenv(VAULT_SECRET_ID_ENV, "wrong")
+			store, err = openStore(fake.URL(""))
+			So(err, ShouldEqual, nil)
+			_, err = store.Identities()
+			So(err.Error(), ShouldEqual, "Vault: invalid role or secret ID")
+		})
+
+		Convey("Vault needs an address and credentials", func() {
+			restore := withVaultEnv(map[string]string{VAULT_TOKEN_ENV: "token"})
+			defer restore()
+			_, err := openStore(VAULT_SCHEME + "secret")
+			So(err.Error(), ShouldEqual, "No address for Vault; please set VAULT_ADDR")
+
+			os.Setenv(VAULT_ADDR_ENV, "http://127.0.0.1:8200")
+			os.Setenv(VAULT_TOKEN_ENV, "")
+			_, err = openStore(VAULT_SCHEME + "secret")
+			So(err.Error(), ShouldEqual, "No credentials for Vault; please set VAULT_TOKEN, or VAULT_ROLE_ID and VAULT_SECRET_ID")
+		})
+
+		Convey("S3 URLs are checked", func() {
+			restore := withS3Credentials()
+			defer restore()
+			_, err := openStore(S3_SCHEME + "bucket?region=nowhere-1")
+			So(err.Error(), ShouldEqual, "Unknown AWS region 'nowhere-1' in s3://bucket?region=nowhere-1")
+			_, err = openStore(S3_SCHEME)
+			So(err.Error(), ShouldEqual, "Invalid S3 repository 's3://'; expected s3://<bucket>[/<prefix>]")
+		})
+	})
+}
+
+func TestStoreRepos(t *testing.T) {
+	Convey("Test saving to and sourcing from a named store", t, func() {
+		home, cleanup := withTempHome()
+		defer cleanup()
+		So(os.MkdirAll(filepath.Join(getRootPath(), LOCAL_REPO), 0700), ShouldEqual, nil)
+
+		fakeIAM := NewFakeIAM("123456789012", "test-alias")
+		defer fakeIAM.Close()
+		restoreIAM := fakeIAM.Install()
+		defer restoreIAM()
+
+		restoreS3 := withS3Credentials()
+		defer restoreS3()
+		fakeS3 := NewFakeS3("creds")
+		defer fakeS3.Close()
+
+		restoreVault := withVaultEnv(map[string]string{VAULT_TOKEN_ENV: FAKE_VAULT_ROOT_TOKEN})
+		defer restoreVault()
+		fakeVault := NewFakeVault()
+		defer fakeVault.Close()
+
+		bundle := filepath.Join(home, "creds"+BUNDLE_SUFFIX)
+		So(addStoreRepo("bucket", fakeS3.URL("creds", "")), ShouldEqual, nil)
+		So(addStoreRepo("bundle", bundle), ShouldEqual, nil)
+		So(addStoreRepo("vault", fakeVault.URL("credulous")), ShouldEqual, nil)
+
+		Convey("Stores are listed and resolved by name", func() {
+			repos, err := listRepos()
+			So(err, ShouldEqual, nil)
+			So(repos, ShouldResemble, []string{LOCAL_REPO, "bucket", "bundle", "vault"})
+
+			repo, err := resolveRepo("bundle")
+			So(err, ShouldEqual, nil)
+			So(repo, ShouldEqual, bundle)
+		})
+
+		Convey("Names can't be reused, and git repos aren't stores", func() {
+			err := addStoreRepo("bucket", bundle)
+			So(err.Error(), ShouldEqual, "Repository 'bucket' already exists")
+			err = addStoreRepo(LOCAL_REPO, bundle)
+			So(err.Error(), ShouldEqual, "Repository 'local' already exists")
+			err = addStoreRepo("git", "/some/where")
+			So(err.Error(), ShouldEqual, "'/some/where' is not an s3:// or vault:// URL, or a .bundle file; use 'credulous repo clone' for git repositories")
+		})
+
+		Convey("Credentials saved to a store can be found and sourced", func() {
+			for name, username := range map[string]string{"bucket": "bob", "bundle": "carol", "vault": "dave"} {
+				repo, err := resolveRepo(name)
+				So(err, ShouldEqual, nil)
+				keyIds := saveTestVersions(fakeIAM, repo, username, 2)
+
+				creds, err := RetrieveCredentials(repo, "", "", "testdata/testkey")
+				So(err, ShouldEqual, nil)
+				So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, keyIds[1])
+
+				history, err := credentialHistory(repo, "test-alias", username)
+				So(err, ShouldEqual, nil)
+				So(len(history), ShouldEqual, 2)
+				So(history[0].Current, ShouldBeTrue)
+
+				creds, err = RetrieveCredentialVersion(repo, "test-alias", username, "1", "testdata/testkey")
+				So(err, ShouldEqual, nil)
+				So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, keyIds[0])
+
+				_, err = restoreCredentials(repo, "test-alias", username, "1")
+				So(err, ShouldNotEqual, nil)
+			}
+
+			found, err := findRepoFor("test-alias", "bob")
+			So(err, ShouldEqual, nil)
+			So(found, ShouldEqual, fakeS3.URL("creds", ""))
+			found, err = findRepoFor("test-alias", "carol")
+			So(err, ShouldEqual, nil)
+			So(found, ShouldEqual, bundle)
+			found, err = findRepoFor("test-alias", "dave")
+			So(err, ShouldEqual, nil)
+			So(found, ShouldEqual, fakeVault.URL("credulous"))
+
+			rootDir, err := os.Open(getRootPath())
+			So(err, ShouldEqual, nil)
+			defer rootDir.Close()
+			settings, err := loadRepoSettings()
+			So(err, ShouldEqual, nil)
+			creds, err := listAvailableCredentials(rootDir, settings)
+			So(err, ShouldEqual, nil)
+			So(creds, ShouldResemble, []string{"bob@test-alias", "carol@test-alias", "dave@test-alias"})
+		})
+
+		Convey("Removing a store only forgets its name", func() {
+			So(addStoreRepo("other", bundle), ShouldEqual, nil)
+			So(bundleStore{file: bundle}.Put("acct", "bob", "1-AAAA.json", []byte("x")), ShouldEqual, nil)
+			So(removeRepo("other", false), ShouldEqual, nil)
+			_, err := resolveRepo("other")
+			So(err, ShouldNotEqual, nil)
+			_, err = os.Stat(bundle)
+			So(err, ShouldEqual, nil)
+		})
+	})
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const VAULT_SCHEME string = "vault://"
+
+// The same variables the vault command reads, plus an AppRole to log in
+// with when there's no token
+const VAULT_ADDR_ENV string = "VAULT_ADDR"
+const VAULT_TOKEN_ENV string = "VAULT_TOKEN"
+const VAULT_ROLE_ID_ENV string = "VAULT_ROLE_ID"
+const VAULT_SECRET_ID_ENV string = "VAULT_SECRET_ID"
+
+const DEFAULT_VAULT_APPROLE string = "approle"
+
+// vaultStore keeps each identity's credentials as one secret in a Vault
+// KV version 2 engine, at <mount>/<prefix>/<account>/<username>. Every
+// save is a new version of the secret, so Vault's versioning is the
+// history, and superseding or pruning a file destroys its version.
+type vaultStore struct {
+	client *vaultClient
+	mount  string
+	prefix string
+}
+
+// vaultSecret is what each version of a secret holds. The credentials
+// are kept as a string, since Vault doesn't keep JSON byte for byte.
+type vaultSecret struct {
+	Name        string `json:"name"`
+	Credentials string `json:"credentials"`
+}
+
+type vaultClient struct {
+	address  string
+	approle  string
+	roleId   string
+	secretId string
+	token    string
+}
+
+// newVaultStore opens vault://<mount>[/<prefix>][?address=<url>][&approle=<path>];
+// the address defaults to $VAULT_ADDR
+func newVaultStore(repo string) (Store, error) {
+	u, err := url.Parse(repo)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("Invalid Vault repository '" + repo + "'; expected vault://<mount>[/<prefix>]")
+	}
+	query := u.Query()
+	client := &vaultClient{
+		address:  query.Get("address"),
+		approle:  query.Get("approle"),
+		token:    os.Getenv(VAULT_TOKEN_ENV),
+		roleId:   os.Getenv(VAULT_ROLE_ID_ENV),
+		secretId: os.Getenv(VAULT_SECRET_ID_ENV),
+	}
+	if client.address == "" {
+		client.address = os.Getenv(VAULT_ADDR_ENV)
+	}
+	if client.address == "" {
+		return nil, errors.New("No address for Vault; please set " + VAULT_ADDR_ENV)
+	}
+	client.address = strings.TrimSuffix(client.address, "/")
+	if client.approle == "" {
+		client.approle = DEFAULT_VAULT_APPROLE
+	}
+	if client.token == "" && (client.roleId == "" || client.secretId == "") {
+		return nil, errors.New("No credentials for Vault; please set " + VAULT_TOKEN_ENV + ", or " +
+			VAULT_ROLE_ID_ENV + " and " + VAULT_SECRET_ID_ENV)
+	}
+	return vaultStore{
+		client: client,
+		mount:  u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+type vaultErrorResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// request calls the Vault API, decoding the response into out if it's
+// not nil. found is false if Vault says there's nothing at that path.
+func (c *vaultClient) request(method, apipath string, body, out interface{}) (found bool, err error) {
+	if c.token == "" {
+		if err = c.login(); err != nil {
+			return false, err
+		}
+	}
+	return c.send(method, apipath, body, out)
+}
+
+func (c *vaultClient) send(method, apipath string, body, out interface{}) (found bool, err error) {
+	var reqBody []byte
+	if body != nil {
+		if reqBody, err = json.Marshal(body); err != nil {
+			return false, err
+		}
+	}
+	req, err := http.NewRequest(method, c.address+"/v1/"+apipath, bytes.NewReader(reqBody))
+	if err != nil {
+		return false, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		var verr vaultErrorResponse
+		json.Unmarshal(b, &verr)
+		if len(verr.Errors) == 0 {
+			verr.Errors = []string{resp.Status}
+		}
+		return false, errors.New("Vault: " + strings.Join(verr.Errors, "; "))
+	}
+	if out != nil && len(b) > 0 {
+		if err = json.Unmarshal(b, out); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+type vaultLoginResponse struct {
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+// login exchanges the AppRole's role and secret ids for a token
+func (c *vaultClient) login() error {
+	var resp vaultLoginResponse
+	body := map[string]string{"role_id": c.roleId, "secret_id": c.secretId}
+	found, err := c.send("POST", "auth/"+c.approle+"/login", body, &resp)
+	if err != nil {
+		return err
+	}
+	if !found || resp.Auth.ClientToken == "" {
+		return errors.New("Vault: cannot log in with AppRole at auth/" + c.approle)
+	}
+	c.token = resp.Auth.ClientToken
+	return nil
+}
+
+func (s vaultStore) secretPath(parts ...string) string {
+	return path.Join(append([]string{s.prefix}, parts...)...)
+}
+
+type vaultVersionMetadata struct {
+	DeletionTime string `json:"deletion_time"`
+	Destroyed    bool   `json:"destroyed"`
+}
+
+type vaultMetadataResponse struct {
+	Data struct {
+		Versions map[string]vaultVersionMetadata `json:"versions"`
+	} `json:"data"`
+}
+
+type vaultReadResponse struct {
+	Data struct {
+		Data vaultSecret `json:"data"`
+	} `json:"data"`
+}
+
+type vaultListResponse struct {
+	Data struct {
+		Keys []string `json:"keys"`
+	} `json:"data"`
+}
+
+// liveVersions lists the versions of an identity's secret, oldest
+// first, leaving out those deleted or destroyed
+func (s vaultStore) liveVersions(account, username string) ([]int, error) {
+	secret := s.secretPath(account, username)
+	var meta vaultMetadataResponse
+	found, err := s.client.request("GET", s.mount+"/metadata/"+secret, nil, &meta)
+	if err != nil || !found {
+		return []int{}, err
+	}
+
+	numbers := []int{}
+	for version, info := range meta.Data.Versions {
+		if info.Destroyed || info.DeletionTime != "" {
+			continue
+		}
+		n, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, errors.New("Vault: bad version '" + version + "' of " + secret)
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// readVersions reads every live version of an identity's secret,
+// oldest first
+func (s vaultStore) readVersions(account, username string) ([]int, []vaultSecret, error) {
+	numbers, err := s.liveVersions(account, username)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := []vaultSecret{}
+	for _, n := range numbers {
+		file, err := s.readVersion(account, username, n)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, file)
+	}
+	return numbers, files, nil
+}
+
+// versions maps the name of each file saved for an identity to the
+// versions of the secret holding it, oldest first
+func (s vaultStore) versions(account, username string) (map[string][]int, error) {
+	numbers, files, err := s.readVersions(account, username)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string][]int)
+	for i, file := range files {
+		names[file.Name] = append(names[file.Name], numbers[i])
+	}
+	return names, nil
+}
+
+// find reads back from the newest version until it finds the file,
+// saying whether that's the newest version and so the current file
+func (s vaultStore) find(account, username, name string) (file vaultSecret, current bool, err error) {
+	numbers, err := s.liveVersions(account, username)
+	if err != nil {
+		return vaultSecret{}, false, err
+	}
+	for i := len(numbers) - 1; i >= 0; i-- {
+		file, err := s.readVersion(account, username, numbers[i])
+		if err != nil {
+			return vaultSecret{}, false, err
+		}
+		if file.Name == name {
+			return file, i == len(numbers)-1, nil
+		}
+	}
+	return vaultSecret{}, false, errors.New("No credential file " + name + " in " + s.mount + "/" + s.secretPath(account, username))
+}
+
+func (s vaultStore) readVersion(account, username string, version int) (vaultSecret, error) {
+	secret := s.secretPath(account, username)
+	var resp vaultReadResponse
+	found, err := s.client.request("GET", s.mount+"/data/"+secret+"?version="+strconv.Itoa(version), nil, &resp)
+	if err != nil {
+		return vaultSecret{}, err
+	}
+	if !found {
+		return vaultSecret{}, errors.New("Vault: no version " + strconv.Itoa(version) + " of " + secret)
+	}
+	return resp.Data.Data, nil
+}
+
+// list returns the keys Vault has directly under a path, with a
+// trailing slash on those that are folders
+func (s vaultStore) list(dir string) ([]string, error) {
+	var resp vaultListResponse
+	found, err := s.client.request("GET", s.mount+"/metadata/"+dir+"?list=true", nil, &resp)
+	if err != nil || !found {
+		return []string{}, err
+	}
+	return resp.Data.Keys, nil
+}
+
+func (s vaultStore) Put(account, username, name string, data []byte) error {
+	body := map[string]interface{}{
+		"data": vaultSecret{Name: name, Credentials: string(data)},
+	}
+	_, err := s.client.request("POST", s.mount+"/data/"+s.secretPath(account, username), body, nil)
+	return err
+}
+
+// Latest reads each version once, where asking for the history, the
+// current file and then the file itself would read them all three times
+func (s vaultStore) Latest(account, username string) (StoredFile, error) {
+	_, files, err := s.readVersions(account, username)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	names, pointer := []string{}, ""
+	for _, file := range files {
+		names = append(names, file.Name)
+		pointer = file.Name
+	}
+	name, err := currentName(username+"@"+account, names, pointer)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	for i := len(files) - 1; ; i-- {
+		if files[i].Name == name {
+			return StoredFile{Name: name, Data: []byte(files[i].Credentials)}, nil
+		}
+	}
+}
+
+// Current is whichever file the newest version of the secret holds,
+// since every save makes a new version
+func (s vaultStore) Current(account, username string) (string, error) {
+	numbers, err := s.liveVersions(account, username)
+	if err != nil || len(numbers) == 0 {
+		return "", err
+	}
+	file, err := s.readVersion(account, username, numbers[len(numbers)-1])
+	if err != nil {
+		return "", err
+	}
+	return file.Name, nil
+}
+
+// SetCurrent writes the file again as a new version, much as 'vault kv
+// rollback' does
+func (s vaultStore) SetCurrent(account, username, name string) error {
+	file, current, err := s.find(account, username, name)
+	if err != nil || current {
+		return err
+	}
+	return s.Put(account, username, name, []byte(file.Credentials))
+}
+
+func (s vaultStore) Identities() ([]string, error) {
+	accounts, err := s.list(s.prefix)
+	if err != nil {
+		return nil, err
+	}
+	identities := []string{}
+	for _, account := range accounts {
+		if !strings.HasSuffix(account, "/") {
+			continue
+		}
+		users, err := s.list(s.secretPath(account))
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			if !strings.HasSuffix(user, "/") {
+				identities = append(identities, account+user)
+			}
+		}
+	}
+	sort.Strings(identities)
+	return identities, nil
+}
+
+func (s vaultStore) History(account, username string) ([]string, error) {
+	versions, err := s.versions(account, username)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s vaultStore) Get(account, username, name string) (StoredFile, error) {
+	file, _, err := s.find(account, username, name)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	return StoredFile{Name: name, Data: []byte(file.Credentials)}, nil
+}
+
+// Delete destroys the versions holding the file, so that it can't be
+// undeleted and decrypted later
+func (s vaultStore) Delete(account, username, name string) error {
+	versions, err := s.versions(account, username)
+	if err != nil {
+		return err
+	}
+	numbers, ok := versions[name]
+	if !ok {
+		return errors.New("No credential file " + name + " in " + s.mount + "/" + s.secretPath(account, username))
+	}
+	body := map[string][]int{"versions": numbers}
+	_, err = s.client.request("POST", s.mount+"/destroy/"+s.secretPath(account, username), body, nil)
+	return err
+}
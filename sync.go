@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/realestate-com-au/goamz/aws"
+	"github.com/realestate-com-au/goamz/iam"
+)
+
+const SUPERSEDED_SUFFIX string = ".superseded"
+
+// SyncAuth is what sync can use to ask IAM which of several concurrently
+// saved credentials is live: a credential known to be good for one
+// identity (say, the one just saved), and a private key to decrypt the
+// rest
+type SyncAuth struct {
+	Cred     *Credential
+	Identity string
+	Keyfile  string
+}
+
+// syncRepo pulls any new credentials from the repo's remote, replays
+// ours on top, and pushes the result. If someone else pushes in the
+// meantime, we try again a couple of times.
+func syncRepo(repo string, auth SyncAuth) error {
+	conf, err := getSyncConfig(repo)
+	if err != nil {
+		return err
+	}
+	if conf.Remote == "" {
+		return errors.New("No remote configured for " + repo + "; please run 'credulous sync --remote <url>' first")
+	}
+	unlock, err := lockRepo(repo)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = pullRepo(repo, conf, auth); err != nil {
+			return err
+		}
+		if err = gitPush(repo, conf.Remote); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func pullRepo(repo string, conf SyncConfig, auth SyncAuth) error {
+	if err := gitFetch(repo, conf.Remote); err != nil {
+		return err
+	}
+	local, remote, err := gitDivergedFiles(repo, conf.Remote)
+	if err != nil {
+		return err
+	}
+	if err = gitRebase(repo, conf.Remote); err != nil {
+		return err
+	}
+	if err = forgetCurrentPointers(repo, remote); err != nil {
+		return err
+	}
+
+	// conflicts we couldn't settle last time are still worth a try
+	pending := loadPendingConflicts(repo)
+	for identity, files := range concurrentSaves(local, remote) {
+		pending[identity] = append(pending[identity], files...)
+	}
+	for identity, files := range pending {
+		err := resolveConcurrentSaves(repo, identity, files, auth)
+		if err != nil {
+			log.Print("WARNING: " + err.Error())
+			continue
+		}
+		delete(pending, identity)
+	}
+	return savePendingConflicts(repo, pending)
+}
+
+// pullIfStale brings a shared repo up to date before we read from it,
+// unless it was synced recently. Failure only warrants a warning, so
+// that credentials can still be used offline.
+func pullIfStale(repo string, auth SyncAuth) {
+	isrepo, err := isGitRepo(repo)
+	if err != nil || !isrepo {
+		return
+	}
+	conf, err := getSyncConfig(repo)
+	if err != nil {
+		log.Print("WARNING: cannot read sync configuration for " + repo + ": " + err.Error())
+		return
+	}
+	if conf.Remote == "" || time.Since(conf.LastSync) < conf.StaleAfter {
+		return
+	}
+	unlock, err := lockRepo(repo)
+	if err != nil {
+		log.Print("WARNING: cannot update " + repo + " from its remote, using local copy: " + err.Error())
+		return
+	}
+	defer unlock()
+	if err = pullRepo(repo, conf, auth); err != nil {
+		log.Print("WARNING: cannot update " + repo + " from its remote, using local copy: " + err.Error())
+	}
+}
+
+// pushIfShared syncs a repo after we've committed to it, if it has a
+// remote. The commit is safe locally either way, so failure is only a
+// warning.
+func pushIfShared(repo string, auth SyncAuth) {
+	isrepo, err := isGitRepo(repo)
+	if err != nil || !isrepo {
+		return
+	}
+	conf, err := getSyncConfig(repo)
+	if err != nil || conf.Remote == "" {
+		return
+	}
+	if err = syncRepo(repo, auth); err != nil {
+		log.Print("WARNING: saved locally, but cannot sync " + repo + " with its remote; run 'credulous sync' later: " + err.Error())
+	}
+}
+
+// concurrentSaves finds identities that had credentials saved both
+// locally and on the remote since they last synced, and returns all of
+// those new files for each, keyed by their <account>/<user> directory
+func concurrentSaves(local, remote []string) map[string][]string {
+	byIdentity := func(files []string) map[string][]string {
+		ids := make(map[string][]string)
+		for _, file := range files {
+			if _, _, err := parseCredentialFilename(file); err != nil {
+				continue
+			}
+			ids[filepath.Dir(file)] = append(ids[filepath.Dir(file)], file)
+		}
+		return ids
+	}
+
+	localIds := byIdentity(local)
+	remoteIds := byIdentity(remote)
+	conflicts := make(map[string][]string)
+	for identity, files := range localIds {
+		if theirs, ok := remoteIds[identity]; ok {
+			conflicts[identity] = append(append([]string{}, files...), theirs...)
+		}
+	}
+	return conflicts
+}
+
+// liveCredentialFile picks, from credential files saved concurrently for
+// one identity, the one whose key IAM says is active. If more than one
+// is, the most recently created wins.
+func liveCredentialFile(files []string, keys []iam.AccessKey) (winner string, losers []string, err error) {
+	var newest int64 = -1
+	for _, file := range files {
+		created, suffix, err := parseCredentialFilename(file)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, key := range keys {
+			if key.Status == "Active" && strings.HasSuffix(key.Id, suffix) && created > newest {
+				newest = created
+				winner = file
+			}
+		}
+	}
+	if winner == "" {
+		return "", nil, errors.New("None of the concurrently saved credentials are active in IAM")
+	}
+	for _, file := range files {
+		if file != winner {
+			losers = append(losers, file)
+		}
+	}
+	return winner, losers, nil
+}
+
+// savedKind is the kind of secret in a saved file, taking anything it
+// can't read to be AWS credentials
+func savedKind(file string) string {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return SECRET_KIND_AWS
+	}
+	creds, _, err := readCredentialMetadata(b)
+	if err != nil {
+		return SECRET_KIND_AWS
+	}
+	return secretKind(creds.Kind)
+}
+
+// newestCredentialFile picks the newest of some concurrently saved files
+func newestCredentialFile(files []string) (winner string, losers []string) {
+	for _, file := range files {
+		if winner == "" || newerCredential(filepath.Base(file), filepath.Base(winner)) {
+			winner = file
+		}
+	}
+	for _, file := range files {
+		if file != winner {
+			losers = append(losers, file)
+		}
+	}
+	return winner, losers
+}
+
+// resolveConcurrentSaves asks IAM which of the concurrently saved files
+// holds the live key, marks the rest as superseded so that they are
+// never sourced, and commits the result
+func resolveConcurrentSaves(repo, identity string, files []string, auth SyncAuth) error {
+	account, username := filepath.Dir(identity), filepath.Base(identity)
+	name := username + "@" + account
+
+	// somebody else may have resolved these already
+	remaining := []string{}
+	for _, file := range uniqueStrings(files) {
+		if _, err := os.Stat(filepath.Join(repo, file)); err == nil {
+			remaining = append(remaining, file)
+		}
+	}
+	if len(remaining) < 2 {
+		return nil
+	}
+
+	var winner, reason string
+	var losers []string
+	if kind := savedKind(filepath.Join(repo, remaining[0])); kind != SECRET_KIND_AWS {
+		// IAM knows nothing of other secrets, so the newest wins
+		name = storedIdentity(kind, account, username)
+		winner, losers = newestCredentialFile(remaining)
+		reason = "the newest"
+	} else {
+		keys, err := listKeysFor(repo, identity, iamUsernameFor(account, username), remaining, auth)
+		if err != nil {
+			return errors.New("Cannot tell which of the credentials saved concurrently for " + name + " is live: " + err.Error())
+		}
+		winner, losers, err = liveCredentialFile(remaining, keys)
+		if err != nil {
+			return errors.New("Cannot resolve credentials saved concurrently for " + name + ": " + err.Error())
+		}
+		reason = "whose key is active in IAM"
+	}
+
+	added, removed := []string{}, []string{}
+	for _, loser := range losers {
+		a, r, err := renameWithSignature(repo, loser, loser+SUPERSEDED_SUFFIX)
+		if err != nil {
+			return err
+		}
+		added, removed = append(added, a...), append(removed, r...)
+	}
+	message := fmt.Sprintf("Resolved concurrent saves for %s\n\nKept %s, %s.\nSuperseded %s.\n",
+		name, filepath.Base(winner), reason, strings.Join(losers, ", "))
+	if _, err := gitCommitPaths(repo, added, removed, message); err != nil {
+		return err
+	}
+	return setCurrentPointer(repo, account, username, filepath.Base(winner))
+}
+
+// forgetCurrentPointers drops the current pointers of identities that
+// somebody else has saved credentials for, since we last synced, so that
+// the newest credentials are current again
+func forgetCurrentPointers(repo string, added []string) error {
+	pointers := loadCurrentPointers(repo)
+	for _, file := range added {
+		if _, _, err := parseCredentialFilename(file); err == nil {
+			delete(pointers, filepath.ToSlash(filepath.Dir(file)))
+		}
+	}
+	return saveCurrentPointers(repo, pointers)
+}
+
+// renameWithSignature renames a credential file within the repo, taking
+// its signature along if it has one, and returns the paths to stage
+func renameWithSignature(repo, from, to string) (added, removed []string, err error) {
+	if err = os.Rename(filepath.Join(repo, from), filepath.Join(repo, to)); err != nil {
+		return nil, nil, err
+	}
+	added, removed = []string{to}, []string{from}
+	sigfile := filepath.Join(repo, from+SIGNATURE_SUFFIX)
+	if _, err := os.Stat(sigfile); err == nil {
+		if err = os.Rename(sigfile, filepath.Join(repo, to+SIGNATURE_SUFFIX)); err != nil {
+			return nil, nil, err
+		}
+		added = append(added, to+SIGNATURE_SUFFIX)
+		removed = append(removed, from+SIGNATURE_SUFFIX)
+	}
+	return added, removed, nil
+}
+
+// listKeysFor lists the identity's access keys, using whichever
+// credential we can get hold of that IAM will accept. Files are only
+// decrypted until one works.
+func listKeysFor(repo, identity, iamUsername string, files []string, auth SyncAuth) ([]iam.AccessKey, error) {
+	var err error = errors.New("no credentials available to ask IAM; run 'credulous sync' with a private key that can decrypt them")
+	tryCred := func(cred Credential) ([]iam.AccessKey, bool) {
+		instance := newIAMClient(aws.Auth{AccessKey: cred.KeyId, SecretKey: cred.SecretKey})
+		var resp *iam.AccessKeysResp
+		resp, err = instance.AccessKeys(iamUsername)
+		if err != nil {
+			return nil, false
+		}
+		return resp.AccessKeys, true
+	}
+
+	if auth.Cred != nil && auth.Identity == identity {
+		if keys, ok := tryCred(*auth.Cred); ok {
+			return keys, nil
+		}
+	}
+	if auth.Keyfile != "" {
+		store, storeErr := openStore(repo)
+		if storeErr != nil {
+			return nil, storeErr
+		}
+		for _, file := range files {
+			account, username := splitIdentity(filepath.Dir(file))
+			stored, getErr := store.Get(account, username, filepath.Base(file))
+			if getErr != nil {
+				continue
+			}
+			decoded, decodeErr := decodeCredentialData(stored.Data, auth.Keyfile)
+			if decodeErr != nil {
+				continue
+			}
+			if keys, ok := tryCred(decoded.Encryptions[0].decoded); ok {
+				return keys, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+// iamUsernameFor gives the username IAM knows an identity by; the root
+// user is saved under the account name, but has no username as far as
+// IAM is concerned
+func iamUsernameFor(account, username string) string {
+	if username == account {
+		return ""
+	}
+	return username
+}
+
+func pendingConflictsFile(repo string) string {
+	return filepath.Join(repo, ".git", "credulous-conflicts")
+}
+
+func loadPendingConflicts(repo string) map[string][]string {
+	pending := make(map[string][]string)
+	b, err := ioutil.ReadFile(pendingConflictsFile(repo))
+	if err != nil {
+		return pending
+	}
+	if err = json.Unmarshal(b, &pending); err != nil {
+		log.Print("WARNING: ignoring unreadable " + pendingConflictsFile(repo))
+	}
+	return pending
+}
+
+func savePendingConflicts(repo string, pending map[string][]string) error {
+	if len(pending) == 0 {
+		err := os.Remove(pendingConflictsFile(repo))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	b, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(pendingConflictsFile(repo), b, 0600)
+}
+
+func uniqueStrings(in []string) []string {
+	seen := make(map[string]bool)
+	out := []string{}
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
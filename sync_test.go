@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/realestate-com-au/goamz/iam"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func initTestRepo(repopath string) {
+	panic_the_err(gitInit(repopath))
+	repo, err := openGitRepo(repopath)
+	panic_the_err(err)
+	_ = repo.SetConfig("user.name", "Test User")
+	_ = repo.SetConfig("user.email", "test.user@nowhere")
+}
+
+func initBareTestRepo(repopath string) error {
+	backend, err := gitBackend()
+	if err != nil {
+		return err
+	}
+	_, err = backend.Init(repopath, true)
+	return err
+}
+
+func addTestFile(repopath, relpath, contents string) {
+	fullpath := filepath.Join(repopath, relpath)
+	err := os.MkdirAll(filepath.Dir(fullpath), 0700)
+	panic_the_err(err)
+	err = ioutil.WriteFile(fullpath, []byte(contents), 0600)
+	panic_the_err(err)
+	_, err = gitCommitPaths(repopath, []string{relpath}, nil, "Added by test")
+	panic_the_err(err)
+}
+
+func fileExists(fullpath string) bool {
+	_, err := os.Stat(fullpath)
+	return err == nil
+}
+
+func TestSync(t *testing.T) {
+	Convey("Test syncing repos through a shared remote", t, func() {
+		tmp, err := ioutil.TempDir("", "credulous-sync")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(tmp)
+
+		remote := filepath.Join(tmp, "remote.git")
+		err = initBareTestRepo(remote)
+		So(err, ShouldEqual, nil)
+
+		alice := filepath.Join(tmp, "alice")
+		bob := filepath.Join(tmp, "bob")
+		initTestRepo(alice)
+		initTestRepo(bob)
+
+		Convey("Syncing without a remote is an error", func() {
+			err := syncRepo(alice, SyncAuth{})
+			So(err, ShouldNotEqual, nil)
+		})
+
+		So(setSyncRemote(alice, "origin", "file://"+remote), ShouldEqual, nil)
+		So(setSyncRemote(bob, "origin", "file://"+remote), ShouldEqual, nil)
+
+		addTestFile(alice, "acct/alice/1-aaaa.json", "alice's first")
+		So(syncRepo(alice, SyncAuth{}), ShouldEqual, nil)
+
+		Convey("A new clone picks up pushed credentials", func() {
+			So(syncRepo(bob, SyncAuth{}), ShouldEqual, nil)
+			So(fileExists(filepath.Join(bob, "acct/alice/1-aaaa.json")), ShouldBeTrue)
+		})
+
+		Convey("Concurrent saves are rebased rather than lost", func() {
+			So(syncRepo(bob, SyncAuth{}), ShouldEqual, nil)
+			addTestFile(alice, "acct/alice/2-bbbb.json", "alice's second")
+			addTestFile(bob, "acct/bob/1-cccc.json", "bob's first")
+
+			So(syncRepo(alice, SyncAuth{}), ShouldEqual, nil)
+			So(syncRepo(bob, SyncAuth{}), ShouldEqual, nil)
+			So(syncRepo(alice, SyncAuth{}), ShouldEqual, nil)
+
+			for _, repo := range []string{alice, bob} {
+				So(fileExists(filepath.Join(repo, "acct/alice/1-aaaa.json")), ShouldBeTrue)
+				So(fileExists(filepath.Join(repo, "acct/alice/2-bbbb.json")), ShouldBeTrue)
+				So(fileExists(filepath.Join(repo, "acct/bob/1-cccc.json")), ShouldBeTrue)
+			}
+		})
+
+		Convey("Credentials pulled from the remote become current", func() {
+			So(syncRepo(bob, SyncAuth{}), ShouldEqual, nil)
+			store := fsStore{root: bob}
+			So(store.SetCurrent("acct", "alice", "1-aaaa.json"), ShouldEqual, nil)
+
+			addTestFile(alice, "acct/alice/2-bbbb.json", "alice's second")
+			So(syncRepo(alice, SyncAuth{}), ShouldEqual, nil)
+			So(syncRepo(bob, SyncAuth{}), ShouldEqual, nil)
+
+			latest, err := store.Latest("acct", "alice")
+			So(err, ShouldEqual, nil)
+			So(latest.Name, ShouldEqual, "2-bbbb.json")
+		})
+
+		Convey("Syncing records when the repo was last synced", func() {
+			conf, err := getSyncConfig(alice)
+			So(err, ShouldEqual, nil)
+			So(conf.Remote, ShouldEqual, "origin")
+			So(conf.StaleAfter, ShouldEqual, DEFAULT_STALE_AFTER)
+			So(time.Since(conf.LastSync), ShouldBeLessThan, time.Minute)
+		})
+
+		Convey("A fresh repo isn't pulled again until it goes stale", func() {
+			So(syncRepo(bob, SyncAuth{}), ShouldEqual, nil)
+			addTestFile(alice, "acct/alice/2-bbbb.json", "alice's second")
+			So(syncRepo(alice, SyncAuth{}), ShouldEqual, nil)
+
+			pullIfStale(bob, SyncAuth{})
+			So(fileExists(filepath.Join(bob, "acct/alice/2-bbbb.json")), ShouldBeFalse)
+
+			So(setSyncStaleAfter(bob, 0), ShouldEqual, nil)
+			pullIfStale(bob, SyncAuth{})
+			So(fileExists(filepath.Join(bob, "acct/alice/2-bbbb.json")), ShouldBeTrue)
+		})
+	})
+}
+
+func TestConcurrentSaves(t *testing.T) {
+	Convey("Test finding credentials saved concurrently", t, func() {
+		Convey("Different identities don't conflict", func() {
+			local := []string{"acct/alice/1-aaaa.json"}
+			remote := []string{"acct/bob/1-bbbb.json"}
+			So(len(concurrentSaves(local, remote)), ShouldEqual, 0)
+		})
+		Convey("The same identity saved on both sides conflicts", func() {
+			local := []string{"acct/alice/2-aaaa.json", "acct/bob/1-bbbb.json"}
+			remote := []string{"acct/alice/3-cccc.json"}
+			conflicts := concurrentSaves(local, remote)
+			So(len(conflicts), ShouldEqual, 1)
+			So(conflicts["acct/alice"], ShouldResemble, []string{"acct/alice/2-aaaa.json", "acct/alice/3-cccc.json"})
+		})
+		Convey("Files that aren't credentials are ignored", func() {
+			local := []string{"acct/alice/README"}
+			remote := []string{"acct/alice/3-cccc.json"}
+			So(len(concurrentSaves(local, remote)), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestLiveCredentialFile(t *testing.T) {
+	Convey("Test picking the live credential", t, func() {
+		files := []string{"acct/alice/100-KEYAAAAA.json", "acct/alice/200-KEYBBBBB.json"}
+
+		Convey("The file whose key is active wins", func() {
+			keys := []iam.AccessKey{
+				{Id: "AKIAFAKE0000KEYAAAAA", Status: "Active"},
+				{Id: "AKIAFAKE0000KEYBBBBB", Status: "Inactive"},
+			}
+			winner, losers, err := liveCredentialFile(files, keys)
+			So(err, ShouldEqual, nil)
+			So(winner, ShouldEqual, files[0])
+			So(losers, ShouldResemble, []string{files[1]})
+		})
+		Convey("The newest wins if both are active", func() {
+			keys := []iam.AccessKey{
+				{Id: "AKIAFAKE0000KEYAAAAA", Status: "Active"},
+				{Id: "AKIAFAKE0000KEYBBBBB", Status: "Active"},
+			}
+			winner, _, err := liveCredentialFile(files, keys)
+			So(err, ShouldEqual, nil)
+			So(winner, ShouldEqual, files[1])
+		})
+		Convey("It's an error if none are active", func() {
+			keys := []iam.AccessKey{{Id: "AKIAFAKE0000KEYCCCCC", Status: "Active"}}
+			_, _, err := liveCredentialFile(files, keys)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestResolveConcurrentSaves(t *testing.T) {
+	Convey("Test resolving concurrent saves through a shared remote", t, func() {
+		fake := NewFakeIAM("123456789012", "test-alias")
+		defer fake.Close()
+		restore := fake.Install()
+		defer restore()
+
+		tmp, err := ioutil.TempDir("", "credulous-sync")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(tmp)
+
+		remote := filepath.Join(tmp, "remote.git")
+		err = initBareTestRepo(remote)
+		So(err, ShouldEqual, nil)
+		alice := filepath.Join(tmp, "alice")
+		bob := filepath.Join(tmp, "bob")
+		for _, repo := range []string{alice, bob} {
+			initTestRepo(repo)
+			So(setSyncRemote(repo, "origin", "file://"+remote), ShouldEqual, nil)
+		}
+		addTestFile(alice, "README", "shared credentials")
+		So(syncRepo(alice, SyncAuth{}), ShouldEqual, nil)
+		So(syncRepo(bob, SyncAuth{}), ShouldEqual, nil)
+
+		pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		So(err, ShouldEqual, nil)
+
+		// alice and bob both save the same user, but only bob's key is live
+		keyId, secret := fake.AddUser("carol")
+		stale := Credential{KeyId: "AKIAFAKE000000000099", SecretKey: "deleted"}
+		live := Credential{KeyId: keyId, SecretKey: secret}
+		So(SaveCredentials(SaveData{cred: stale, username: "carol", alias: "test-alias",
+			pubkeys: []ssh.PublicKey{pubkey}, force: true, repo: alice}), ShouldEqual, nil)
+		So(SaveCredentials(SaveData{cred: live, pubkeys: []ssh.PublicKey{pubkey}, repo: bob}), ShouldEqual, nil)
+
+		So(syncRepo(bob, SyncAuth{}), ShouldEqual, nil)
+		So(syncRepo(alice, SyncAuth{Keyfile: "testdata/testkey"}), ShouldEqual, nil)
+
+		creds, err := RetrieveCredentials(alice, "test-alias", "carol", "testdata/testkey")
+		So(err, ShouldEqual, nil)
+		So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, keyId)
+
+		So(syncRepo(bob, SyncAuth{}), ShouldEqual, nil)
+		creds, err = RetrieveCredentials(bob, "test-alias", "carol", "testdata/testkey")
+		So(err, ShouldEqual, nil)
+		So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, keyId)
+		So(fileExists(pendingConflictsFile(alice)), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,3 @@
+module github.com/realestate-com-au/goamz
+
+go 1.25
@@ -6,10 +6,33 @@ import (
 	"os"
 )
 
+// Exit statuses, so that scripts can tell why credulous failed
+const (
+	EXIT_ERROR               int = 1
+	EXIT_INVALID_CREDENTIALS int = 2
+	EXIT_ACCESS_DENIED       int = 3
+	EXIT_THROTTLED           int = 4
+	EXIT_NETWORK             int = 5
+)
+
+func exitCode(err error) int {
+	switch classifyAWSError(err) {
+	case AWSInvalidCredentialsError:
+		return EXIT_INVALID_CREDENTIALS
+	case AWSAccessDeniedError:
+		return EXIT_ACCESS_DENIED
+	case AWSThrottlingError:
+		return EXIT_THROTTLED
+	case AWSNetworkError, AWSServerError:
+		return EXIT_NETWORK
+	}
+	return EXIT_ERROR
+}
+
 func panic_the_err(err error) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 